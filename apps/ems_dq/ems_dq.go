@@ -0,0 +1,184 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// This is a tool for inspecting and repairing the diskqueue files of a
+// Bhojpur EMS daemon, which must not be running while they are used.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bhojpur/ems/pkg/core/keyring"
+	"github.com/bhojpur/ems/pkg/core/version"
+	"github.com/bhojpur/ems/pkg/diskqueue"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	dataPath       = flag.String("data-path", "", "EMSd data path")
+	queueName      = flag.String("queue", "", "diskqueue name, <topic> or <topic>:<channel>")
+	maxMsgSize     = flag.Int64("max-msg-size", 1024768, "maximum size of a single message in bytes, as configured for EMSd")
+	dataKeyFile    = flag.String("data-key-file", "", "keyring file, to read encrypted diskqueues")
+	dataKeyringEnv = flag.String("data-keyring-env", "", "name of an environment variable holding the keyring (instead of --data-key-file)")
+
+	all       = flag.Bool("all", false, "dump: and export: every record on disk rather than only unread ones")
+	format    = flag.String("format", "json", "dump: output format, json (one record per line) or raw (message bodies)")
+	output    = flag.String("output", "", "export: file to write to (defaults to stdout)")
+	delimiter = flag.String("delimiter", "\n", "export: character to write after each message body (as read by to_ems)")
+	setRead   = flag.String("set-read", "", "meta: <file>,<pos> read position to set")
+	setWrite  = flag.String("set-write", "", "meta: <file>,<pos> write position to set")
+	setDepth  = flag.Int64("set-depth", -1, "meta: depth to set")
+	dryRun    = flag.Bool("dry-run", false, "truncate: only show what would be truncated")
+)
+
+const usage = `Usage: ems_dq [flags] <command>
+
+Commands:
+  dump      print records as decoded messages
+  validate  check every segment and the metadata for corruption
+  meta      show (or with --set-* flags, edit) the metadata
+  truncate  remove unreadable data at the end of segments
+  export    write message bodies to a file to republish with to_ems
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("ems_dq v%s\n", version.Binary)
+		return
+	}
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *dataPath == "" {
+		log.Fatal("--data-path required")
+	}
+	if *queueName == "" {
+		log.Fatal("--queue required")
+	}
+
+	var options []diskqueue.Option
+	k, err := loadKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if k != nil {
+		options = append(options, diskqueue.WithKeyring(k))
+	}
+
+	q, err := openQueue(*dataPath, *queueName, *maxMsgSize, options...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	switch flag.Arg(0) {
+	case "dump":
+		if *format != "json" && *format != "raw" {
+			log.Fatal("--format must be json or raw")
+		}
+		err = q.dump(w, *format, *all)
+	case "validate":
+		var ok bool
+		ok, err = q.validate(w)
+		if err == nil && !ok {
+			w.Flush()
+			os.Exit(1)
+		}
+	case "meta":
+		if *setRead != "" || *setWrite != "" || *setDepth >= 0 {
+			err = q.setMeta(*setRead, *setWrite, *setDepth)
+		}
+		if err == nil {
+			q.printMeta(w)
+		}
+	case "truncate":
+		err = q.truncate(w, *dryRun)
+	case "export":
+		err = export(q)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		w.Flush()
+		log.Fatal(err)
+	}
+}
+
+func export(q *queue) error {
+	if len(*delimiter) != 1 {
+		return fmt.Errorf("--delimiter must be a single byte")
+	}
+
+	f := os.Stdout
+	if *output != "" {
+		var err error
+		f, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	w := bufio.NewWriter(f)
+	count, err := q.export(w, (*delimiter)[0], *all)
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d messages", count)
+	return nil
+}
+
+func loadKeyring() (*keyring.Keyring, error) {
+	switch {
+	case *dataKeyFile != "" && *dataKeyringEnv != "":
+		return nil, fmt.Errorf("cannot use both --data-key-file and --data-keyring-env")
+	case *dataKeyFile != "":
+		return keyring.Load(*dataKeyFile)
+	case *dataKeyringEnv != "":
+		s, ok := os.LookupEnv(*dataKeyringEnv)
+		if !ok {
+			return nil, fmt.Errorf("--data-keyring-env %s is not set", *dataKeyringEnv)
+		}
+		return keyring.Parse(s)
+	}
+	return nil, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+	"github.com/bhojpur/ems/pkg/diskqueue"
+	"github.com/bhojpur/ems/pkg/engine"
+)
+
+// writeTestQueue writes n messages to a diskqueue and then reads read of them
+func writeTestQueue(t *testing.T, dataPath string, n int, read int) {
+	dq := diskqueue.New("test:ch", dataPath, 256, int32(engine.MinValidMsgLength), 1024+int32(engine.MinValidMsgLength),
+		1, time.Second, func(lvl diskqueue.LogLevel, f string, args ...interface{}) {})
+	for i := 0; i < n; i++ {
+		var id engine.MessageID
+		copy(id[:], fmt.Sprintf("%016d", i))
+		var buf bytes.Buffer
+		_, err := engine.NewMessage(id, []byte(fmt.Sprintf("body %d", i))).WriteTo(&buf)
+		test.Nil(t, err)
+		test.Nil(t, dq.Put(buf.Bytes()))
+	}
+	for i := 0; i < read; i++ {
+		<-dq.ReadChan()
+	}
+	test.Nil(t, dq.Close())
+}
+
+func TestDumpAndExport(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	writeTestQueue(t, dataPath, 20, 5)
+
+	q, err := openQueue(dataPath, "test:ch", 1024)
+	test.Nil(t, err)
+
+	var buf bytes.Buffer
+	test.Nil(t, q.dump(&buf, "json", false))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	test.Equal(t, 15, len(lines))
+	var d dumpedRecord
+	test.Nil(t, json.Unmarshal([]byte(lines[0]), &d))
+	test.Equal(t, fmt.Sprintf("%016d", 5), d.ID)
+	test.Equal(t, "body 5", d.Body)
+	test.Equal(t, "", d.Error)
+
+	buf.Reset()
+	test.Nil(t, q.dump(&buf, "raw", true))
+	test.Equal(t, 20, strings.Count(buf.String(), "\n"))
+
+	buf.Reset()
+	count, err := q.export(&buf, '\n', false)
+	test.Nil(t, err)
+	test.Equal(t, 15, count)
+	test.Equal(t, true, strings.HasPrefix(buf.String(), "body 5\nbody 6\n"))
+
+	_, err = q.export(&buf, ' ', false)
+	test.NotNil(t, err)
+}
+
+func TestValidateAndTruncate(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	writeTestQueue(t, dataPath, 20, 0)
+
+	q, err := openQueue(dataPath, "test:ch", 1024)
+	test.Nil(t, err)
+	var buf bytes.Buffer
+	ok, err := q.validate(&buf)
+	test.Nil(t, err)
+	test.Equal(t, true, ok)
+
+	// a torn write at the end of the last segment
+	fileName := q.fileName(q.meta.WriteFileNum)
+	size, err := fileSize(fileName)
+	test.Nil(t, err)
+	test.Nil(t, os.Truncate(fileName, size-5))
+
+	q, err = openQueue(dataPath, "test:ch", 1024)
+	test.Nil(t, err)
+	buf.Reset()
+	ok, err = q.validate(&buf)
+	test.Nil(t, err)
+	test.Equal(t, false, ok)
+
+	buf.Reset()
+	test.Nil(t, q.truncate(&buf, true))
+	newSize, err := fileSize(fileName)
+	test.Nil(t, err)
+	test.Equal(t, size-5, newSize)
+
+	test.Nil(t, q.truncate(&buf, false))
+	test.Equal(t, int64(19), q.meta.Depth)
+
+	q, err = openQueue(dataPath, "test:ch", 1024)
+	test.Nil(t, err)
+	buf.Reset()
+	ok, err = q.validate(&buf)
+	test.Nil(t, err)
+	test.Equal(t, true, ok)
+	test.Equal(t, int64(19), q.meta.Depth)
+}
+
+func TestSetMeta(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	writeTestQueue(t, dataPath, 10, 0)
+
+	q, err := openQueue(dataPath, "test:ch", 1024)
+	test.Nil(t, err)
+	write := fmt.Sprintf("%d,%d", q.meta.WriteFileNum, q.meta.WritePos)
+	test.Nil(t, q.setMeta(write, "", 0))
+	test.NotNil(t, q.setMeta("", "0,0", -1))
+	test.NotNil(t, q.setMeta("1", "", -1))
+
+	q, err = openQueue(dataPath, "test:ch", 1024)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), q.meta.Depth)
+	test.Equal(t, q.meta.WritePos, q.meta.ReadPos)
+
+	var buf bytes.Buffer
+	test.Nil(t, q.dump(&buf, "json", false))
+	test.Equal(t, "", buf.String())
+}
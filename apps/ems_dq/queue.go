@@ -0,0 +1,433 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bhojpur/ems/pkg/diskqueue"
+	"github.com/bhojpur/ems/pkg/engine"
+)
+
+// queue is a diskqueue on disk, which must not be in use by a running EMSd
+type queue struct {
+	dataPath   string
+	name       string
+	minMsgSize int32
+	maxMsgSize int32
+	options    []diskqueue.Option
+
+	// nil if there is no metadata file
+	meta *diskqueue.MetaData
+}
+
+func openQueue(dataPath string, name string, maxMsgSize int64, options ...diskqueue.Option) (*queue, error) {
+	q := &queue{
+		dataPath:   dataPath,
+		name:       name,
+		minMsgSize: int32(engine.MinValidMsgLength),
+		maxMsgSize: int32(maxMsgSize) + int32(engine.MinValidMsgLength),
+		options:    options,
+	}
+	meta, err := diskqueue.ReadMetaData(q.metaDataFileName())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s - %s", q.metaDataFileName(), err)
+	}
+	q.meta = meta
+	return q, nil
+}
+
+func (q *queue) metaDataFileName() string {
+	return diskqueue.MetaDataFileName(q.dataPath, q.name)
+}
+
+func (q *queue) fileName(fileNum int64) string {
+	return diskqueue.SegmentFileName(q.dataPath, q.name, fileNum)
+}
+
+// fileNums returns the numbers of all segment files, in order
+func (q *queue) fileNums() ([]int64, error) {
+	prefix := q.fileName(0)
+	prefix = prefix[:len(prefix)-len("000000.dat")]
+	matches, err := filepath.Glob(prefix + "*.dat")
+	if err != nil {
+		return nil, err
+	}
+	var fileNums []int64
+	for _, fn := range matches {
+		num, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(fn, prefix), ".dat"), 10, 64)
+		if err != nil {
+			// the metadata file
+			continue
+		}
+		fileNums = append(fileNums, num)
+	}
+	sort.Slice(fileNums, func(i, j int) bool { return fileNums[i] < fileNums[j] })
+	return fileNums, nil
+}
+
+// unread returns whether the record at offset of fileNum is between the read
+// and write positions in the metadata
+func (q *queue) unread(fileNum int64, offset int64) bool {
+	if q.meta == nil {
+		return true
+	}
+	m := q.meta
+	if fileNum < m.ReadFileNum || (fileNum == m.ReadFileNum && offset < m.ReadPos) {
+		return false
+	}
+	if fileNum > m.WriteFileNum || (fileNum == m.WriteFileNum && offset >= m.WritePos) {
+		return false
+	}
+	return true
+}
+
+// records calls fn with every record of every segment, or only the unread
+// ones unless all is set
+func (q *queue) records(all bool, fn func(fileNum int64, rec *diskqueue.Record) error) error {
+	fileNums, err := q.fileNums()
+	if err != nil {
+		return err
+	}
+	for _, fileNum := range fileNums {
+		err := q.segmentRecords(fileNum, func(rec *diskqueue.Record) error {
+			if !all && !q.unread(fileNum, rec.Offset) {
+				return nil
+			}
+			return fn(fileNum, rec)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *queue) segmentRecords(fileNum int64, fn func(rec *diskqueue.Record) error) error {
+	s, err := diskqueue.OpenSegment(q.fileName(fileNum), q.minMsgSize, q.maxMsgSize, q.options...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	for {
+		rec, err := s.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s - %s", q.fileName(fileNum), err)
+		}
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type dumpedRecord struct {
+	File       string `json:"file"`
+	Offset     int64  `json:"offset"`
+	ID         string `json:"id,omitempty"`
+	Timestamp  int64  `json:"timestamp,omitempty"`
+	Attempts   uint16 `json:"attempts,omitempty"`
+	Body       string `json:"body,omitempty"`
+	BodyBase64 []byte `json:"body_base64,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// dump writes records as decoded messages, as JSON (one object per line,
+// including unreadable records) or just their bodies
+func (q *queue) dump(w io.Writer, format string, all bool) error {
+	enc := json.NewEncoder(w)
+	return q.records(all, func(fileNum int64, rec *diskqueue.Record) error {
+		var msg *engine.Message
+		err := rec.Err
+		if err == nil {
+			msg, err = engine.DecodeMessage(rec.Data)
+		}
+
+		if format == "raw" {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s:%d: %s\n", q.fileName(fileNum), rec.Offset, err)
+				return nil
+			}
+			_, err = w.Write(append(msg.Body, '\n'))
+			return err
+		}
+
+		d := dumpedRecord{
+			File:   filepath.Base(q.fileName(fileNum)),
+			Offset: rec.Offset,
+		}
+		if err != nil {
+			d.Error = err.Error()
+			return enc.Encode(&d)
+		}
+		d.ID = string(msg.ID[:])
+		d.Timestamp = msg.Timestamp
+		d.Attempts = msg.Attempts
+		if utf8.Valid(msg.Body) {
+			d.Body = string(msg.Body)
+		} else {
+			d.BodyBase64 = msg.Body
+		}
+		return enc.Encode(&d)
+	})
+}
+
+// export writes the body of every message followed by delim, in the format
+// to_ems reads from stdin
+func (q *queue) export(w io.Writer, delim byte, all bool) (int, error) {
+	var count int
+	err := q.records(all, func(fileNum int64, rec *diskqueue.Record) error {
+		if rec.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: skipping - %s\n", q.fileName(fileNum), rec.Offset, rec.Err)
+			return nil
+		}
+		msg, err := engine.DecodeMessage(rec.Data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: skipping - %s\n", q.fileName(fileNum), rec.Offset, err)
+			return nil
+		}
+		if bytes.IndexByte(msg.Body, delim) != -1 {
+			return fmt.Errorf("message %s contains the delimiter %q, use another --delimiter", msg.ID[:], delim)
+		}
+		_, err = w.Write(append(msg.Body, delim))
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// validate checks every segment and the metadata, reporting problems to w
+// and returning whether there were any
+func (q *queue) validate(w io.Writer) (bool, error) {
+	ok := true
+	problem := func(f string, args ...interface{}) {
+		ok = false
+		fmt.Fprintf(w, f+"\n", args...)
+	}
+
+	fileNums, err := q.fileNums()
+	if err != nil {
+		return false, err
+	}
+
+	var unread int64
+	for _, fileNum := range fileNums {
+		var records, corrupt int
+		err := q.segmentRecords(fileNum, func(rec *diskqueue.Record) error {
+			err := rec.Err
+			if err == nil {
+				_, err = engine.DecodeMessage(rec.Data)
+			}
+			if err != nil {
+				corrupt++
+				problem("%s: %d bytes at %d unreadable - %s", q.fileName(fileNum), rec.Size, rec.Offset, err)
+				return nil
+			}
+			records++
+			if q.unread(fileNum, rec.Offset) {
+				unread++
+			}
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(w, "%s: %d records, %d unreadable\n", q.fileName(fileNum), records, corrupt)
+	}
+
+	if q.meta == nil {
+		problem("%s: missing", q.metaDataFileName())
+		return ok, nil
+	}
+	m := q.meta
+	if size, err := fileSize(q.fileName(m.ReadFileNum)); err == nil && m.ReadPos > size {
+		problem("%s: read position %d is past the end of %s (%d bytes)",
+			q.metaDataFileName(), m.ReadPos, q.fileName(m.ReadFileNum), size)
+	}
+	if size, err := fileSize(q.fileName(m.WriteFileNum)); err == nil {
+		if m.WritePos > size {
+			problem("%s: write position %d is past the end of %s (%d bytes)",
+				q.metaDataFileName(), m.WritePos, q.fileName(m.WriteFileNum), size)
+		} else if m.WritePos < size {
+			// EMSd skips to a new file for writes and reads what it can
+			fmt.Fprintf(w, "%s: %d bytes written after the write position %d were not synced\n",
+				q.fileName(m.WriteFileNum), size-m.WritePos, m.WritePos)
+		}
+	}
+	if unread != m.Depth {
+		problem("%s: depth is %d but there are %d unread records", q.metaDataFileName(), m.Depth, unread)
+	}
+	return ok, nil
+}
+
+// truncate removes unreadable data at the end of every segment, the
+// metadata positions are moved back accordingly and its depth recounted
+func (q *queue) truncate(w io.Writer, dryRun bool) error {
+	fileNums, err := q.fileNums()
+	if err != nil {
+		return err
+	}
+
+	for _, fileNum := range fileNums {
+		var end, size int64
+		err := q.segmentRecords(fileNum, func(rec *diskqueue.Record) error {
+			if errors.Is(rec.Err, diskqueue.ErrKeyUnavailable) {
+				return fmt.Errorf("%s:%d: %s, a keyring is needed to tell corrupt records apart",
+					q.fileName(fileNum), rec.Offset, rec.Err)
+			}
+			size = rec.Offset + rec.Size
+			if rec.Err == nil {
+				end = size
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if end == size {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: truncating %d unreadable bytes at %d\n", q.fileName(fileNum), size-end, end)
+		if dryRun {
+			continue
+		}
+		err = os.Truncate(q.fileName(fileNum), end)
+		if err != nil {
+			return err
+		}
+		if q.meta != nil {
+			if fileNum == q.meta.ReadFileNum && q.meta.ReadPos > end {
+				q.meta.ReadPos = end
+			}
+			if fileNum == q.meta.WriteFileNum && q.meta.WritePos > end {
+				q.meta.WritePos = end
+			}
+		}
+	}
+
+	if q.meta == nil || dryRun {
+		return nil
+	}
+	var depth int64
+	err = q.records(false, func(fileNum int64, rec *diskqueue.Record) error {
+		if rec.Err == nil {
+			depth++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if depth != q.meta.Depth {
+		fmt.Fprintf(w, "%s: depth %d -> %d\n", q.metaDataFileName(), q.meta.Depth, depth)
+		q.meta.Depth = depth
+	}
+	return diskqueue.WriteMetaData(q.metaDataFileName(), q.meta)
+}
+
+// setMeta rewrites the metadata with new positions (given as <file>,<pos>)
+// and/or depth, empty positions and a negative depth are left unchanged
+func (q *queue) setMeta(readPos string, writePos string, depth int64) error {
+	if q.meta == nil {
+		return errors.New("no metadata to edit")
+	}
+	m := *q.meta
+	var err error
+	if readPos != "" {
+		m.ReadFileNum, m.ReadPos, err = parsePosition(readPos)
+		if err != nil {
+			return fmt.Errorf("invalid read position - %s", err)
+		}
+	}
+	if writePos != "" {
+		m.WriteFileNum, m.WritePos, err = parsePosition(writePos)
+		if err != nil {
+			return fmt.Errorf("invalid write position - %s", err)
+		}
+	}
+	if depth >= 0 {
+		m.Depth = depth
+	}
+	if m.WriteFileNum < m.ReadFileNum || (m.WriteFileNum == m.ReadFileNum && m.WritePos < m.ReadPos) {
+		return errors.New("read position is after the write position")
+	}
+	err = diskqueue.WriteMetaData(q.metaDataFileName(), &m)
+	if err != nil {
+		return err
+	}
+	q.meta = &m
+	return nil
+}
+
+func (q *queue) printMeta(w io.Writer) {
+	if q.meta == nil {
+		fmt.Fprintf(w, "%s: missing\n", q.metaDataFileName())
+		return
+	}
+	m := q.meta
+	fmt.Fprintf(w, "depth: %d\n", m.Depth)
+	fmt.Fprintf(w, "read: %d,%d (%s)\n", m.ReadFileNum, m.ReadPos, q.fileName(m.ReadFileNum))
+	fmt.Fprintf(w, "write: %d,%d (%s)\n", m.WriteFileNum, m.WritePos, q.fileName(m.WriteFileNum))
+	if m.Compression != "" {
+		fmt.Fprintf(w, "compression: %s (%d bytes written, %d stored)\n", m.Compression, m.RawBytes, m.StoredBytes)
+	}
+}
+
+func parsePosition(s string) (int64, int64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%q is not <file>,<pos>", s)
+	}
+	fileNum, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	pos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return fileNum, pos, nil
+}
+
+func fileSize(fileName string) (int64, error) {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -75,6 +75,7 @@ func emsadminFlagSet(opts *emsadm.Options) *flag.FlagSet {
 
 	emslookupdHTTPAddresses := app.StringArray{}
 	flagSet.Var(&emslookupdHTTPAddresses, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
+	flagSet.String("lookupd-http-admin-token", opts.EMSLookupdHTTPAdminToken, "bearer token sent to the lookupd HTTP admin endpoints (--http-admin-token of lookupd)")
 	emsdHTTPAddresses := app.StringArray{}
 	flagSet.Var(&emsdHTTPAddresses, "emsd-http-address", "EMSd HTTP address (may be given multiple times)")
 	adminUsers := app.StringArray{}
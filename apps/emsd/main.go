@@ -94,6 +94,15 @@ func (p *program) Start() error {
 		logFatal("failed to persist metadata - %s", err)
 	}
 
+	drainChan := make(chan os.Signal, 1)
+	notifyDrain(drainChan)
+	go func() {
+		for range drainChan {
+			// fails only when already draining
+			p.emssvr.Drain("", 0)
+		}
+	}()
+
 	go func() {
 		err := p.emssvr.Main()
 		if err != nil {
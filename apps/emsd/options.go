@@ -137,19 +137,28 @@ func emsdFlagSet(opts *emssvr.Options) *flag.FlagSet {
 	flagSet.String("log-prefix", "[emsd] ", "log message prefix")
 	flagSet.Bool("verbose", false, "[deprecated] has no effect, use --log-level")
 
-	flagSet.Int64("node-id", opts.ID, "unique part for message IDs, (int) in range [0,1024) (default is hash of hostname)")
+	flagSet.Int64("node-id", opts.ID, "unique part for message IDs, (int) in range [0,1024) (default is hash of hostname, the first emslookupd with --node-id-policy=assign may change it, the assigned ID is kept in the data path)")
 	flagSet.Bool("worker-id", false, "[deprecated] use --node-id")
 
 	flagSet.String("https-address", opts.HTTPSAddress, "<addr>:<port> to listen on for HTTPS clients")
 	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
 	flagSet.String("tcp-address", opts.TCPAddress, "<addr>:<port> to listen on for TCP clients")
+	flagSet.String("stomp-address", opts.STOMPAddress, "<addr>:<port> to listen on for STOMP clients (disabled by default)")
+	flagSet.String("kafka-address", opts.KafkaAddress, "<addr>:<port> to listen on for Kafka producers (disabled by default)")
 	authHTTPAddresses := app.StringArray{}
 	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> or a full url to query auth server (may be given multiple times)")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address that will be registered with lookupd (defaults to the OS hostname)")
 	flagSet.Int("broadcast-tcp-port", opts.BroadcastTCPPort, "TCP port that will be registered with lookupd (defaults to the TCP port that this EMSd is listening on)")
 	flagSet.Int("broadcast-http-port", opts.BroadcastHTTPPort, "HTTP port that will be registered with lookupd (defaults to the HTTP port that this EMSd is listening on)")
+	labels := app.StringArray{}
+	flagSet.Var(&labels, "label", "<key>=<value> topology label (e.g. zone=a) sent to lookupd with the broadcast address (may be given multiple times)")
 	lookupdTCPAddrs := app.StringArray{}
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
+	flagSet.Bool("lookupd-tls", opts.EMSLookupdTLS, "connect to lookupd over TLS")
+	flagSet.String("lookupd-tls-cert", opts.EMSLookupdTLSCert, "path to the client certificate file presented to lookupd")
+	flagSet.String("lookupd-tls-key", opts.EMSLookupdTLSKey, "path to the client key file presented to lookupd")
+	flagSet.String("lookupd-tls-root-ca-file", opts.EMSLookupdTLSRootCAFile, "path to the certificate authority file lookupd certificates are verified with (system roots if empty)")
+	flagSet.String("lookupd-secret", opts.EMSLookupdSecret, "secret sent to lookupd in IDENTIFY (--registration-secret of lookupd)")
 	flagSet.Duration("http-client-connect-timeout", opts.HTTPClientConnectTimeout, "timeout for HTTP connect")
 	flagSet.Duration("http-client-request-timeout", opts.HTTPClientRequestTimeout, "timeout for HTTP request")
 
@@ -159,6 +168,38 @@ func emsdFlagSet(opts *emssvr.Options) *flag.FlagSet {
 	flagSet.Int64("max-bytes-per-file", opts.MaxBytesPerFile, "number of bytes per diskqueue file before rolling")
 	flagSet.Int64("sync-every", opts.SyncEvery, "number of messages per diskqueue fsync")
 	flagSet.Duration("sync-timeout", opts.SyncTimeout, "duration of time per diskqueue fsync")
+	flagSet.Int("metadata-snapshots", opts.MetadataSnapshots, "number of previous versions of the topic/channel metadata to keep in the data path (0 disables)")
+	flagSet.String("diskqueue-compression", opts.DiskQueueCompression, "compression of diskqueue records (none or snappy)")
+	topicDiskQueueCompressions := app.StringArray{}
+	flagSet.Var(&topicDiskQueueCompressions, "topic-diskqueue-compression", "<topic>=<compression> diskqueue compression override for a topic and its channels, a trailing * matches a topic prefix (may be given multiple times)")
+
+	// encryption at rest
+	flagSet.String("data-key-file", opts.DataKeyFile, "path to a keyring file of <id>:<base64 AES key> lines, enables encryption of diskqueue records and metadata with the highest key ID")
+	flagSet.String("data-keyring-env", opts.DataKeyringEnv, "name of an environment variable holding a comma separated keyring of <id>:<base64 AES key> entries (instead of --data-key-file)")
+
+	// backend queue options
+	flagSet.String("backend-queue", opts.BackendQueue, "storage backend for messages beyond mem-queue-size (disk, log or memory)")
+	topicBackendQueues := app.StringArray{}
+	flagSet.Var(&topicBackendQueues, "topic-backend-queue", "<topic>=<backend> storage backend override for a topic and its channels, a trailing * matches a topic prefix (may be given multiple times)")
+	flagSet.Int64("memory-backend-max-depth", opts.MemoryBackendMaxDepth, "maximum number of messages per topic/channel held by the memory backend")
+
+	// fanout storage options
+	flagSet.String("fanout-storage", opts.FanoutStorage, "how topics fan messages out to channels: copy (to every channel) or shared (one topic log read by a cursor per channel)")
+	topicFanoutStorages := app.StringArray{}
+	flagSet.Var(&topicFanoutStorages, "topic-fanout-storage", "<topic>=<storage> fanout storage override for a topic, a trailing * matches a topic prefix (may be given multiple times)")
+
+	flagSet.Float64("disk-high-watermark", opts.DiskHighWatermark, "percent of the data path's filesystem in use above which publishes to disk backed topics are rejected (0 disables)")
+	flagSet.Float64("disk-low-watermark", opts.DiskLowWatermark, "percent of the data path's filesystem in use below which publishes are accepted again")
+	flagSet.Duration("disk-check-interval", opts.DiskCheckInterval, "duration of time between checks of the data path's disk usage")
+	diskFullPauseTopics := app.StringArray{}
+	flagSet.Var(&diskFullPauseTopics, "disk-full-pause-topic", "topic to reject publishes to above --disk-high-watermark before rejecting them to every disk backed topic, a trailing * matches a topic prefix (may be given multiple times, applied in order)")
+
+	flagSet.Duration("drain-timeout", opts.DrainTimeout, "duration of time to wait for channels to empty when draining, before forwarding the remaining messages (or exiting)")
+	flagSet.String("drain-forward-address", opts.DrainForwardAddress, "<addr>:<port> of the emsd TCP address to forward remaining messages to when draining (on SIGUSR1)")
+
+	topicReplicas := app.StringArray{}
+	flagSet.Var(&topicReplicas, "topic-replicas", "<topic>=<addr>:<port>[,<addr>:<port>...] emsd HTTP addresses a topic is synchronously replicated to, a trailing * matches a topic prefix (may be given multiple times)")
+	flagSet.Int("replica-acks", opts.ReplicaAcks, "number of replicas which must durably append a message before a publish is acknowledged (0 for all of them)")
 
 	flagSet.Int("queue-scan-worker-pool-max", opts.QueueScanWorkerPoolMax, "max concurrency for checking in-flight and deferred message timeouts")
 	flagSet.Int("queue-scan-selection-count", opts.QueueScanSelectionCount, "number of channels to check per cycle (every 100ms) for in-flight and deferred timeouts")
@@ -29,6 +29,7 @@ import (
 	"syscall"
 
 	"github.com/BurntSushi/toml"
+	"github.com/bhojpur/ems/pkg/core/app"
 	"github.com/bhojpur/ems/pkg/core/lg"
 	"github.com/bhojpur/ems/pkg/core/version"
 	emslookupd "github.com/bhojpur/ems/pkg/lookup"
@@ -50,10 +51,31 @@ func emslookupdFlagSet(opts *emslookupd.Options) *flag.FlagSet {
 	flagSet.String("tcp-address", opts.TCPAddress, "<addr>:<port> to listen on for TCP clients")
 	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address of this lookupd node, (default to the OS hostname)")
+	flagSet.String("data-path", opts.DataPath, "path to persist registrations and tombstones across restarts (in memory only if empty)")
 
 	flagSet.Duration("inactive-producer-timeout", opts.InactiveProducerTimeout, "duration of time a producer will remain in the active list since its last ping")
 	flagSet.Duration("tombstone-lifetime", opts.TombstoneLifetime, "duration of time a producer will remain tombstoned if registration remains")
 
+	flagSet.String("tls-cert", opts.TLSCert, "path to certificate file, enables TLS on the TCP listener")
+	flagSet.String("tls-key", opts.TLSKey, "path to key file")
+	flagSet.String("tls-client-auth-policy", opts.TLSClientAuthPolicy, "client certificate auth policy ('require' or 'require-verify')")
+	flagSet.String("tls-root-ca-file", opts.TLSRootCAFile, "path to certificate authority file client certificates are verified with")
+
+	flagSet.String("registration-secret", opts.RegistrationSecret, "secret emsd must send in IDENTIFY to register (--lookupd-secret of emsd)")
+	allowedNodes := app.StringArray{}
+	flagSet.Var(&allowedNodes, "allowed-node", "identity of an emsd allowed to register: a name of its client certificate verified with --tls-root-ca-file, or else the IP address it connects from (may be given multiple times)")
+	flagSet.String("http-admin-token", opts.HTTPAdminToken, "bearer token required by the HTTP admin and cluster endpoints (topic/channel create and delete, tombstone)")
+
+	flagSet.String("node-id-policy", opts.NodeIDPolicy, "when emsd registers with the node ID of another node: 'warn', 'reject' its registration or 'assign' it a free node ID")
+
+	flagSet.String("dns-address", opts.DNSAddress, "<addr>:<port> to serve DNS on (UDP and TCP), disabled if empty")
+	flagSet.String("dns-domain", opts.DNSDomain, "domain of the DNS records, _<topic>._tcp.<domain> SRV records list the producers of a topic and nodes.<domain> A/AAAA records every node")
+	flagSet.Duration("dns-ttl", opts.DNSTTL, "TTL of the DNS records")
+
+	clusterPeers := app.StringArray{}
+	flagSet.Var(&clusterPeers, "cluster-peer", "<broadcast-address>:<http port> of another emslookupd of the cluster (may be given multiple times)")
+	flagSet.Duration("cluster-sync-interval", opts.ClusterSyncInterval, "duration of time between syncs of the registrations with the other cluster members")
+
 	return flagSet
 }
 
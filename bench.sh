@@ -26,9 +26,9 @@ echo "# creating topic/channel"
 curl --silent 'http://127.0.0.1:4151/create_topic?topic=sub_bench' >/dev/null 2>&1
 curl --silent 'http://127.0.0.1:4151/create_channel?topic=sub_bench&channel=ch' >/dev/null 2>&1
 
-echo "# compiling bench_reader/bench_writer"
+echo "# compiling bench_reader/bench_writer/bench_producer"
 pushd bench >/dev/null
-for app in bench_reader bench_writer; do
+for app in bench_reader bench_writer bench_producer; do
     pushd $app >/dev/null
     go build
     popd >/dev/null
@@ -38,6 +38,9 @@ popd >/dev/null
 echo -n "PUB: "
 bench/bench_writer/bench_writer --size=$messageSize --batch-size=$batchSize 2>&1
 
+echo -n "PUB (producer batching): "
+bench/bench_producer/bench_producer --size=$messageSize --batch-size=$batchSize 2>&1
+
 curl -s -o cpu.pprof http://127.0.0.1:4151/debug/pprof/profile &
 pprof_pid=$!
 
@@ -0,0 +1,133 @@
+package main
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// bench_producer measures the publish rate of the Go client Producer using
+// PublishAsync, with or without its batching (--batch-size 0)
+
+import (
+	"flag"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	emsctl "github.com/bhojpur/ems/pkg/client"
+)
+
+var (
+	runfor     = flag.Duration("runfor", 10*time.Second, "duration of time to run")
+	tcpAddress = flag.String("emsd-tcp-address", "127.0.0.1:4150", "<addr>:<port> to connect to Bhojpur EMS daemon")
+	topic      = flag.String("topic", "sub_bench", "topic to receive messages on")
+	size       = flag.Int("size", 200, "size of messages")
+	batchSize  = flag.Int("batch-size", 200, "messages per MPUB batched by the producer (0 to publish them one by one)")
+	batchBytes = flag.Int64("batch-bytes", 1048576, "maximum bytes of message bodies per batch")
+	linger     = flag.Duration("linger", 5*time.Millisecond, "maximum duration a message waits for its batch to fill")
+	window     = flag.Int("window", 1000, "messages published by each worker before waiting for their responses")
+	deadline   = flag.String("deadline", "", "deadline to start the benchmark run")
+)
+
+var totalMsgCount int64
+
+func main() {
+	flag.Parse()
+	var wg sync.WaitGroup
+
+	log.SetPrefix("[bench_producer] ")
+
+	config := emsctl.NewConfig()
+	config.PublishBatchSize = *batchSize
+	config.PublishBatchBytes = *batchBytes
+	config.PublishLinger = *linger
+
+	msg := make([]byte, *size)
+
+	goChan := make(chan int)
+	rdyChan := make(chan int)
+	for j := 0; j < runtime.GOMAXPROCS(0); j++ {
+		wg.Add(1)
+		go func() {
+			pubWorker(*runfor, *tcpAddress, config, msg, *topic, rdyChan, goChan)
+			wg.Done()
+		}()
+		<-rdyChan
+	}
+
+	if *deadline != "" {
+		t, err := time.Parse("2006-01-02 15:04:05", *deadline)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d := t.Sub(time.Now())
+		log.Printf("sleeping until %s (%s)", t, d)
+		time.Sleep(d)
+	}
+
+	start := time.Now()
+	close(goChan)
+	wg.Wait()
+	end := time.Now()
+	duration := end.Sub(start)
+	tmc := atomic.LoadInt64(&totalMsgCount)
+	log.Printf("duration: %s - %.03fmb/s - %.03fops/s - %.03fus/op",
+		duration,
+		float64(tmc*int64(*size))/duration.Seconds()/1024/1024,
+		float64(tmc)/duration.Seconds(),
+		float64(duration/time.Microsecond)/float64(tmc))
+}
+
+func pubWorker(td time.Duration, tcpAddr string, config *emsctl.Config, msg []byte, topic string, rdyChan chan int, goChan chan int) {
+	producer, err := emsctl.NewProducer(tcpAddr, config)
+	if err != nil {
+		panic(err.Error())
+	}
+	producer.SetLogger(log.New(log.Writer(), log.Prefix(), log.Flags()), emsctl.LogLevelError)
+	defer producer.Stop()
+	err = producer.Ping()
+	if err != nil {
+		panic(err.Error())
+	}
+	doneChan := make(chan *emsctl.ProducerTransaction, *window)
+	rdyChan <- 1
+	<-goChan
+	var msgCount int64
+	endTime := time.Now().Add(td)
+	for {
+		for i := 0; i < *window; i++ {
+			err := producer.PublishAsync(topic, msg, doneChan)
+			if err != nil {
+				panic(err.Error())
+			}
+		}
+		for i := 0; i < *window; i++ {
+			t := <-doneChan
+			if t.Error != nil {
+				panic(t.Error.Error())
+			}
+		}
+		msgCount += int64(*window)
+		if time.Now().After(endTime) {
+			break
+		}
+	}
+	atomic.AddInt64(&totalMsgCount, msgCount)
+}
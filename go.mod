@@ -15,6 +15,7 @@ require (
 	github.com/mreiferson/go-options v1.0.0
 	github.com/sirupsen/logrus v1.2.0
 	github.com/spf13/cobra v1.1.3
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	google.golang.org/grpc v1.34.0
 	google.golang.org/protobuf v1.27.1
 	k8s.io/apimachinery v0.21.1
@@ -38,7 +39,6 @@ require (
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83 // indirect
-	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
 	golang.org/x/sys v0.0.0-20220204135822-1c1b9b1eba6a // indirect
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
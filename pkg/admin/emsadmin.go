@@ -48,6 +48,8 @@ type EMSAdmin struct {
 	httpListener        net.Listener
 	waitGroup           util.WaitGroupWrapper
 	notifications       chan *AdminAction
+	migrations          map[string]bool // topic migrations being watched
+	exitChan            chan int
 	graphiteURL         *url.URL
 	httpClientTLSConfig *tls.Config
 }
@@ -59,6 +61,8 @@ func New(opts *Options) (*EMSAdmin, error) {
 
 	n := &EMSAdmin{
 		notifications: make(chan *AdminAction),
+		migrations:    make(map[string]bool),
+		exitChan:      make(chan int),
 	}
 	n.swapOpts(opts)
 
@@ -213,5 +217,6 @@ func (n *EMSAdmin) Exit() {
 		n.httpListener.Close()
 	}
 	close(n.notifications)
+	close(n.exitChan)
 	n.waitGroup.Wait()
 }
@@ -33,6 +33,7 @@ import (
 	"net/url"
 	"path"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -92,7 +93,7 @@ func NewHTTPServer(emsadmin *EMSAdmin) *httpServer {
 		emsadmin: emsadmin,
 		router:   router,
 		client:   client,
-		ci:       clusterinfo.New(emsadmin.logf, client),
+		ci:       newClusterInfo(emsadmin, client),
 
 		basePath:     emsadmin.getOpts().BasePath,
 		devStaticDir: emsadmin.getOpts().DevStaticDir,
@@ -131,6 +132,7 @@ func NewHTTPServer(emsadmin *EMSAdmin) *httpServer {
 	router.Handle("POST", bp("/api/topics/:topic"), http_api.Decorate(s.topicActionHandler, log, http_api.V1))
 	router.Handle("POST", bp("/api/topics/:topic/:channel"), http_api.Decorate(s.channelActionHandler, log, http_api.V1))
 	router.Handle("DELETE", bp("/api/nodes/:node"), http_api.Decorate(s.tombstoneNodeForTopicHandler, log, http_api.V1))
+	router.Handle("POST", bp("/api/nodes/:node"), http_api.Decorate(s.nodeActionHandler, log, http_api.V1))
 	router.Handle("DELETE", bp("/api/topics/:topic"), http_api.Decorate(s.deleteTopicHandler, log, http_api.V1))
 	router.Handle("DELETE", bp("/api/topics/:topic/:channel"), http_api.Decorate(s.deleteChannelHandler, log, http_api.V1))
 	router.Handle("GET", bp("/api/counter"), http_api.Decorate(s.counterHandler, log, http_api.V1))
@@ -141,6 +143,14 @@ func NewHTTPServer(emsadmin *EMSAdmin) *httpServer {
 	return s
 }
 
+func newClusterInfo(emsadmin *EMSAdmin, client *http_api.Client) *clusterinfo.ClusterInfo {
+	ci := clusterinfo.New(emsadmin.logf, client)
+	if token := emsadmin.getOpts().EMSLookupdHTTPAdminToken; token != "" {
+		ci.SetEMSLookupdAdminToken(token)
+	}
+	return ci
+}
+
 func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.router.ServeHTTP(w, req)
 }
@@ -236,11 +246,17 @@ func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{400, err.Error()}
 	}
 
+	listParams, err := http_api.NewListParams(reqParams)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	filter := clusterinfo.ListFilter{Prefix: listParams.Prefix, Regex: listParams.Regex}
+
 	var topics []string
 	if len(s.emsadmin.getOpts().EMSLookupdHTTPAddresses) != 0 {
-		topics, err = s.ci.GetLookupdTopics(s.emsadmin.getOpts().EMSLookupdHTTPAddresses)
+		topics, err = s.ci.GetLookupdTopicsFiltered(filter, s.emsadmin.getOpts().EMSLookupdHTTPAddresses)
 	} else {
-		topics, err = s.ci.GetEMSDTopics(s.emsadmin.getOpts().EMSDHTTPAddresses)
+		topics, err = s.ci.GetEMSDTopicsFiltered(filter, s.emsadmin.getOpts().EMSDHTTPAddresses)
 	}
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
@@ -274,10 +290,12 @@ func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request, ps
 		}{topicChannelMap, maybeWarnMsg(messages)}, nil
 	}
 
+	topics, nextCursor := listParams.PageStrings(topics)
 	return struct {
-		Topics  []string `json:"topics"`
-		Message string   `json:"message"`
-	}{topics, maybeWarnMsg(messages)}, nil
+		Topics     []string `json:"topics"`
+		NextCursor string   `json:"next_cursor,omitempty"`
+		Message    string   `json:"message"`
+	}{topics, nextCursor, maybeWarnMsg(messages)}, nil
 }
 
 func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -285,6 +303,18 @@ func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request, ps h
 
 	topicName := ps.ByName("topic")
 
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+
+	// the channels of the topic are filtered, sorted and paged
+	listParams, err := http_api.NewListParams(reqParams, "depth", "message_count", "message_rate")
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	filter := clusterinfo.ListFilter{Prefix: listParams.Prefix, Regex: listParams.Regex}
+
 	producers, err := s.ci.GetTopicProducers(topicName,
 		s.emsadmin.getOpts().EMSLookupdHTTPAddresses,
 		s.emsadmin.getOpts().EMSDHTTPAddresses)
@@ -297,7 +327,7 @@ func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request, ps h
 		s.emsadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
 	}
-	topicStats, _, err := s.ci.GetEMSDStats(producers, topicName, "", false)
+	topicStats, _, err := s.ci.GetEMSDStatsFiltered(producers, topicName, "", false, filter)
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -312,11 +342,48 @@ func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request, ps h
 	for _, t := range topicStats {
 		allNodesTopicStats.Add(t)
 	}
+	var nextCursor string
+	allNodesTopicStats.Channels, nextCursor = pageChannelStats(allNodesTopicStats.Channels, listParams)
+
+	violations := []*clusterinfo.PlacementViolation{}
+	if len(s.emsadmin.getOpts().EMSLookupdHTTPAddresses) != 0 {
+		violations, err = s.ci.GetLookupdPlacementViolations(topicName,
+			s.emsadmin.getOpts().EMSLookupdHTTPAddresses)
+		if err != nil {
+			s.emsadmin.logf(LOG_WARN, "failed to get placement violations - %s", err)
+			messages = append(messages, err.Error())
+		}
+	}
 
 	return struct {
 		*clusterinfo.TopicStats
-		Message string `json:"message"`
-	}{allNodesTopicStats, maybeWarnMsg(messages)}, nil
+		NextCursor          string                            `json:"next_cursor,omitempty"`
+		PlacementViolations []*clusterinfo.PlacementViolation `json:"placement_violations"`
+		Message             string                            `json:"message"`
+	}{allNodesTopicStats, nextCursor, violations, maybeWarnMsg(messages)}, nil
+}
+
+// pageChannelStats sorts the channel stats by the requested field, then by
+// name, and returns the requested page
+func pageChannelStats(channels []*clusterinfo.ChannelStats, listParams *http_api.ListParams) ([]*clusterinfo.ChannelStats, string) {
+	byName := func(i, j int) bool { return channels[i].ChannelName < channels[j].ChannelName }
+	sort.Slice(channels, byName)
+	var key func(i int) interface{}
+	switch listParams.Sort {
+	case "name":
+		listParams.SortSlice(channels, byName)
+	case "depth":
+		listParams.SortSlice(channels, func(i, j int) bool { return channels[i].Depth < channels[j].Depth })
+		key = func(i int) interface{} { return channels[i].Depth }
+	case "message_count":
+		listParams.SortSlice(channels, func(i, j int) bool { return channels[i].MessageCount < channels[j].MessageCount })
+		key = func(i int) interface{} { return channels[i].MessageCount }
+	case "message_rate":
+		listParams.SortSlice(channels, func(i, j int) bool { return channels[i].MessageRate < channels[j].MessageRate })
+		key = func(i int) interface{} { return channels[i].MessageRate }
+	}
+	start, end, next := listParams.Page(len(channels), func(i int) string { return channels[i].ChannelName }, key)
+	return channels[start:end], next
 }
 
 func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -461,6 +528,109 @@ func (s *httpServer) tombstoneNodeForTopicHandler(w http.ResponseWriter, req *ht
 	}{maybeWarnMsg(messages)}, nil
 }
 
+func (s *httpServer) nodeActionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+
+	node := ps.ByName("node")
+
+	var body struct {
+		Action  string `json:"action"`
+		Forward string `json:"forward"`
+	}
+
+	if !s.isAuthorizedAdminRequest(req) {
+		return nil, http_api.Err{403, "FORBIDDEN"}
+	}
+
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_BODY"}
+	}
+
+	switch body.Action {
+	case "drain":
+		err = s.ci.DrainNode(node, body.Forward)
+
+		s.notifyAdminAction("drain_node", "", "", node, req)
+	default:
+		return nil, http_api.Err{400, "INVALID_ACTION"}
+	}
+
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.emsadmin.logf(LOG_ERROR, "failed to drain node - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.emsadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	return struct {
+		Message string `json:"message"`
+	}{maybeWarnMsg(messages)}, nil
+}
+
+// watchTopicMigration tombstones the topic on the source node once it has been
+// migrated and deletes it there, so it stops forwarding and isn't discovered
+// again once the tombstone expires. After a restart of emsadmin, starting the
+// migration again resumes watching it.
+func (s *httpServer) watchTopicMigration(topicName string, source string) {
+	key := topicName + "@" + source
+	s.emsadmin.Lock()
+	defer s.emsadmin.Unlock()
+	if s.emsadmin.migrations[key] {
+		return
+	}
+	s.emsadmin.migrations[key] = true
+
+	s.emsadmin.waitGroup.Wrap(func() {
+		defer func() {
+			s.emsadmin.Lock()
+			delete(s.emsadmin.migrations, key)
+			s.emsadmin.Unlock()
+		}()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.emsadmin.exitChan:
+				return
+			}
+
+			m, err := s.ci.GetTopicMigration(topicName, source)
+			if err != nil {
+				s.emsadmin.logf(LOG_WARN, "failed to get migration of topic %s on %s - %s", topicName, source, err)
+				if strings.Contains(err.Error(), "MIGRATION_NOT_FOUND") ||
+					strings.Contains(err.Error(), "TOPIC_NOT_FOUND") {
+					// cancelled or already tombstoned
+					return
+				}
+				continue
+			}
+			if !m.Done() {
+				continue
+			}
+
+			s.emsadmin.logf(LOG_INFO, "topic %s migrated from %s to %s, tombstoning", topicName, source, m.Target)
+			err = s.ci.TombstoneNodeForTopic(topicName, source,
+				s.emsadmin.getOpts().EMSLookupdHTTPAddresses)
+			if err != nil {
+				s.emsadmin.logf(LOG_ERROR, "failed to tombstone topic %s on %s - %s", topicName, source, err)
+				continue
+			}
+			err = s.ci.DeleteNodeTopic(topicName, source)
+			if err != nil && !strings.Contains(err.Error(), "TOPIC_NOT_FOUND") {
+				s.emsadmin.logf(LOG_ERROR, "failed to delete topic %s on %s - %s", topicName, source, err)
+				continue
+			}
+			return
+		}
+	})
+}
+
 func (s *httpServer) createTopicChannelHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
@@ -583,6 +753,8 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 
 	var body struct {
 		Action string `json:"action"`
+		Source string `json:"source"`
+		Target string `json:"target"`
 	}
 
 	if !s.isAuthorizedAdminRequest(req) {
@@ -637,6 +809,16 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 
 			s.notifyAdminAction("empty_topic", topicName, "", "", req)
 		}
+	case "migrate":
+		if channelName != "" {
+			return nil, http_api.Err{400, "INVALID_ACTION"}
+		}
+		err = s.ci.MigrateTopic(topicName, body.Source, body.Target)
+		if err == nil {
+			s.watchTopicMigration(topicName, body.Source)
+		}
+
+		s.notifyAdminAction("migrate_topic", topicName, "", body.Source, req)
 	default:
 		return nil, http_api.Err{400, "INVALID_ACTION"}
 	}
@@ -40,12 +40,15 @@ import (
 )
 
 type TopicsDoc struct {
-	Topics []interface{} `json:"topics"`
+	Topics     []interface{} `json:"topics"`
+	NextCursor string        `json:"next_cursor"`
 }
 
 type TopicStatsDoc struct {
 	*clusterinfo.TopicStats
-	Message string `json:"message"`
+	NextCursor          string                            `json:"next_cursor"`
+	PlacementViolations []*clusterinfo.PlacementViolation `json:"placement_violations"`
+	Message             string                            `json:"message"`
 }
 
 type NodesDoc struct {
@@ -231,6 +234,92 @@ func TestHTTPTopicGET(t *testing.T) {
 	test.Equal(t, false, ts.Paused)
 }
 
+func TestHTTPTopicsPagedGET(t *testing.T) {
+	dataPath, emsds, emslookupds, emsadmin1 := bootstrapEMSCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer emsds[0].Exit()
+	defer emslookupds[0].Exit()
+	defer emsadmin1.Exit()
+
+	for _, topicName := range []string{"paged_c", "paged_a", "paged_b", "other"} {
+		emsds[0].GetTopic(topicName)
+	}
+	topic := emsds[0].GetTopic("other")
+	for _, channelName := range []string{"ch1", "ch3", "ch2"} {
+		topic.GetChannel(channelName)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	get := func(url string, v interface{}) {
+		resp, err := client.Get(url)
+		test.Nil(t, err)
+		test.Equal(t, 200, resp.StatusCode)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Logf("%s", body)
+		test.Nil(t, json.Unmarshal(body, v))
+	}
+
+	var tr TopicsDoc
+	url := fmt.Sprintf("http://%s/api/topics?prefix=paged_&limit=2", emsadmin1.RealHTTPAddr())
+	get(url, &tr)
+	test.Equal(t, []interface{}{"paged_a", "paged_b"}, tr.Topics)
+	test.NotEqual(t, "", tr.NextCursor)
+
+	cursor := tr.NextCursor
+	tr = TopicsDoc{}
+	get(url+"&cursor="+cursor, &tr)
+	test.Equal(t, []interface{}{"paged_c"}, tr.Topics)
+	test.Equal(t, "", tr.NextCursor)
+
+	var ts TopicStatsDoc
+	url = fmt.Sprintf("http://%s/api/topics/other?sort=-name&limit=2", emsadmin1.RealHTTPAddr())
+	get(url, &ts)
+	test.Equal(t, 2, len(ts.Channels))
+	test.Equal(t, "ch3", ts.Channels[0].ChannelName)
+	test.Equal(t, "ch2", ts.Channels[1].ChannelName)
+	test.NotEqual(t, "", ts.NextCursor)
+}
+
+func TestHTTPTopicPlacementGET(t *testing.T) {
+	dataPath, emsds, emslookupds, emsadmin1 := bootstrapEMSCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer emsds[0].Exit()
+	defer emslookupds[0].Exit()
+	defer emsadmin1.Exit()
+
+	topicName := "test_topic_placement" + strconv.Itoa(int(time.Now().Unix()))
+	emsds[0].GetTopic(topicName)
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/placement/rule?pattern=test_topic_placement*&selector=zone=a&replicas=1",
+		emslookupds[0].RealHTTPAddr())
+	resp, err := client.Post(url, "", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/api/topics/%s", emsadmin1.RealHTTPAddr(), topicName)
+	resp, err = client.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	ts := TopicStatsDoc{}
+	err = json.Unmarshal(body, &ts)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(ts.PlacementViolations))
+	test.Equal(t, "under_replicated", ts.PlacementViolations[0].Reason)
+	test.Equal(t, 0, ts.PlacementViolations[0].Hosts)
+	test.Equal(t, 1, ts.PlacementViolations[0].Wanted)
+	test.Equal(t, "unselected_node", ts.PlacementViolations[1].Reason)
+	test.Equal(t, fmt.Sprintf("127.0.0.1:%d", emsds[0].RealHTTPAddr().Port), ts.PlacementViolations[1].Node)
+}
+
 func TestHTTPNodesGET(t *testing.T) {
 	dataPath, emsds, emslookupds, emsadmin1 := bootstrapEMSCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -262,6 +351,9 @@ func TestHTTPNodesGET(t *testing.T) {
 	test.Equal(t, emsds[0].RealTCPAddr().Port, testNode.TCPPort)
 	test.Equal(t, emsds[0].RealHTTPAddr().Port, testNode.HTTPPort)
 	test.Equal(t, version.Binary, testNode.Version)
+	test.NotNil(t, testNode.NodeID)
+	test.Equal(t, emssvr.NewOptions().ID, *testNode.NodeID)
+	test.Equal(t, false, testNode.NodeIDConflict)
 	test.Equal(t, 0, len(testNode.Topics))
 }
 
@@ -411,6 +503,61 @@ func TestHTTPTombstoneTopicNodePOST(t *testing.T) {
 	resp.Body.Close()
 }
 
+func TestHTTPMigrateTopicPOST(t *testing.T) {
+	dataPath, emsds, emslookupds, emsadmin1 := bootstrapEMSCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer emsds[0].Exit()
+	defer emslookupds[0].Exit()
+	defer emsadmin1.Exit()
+
+	emsdOpts := emssvr.NewOptions()
+	emsdOpts.TCPAddress = "127.0.0.1:0"
+	emsdOpts.HTTPAddress = "127.0.0.1:0"
+	emsdOpts.BroadcastAddress = "127.0.0.1"
+	emsdOpts.EMSLookupdTCPAddresses = []string{emslookupds[0].RealTCPAddr().String()}
+	emsdOpts.Logger = test.NewTestLogger(t)
+	emsdOpts.DataPath, _ = ioutil.TempDir("", "ems-test-")
+	defer os.RemoveAll(emsdOpts.DataPath)
+	target, err := emssvr.New(emsdOpts)
+	test.Nil(t, err)
+	go target.Main()
+	defer target.Exit()
+
+	topicName := "test_migrate_topic_post" + strconv.Itoa(int(time.Now().Unix()))
+	topic := emsds[0].GetTopic(topicName)
+	topic.GetChannel("ch")
+	test.Nil(t, topic.PutMessage(emssvr.NewMessage(topic.GenerateID(), []byte("test"))))
+	time.Sleep(100 * time.Millisecond)
+
+	url := fmt.Sprintf("http://%s/api/topics/%s", emsadmin1.RealHTTPAddr(), topicName)
+	body, _ := json.Marshal(map[string]interface{}{
+		"action": "migrate",
+		"source": emsds[0].RealHTTPAddr().String(),
+		"target": target.RealHTTPAddr().String(),
+	})
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	// once migrated the topic is deleted on the source
+	for i := 0; ; i++ {
+		_, err := emsds[0].GetExistingTopic(topicName)
+		if err != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("topic not deleted on the source")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	migrated, err := target.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	ch, err := migrated.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), ch.Depth())
+}
+
 func TestHTTPDeleteTopicPOST(t *testing.T) {
 	dataPath, emsds, emslookupds, emsadmin1 := bootstrapEMSCluster(t)
 	defer os.RemoveAll(dataPath)
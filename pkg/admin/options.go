@@ -45,8 +45,9 @@ type Options struct {
 
 	StatsdInterval time.Duration `flag:"statsd-interval"`
 
-	EMSLookupdHTTPAddresses []string `flag:"lookupd-http-address" cfg:"emslookupd_http_addresses"`
-	EMSDHTTPAddresses       []string `flag:"emsd-http-address" cfg:"emsd_http_addresses"`
+	EMSLookupdHTTPAddresses  []string `flag:"lookupd-http-address" cfg:"emslookupd_http_addresses"`
+	EMSLookupdHTTPAdminToken string   `flag:"lookupd-http-admin-token" cfg:"emslookupd_http_admin_token"`
+	EMSDHTTPAddresses        []string `flag:"emsd-http-address" cfg:"emsd_http_addresses"`
 
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout"`
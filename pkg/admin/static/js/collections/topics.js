@@ -19,6 +19,7 @@ var Topics = Backbone.Collection.extend({
     },
 
     parse: function(resp) {
+        this.nextCursor = resp['next_cursor'];
         var topics = _.map(resp['topics'], function(name) {
             return {'name': name};
         });
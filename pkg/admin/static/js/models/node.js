@@ -1,4 +1,5 @@
 var AppState = require('../app_state');
+var $ = require('jquery');
 var Backbone = require('backbone');
 
 var Node = Backbone.Model.extend({ //eslint-disable-line no-undef
@@ -12,6 +13,10 @@ var Node = Backbone.Model.extend({ //eslint-disable-line no-undef
         return AppState.apiPath('/nodes');
     },
 
+    drain: function(forward) {
+        return $.post(this.url(), JSON.stringify({'action': 'drain', 'forward': forward}));
+    },
+
     tombstoneTopic: function(topic) {
         return this.destroy({
             'data': JSON.stringify({'topic': topic}),
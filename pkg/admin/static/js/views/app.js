@@ -126,7 +126,7 @@ var AppView = BaseView.extend({
 
     showNode: function(node) {
         this.showView(function() {
-            var model = new Node({'name': node});
+            var model = new Node({'name': node, 'isAdmin': AppState.get('IS_ADMIN')});
             return new NodeView({'model': model});
         });
     },
@@ -1,3 +1,9 @@
+var $ = require('jquery');
+
+window.jQuery = $;
+var bootstrap = require('bootstrap'); //eslint-disable-line no-unused-vars
+var bootbox = require('bootbox');
+
 var Pubsub = require('../lib/pubsub');
 var AppState = require('../app_state');
 
@@ -8,16 +14,41 @@ var NodeView = BaseView.extend({
 
     template: require('./spinner.hbs'),
 
+    events: {
+        'click .node-actions button': 'nodeAction'
+    },
+
     initialize: function() {
         BaseView.prototype.initialize.apply(this, arguments);
         this.listenTo(AppState, 'change:graph_interval', this.render);
+        var isAdmin = this.model.get('isAdmin');
         this.model.fetch()
             .done(function(data) {
                 this.template = require('./node.hbs');
-                this.render({'message': data['message']});
+                this.render({'message': data['message'], 'isAdmin': isAdmin});
             }.bind(this))
             .fail(this.handleViewError.bind(this))
             .always(Pubsub.trigger.bind(Pubsub, 'view:ready'));
+    },
+
+    nodeAction: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        var txt = 'Are you sure you want to <strong>drain</strong> <em>' +
+            this.model.get('name') + '</em>? It stops accepting messages, ' +
+            'unregisters from lookupd and exits once its channels are empty.<br/><br/>' +
+            'Forward remaining messages to (emsd TCP address, optional):';
+        bootbox.prompt({
+            'title': txt,
+            'callback': function(forward) {
+                if (forward === null) {
+                    return;
+                }
+                this.model.drain(forward)
+                    .done(function() { window.location.reload(true); })
+                    .fail(this.handleAJAXError.bind(this));
+            }.bind(this)
+        });
     }
 });
 
@@ -35,6 +35,10 @@ var TopicView = BaseView.extend({
         e.preventDefault();
         e.stopPropagation();
         var action = $(e.currentTarget).data('action');
+        if (action === 'migrate') {
+            this.migrateTopic();
+            return;
+        }
         var txt = 'Are you sure you want to <strong>' +
             action + '</strong> <em>' + this.model.get('name') + '</em>?';
         bootbox.confirm(txt, function(result) {
@@ -50,6 +54,28 @@ var TopicView = BaseView.extend({
                     .fail(this.handleAJAXError.bind(this));
             }
         }.bind(this));
+    },
+
+    migrateTopic: function() {
+        bootbox.prompt('Move <em>' + this.model.get('name') + '</em> from node (emsd HTTP address):',
+            function(source) {
+                if (!source) {
+                    return;
+                }
+                bootbox.prompt('Move <em>' + this.model.get('name') + '</em> from ' + source +
+                    ' to node (emsd HTTP address):', function(target) {
+                    if (!target) {
+                        return;
+                    }
+                    $.post(this.model.url(), JSON.stringify({
+                        'action': 'migrate',
+                        'source': source,
+                        'target': target
+                    }))
+                        .done(function() { window.location.reload(true); })
+                        .fail(this.handleAJAXError.bind(this));
+                }.bind(this));
+            }.bind(this));
     }
 });
 
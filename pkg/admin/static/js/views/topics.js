@@ -1,3 +1,5 @@
+var $ = require('jquery');
+
 var Pubsub = require('../lib/pubsub');
 var AppState = require('../app_state');
 
@@ -9,17 +11,56 @@ var TopicsView = BaseView.extend({
 
     template: require('./spinner.hbs'),
 
+    events: {
+        'submit .topics-filter': 'onFilter',
+        'click .topics-next': 'onNextPage'
+    },
+
+    pageSize: 100,
+
     initialize: function() {
         BaseView.prototype.initialize.apply(this, arguments);
         this.listenTo(AppState, 'change:graph_interval', this.render);
         this.collection = new Topics();
-        this.collection.fetch()
+        this.prefix = '';
+        this.cursor = '';
+        this.fetchPage()
+            .always(Pubsub.trigger.bind(Pubsub, 'view:ready'));
+    },
+
+    fetchPage: function() {
+        var params = {'limit': this.pageSize};
+        if (this.prefix !== '') {
+            params['prefix'] = this.prefix;
+        }
+        if (this.cursor !== '') {
+            params['cursor'] = this.cursor;
+        }
+        return this.collection.fetch({'data': params, 'reset': true})
             .done(function(data) {
                 this.template = require('./topics.hbs');
-                this.render({'message': data['message']});
+                this.render({
+                    'message': data['message'],
+                    'prefix': this.prefix,
+                    'next_cursor': this.collection.nextCursor
+                });
             }.bind(this))
-            .fail(this.handleViewError.bind(this))
-            .always(Pubsub.trigger.bind(Pubsub, 'view:ready'));
+            .fail(this.handleViewError.bind(this));
+    },
+
+    onFilter: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        this.prefix = $(e.target.elements['prefix']).val();
+        this.cursor = '';
+        this.fetchPage();
+    },
+
+    onNextPage: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        this.cursor = this.collection.nextCursor;
+        this.fetchPage();
     }
 });
 
@@ -21,6 +21,7 @@ package client
 // THE SOFTWARE.
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -50,9 +51,20 @@ type wrappedResp struct {
 	Data       interface{} `json:"data"`
 }
 
+// apiStatusError is returned for a non-200 response
+type apiStatusError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("got response %s %q", e.Status, e.Body)
+}
+
 // stores the result in the value pointed to by ret(must be a pointer)
-func apiRequestNegotiateV1(httpclient *http.Client, method string, endpoint string, headers http.Header, ret interface{}) error {
-	req, err := http.NewRequest(method, endpoint, nil)
+func apiRequestNegotiateV1(ctx context.Context, httpclient *http.Client, method string, endpoint string, headers http.Header, ret interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
 	if err != nil {
 		return err
 	}
@@ -74,7 +86,7 @@ func apiRequestNegotiateV1(httpclient *http.Client, method string, endpoint stri
 	}
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("got response %s %q", resp.Status, respBody)
+		return &apiStatusError{resp.StatusCode, resp.Status, respBody}
 	}
 
 	if len(respBody) == 0 {
@@ -138,6 +138,18 @@ func UnRegister(topic string, channel string) *Command {
 	return &Command{[]byte("UNREGISTER"), params, nil}
 }
 
+// RegisterReplica creates a new Command to add a replica of a topic for the
+// connected emsd
+func RegisterReplica(topic string) *Command {
+	return &Command{[]byte("REGISTER_REPLICA"), [][]byte{[]byte(topic)}, nil}
+}
+
+// UnRegisterReplica creates a new Command to remove a replica of a topic for
+// the connected emsd
+func UnRegisterReplica(topic string) *Command {
+	return &Command{[]byte("UNREGISTER_REPLICA"), [][]byte{[]byte(topic)}, nil}
+}
+
 // Ping creates a new Command to keep-alive the state of all the
 // announced topic/channels for a given client
 func Ping() *Command {
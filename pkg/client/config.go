@@ -133,6 +133,33 @@ type Config struct {
 	LookupdPollJitter   float64       `opt:"lookupd_poll_jitter" min:"0" max:"1" default:"0.3"`
 	LookupdPollTimeout  time.Duration `opt:"lookupd_poll_timeout" default:"1m"`
 
+	// Maximum duration emslookupd holds a watch, which returns as soon as the
+	// producers of the topic change. emslookupd is only polled while watching
+	// fails, or if this is 0.
+	LookupdWatchTimeout time.Duration `opt:"lookupd_watch_timeout" min:"0" max:"5m" default:"30s"`
+
+	// Comma separated "<key>:<value>" emsd labels (e.g. "zone:a,region:eu"),
+	// earlier ones weigh more. A Consumer only connects to the producers
+	// discovered via emslookupd which match the most of them, or to all of
+	// them if none matches any. Every message is still consumed as long as
+	// every locality has consumers.
+	LocalityPreference string `opt:"locality_preference"`
+
+	// Opt-in batching of the publishes queued with Producer.PublishAsync: the
+	// messages of a topic are sent together in an MPUB once there are
+	// PublishBatchSize of them (disabled below 2), PublishBatchBytes of bodies,
+	// or PublishLinger after the first one was queued
+	PublishBatchSize  int           `opt:"publish_batch_size" min:"0" default:"0"`
+	PublishBatchBytes int64         `opt:"publish_batch_bytes" min:"1" default:"1048576"`
+	PublishLinger     time.Duration `opt:"publish_linger" min:"0" max:"1m" default:"5ms"`
+
+	// Strategy a ProducerPool picks the emsd to publish to with: round_robin,
+	// least_pending (the fewest publishes awaiting a response) or sticky (the
+	// same emsd until it fails)
+	PoolStrategy string `opt:"pool_strategy" default:"round_robin"`
+	// Duration between the Pings a ProducerPool checks the health of its emsd with
+	PoolHealthCheckInterval time.Duration `opt:"pool_health_check_interval" min:"10ms" max:"5m" default:"5s"`
+
 	// Maximum duration when REQueueing (for doubling of deferred requeue)
 	MaxRequeueDelay     time.Duration `opt:"max_requeue_delay" min:"0" max:"60m" default:"15m"`
 	DefaultRequeueDelay time.Duration `opt:"default_requeue_delay" min:"0" max:"60m" default:"90s"`
@@ -329,7 +356,7 @@ func (h *structTagsConfig) Set(c *Config, option string, value interface{}) erro
 					option, coercedVal.Interface(), coercedMaxVal.Interface())
 			}
 		}
-		if coercedVal.Type().String() == "ems.BackoffStrategy" {
+		if coercedVal.Type() == backoffStrategyType {
 			v := coercedVal.Interface().(BackoffStrategy)
 			if v, ok := v.(interface {
 				setConfig(*Config)
@@ -405,6 +432,16 @@ func (h *structTagsConfig) Validate(c *Config) error {
 		return fmt.Errorf("HeartbeatInterval %v must be less than ReadTimeout %v", c.HeartbeatInterval, c.ReadTimeout)
 	}
 
+	if _, err := parseLocality(c.LocalityPreference); err != nil {
+		return err
+	}
+
+	switch c.PoolStrategy {
+	case poolRoundRobin, poolLeastPending, poolSticky:
+	default:
+		return fmt.Errorf("invalid PoolStrategy %q", c.PoolStrategy)
+	}
+
 	return nil
 }
 
@@ -539,6 +576,8 @@ func valueCompare(v1 reflect.Value, v2 reflect.Value) int {
 	panic("impossible")
 }
 
+var backoffStrategyType = reflect.TypeOf((*BackoffStrategy)(nil)).Elem()
+
 func coerce(v interface{}, typ reflect.Type) (reflect.Value, error) {
 	var err error
 	if typ.Kind() == reflect.Ptr {
@@ -559,7 +598,7 @@ func coerce(v interface{}, typ reflect.Type) (reflect.Value, error) {
 		v, err = coerceDuration(v)
 	case "net.Addr":
 		v, err = coerceAddr(v)
-	case "ems.BackoffStrategy":
+	case backoffStrategyType.String():
 		v, err = coerceBackoffStrategy(v)
 	default:
 		v = nil
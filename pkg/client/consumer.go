@@ -22,6 +22,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -149,6 +150,7 @@ type Consumer struct {
 	lookupdHTTPAddrs   []string
 	lookupdQueryIndex  int
 	lookupdHttpClient  *http.Client
+	lookupdWatching    int32 // lookupdWatchLoop is picking up changes
 
 	wg              sync.WaitGroup
 	runningHandlers int32
@@ -406,6 +408,10 @@ func (r *Consumer) ConnectToEMSLookupd(addr string) error {
 		r.queryLookupd()
 		r.wg.Add(1)
 		go r.lookupdLoop()
+		if r.config.LookupdWatchTimeout > 0 {
+			r.wg.Add(1)
+			go r.lookupdWatchLoop()
+		}
 	}
 
 	return nil
@@ -427,7 +433,8 @@ func (r *Consumer) ConnectToEMSLookupds(addresses []string) error {
 	return nil
 }
 
-// poll all known lookup servers every LookupdPollInterval
+// poll all known lookup servers every LookupdPollInterval, unless
+// lookupdWatchLoop is watching one
 func (r *Consumer) lookupdLoop() {
 	// add some jitter so that multiple consumers discovering the same topic,
 	// when restarted at the same time, dont all connect at once.
@@ -448,6 +455,9 @@ func (r *Consumer) lookupdLoop() {
 	for {
 		select {
 		case <-ticker.C:
+			if atomic.LoadInt32(&r.lookupdWatching) == 1 {
+				continue
+			}
 			r.queryLookupd()
 		case <-r.lookupdRecheckChan:
 			r.queryLookupd()
@@ -464,6 +474,76 @@ exit:
 	r.wg.Done()
 }
 
+// long-poll one of the lookup servers for changes to the producers of the
+// topic, moving on to the next one on errors. Exits if it doesn't support
+// watches, leaving lookupdLoop to poll.
+func (r *Consumer) lookupdWatchLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-r.exitChan
+		cancel()
+	}()
+
+	timeout := r.config.LookupdWatchTimeout
+	if r.config.LookupdPollTimeout > 0 && timeout > r.config.LookupdPollTimeout/2 {
+		// leave time for the response
+		timeout = r.config.LookupdPollTimeout / 2
+	}
+
+	var idx int
+	var version uint64
+	var hasVersion bool
+	for {
+		r.mtx.RLock()
+		addr := r.lookupdHTTPAddrs[idx%len(r.lookupdHTTPAddrs)]
+		r.mtx.RUnlock()
+
+		endpoint, err := buildWatchAddr(addr, version, hasVersion, timeout)
+		if err != nil {
+			r.log(LogLevelError, "(%s) invalid emslookupd address - %s", addr, err)
+			break
+		}
+
+		var data lookupResp
+		headers := make(http.Header)
+		if r.config.AuthSecret != "" && r.config.LookupdAuthorization {
+			headers.Set("Authorization", fmt.Sprintf("Bearer %s", r.config.AuthSecret))
+		}
+		err = apiRequestNegotiateV1(ctx, r.lookupdHttpClient, "GET", endpoint, headers, &data)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			atomic.StoreInt32(&r.lookupdWatching, 0)
+			if statusErr, ok := err.(*apiStatusError); ok &&
+				(statusErr.StatusCode == 404 || statusErr.StatusCode == 405) {
+				r.log(LogLevelInfo, "emslookupd %s doesn't support watching, polling every %s",
+					addr, r.config.LookupdPollInterval)
+				break
+			}
+			r.log(LogLevelError, "error watching emslookupd (%s) - %s", endpoint, err)
+			idx++
+			hasVersion = false
+			select {
+			case <-time.After(r.config.LookupdPollInterval):
+			case <-r.exitChan:
+			}
+			continue
+		}
+
+		atomic.StoreInt32(&r.lookupdWatching, 1)
+		if !hasVersion || data.Version != version {
+			r.connectToProducers(data.Producers)
+		}
+		version = data.Version
+		hasVersion = true
+	}
+
+	atomic.StoreInt32(&r.lookupdWatching, 0)
+	r.log(LogLevelInfo, "exiting lookupdWatchLoop")
+	r.wg.Done()
+}
+
 // return the next lookupd endpoint to query
 // keeping track of which one was last used
 func (r *Consumer) nextLookupdEndpoint() string {
@@ -483,6 +563,7 @@ type lookupResp struct {
 	Channels  []string    `json:"channels"`
 	Producers []*peerInfo `json:"producers"`
 	Timestamp int64       `json:"timestamp"`
+	Version   uint64      `json:"version"`
 }
 
 type peerInfo struct {
@@ -492,6 +573,62 @@ type peerInfo struct {
 	TCPPort          int    `json:"tcp_port"`
 	HTTPPort         int    `json:"http_port"`
 	Version          string `json:"version"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type localityLabel struct {
+	key   string
+	value string
+}
+
+// parseLocality parses Config.LocalityPreference
+func parseLocality(s string) ([]localityLabel, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var labels []localityLabel
+	for _, term := range strings.Split(s, ",") {
+		idx := strings.IndexByte(term, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid LocalityPreference %q, must be <key>:<value>[,<key>:<value>...]", s)
+		}
+		labels = append(labels, localityLabel{term[:idx], term[idx+1:]})
+	}
+	return labels, nil
+}
+
+// preferLocal returns the producers matching the most locality labels, all of
+// them if none matches any
+func preferLocal(producers []*peerInfo, locality []localityLabel) []*peerInfo {
+	score := func(producer *peerInfo) int {
+		var n int
+		for _, l := range locality {
+			n <<= 1
+			if v, ok := producer.Labels[l.key]; ok && v == l.value {
+				n |= 1
+			}
+		}
+		return n
+	}
+
+	var best int
+	for _, producer := range producers {
+		if n := score(producer); n > best {
+			best = n
+		}
+	}
+	if best == 0 {
+		return producers
+	}
+
+	var local []*peerInfo
+	for _, producer := range producers {
+		if score(producer) == best {
+			local = append(local, producer)
+		}
+	}
+	return local
 }
 
 // make an HTTP req to one of the configured emslookupd instances to discover
@@ -511,7 +648,7 @@ retry:
 	if r.config.AuthSecret != "" && r.config.LookupdAuthorization {
 		headers.Set("Authorization", fmt.Sprintf("Bearer %s", r.config.AuthSecret))
 	}
-	err := apiRequestNegotiateV1(r.lookupdHttpClient, "GET", endpoint, headers, &data)
+	err := apiRequestNegotiateV1(context.Background(), r.lookupdHttpClient, "GET", endpoint, headers, &data)
 	if err != nil {
 		r.log(LogLevelError, "error querying emslookupd (%s) - %s", endpoint, err)
 		retries++
@@ -522,8 +659,19 @@ retry:
 		return
 	}
 
+	r.connectToProducers(data.Producers)
+}
+
+// connect to the producers returned by emslookupd which aren't connected yet
+func (r *Consumer) connectToProducers(producers []*peerInfo) {
+	// validated with the config
+	locality, _ := parseLocality(r.config.LocalityPreference)
+	if len(locality) > 0 {
+		producers = preferLocal(producers, locality)
+	}
+
 	var emsdAddrs []string
-	for _, producer := range data.Producers {
+	for _, producer := range producers {
 		broadcastAddress := producer.BroadcastAddress
 		port := producer.TCPPort
 		joined := net.JoinHostPort(broadcastAddress, strconv.Itoa(port))
@@ -534,7 +682,7 @@ retry:
 		emsdAddrs = discoveryFilter.Filter(emsdAddrs)
 	}
 	for _, addr := range emsdAddrs {
-		err = r.ConnectToEMSD(addr)
+		err := r.ConnectToEMSD(addr)
 		if err != nil && err != ErrAlreadyConnected {
 			r.log(LogLevelError, "(%s) error connecting to emsd - %s", addr, err)
 			continue
@@ -1253,3 +1401,56 @@ func buildLookupAddr(addr, topic string) (string, error) {
 	u.RawQuery = v.Encode()
 	return u.String(), nil
 }
+
+// buildPlacementAddr returns the placement endpoint of topic for an emslookupd
+// address
+func buildPlacementAddr(addr, topic string) (string, error) {
+	lookupAddr, err := buildLookupAddr(addr, topic)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(lookupAddr)
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = "/placement"
+	return u.String(), nil
+}
+
+// buildNodesAddr returns the /nodes endpoint of an emslookupd address as
+// accepted by buildLookupAddr
+func buildNodesAddr(addr string) (string, error) {
+	lookupAddr, err := buildLookupAddr(addr, "")
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(lookupAddr)
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = "/nodes"
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// buildWatchAddr returns the watch endpoint for a lookup address built by
+// buildLookupAddr
+func buildWatchAddr(addr string, version uint64, hasVersion bool, timeout time.Duration) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/watch"
+	v := u.Query()
+	if hasVersion {
+		v.Set("version", strconv.FormatUint(version, 10))
+	}
+	v.Set("timeout", timeout.String())
+	u.RawQuery = v.Encode()
+	return u.String(), nil
+}
@@ -31,8 +31,10 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -176,6 +178,107 @@ func TestConsumerLookupdAuthorization(t *testing.T) {
 	}
 }
 
+func TestConsumerLookupdWatch(t *testing.T) {
+	// confirm that producers returned by a lookupd watch are connected to
+	// without waiting for the next poll
+	config := NewConfig()
+	config.LookupdPollInterval = time.Minute
+	topicName := "watch" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	var watches int32
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-EMS-Content-Type", "Bhojpur EMS; version=1.0")
+		if r.URL.Path == "/lookup" {
+			w.Write([]byte(`{"channels":[],"producers":[]}`))
+			return
+		}
+		if r.URL.Path != "/lookup/watch" || r.URL.Query().Get("timeout") == "" {
+			t.Errorf("unexpected request %s", r.URL)
+			w.WriteHeader(404)
+			return
+		}
+		version := r.URL.Query().Get("version")
+		switch atomic.AddInt32(&watches, 1) {
+		case 1:
+			if version != "" {
+				t.Errorf("unexpected version %q", version)
+			}
+			w.Write([]byte(`{"channels":[],"producers":[],"version":1}`))
+		case 2:
+			if version != "1" {
+				t.Errorf("unexpected version %q", version)
+			}
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte(`{"channels":[],"producers":[{"broadcast_address":"127.0.0.1","tcp_port":4150}],"version":2}`))
+		default:
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+				w.Write([]byte(`{"channels":[],"producers":[],"version":2}`))
+			}
+		}
+	}))
+	defer lookupd.Close()
+
+	h := &MyTestHandler{
+		t: t,
+		q: q,
+	}
+	q.AddHandler(h)
+	defer q.Stop()
+
+	err := q.ConnectToEMSLookupd(lookupd.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && q.Stats().Connections == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Stats().Connections != 1 {
+		t.Fatalf("expected 1 connection, got %d", q.Stats().Connections)
+	}
+}
+
+func TestConsumerLocalityPreference(t *testing.T) {
+	producers := []*peerInfo{
+		{BroadcastAddress: "a1", Labels: map[string]string{"zone": "a", "region": "eu"}},
+		{BroadcastAddress: "b1", Labels: map[string]string{"zone": "b", "region": "eu"}},
+		{BroadcastAddress: "c1", Labels: map[string]string{"zone": "c", "region": "us"}},
+		{BroadcastAddress: "x1"},
+	}
+	addrs := func(producers []*peerInfo) []string {
+		var addrs []string
+		for _, p := range producers {
+			addrs = append(addrs, p.BroadcastAddress)
+		}
+		return addrs
+	}
+
+	for preference, expected := range map[string][]string{
+		"zone:a":           {"a1"},
+		"region:eu":        {"a1", "b1"},
+		"zone:d,region:eu": {"a1", "b1"},
+		"zone:b,region:us": {"b1"},
+		"zone:d":           {"a1", "b1", "c1", "x1"},
+	} {
+		locality, err := parseLocality(preference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := addrs(preferLocal(producers, locality)); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", preference, expected, got)
+		}
+	}
+
+	config := NewConfig()
+	config.LocalityPreference = "zone"
+	if config.Validate() == nil {
+		t.Fatal("expected an invalid LocalityPreference")
+	}
+}
+
 func TestConsumerTLSClientCertViaSet(t *testing.T) {
 	consumerTest(t, func(c *Config) {
 		c.Set("tls_v1", true)
@@ -108,4 +108,16 @@ Producing messages can be done by creating an instance of a Producer.
 	// Gracefully stop the producer when appropriate (e.g. before shutting down the service)
 	producer.Stop()
 
+A ProducerPool has the same API but publishes to several emsd, listed or
+discovered via emslookupd, failing over between them.
+
+	config := ems.NewConfig()
+	config.PoolStrategy = "least_pending"
+	pool, err := ems.NewProducerPoolFromLookupd([]string{"127.0.0.1:4161"}, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = pool.Publish(topicName, messageBody)
+
 */
@@ -33,6 +33,10 @@ var ErrNotConnected = errors.New("not connected")
 // made against a Producer that has been stopped
 var ErrStopped = errors.New("stopped")
 
+// ErrNoProducers is returned when a publish command is made against a
+// ProducerPool without any emsd left to try
+var ErrNoProducers = errors.New("no emsd available")
+
 // ErrClosing is returned when a connection is closing
 var ErrClosing = errors.New("closing")
 
@@ -21,9 +21,14 @@ package client
 // THE SOFTWARE.
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -67,6 +72,14 @@ type Producer struct {
 	exitChan            chan int
 	wg                  sync.WaitGroup
 	guard               sync.Mutex
+
+	// PublishAsync batching (Config.PublishBatchSize)
+	batchGuard   sync.Mutex
+	batches      map[string]*publishBatch
+	batchQueue   []*publishBatch
+	batchSending bool
+	batchStopped bool
+	batchWG      sync.WaitGroup
 }
 
 // ProducerTransaction is returned by the async publish methods
@@ -108,6 +121,8 @@ func NewProducer(addr string, config *Config) (*Producer, error) {
 		exitChan:        make(chan int),
 		responseChan:    make(chan []byte),
 		errorChan:       make(chan []byte),
+
+		batches: make(map[string]*publishBatch),
 	}
 
 	// Set default logger for all log levels
@@ -118,6 +133,59 @@ func NewProducer(addr string, config *Config) (*Producer, error) {
 	return p, nil
 }
 
+// NewProducerForTopic returns an instance of Producer for the emsd the given
+// emslookupd place topic on (see their /placement endpoint), according to
+// their placement rules. The emslookupd are queried in order until one
+// answers, the emsd picked is the first one it returns matching the most
+// Config.LocalityPreference labels.
+//
+// The placement is only looked up once, the Producer keeps publishing to the
+// same emsd.
+func NewProducerForTopic(topic string, lookupdHTTPAddrs []string, config *Config) (*Producer, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if len(lookupdHTTPAddrs) == 0 {
+		return nil, errors.New("no emslookupd")
+	}
+
+	httpclient := &http.Client{Timeout: config.LookupdPollTimeout}
+	headers := make(http.Header)
+	if config.AuthSecret != "" && config.LookupdAuthorization {
+		headers.Set("Authorization", fmt.Sprintf("Bearer %s", config.AuthSecret))
+	}
+
+	var data lookupResp
+	for _, addr := range lookupdHTTPAddrs {
+		var endpoint string
+		endpoint, err = buildPlacementAddr(addr, topic)
+		if err != nil {
+			return nil, err
+		}
+		err = apiRequestNegotiateV1(context.Background(), httpclient, "GET", endpoint, headers, &data)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query placement of topic %s - %s", topic, err)
+	}
+
+	producers := data.Producers
+	// validated with the config
+	locality, _ := parseLocality(config.LocalityPreference)
+	if len(locality) > 0 {
+		producers = preferLocal(producers, locality)
+	}
+	if len(producers) == 0 {
+		return nil, fmt.Errorf("no emsd to place topic %s on", topic)
+	}
+
+	addr := net.JoinHostPort(producers[0].BroadcastAddress, strconv.Itoa(producers[0].TCPPort))
+	return NewProducer(addr, config)
+}
+
 // Ping causes the Producer to connect to it's configured emsd (if not already
 // connected) and send a `Nop` command, returning any error that might occur.
 //
@@ -191,6 +259,8 @@ func (w *Producer) String() string {
 //
 // NOTE: this blocks until completion
 func (w *Producer) Stop() {
+	w.stopBatching()
+
 	w.guard.Lock()
 	if !atomic.CompareAndSwapInt32(&w.stopFlag, 0, 1) {
 		w.guard.Unlock()
@@ -210,8 +280,15 @@ func (w *Producer) Stop() {
 // the supplied `doneChan` (if specified)
 // will receive a `ProducerTransaction` instance with the supplied variadic arguments
 // and the response error if present
+//
+// With Config.PublishBatchSize set, the message is queued to be published
+// in an MPUB with the other ones of the topic (see publishBatch), errors
+// (including connection ones) are then only reported via `doneChan`.
 func (w *Producer) PublishAsync(topic string, body []byte, doneChan chan *ProducerTransaction,
 	args ...interface{}) error {
+	if w.config.PublishBatchSize > 1 {
+		return w.queuePublish(topic, body, doneChan, args)
+	}
 	return w.sendCommandAsync(Publish(topic, body), doneChan, args)
 }
 
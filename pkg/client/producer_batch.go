@@ -0,0 +1,155 @@
+package client
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"time"
+)
+
+// publishBatch is the messages of a topic queued with PublishAsync while
+// batching, they're sent together in an MPUB once there are
+// Config.PublishBatchSize of them, Config.PublishBatchBytes of bodies or
+// Config.PublishLinger after the first one was queued. The transaction of
+// every message completes with the response to the MPUB.
+//
+// The messages of a topic are sent in order, but Publish and the other
+// publish methods aren't batched and may overtake the queued ones.
+type publishBatch struct {
+	topic        string
+	bodies       [][]byte
+	transactions []*ProducerTransaction
+	size         int64
+	timer        *time.Timer
+}
+
+func (b *publishBatch) finish(err error) {
+	for _, t := range b.transactions {
+		t.Error = err
+		t.finish()
+	}
+}
+
+func (w *Producer) queuePublish(topic string, body []byte, doneChan chan *ProducerTransaction,
+	args []interface{}) error {
+	w.batchGuard.Lock()
+	defer w.batchGuard.Unlock()
+
+	if w.batchStopped {
+		return ErrStopped
+	}
+
+	b := w.batches[topic]
+	if b != nil && b.size+int64(len(body)) > w.config.PublishBatchBytes {
+		w.sendBatch(b)
+		b = nil
+	}
+	if b == nil {
+		b = &publishBatch{topic: topic}
+		b.timer = time.AfterFunc(w.config.PublishLinger, func() {
+			w.batchGuard.Lock()
+			defer w.batchGuard.Unlock()
+			// unless it was sent in the meantime
+			if w.batches[topic] == b {
+				w.sendBatch(b)
+			}
+		})
+		w.batches[topic] = b
+	}
+
+	b.bodies = append(b.bodies, body)
+	b.transactions = append(b.transactions, &ProducerTransaction{
+		doneChan: doneChan,
+		Args:     args,
+	})
+	b.size += int64(len(body))
+	if len(b.bodies) >= w.config.PublishBatchSize || b.size >= w.config.PublishBatchBytes {
+		w.sendBatch(b)
+	}
+	return nil
+}
+
+// sendBatch queues a complete batch, with batchGuard held, for sendBatches
+// to publish without it
+func (w *Producer) sendBatch(b *publishBatch) {
+	b.timer.Stop()
+	delete(w.batches, b.topic)
+
+	w.batchWG.Add(1)
+	w.batchQueue = append(w.batchQueue, b)
+	if !w.batchSending {
+		w.batchSending = true
+		go w.sendBatches()
+	}
+}
+
+// sendBatches publishes the queued batches, one at a time so that the
+// batches of a topic are sent in order, until there are none left
+func (w *Producer) sendBatches() {
+	for {
+		w.batchGuard.Lock()
+		if len(w.batchQueue) == 0 {
+			w.batchSending = false
+			w.batchGuard.Unlock()
+			return
+		}
+		b := w.batchQueue[0]
+		w.batchQueue[0] = nil
+		w.batchQueue = w.batchQueue[1:]
+		w.batchGuard.Unlock()
+
+		w.mpub(b)
+	}
+}
+
+func (w *Producer) mpub(b *publishBatch) {
+	cmd, err := MultiPublish(b.topic, b.bodies)
+	if err != nil {
+		go func() {
+			defer w.batchWG.Done()
+			b.finish(err)
+		}()
+		return
+	}
+
+	doneChan := make(chan *ProducerTransaction, 1)
+	err = w.sendCommandAsync(cmd, doneChan, nil)
+	go func() {
+		defer w.batchWG.Done()
+		if err == nil {
+			t := <-doneChan
+			err = t.Error
+		}
+		b.finish(err)
+	}()
+}
+
+// stopBatching sends the queued batches and waits for their responses,
+// PublishAsync then fails with ErrStopped
+func (w *Producer) stopBatching() {
+	w.batchGuard.Lock()
+	w.batchStopped = true
+	for _, b := range w.batches {
+		w.sendBatch(b)
+	}
+	w.batchGuard.Unlock()
+
+	w.batchWG.Wait()
+}
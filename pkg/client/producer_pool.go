@@ -0,0 +1,620 @@
+package client
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// strategies of a ProducerPool (Config.PoolStrategy)
+const (
+	poolRoundRobin   = "round_robin"
+	poolLeastPending = "least_pending"
+	poolSticky       = "sticky"
+)
+
+// ProducerPool is a high-level type to publish to a set of `emsd`.
+//
+// It has the API of a Producer but spreads the publishes over a Producer
+// per emsd, picked by Config.PoolStrategy among the healthy ones. An emsd is
+// unhealthy from a connection error until it answers the next Ping, they're
+// sent every Config.PoolHealthCheckInterval.
+//
+// A publish failing with a connection error or an emsd side failure (e.g.
+// E_PUB_FAILED, E_DISK_FULL) is retried on the other emsd, once on each, so a
+// message published to an emsd which then lost the connection may be
+// published twice.
+type ProducerPool struct {
+	id     int64
+	config Config
+
+	lookupdHTTPAddrs []string
+	lookupdClient    *http.Client
+
+	logger   []logger
+	logLvl   LogLevel
+	logGuard sync.RWMutex
+
+	sync.Mutex
+	nodes  []*poolNode
+	next   uint64 // round_robin position
+	sticky int    // sticky index
+
+	stopFlag int32
+	exitChan chan int
+	wg       sync.WaitGroup
+}
+
+type poolNode struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	pending   int64
+	published uint64
+	failed    uint64
+
+	producer *Producer
+	healthy  int32
+}
+
+// PoolNodeStats are the publish stats of one emsd of a ProducerPool
+type PoolNodeStats struct {
+	Addr      string
+	Healthy   bool
+	Pending   int64  // publishes awaiting a response
+	Published uint64 // publishes acknowledged
+	Failed    uint64 // publishes failed on this emsd
+}
+
+// NewProducerPool returns an instance of ProducerPool for the specified emsd
+// addresses
+//
+// The only valid way to create a Config is via NewConfig, using a struct literal will panic.
+// After Config is passed into NewProducerPool the values are no longer mutable (they are copied).
+func NewProducerPool(addrs []string, config *Config) (*ProducerPool, error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoProducers
+	}
+
+	p, err := newProducerPool(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		p.addNode(addr)
+	}
+
+	p.wg.Add(1)
+	go p.healthLoop()
+	return p, nil
+}
+
+// NewProducerPoolFromLookupd returns an instance of ProducerPool for the emsd
+// registered with the given emslookupd (see their /nodes endpoint), which are
+// queried again every Config.LookupdPollInterval to keep up with emsd joining
+// and leaving
+func NewProducerPoolFromLookupd(lookupdHTTPAddrs []string, config *Config) (*ProducerPool, error) {
+	p, err := newProducerPool(config)
+	if err != nil {
+		return nil, err
+	}
+	p.lookupdHTTPAddrs = lookupdHTTPAddrs
+	p.lookupdClient = &http.Client{Timeout: p.config.LookupdPollTimeout}
+
+	err = p.queryLookupd()
+	if err != nil {
+		return nil, err
+	}
+
+	p.wg.Add(2)
+	go p.healthLoop()
+	go p.lookupdLoop()
+	return p, nil
+}
+
+func newProducerPool(config *Config) (*ProducerPool, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ProducerPool{
+		id:     atomic.AddInt64(&instCount, 1),
+		config: *config,
+
+		logger: make([]logger, int(LogLevelMax+1)),
+		logLvl: LogLevelInfo,
+
+		exitChan: make(chan int),
+	}
+
+	// Set default logger for all log levels
+	l := log.New(os.Stderr, "", log.Flags())
+	for index := range p.logger {
+		p.logger[index] = l
+	}
+	return p, nil
+}
+
+// addNode adds a Producer for addr to the pool, with the pool logging
+func (p *ProducerPool) addNode(addr string) {
+	// the config was validated with the pool
+	producer, _ := NewProducer(addr, &p.config)
+
+	p.logGuard.RLock()
+	for lvl, l := range p.logger {
+		producer.SetLoggerForLevel(l, LogLevel(lvl))
+	}
+	producer.SetLoggerLevel(p.logLvl)
+	p.logGuard.RUnlock()
+
+	p.Lock()
+	p.nodes = append(p.nodes, &poolNode{producer: producer, healthy: 1})
+	p.Unlock()
+}
+
+// Ping causes the ProducerPool to Ping all of its emsd, updating their
+// health, and returns an error if none answers
+func (p *ProducerPool) Ping() error {
+	var healthy int32
+	var wg sync.WaitGroup
+	for _, n := range p.getNodes() {
+		wg.Add(1)
+		go func(n *poolNode) {
+			defer wg.Done()
+			err := n.producer.Ping()
+			if err != nil {
+				p.log(LogLevelWarning, "(%s) failed health check - %s", n.producer, err)
+				atomic.StoreInt32(&n.healthy, 0)
+				return
+			}
+			atomic.StoreInt32(&n.healthy, 1)
+			atomic.AddInt32(&healthy, 1)
+		}(n)
+	}
+	wg.Wait()
+
+	if healthy == 0 {
+		return ErrNoProducers
+	}
+	return nil
+}
+
+func (p *ProducerPool) healthLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.PoolHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.Ping()
+		case <-p.exitChan:
+			return
+		}
+	}
+}
+
+func (p *ProducerPool) lookupdLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.LookupdPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := p.queryLookupd()
+			if err != nil {
+				p.log(LogLevelError, "%s", err)
+			}
+		case <-p.exitChan:
+			return
+		}
+	}
+}
+
+// queryLookupd syncs the emsd of the pool with the ones registered with the
+// emslookupd, they're queried in order until one answers
+func (p *ProducerPool) queryLookupd() error {
+	headers := make(http.Header)
+	if p.config.AuthSecret != "" && p.config.LookupdAuthorization {
+		headers.Set("Authorization", fmt.Sprintf("Bearer %s", p.config.AuthSecret))
+	}
+
+	var data lookupResp
+	err := ErrNoProducers
+	for _, addr := range p.lookupdHTTPAddrs {
+		var endpoint string
+		endpoint, err = buildNodesAddr(addr)
+		if err != nil {
+			return err
+		}
+		p.log(LogLevelDebug, "querying emslookupd %s", endpoint)
+		err = apiRequestNegotiateV1(context.Background(), p.lookupdClient, "GET", endpoint, headers, &data)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query emslookupd nodes - %s", err)
+	}
+
+	addrs := make(map[string]bool)
+	for _, producer := range data.Producers {
+		addrs[net.JoinHostPort(producer.BroadcastAddress, strconv.Itoa(producer.TCPPort))] = true
+	}
+
+	var removed []*poolNode
+	p.Lock()
+	nodes := p.nodes[:0]
+	for _, n := range p.nodes {
+		if !addrs[n.producer.String()] {
+			removed = append(removed, n)
+			continue
+		}
+		delete(addrs, n.producer.String())
+		nodes = append(nodes, n)
+	}
+	p.nodes = nodes
+	p.Unlock()
+
+	for addr := range addrs {
+		p.log(LogLevelInfo, "(%s) adding emsd", addr)
+		p.addNode(addr)
+	}
+	// their pending publishes fail with ErrNotConnected and are retried
+	for _, n := range removed {
+		p.log(LogLevelInfo, "(%s) removing emsd", n.producer)
+		go n.producer.Stop()
+	}
+	return nil
+}
+
+func (p *ProducerPool) getNodes() []*poolNode {
+	p.Lock()
+	defer p.Unlock()
+	return append([]*poolNode(nil), p.nodes...)
+}
+
+// pick returns the node to publish to next according to the strategy, the
+// healthy ones first, skipping the ones already tried
+func (p *ProducerPool) pick(tried map[*poolNode]bool) *poolNode {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.nodes) == 0 {
+		return nil
+	}
+
+	candidate := func(n *poolNode, healthy bool) bool {
+		return !tried[n] && (!healthy || atomic.LoadInt32(&n.healthy) == 1)
+	}
+
+	for _, healthy := range []bool{true, false} {
+		switch p.config.PoolStrategy {
+		case poolLeastPending:
+			var picked *poolNode
+			for _, n := range p.nodes {
+				if candidate(n, healthy) &&
+					(picked == nil || atomic.LoadInt64(&n.pending) < atomic.LoadInt64(&picked.pending)) {
+					picked = n
+				}
+			}
+			if picked != nil {
+				return picked
+			}
+		case poolSticky:
+			for i := range p.nodes {
+				idx := (p.sticky + i) % len(p.nodes)
+				if candidate(p.nodes[idx], healthy) {
+					p.sticky = idx
+					return p.nodes[idx]
+				}
+			}
+		default:
+			start := int(p.next % uint64(len(p.nodes)))
+			for i := range p.nodes {
+				idx := (start + i) % len(p.nodes)
+				if candidate(p.nodes[idx], healthy) {
+					p.next = uint64(idx) + 1
+					return p.nodes[idx]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type poolPublish func(w *Producer, doneChan chan *ProducerTransaction) error
+
+// attempt publishes to the nodes picked in turn until one accepts the command,
+// returning it and the channel of its transaction
+func (p *ProducerPool) attempt(publish poolPublish, tried map[*poolNode]bool) (*poolNode, chan *ProducerTransaction, error) {
+	err := ErrNoProducers
+	for {
+		if atomic.LoadInt32(&p.stopFlag) == 1 {
+			return nil, nil, ErrStopped
+		}
+		n := p.pick(tried)
+		if n == nil {
+			return nil, nil, err
+		}
+		tried[n] = true
+
+		doneChan := make(chan *ProducerTransaction, 1)
+		atomic.AddInt64(&n.pending, 1)
+		err = publish(n.producer, doneChan)
+		if err == nil {
+			return n, doneChan, nil
+		}
+		atomic.AddInt64(&n.pending, -1)
+		p.failed(n, err)
+	}
+}
+
+// done accounts for the response of a node, returning whether to retry the
+// publish on another
+func (p *ProducerPool) done(n *poolNode, t *ProducerTransaction) bool {
+	atomic.AddInt64(&n.pending, -1)
+	if t.Error == nil {
+		atomic.AddUint64(&n.published, 1)
+		return false
+	}
+	return p.failed(n, t.Error)
+}
+
+// failed accounts for a publish that failed on a node, returning whether to
+// retry it on another
+func (p *ProducerPool) failed(n *poolNode, err error) bool {
+	atomic.AddUint64(&n.failed, 1)
+	p.log(LogLevelWarning, "(%s) publish failed - %s", n.producer, err)
+
+	protocolErr, ok := err.(ErrProtocol)
+	if !ok {
+		// connection failure, until the next health check
+		atomic.StoreInt32(&n.healthy, 0)
+		return atomic.LoadInt32(&p.stopFlag) == 0
+	}
+	for _, code := range []string{"E_PUB_FAILED", "E_MPUB_FAILED", "E_DPUB_FAILED",
+		"E_DISK_FULL", "E_DRAINING", "E_REPLICATION_FAILED"} {
+		if strings.HasPrefix(protocolErr.Reason, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ProducerPool) send(publish poolPublish) error {
+	tried := make(map[*poolNode]bool)
+	for {
+		n, doneChan, err := p.attempt(publish, tried)
+		if err != nil {
+			return err
+		}
+		t := <-doneChan
+		if !p.done(n, t) {
+			return t.Error
+		}
+	}
+}
+
+func (p *ProducerPool) sendAsync(publish poolPublish, doneChan chan *ProducerTransaction, args []interface{}) error {
+	tried := make(map[*poolNode]bool)
+	n, nodeDoneChan, err := p.attempt(publish, tried)
+	if err != nil {
+		return err
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			t := <-nodeDoneChan
+			if p.done(n, t) {
+				var err error
+				n, nodeDoneChan, err = p.attempt(publish, tried)
+				if err == nil {
+					continue
+				}
+			}
+			t.doneChan = doneChan
+			t.Args = args
+			t.finish()
+			return
+		}
+	}()
+	return nil
+}
+
+// Stats returns the publish stats of every emsd of the pool
+func (p *ProducerPool) Stats() []PoolNodeStats {
+	nodes := p.getNodes()
+	stats := make([]PoolNodeStats, 0, len(nodes))
+	for _, n := range nodes {
+		stats = append(stats, PoolNodeStats{
+			Addr:      n.producer.String(),
+			Healthy:   atomic.LoadInt32(&n.healthy) == 1,
+			Pending:   atomic.LoadInt64(&n.pending),
+			Published: atomic.LoadUint64(&n.published),
+			Failed:    atomic.LoadUint64(&n.failed),
+		})
+	}
+	return stats
+}
+
+// SetLogger assigns the logger to use as well as a level, to the
+// ProducerPool and all of its Producers
+//
+// The logger parameter is an interface that requires the following
+// method to be implemented (such as the the stdlib log.Logger):
+//
+//	Output(calldepth int, s string)
+func (p *ProducerPool) SetLogger(l logger, lvl LogLevel) {
+	p.logGuard.Lock()
+	for level := range p.logger {
+		p.logger[level] = l
+	}
+	p.logLvl = lvl
+	p.logGuard.Unlock()
+
+	for _, n := range p.getNodes() {
+		n.producer.SetLogger(l, lvl)
+	}
+}
+
+// SetLoggerForLevel assigns the same logger for specified `level`.
+func (p *ProducerPool) SetLoggerForLevel(l logger, lvl LogLevel) {
+	p.logGuard.Lock()
+	p.logger[lvl] = l
+	p.logGuard.Unlock()
+
+	for _, n := range p.getNodes() {
+		n.producer.SetLoggerForLevel(l, lvl)
+	}
+}
+
+// SetLoggerLevel sets the package logging level.
+func (p *ProducerPool) SetLoggerLevel(lvl LogLevel) {
+	p.logGuard.Lock()
+	p.logLvl = lvl
+	p.logGuard.Unlock()
+
+	for _, n := range p.getNodes() {
+		n.producer.SetLoggerLevel(lvl)
+	}
+}
+
+func (p *ProducerPool) log(lvl LogLevel, line string, args ...interface{}) {
+	p.logGuard.RLock()
+	logger, logLvl := p.logger[lvl], p.logLvl
+	p.logGuard.RUnlock()
+
+	if logger == nil {
+		return
+	}
+
+	if logLvl > lvl {
+		return
+	}
+
+	logger.Output(2, fmt.Sprintf("%-4s %3d %s", lvl, p.id, fmt.Sprintf(line, args...)))
+}
+
+// String returns the addresses of the emsd of the ProducerPool
+func (p *ProducerPool) String() string {
+	var addrs []string
+	for _, n := range p.getNodes() {
+		addrs = append(addrs, n.producer.String())
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Stop initiates a graceful stop of the ProducerPool and all of its
+// Producers (permanent)
+//
+// NOTE: this blocks until completion
+func (p *ProducerPool) Stop() {
+	if !atomic.CompareAndSwapInt32(&p.stopFlag, 0, 1) {
+		return
+	}
+	p.log(LogLevelInfo, "stopping")
+	close(p.exitChan)
+	for _, n := range p.getNodes() {
+		n.producer.Stop()
+	}
+	p.wg.Wait()
+}
+
+// PublishAsync publishes a message body to the specified topic
+// but does not wait for the response from `emsd`.
+//
+// When the ProducerPool eventually receives the response from `emsd`,
+// after retries, the supplied `doneChan` (if specified)
+// will receive a `ProducerTransaction` instance with the supplied variadic arguments
+// and the response error if present
+func (p *ProducerPool) PublishAsync(topic string, body []byte, doneChan chan *ProducerTransaction,
+	args ...interface{}) error {
+	return p.sendAsync(func(w *Producer, doneChan chan *ProducerTransaction) error {
+		return w.PublishAsync(topic, body, doneChan)
+	}, doneChan, args)
+}
+
+// MultiPublishAsync publishes a slice of message bodies to the specified topic
+// but does not wait for the response from `emsd`.
+//
+// When the ProducerPool eventually receives the response from `emsd`,
+// after retries, the supplied `doneChan` (if specified)
+// will receive a `ProducerTransaction` instance with the supplied variadic arguments
+// and the response error if present
+func (p *ProducerPool) MultiPublishAsync(topic string, body [][]byte, doneChan chan *ProducerTransaction,
+	args ...interface{}) error {
+	return p.sendAsync(func(w *Producer, doneChan chan *ProducerTransaction) error {
+		return w.MultiPublishAsync(topic, body, doneChan)
+	}, doneChan, args)
+}
+
+// Publish synchronously publishes a message body to the specified topic, returning
+// an error if publish failed on every emsd tried
+func (p *ProducerPool) Publish(topic string, body []byte) error {
+	return p.send(func(w *Producer, doneChan chan *ProducerTransaction) error {
+		return w.PublishAsync(topic, body, doneChan)
+	})
+}
+
+// MultiPublish synchronously publishes a slice of message bodies to the specified topic, returning
+// an error if publish failed on every emsd tried
+func (p *ProducerPool) MultiPublish(topic string, body [][]byte) error {
+	return p.send(func(w *Producer, doneChan chan *ProducerTransaction) error {
+		return w.MultiPublishAsync(topic, body, doneChan)
+	})
+}
+
+// DeferredPublish synchronously publishes a message body to the specified topic
+// where the message will queue at the channel level until the timeout expires, returning
+// an error if publish failed on every emsd tried
+func (p *ProducerPool) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	return p.send(func(w *Producer, doneChan chan *ProducerTransaction) error {
+		return w.DeferredPublishAsync(topic, delay, body, doneChan)
+	})
+}
+
+// DeferredPublishAsync publishes a message body to the specified topic
+// where the message will queue at the channel level until the timeout expires
+// but does not wait for the response from `emsd`.
+//
+// When the ProducerPool eventually receives the response from `emsd`,
+// after retries, the supplied `doneChan` (if specified)
+// will receive a `ProducerTransaction` instance with the supplied variadic arguments
+// and the response error if present
+func (p *ProducerPool) DeferredPublishAsync(topic string, delay time.Duration, body []byte,
+	doneChan chan *ProducerTransaction, args ...interface{}) error {
+	return p.sendAsync(func(w *Producer, doneChan chan *ProducerTransaction) error {
+		return w.DeferredPublishAsync(topic, delay, body, doneChan)
+	}, doneChan, args)
+}
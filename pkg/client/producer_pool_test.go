@@ -0,0 +1,181 @@
+package client
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProducerPoolPick(t *testing.T) {
+	for _, strategy := range []string{poolRoundRobin, poolLeastPending, poolSticky} {
+		config := NewConfig()
+		config.PoolStrategy = strategy
+		p, err := NewProducerPool([]string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}, config)
+		if err != nil {
+			t.Fatalf("error %s", err)
+		}
+		p.SetLogger(nullLogger, LogLevelInfo)
+
+		setNode := func(i int, pending int64, healthy int32) {
+			p.nodes[i].pending = pending
+			p.nodes[i].healthy = healthy
+		}
+		setNode(0, 2, 1)
+		setNode(1, 1, 0)
+		setNode(2, 3, 1)
+
+		var picked []string
+		for i := 0; i < 3; i++ {
+			picked = append(picked, p.pick(nil).producer.String())
+		}
+		expected := map[string][]string{
+			poolRoundRobin:   {"127.0.0.1:1", "127.0.0.1:3", "127.0.0.1:1"},
+			poolLeastPending: {"127.0.0.1:1", "127.0.0.1:1", "127.0.0.1:1"},
+			poolSticky:       {"127.0.0.1:1", "127.0.0.1:1", "127.0.0.1:1"},
+		}[strategy]
+		for i := range expected {
+			if picked[i] != expected[i] {
+				t.Fatalf("%s picked %v, expected %v", strategy, picked, expected)
+			}
+		}
+
+		// the unhealthy node comes last
+		tried := map[*poolNode]bool{p.nodes[0]: true, p.nodes[2]: true}
+		if n := p.pick(tried); n != p.nodes[1] {
+			t.Fatalf("%s picked %v", strategy, n)
+		}
+		tried[p.nodes[1]] = true
+		if n := p.pick(tried); n != nil {
+			t.Fatalf("%s picked %v", strategy, n)
+		}
+
+		p.Stop()
+	}
+
+	config := NewConfig()
+	if err := config.Set("pool_strategy", "random"); err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if _, err := NewProducerPool([]string{"127.0.0.1:4150"}, config); err == nil {
+		t.Fatal("should fail with an invalid strategy")
+	}
+}
+
+func TestProducerPoolFailover(t *testing.T) {
+	topicName := "pool_failover" + strconv.Itoa(int(time.Now().Unix()))
+	msgCount := 10
+
+	// the first emsd isn't up
+	config := NewConfig()
+	p, err := NewProducerPool([]string{"127.0.0.1:1", "127.0.0.1:4150"}, config)
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	p.SetLogger(nullLogger, LogLevelInfo)
+	defer p.Stop()
+
+	for i := 0; i < msgCount; i++ {
+		err := p.Publish(topicName, []byte("publish_test_case"))
+		if err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+
+	doneChan := make(chan *ProducerTransaction, 1)
+	err = p.PublishAsync(topicName, []byte("bad_test_case"), doneChan, "test")
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	trans := <-doneChan
+	if trans.Error != nil {
+		t.Fatalf("error %s", trans.Error)
+	}
+	if trans.Args[0].(string) != "test" {
+		t.Fatalf("proxied arg %s", trans.Args[0])
+	}
+
+	stats := p.Stats()
+	if stats[0].Healthy || stats[0].Failed != 1 || stats[0].Published != 0 {
+		t.Fatalf("unexpected stats %+v", stats[0])
+	}
+	if !stats[1].Healthy || stats[1].Published != uint64(msgCount+1) || stats[1].Pending != 0 {
+		t.Fatalf("unexpected stats %+v", stats[1])
+	}
+
+	readMessages(topicName, t, msgCount)
+
+	err = p.Ping()
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	p, err = NewProducerPool([]string{"127.0.0.1:1"}, config)
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	p.SetLogger(nullLogger, LogLevelInfo)
+	defer p.Stop()
+	err = p.Publish(topicName, []byte("publish_test_case"))
+	if err == nil {
+		t.Fatal("should fail without emsd")
+	}
+}
+
+func TestProducerPoolFromLookupd(t *testing.T) {
+	topicName := "pool_lookupd" + strconv.Itoa(int(time.Now().Unix()))
+	msgCount := 10
+
+	config := NewConfig()
+	config.PoolStrategy = poolLeastPending
+	p, err := NewProducerPoolFromLookupd([]string{"127.0.0.1:1", "127.0.0.1:4161"}, config)
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	p.SetLogger(nullLogger, LogLevelInfo)
+	defer p.Stop()
+
+	stats := p.Stats()
+	if len(stats) != 1 || stats[0].Addr[len(stats[0].Addr)-5:] != ":4150" {
+		t.Fatalf("unexpected emsd %+v", stats)
+	}
+
+	body := make([][]byte, msgCount)
+	for i := range body {
+		body[i] = []byte("multipublish_test_case")
+	}
+	err = p.MultiPublish(topicName, body)
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	err = p.Publish(topicName, []byte("bad_test_case"))
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	readMessages(topicName, t, msgCount)
+
+	_, err = NewProducerPoolFromLookupd([]string{"127.0.0.1:1"}, config)
+	if err == nil {
+		t.Fatal("should fail without emslookupd")
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -127,6 +128,43 @@ func TestProducerPublish(t *testing.T) {
 	readMessages(topicName, t, msgCount)
 }
 
+func TestProducerForTopic(t *testing.T) {
+	topicName := "placed" + strconv.Itoa(int(time.Now().Unix()))
+	msgCount := 10
+
+	// the first emslookupd isn't up
+	config := NewConfig()
+	w, err := NewProducerForTopic(topicName, []string{"127.0.0.1:1", "127.0.0.1:4161"}, config)
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	w.SetLogger(nullLogger, LogLevelInfo)
+	defer w.Stop()
+
+	if !strings.HasSuffix(w.String(), ":4150") {
+		t.Fatalf("unexpected emsd %s", w.String())
+	}
+
+	for i := 0; i < msgCount; i++ {
+		err := w.Publish(topicName, []byte("publish_test_case"))
+		if err != nil {
+			t.Fatalf("error %s", err)
+		}
+	}
+
+	err = w.Publish(topicName, []byte("bad_test_case"))
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	readMessages(topicName, t, msgCount)
+
+	_, err = NewProducerForTopic(topicName, []string{"127.0.0.1:1"}, config)
+	if err == nil {
+		t.Fatal("should fail without emslookupd")
+	}
+}
+
 func TestProducerMultiPublish(t *testing.T) {
 	topicName := "multi_publish" + strconv.Itoa(int(time.Now().Unix()))
 	msgCount := 10
@@ -189,6 +227,107 @@ func TestProducerPublishAsync(t *testing.T) {
 	readMessages(topicName, t, msgCount)
 }
 
+func TestProducerPublishAsyncBatch(t *testing.T) {
+	topicName := "batch_publish" + strconv.Itoa(int(time.Now().Unix()))
+	msgCount := 10
+
+	config := NewConfig()
+	config.PublishBatchSize = 4
+	config.PublishLinger = 10 * time.Millisecond
+	w, _ := NewProducer("127.0.0.1:4150", config)
+	w.SetLogger(nullLogger, LogLevelInfo)
+	defer w.Stop()
+
+	responseChan := make(chan *ProducerTransaction, msgCount)
+	for i := 0; i < msgCount; i++ {
+		err := w.PublishAsync(topicName, []byte("publish_test_case"), responseChan, i)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	// the last two lingered
+	seen := make(map[int]bool)
+	for i := 0; i < msgCount; i++ {
+		trans := <-responseChan
+		if trans.Error != nil {
+			t.Fatalf(trans.Error.Error())
+		}
+		seen[trans.Args[0].(int)] = true
+	}
+	if len(seen) != msgCount {
+		t.Fatalf("transactions of %v", seen)
+	}
+
+	err := w.Publish(topicName, []byte("bad_test_case"))
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	readMessages(topicName, t, msgCount)
+}
+
+func TestProducerBatching(t *testing.T) {
+	config := NewConfig()
+	config.PublishBatchSize = 4
+	config.PublishBatchBytes = 10
+	config.PublishLinger = time.Minute
+	w, conn := newMockProducer(config)
+
+	responseChan := make(chan *ProducerTransaction, 100)
+	publish := func(topic string, body string, count int) {
+		for i := 0; i < count; i++ {
+			err := w.PublishAsync(topic, []byte(body), responseChan)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+	waitResponses := func(count int) {
+		for i := 0; i < count; i++ {
+			trans := <-responseChan
+			if trans.Error != nil {
+				t.Fatalf(trans.Error.Error())
+			}
+		}
+	}
+
+	// by count, the batches of each topic are separate
+	publish("a", "1", 10)
+	publish("b", "1", 3)
+	waitResponses(8)
+	if n := atomic.LoadInt32(&conn.mpubCount); n != 2 {
+		t.Fatalf("%d MPUB", n)
+	}
+
+	// by size, 4+4 bytes and then the next body doesn't fit
+	publish("c", "1234", 3)
+	waitResponses(2)
+	if n := atomic.LoadInt32(&conn.mpubCount); n != 3 {
+		t.Fatalf("%d MPUB", n)
+	}
+
+	// the rest is sent when stopping
+	w.Stop()
+	waitResponses(6)
+	if n := atomic.LoadInt32(&conn.mpubCount); n != 6 {
+		t.Fatalf("%d MPUB", n)
+	}
+	if err := w.PublishAsync("a", []byte("1"), responseChan); err != ErrStopped {
+		t.Fatalf("error %v", err)
+	}
+
+	// by linger
+	config.PublishLinger = 10 * time.Millisecond
+	w, conn = newMockProducer(config)
+	defer w.Stop()
+	publish("a", "1", 3)
+	waitResponses(3)
+	if n := atomic.LoadInt32(&conn.mpubCount); n != 1 {
+		t.Fatalf("%d MPUB", n)
+	}
+}
+
 func TestProducerMultiPublishAsync(t *testing.T) {
 	topicName := "multi_publish" + strconv.Itoa(int(time.Now().Unix()))
 	msgCount := 10
@@ -304,16 +443,32 @@ func readMessages(topicName string, t *testing.T, msgCount int) {
 }
 
 type mockProducerConn struct {
-	delegate ConnDelegate
-	closeCh  chan struct{}
-	pubCh    chan struct{}
+	delegate  ConnDelegate
+	closeCh   chan struct{}
+	pubCh     chan struct{}
+	pending   int32
+	mpubCount int32
+}
+
+// newMockProducer returns a Producer connected to a mockProducerConn
+func newMockProducer(config *Config) (*Producer, *mockProducerConn) {
+	p, _ := NewProducer("127.0.0.1:0", config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+
+	conn := newMockProducerConn(&producerConnDelegate{p})
+	p.conn = conn
+	atomic.StoreInt32(&p.state, StateConnected)
+	p.closeChan = make(chan int)
+	p.wg.Add(1)
+	go p.router()
+	return p, conn.(*mockProducerConn)
 }
 
 func newMockProducerConn(delegate ConnDelegate) producerConn {
 	m := &mockProducerConn{
 		delegate: delegate,
 		closeCh:  make(chan struct{}),
-		pubCh:    make(chan struct{}, 4),
+		pubCh:    make(chan struct{}, 1),
 	}
 	go m.router()
 	return m
@@ -339,8 +494,16 @@ func (m *mockProducerConn) Close() error {
 }
 
 func (m *mockProducerConn) WriteCommand(cmd *Command) error {
-	if bytes.Equal(cmd.Name, []byte("PUB")) {
-		m.pubCh <- struct{}{}
+	if bytes.Equal(cmd.Name, []byte("MPUB")) {
+		atomic.AddInt32(&m.mpubCount, 1)
+	} else if !bytes.Equal(cmd.Name, []byte("PUB")) {
+		return nil
+	}
+	// never blocks the Producer router, the responses are sent by our router
+	atomic.AddInt32(&m.pending, 1)
+	select {
+	case m.pubCh <- struct{}{}:
+	default:
 	}
 	return nil
 }
@@ -351,7 +514,10 @@ func (m *mockProducerConn) router() {
 		case <-m.closeCh:
 			goto exit
 		case <-m.pubCh:
-			m.delegate.OnResponse(nil, framedResponse(FrameTypeResponse, []byte("OK")))
+			for atomic.LoadInt32(&m.pending) > 0 {
+				atomic.AddInt32(&m.pending, -1)
+				m.delegate.OnResponse(nil, framedResponse(FrameTypeResponse, []byte("OK")))
+			}
 		}
 	}
 exit:
@@ -388,3 +554,45 @@ func BenchmarkProducer(b *testing.B) {
 	close(startCh)
 	wg.Wait()
 }
+
+func BenchmarkProducerPublishAsync(b *testing.B) {
+	benchmarkProducerPublishAsync(b, 0)
+}
+
+func BenchmarkProducerPublishAsyncBatch(b *testing.B) {
+	benchmarkProducerPublishAsync(b, 100)
+}
+
+func benchmarkProducerPublishAsync(b *testing.B, batchSize int) {
+	b.StopTimer()
+	body := make([]byte, 512)
+
+	config := NewConfig()
+	config.PublishBatchSize = batchSize
+	p, _ := newMockProducer(config)
+	defer p.Stop()
+
+	startCh := make(chan struct{})
+	var wg sync.WaitGroup
+	parallel := runtime.GOMAXPROCS(0)
+
+	for j := 0; j < parallel; j++ {
+		wg.Add(1)
+		go func() {
+			<-startCh
+			n := b.N / parallel
+			doneChan := make(chan *ProducerTransaction, n)
+			for i := 0; i < n; i++ {
+				p.PublishAsync("test", body, doneChan)
+			}
+			for i := 0; i < n; i++ {
+				<-doneChan
+			}
+			wg.Done()
+		}()
+	}
+
+	b.StartTimer()
+	close(startCh)
+	wg.Wait()
+}
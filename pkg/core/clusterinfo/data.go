@@ -57,15 +57,24 @@ func (l ErrList) Errors() []error {
 type ClusterInfo struct {
 	log    lg.AppLogFunc
 	client *http_api.Client
+
+	lookupdClient *http_api.Client
 }
 
 func New(log lg.AppLogFunc, client *http_api.Client) *ClusterInfo {
 	return &ClusterInfo{
-		log:    log,
-		client: client,
+		log:           log,
+		client:        client,
+		lookupdClient: client,
 	}
 }
 
+// SetEMSLookupdAdminToken sets the bearer token sent to the emslookupd HTTP
+// admin endpoints
+func (c *ClusterInfo) SetEMSLookupdAdminToken(token string) {
+	c.lookupdClient = c.client.WithAuthToken(token)
+}
+
 func (c *ClusterInfo) logf(f string, args ...interface{}) {
 	if c.log != nil {
 		c.log(lg.INFO, f, args...)
@@ -88,9 +97,39 @@ func (c *ClusterInfo) GetVersion(addr string) (semver.Version, error) {
 	return semver.Parse(resp.Version)
 }
 
+// ListFilter narrows the topics (or channels) listed by emslookupd and emsd
+// down to the names starting with Prefix and matching the regexp Regex
+type ListFilter struct {
+	Prefix string
+	Regex  string
+}
+
+func (f ListFilter) appendTo(endpoint string) string {
+	v := url.Values{}
+	if f.Prefix != "" {
+		v.Set("prefix", f.Prefix)
+	}
+	if f.Regex != "" {
+		v.Set("regex", f.Regex)
+	}
+	if len(v) == 0 {
+		return endpoint
+	}
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + v.Encode()
+	}
+	return endpoint + "?" + v.Encode()
+}
+
 // GetLookupdTopics returns a []string containing a union of all the topics
 // from all the given emslookupd
 func (c *ClusterInfo) GetLookupdTopics(lookupdHTTPAddrs []string) ([]string, error) {
+	return c.GetLookupdTopicsFiltered(ListFilter{}, lookupdHTTPAddrs)
+}
+
+// GetLookupdTopicsFiltered is GetLookupdTopics limited to the topics that pass
+// the filter
+func (c *ClusterInfo) GetLookupdTopicsFiltered(filter ListFilter, lookupdHTTPAddrs []string) ([]string, error) {
 	var topics []string
 	var lock sync.Mutex
 	var wg sync.WaitGroup
@@ -105,7 +144,7 @@ func (c *ClusterInfo) GetLookupdTopics(lookupdHTTPAddrs []string) ([]string, err
 		go func(addr string) {
 			defer wg.Done()
 
-			endpoint := fmt.Sprintf("http://%s/topics", addr)
+			endpoint := filter.appendTo(fmt.Sprintf("http://%s/topics", addr))
 			c.logf("CI: querying emslookupd %s", endpoint)
 
 			var resp respType
@@ -186,6 +225,69 @@ func (c *ClusterInfo) GetLookupdTopicChannels(topic string, lookupdHTTPAddrs []s
 	return channels, nil
 }
 
+// GetLookupdPlacementViolations returns a union of the placement violations of
+// the given topic (all topics if empty) reported by all the given emslookupd
+func (c *ClusterInfo) GetLookupdPlacementViolations(topic string, lookupdHTTPAddrs []string) ([]*PlacementViolation, error) {
+	var violations []*PlacementViolation
+	seen := make(map[PlacementViolation]bool)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+
+	type respType struct {
+		Violations []*PlacementViolation `json:"violations"`
+	}
+
+	for _, addr := range lookupdHTTPAddrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+
+			endpoint := fmt.Sprintf("http://%s/placement/violations?topic=%s", addr, url.QueryEscape(topic))
+			c.logf("CI: querying emslookupd %s", endpoint)
+
+			var resp respType
+			err := c.client.GETV1(endpoint, &resp)
+			if err != nil {
+				lock.Lock()
+				errs = append(errs, err)
+				lock.Unlock()
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			for _, v := range resp.Violations {
+				if !seen[*v] {
+					seen[*v] = true
+					violations = append(violations, v)
+				}
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	if len(errs) == len(lookupdHTTPAddrs) {
+		return nil, fmt.Errorf("Failed to query any emslookupd: %s", ErrList(errs))
+	}
+
+	sort.Slice(violations, func(i, j int) bool {
+		a, b := violations[i], violations[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		if a.Reason != b.Reason {
+			return a.Reason < b.Reason
+		}
+		return a.Node < b.Node
+	})
+
+	if len(errs) > 0 {
+		return violations, ErrList(errs)
+	}
+	return violations, nil
+}
+
 // GetLookupdProducers returns Producers of all the emsd connected to the given lookupds
 func (c *ClusterInfo) GetLookupdProducers(lookupdHTTPAddrs []string) (Producers, error) {
 	var producers []*Producer
@@ -233,6 +335,9 @@ func (c *ClusterInfo) GetLookupdProducers(lookupdHTTPAddrs []string) (Producers,
 				}
 				p.RemoteAddresses = append(p.RemoteAddresses,
 					fmt.Sprintf("%s/%s", addr, producer.Address()))
+				if producer.NodeIDConflict {
+					p.NodeIDConflict = true
+				}
 			}
 		}(addr)
 	}
@@ -242,10 +347,22 @@ func (c *ClusterInfo) GetLookupdProducers(lookupdHTTPAddrs []string) (Producers,
 		return nil, fmt.Errorf("Failed to query any emslookupd: %s", ErrList(errs))
 	}
 
+	// the lookupds may not know each other's nodes
+	nodeIDs := make(map[int64][]*Producer)
 	for _, producer := range producersByAddr {
 		if producer.VersionObj.LT(maxVersion) {
 			producer.OutOfDate = true
 		}
+		if producer.NodeID != nil {
+			nodeIDs[*producer.NodeID] = append(nodeIDs[*producer.NodeID], producer)
+		}
+	}
+	for _, producers := range nodeIDs {
+		if len(producers) > 1 {
+			for _, producer := range producers {
+				producer.NodeIDConflict = true
+			}
+		}
 	}
 	sort.Sort(ProducersByHost{producers})
 
@@ -310,6 +427,12 @@ func (c *ClusterInfo) GetLookupdTopicProducers(topic string, lookupdHTTPAddrs []
 
 // GetEMSDTopics returns a []string containing all the topics produced by the given emsd
 func (c *ClusterInfo) GetEMSDTopics(emsdHTTPAddrs []string) ([]string, error) {
+	return c.GetEMSDTopicsFiltered(ListFilter{}, emsdHTTPAddrs)
+}
+
+// GetEMSDTopicsFiltered is GetEMSDTopics limited to the topics that pass the
+// filter
+func (c *ClusterInfo) GetEMSDTopicsFiltered(filter ListFilter, emsdHTTPAddrs []string) ([]string, error) {
 	var topics []string
 	var lock sync.Mutex
 	var wg sync.WaitGroup
@@ -326,7 +449,7 @@ func (c *ClusterInfo) GetEMSDTopics(emsdHTTPAddrs []string) ([]string, error) {
 		go func(addr string) {
 			defer wg.Done()
 
-			endpoint := fmt.Sprintf("http://%s/stats?format=json", addr)
+			endpoint := filter.appendTo(fmt.Sprintf("http://%s/stats?format=json&fields=topic_name", addr))
 			c.logf("CI: querying emsd %s", endpoint)
 
 			var resp respType
@@ -556,6 +679,14 @@ func (c *ClusterInfo) GetEMSDTopicProducers(topic string, emsdHTTPAddrs []string
 func (c *ClusterInfo) GetEMSDStats(producers Producers,
 	selectedTopic string, selectedChannel string,
 	includeClients bool) ([]*TopicStats, map[string]*ChannelStats, error) {
+	return c.GetEMSDStatsFiltered(producers, selectedTopic, selectedChannel, includeClients, ListFilter{})
+}
+
+// GetEMSDStatsFiltered is GetEMSDStats limited to the topics (or the channels of
+// selectedTopic, when given) that pass the filter
+func (c *ClusterInfo) GetEMSDStatsFiltered(producers Producers,
+	selectedTopic string, selectedChannel string,
+	includeClients bool, filter ListFilter) ([]*TopicStats, map[string]*ChannelStats, error) {
 	var lock sync.Mutex
 	var wg sync.WaitGroup
 	var topicStatsList TopicStatsList
@@ -584,6 +715,7 @@ func (c *ClusterInfo) GetEMSDStats(producers Producers,
 			if !includeClients {
 				endpoint += "&include_clients=false"
 			}
+			endpoint = filter.appendTo(endpoint)
 
 			c.logf("CI: querying emsd %s", endpoint)
 
@@ -689,6 +821,57 @@ func (c *ClusterInfo) TombstoneNodeForTopic(topic string, node string, lookupdHT
 	return nil
 }
 
+// DrainNode puts the given node into drain mode, optionally forwarding its
+// remaining backlog to the emsd at forwardAddr
+func (c *ClusterInfo) DrainNode(node string, forwardAddr string) error {
+	producers, err := c.GetEMSDProducers([]string{node})
+	if err != nil {
+		return err
+	}
+
+	qs := fmt.Sprintf("forward=%s", url.QueryEscape(forwardAddr))
+	return c.producersPOST(producers, "drain", qs)
+}
+
+// MigrateTopic starts (or resumes) moving the given topic with its backlog from
+// the source node to the target node, once GetTopicMigration reports it done
+// the source should be tombstoned with TombstoneNodeForTopic
+func (c *ClusterInfo) MigrateTopic(topic string, source string, target string) error {
+	sources, err := c.GetEMSDProducers([]string{source})
+	if err != nil {
+		return err
+	}
+	targets, err := c.GetEMSDProducers([]string{target})
+	if err != nil {
+		return err
+	}
+	if sources[0].HTTPAddress() == targets[0].HTTPAddress() {
+		return fmt.Errorf("cannot migrate topic %s from %s to itself", topic, source)
+	}
+
+	qs := fmt.Sprintf("topic=%s&target=%s", url.QueryEscape(topic), url.QueryEscape(targets[0].HTTPAddress()))
+	return c.producersPOST(sources, "topic/migrate", qs)
+}
+
+// GetTopicMigration returns the progress of moving the given topic off node
+func (c *ClusterInfo) GetTopicMigration(topic string, node string) (*TopicMigration, error) {
+	endpoint := fmt.Sprintf("http://%s/topic/migrate?topic=%s", node, url.QueryEscape(topic))
+	c.logf("CI: querying emsd %s", endpoint)
+	var resp TopicMigration
+	err := c.client.GETV1(endpoint, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteNodeTopic deletes the given topic, with its channels, on node only
+func (c *ClusterInfo) DeleteNodeTopic(topic string, node string) error {
+	endpoint := fmt.Sprintf("http://%s/topic/delete?topic=%s", node, url.QueryEscape(topic))
+	c.logf("CI: querying emsd %s", endpoint)
+	return c.client.POSTV1(endpoint)
+}
+
 func (c *ClusterInfo) CreateTopicChannel(topicName string, channelName string, lookupdHTTPAddrs []string) error {
 	var errs []error
 
@@ -898,7 +1081,7 @@ func (c *ClusterInfo) emslookupdPOST(addrs []string, uri string, qs string) erro
 	for _, addr := range addrs {
 		endpoint := fmt.Sprintf("http://%s/%s?%s", addr, uri, qs)
 		c.logf("CI: querying emslookupd %s", endpoint)
-		err := c.client.POSTV1(endpoint)
+		err := c.lookupdClient.POSTV1(endpoint)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -53,6 +53,8 @@ type Producer struct {
 	VersionObj       semver.Version `json:"-"`
 	Topics           ProducerTopics `json:"topics"`
 	OutOfDate        bool           `json:"out_of_date"`
+	NodeID           *int64         `json:"node_id,omitempty"`
+	NodeIDConflict   bool           `json:"node_id_conflict"` // another node uses its node ID
 }
 
 // UnmarshalJSON implements json.Unmarshaler and postprocesses of ProducerTopics and VersionObj
@@ -66,6 +68,8 @@ func (p *Producer) UnmarshalJSON(b []byte) error {
 		Version          string   `json:"version"`
 		Topics           []string `json:"topics"`
 		Tombstoned       []bool   `json:"tombstones"`
+		NodeID           *int64   `json:"node_id"`
+		NodeIDConflict   bool     `json:"node_id_conflict"`
 	}
 	if err := json.Unmarshal(b, &r); err != nil {
 		return err
@@ -77,6 +81,8 @@ func (p *Producer) UnmarshalJSON(b []byte) error {
 		TCPPort:          r.TCPPort,
 		HTTPPort:         r.HTTPPort,
 		Version:          r.Version,
+		NodeID:           r.NodeID,
+		NodeIDConflict:   r.NodeIDConflict,
 	}
 	for i, t := range r.Topics {
 		p.Topics = append(p.Topics, ProducerTopic{Topic: t, Tombstoned: r.Tombstoned[i]})
@@ -119,6 +125,7 @@ type TopicStats struct {
 	MemoryDepth  int64           `json:"memory_depth"`
 	BackendDepth int64           `json:"backend_depth"`
 	MessageCount int64           `json:"message_count"`
+	MessageRate  float64         `json:"message_rate"`
 	NodeStats    []*TopicStats   `json:"nodes"`
 	Channels     []*ChannelStats `json:"channels"`
 	Paused       bool            `json:"paused"`
@@ -132,6 +139,7 @@ func (t *TopicStats) Add(a *TopicStats) {
 	t.MemoryDepth += a.MemoryDepth
 	t.BackendDepth += a.BackendDepth
 	t.MessageCount += a.MessageCount
+	t.MessageRate += a.MessageRate
 	if a.Paused {
 		t.Paused = a.Paused
 	}
@@ -171,6 +179,7 @@ type ChannelStats struct {
 	RequeueCount  int64           `json:"requeue_count"`
 	TimeoutCount  int64           `json:"timeout_count"`
 	MessageCount  int64           `json:"message_count"`
+	MessageRate   float64         `json:"message_rate"`
 	ClientCount   int             `json:"client_count"`
 	Selected      bool            `json:"-"`
 	NodeStats     []*ChannelStats `json:"nodes"`
@@ -190,6 +199,7 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	c.RequeueCount += a.RequeueCount
 	c.TimeoutCount += a.TimeoutCount
 	c.MessageCount += a.MessageCount
+	c.MessageRate += a.MessageRate
 	c.ClientCount += a.ClientCount
 	if a.Paused {
 		c.Paused = a.Paused
@@ -324,3 +334,30 @@ type ProducersByHost struct {
 func (c ProducersByHost) Less(i, j int) bool {
 	return c.Producers[i].Hostname < c.Producers[j].Hostname
 }
+
+// TopicMigration is the progress of moving a topic from one emsd to another
+type TopicMigration struct {
+	Target        string `json:"target"`
+	Phase         string `json:"phase"`
+	Depth         int64  `json:"depth"`
+	InFlightCount int    `json:"in_flight_count"`
+	DeferredCount int    `json:"deferred_count"`
+	MigratedCount uint64 `json:"migrated_count"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Done returns true once the topic is empty on the source
+func (m *TopicMigration) Done() bool {
+	return m.Phase == "empty"
+}
+
+// PlacementViolation is a topic hosted against the emslookupd placement rule
+// matching it
+type PlacementViolation struct {
+	Topic   string `json:"topic"`
+	Pattern string `json:"pattern"`
+	Reason  string `json:"reason"`
+	Node    string `json:"node,omitempty"`
+	Hosts   int    `json:"hosts"`
+	Wanted  int    `json:"wanted"`
+}
@@ -21,6 +21,7 @@ package http_api
 // THE SOFTWARE.
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -51,7 +52,8 @@ func NewDeadlineTransport(connectTimeout time.Duration, requestTimeout time.Dura
 }
 
 type Client struct {
-	c *http.Client
+	c     *http.Client
+	token string
 }
 
 func NewClient(tlsConfig *tls.Config, connectTimeout time.Duration, requestTimeout time.Duration) *Client {
@@ -65,6 +67,22 @@ func NewClient(tlsConfig *tls.Config, connectTimeout time.Duration, requestTimeo
 	}
 }
 
+// WithAuthToken returns a Client sending the token as a bearer token in the
+// Authorization header, sharing c's connections
+func (c *Client) WithAuthToken(token string) *Client {
+	return &Client{
+		c:     c.c,
+		token: token,
+	}
+}
+
+func (c *Client) setHeaders(req *http.Request) {
+	req.Header.Add("Accept", "application/vnd.ems; version=1.0")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
 // GETV1 is a helper function to perform a V1 HTTP request
 // and parse our Bhojpur EMS daemon's expected response format, with deadlines.
 func (c *Client) GETV1(endpoint string, v interface{}) error {
@@ -74,7 +92,7 @@ retry:
 		return err
 	}
 
-	req.Header.Add("Accept", "application/vnd.ems; version=1.0")
+	c.setHeaders(req)
 
 	resp, err := c.c.Do(req)
 	if err != nil {
@@ -107,13 +125,18 @@ retry:
 // PostV1 is a helper function to perform a V1 HTTP request
 // and parse our Bhojpur EMS daemon's expected response format, with deadlines.
 func (c *Client) POSTV1(endpoint string) error {
+	return c.POSTV1Body(endpoint, nil)
+}
+
+// POSTV1Body is POSTV1 with a request body
+func (c *Client) POSTV1Body(endpoint string, reqBody []byte) error {
 retry:
-	req, err := http.NewRequest("POST", endpoint, nil)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(reqBody))
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("Accept", "application/vnd.ems; version=1.0")
+	c.setHeaders(req)
 
 	resp, err := c.c.Do(req)
 	if err != nil {
@@ -0,0 +1,233 @@
+package http_api
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ListParams are the query parameters shared by the listing endpoints
+//
+//	prefix=<str>  only list names starting with str
+//	regex=<re>    only list names matching re
+//	sort=<field>  order by field, -field for descending order
+//	limit=<n>     list at most n items, the response carries a next_cursor
+//	              as long as there are more
+//	cursor=<str>  continue after the page that returned this next_cursor
+//
+// the cursor holds the sort field and name of the last item of the page, so
+// items added or removed in between don't shift the next page
+// without any of them the whole list is returned in name order
+type ListParams struct {
+	Prefix string
+	Regex  string
+	Sort   string
+	Desc   bool
+	Limit  int
+
+	re    *regexp.Regexp
+	after *listCursor
+}
+
+// listCursor is the position of the last item of a page in the sort order
+type listCursor struct {
+	Key  string `json:"k"`
+	Name string `json:"n"`
+}
+
+// NewListParams parses the ListParams of a request, sort must be one of
+// sortFields ("name" is always accepted)
+func NewListParams(rp getter, sortFields ...string) (*ListParams, error) {
+	p := &ListParams{Sort: "name"}
+
+	p.Prefix, _ = rp.Get("prefix")
+
+	if regex, err := rp.Get("regex"); err == nil && regex != "" {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, errors.New("INVALID_ARG_REGEX")
+		}
+		p.Regex = regex
+		p.re = re
+	}
+
+	if field, err := rp.Get("sort"); err == nil && field != "" {
+		if strings.HasPrefix(field, "-") {
+			p.Desc = true
+			field = field[1:]
+		}
+		if field != "name" && !inStrings(field, sortFields) {
+			return nil, errors.New("INVALID_ARG_SORT")
+		}
+		p.Sort = field
+	}
+
+	if limit, err := rp.Get("limit"); err == nil && limit != "" {
+		p.Limit, err = strconv.Atoi(limit)
+		if err != nil || p.Limit < 0 {
+			return nil, errors.New("INVALID_ARG_LIMIT")
+		}
+	}
+
+	if cursor, err := rp.Get("cursor"); err == nil && cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, errors.New("INVALID_ARG_CURSOR")
+		}
+		p.after = &listCursor{}
+		if err := json.Unmarshal(data, p.after); err != nil {
+			return nil, errors.New("INVALID_ARG_CURSOR")
+		}
+	}
+
+	return p, nil
+}
+
+// Match reports whether name passes the prefix and regex filters
+func (p *ListParams) Match(name string) bool {
+	if !strings.HasPrefix(name, p.Prefix) {
+		return false
+	}
+	return p.re == nil || p.re.MatchString(name)
+}
+
+// Filter returns the names that Match, in place
+func (p *ListParams) Filter(names []string) []string {
+	filtered := names[:0]
+	for _, name := range names {
+		if p.Match(name) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+// SortSlice orders the slice s, which is expected in name order, by the
+// requested field. less reports whether the field of s[i] is lower than the
+// one of s[j], elements with equal fields keep their name order
+func (p *ListParams) SortSlice(s interface{}, less func(i, j int) bool) {
+	if p.Desc {
+		sort.SliceStable(s, func(i, j int) bool { return less(j, i) })
+		return
+	}
+	sort.SliceStable(s, less)
+}
+
+// Page returns the bounds of the requested page of a list of n items, ordered
+// by SortSlice, and the cursor of the next one, empty on the last page. name
+// returns the name of the i-th item and key the value of its sort field, a
+// string, int, int64, uint64 or float64 (nil when sorting by name)
+func (p *ListParams) Page(n int, name func(i int) string, key func(i int) interface{}) (int, int, string) {
+	if key == nil {
+		key = func(i int) interface{} { return name(i) }
+	}
+
+	start := 0
+	if p.after != nil {
+		start = sort.Search(n, func(i int) bool {
+			c, ok := compareKey(key(i), p.after.Key)
+			if !ok {
+				// a cursor of another sort field, nothing follows it
+				return false
+			}
+			if p.Desc {
+				c = -c
+			}
+			return c > 0 || c == 0 && name(i) > p.after.Name
+		})
+	}
+	if p.Limit == 0 || start+p.Limit >= n {
+		return start, n, ""
+	}
+	end := start + p.Limit
+	data, _ := json.Marshal(listCursor{fmt.Sprint(key(end - 1)), name(end - 1)})
+	return start, end, base64.RawURLEncoding.EncodeToString(data)
+}
+
+// PageStrings sorts, in the requested direction, and pages a list of names
+func (p *ListParams) PageStrings(names []string) ([]string, string) {
+	sort.Strings(names)
+	if p.Desc {
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	}
+	start, end, next := p.Page(len(names), func(i int) string { return names[i] }, nil)
+	return names[start:end], next
+}
+
+// compareKey compares the sort field v with the one of a cursor, formatted by
+// Page, ok is false when s isn't of the type of v
+func compareKey(v interface{}, s string) (int, bool) {
+	switch v := v.(type) {
+	case string:
+		return strings.Compare(v, s), true
+	case int:
+		k, err := strconv.Atoi(s)
+		return compareInt64(int64(v), int64(k)), err == nil
+	case int64:
+		k, err := strconv.ParseInt(s, 10, 64)
+		return compareInt64(v, k), err == nil
+	case uint64:
+		k, err := strconv.ParseUint(s, 10, 64)
+		switch {
+		case v < k:
+			return -1, err == nil
+		case v > k:
+			return 1, err == nil
+		}
+		return 0, err == nil
+	case float64:
+		k, err := strconv.ParseFloat(s, 64)
+		switch {
+		case v < k:
+			return -1, err == nil
+		case v > k:
+			return 1, err == nil
+		}
+		return 0, err == nil
+	}
+	return 0, false
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func inStrings(s string, list []string) bool {
+	for _, v := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package keyring
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	nonceSize = 12
+	tagSize   = 16
+
+	// Overhead is the number of bytes Seal adds to a plaintext
+	Overhead = 4 + nonceSize + tagSize
+)
+
+var ErrUnknownKey = errors.New("unknown key ID")
+
+// Keyring holds AES keys by ID, data is always sealed with the key with the
+// highest ID and can be opened with any key in the keyring, so keys are
+// rotated by adding a new key and dropping old ones once nothing sealed with
+// them is left
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// Parse reads a keyring of "<id>:<base64 key>" entries separated by commas
+// or newlines, lines starting with # are ignored and keys must be 16, 24 or
+// 32 bytes (AES-128, AES-192 or AES-256)
+func Parse(s string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			err := k.add(entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(k.keys) == 0 {
+		return nil, errors.New("keyring has no keys")
+	}
+	return k, nil
+}
+
+// Load parses the keyring in fileName
+func Load(fileName string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	k, err := Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s - %s", fileName, err)
+	}
+	return k, nil
+}
+
+func (k *Keyring) add(entry string) error {
+	idx := strings.IndexByte(entry, ':')
+	if idx <= 0 {
+		return errors.New("invalid keyring entry, must be <id>:<base64 key>")
+	}
+	id, err := strconv.ParseUint(entry[:idx], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid key ID %q", entry[:idx])
+	}
+	if _, ok := k.keys[uint32(id)]; ok {
+		return fmt.Errorf("duplicate key ID %d", id)
+	}
+	key, err := base64.StdEncoding.DecodeString(entry[idx+1:])
+	if err != nil {
+		return fmt.Errorf("invalid key %d - %s", id, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("invalid key %d - %s", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.keys[uint32(id)] = aead
+	if len(k.keys) == 1 || uint32(id) > k.active {
+		k.active = uint32(id)
+	}
+	return nil
+}
+
+// ActiveID returns the ID of the key used by Seal
+func (k *Keyring) ActiveID() uint32 {
+	return k.active
+}
+
+// IDs returns the IDs of all keys in the keyring
+func (k *Keyring) IDs() []uint32 {
+	ids := make([]uint32, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Seal encrypts and authenticates plaintext with the active key, appending
+// [key ID][nonce][ciphertext and tag] to dst
+func (k *Keyring) Seal(dst []byte, plaintext []byte) []byte {
+	var hdr [4 + nonceSize]byte
+	binary.BigEndian.PutUint32(hdr[:4], k.active)
+	_, err := rand.Read(hdr[4:])
+	if err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	dst = append(dst, hdr[:]...)
+	return k.keys[k.active].Seal(dst, hdr[4:], plaintext, nil)
+}
+
+// Open authenticates and decrypts the output of Seal, appending the
+// plaintext to dst
+func (k *Keyring) Open(dst []byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, errors.New("sealed data too short")
+	}
+	id := KeyID(sealed)
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+	return aead.Open(dst, sealed[4:4+nonceSize], sealed[4+nonceSize:], nil)
+}
+
+// KeyID returns the ID of the key the output of Seal was sealed with, sealed
+// must be at least 4 bytes
+func KeyID(sealed []byte) uint32 {
+	return binary.BigEndian.Uint32(sealed)
+}
@@ -0,0 +1,94 @@
+package keyring
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+const (
+	key1 = "MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTI=" // 32 bytes
+	key2 = "YWJjZGVmZ2hpamtsbW5vcA=="                     // 16 bytes
+)
+
+func TestKeyringRotation(t *testing.T) {
+	old, err := Parse("1:" + key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := old.Seal(nil, []byte("secret"))
+	if len(sealed) != Overhead+len("secret") || KeyID(sealed) != 1 {
+		t.Fatalf("unexpected sealed data %x", sealed)
+	}
+
+	k, err := Parse("# rotated\n1:" + key1 + "\n2:" + key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.ActiveID() != 2 {
+		t.Fatalf("active key %d != 2", k.ActiveID())
+	}
+	plaintext, err := k.Open(nil, sealed)
+	if err != nil || !bytes.Equal(plaintext, []byte("secret")) {
+		t.Fatalf("failed to open data sealed with an old key - %v %q", err, plaintext)
+	}
+
+	sealed = k.Seal(nil, []byte("secret"))
+	if KeyID(sealed) != 2 {
+		t.Fatalf("sealed with key %d != 2", KeyID(sealed))
+	}
+	_, err = old.Open(nil, sealed)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = k.Open(nil, sealed)
+	if err == nil {
+		t.Fatal("opened tampered data")
+	}
+}
+
+func TestKeyringParse(t *testing.T) {
+	k, err := Parse("3:" + key2 + ", 1:" + key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := k.IDs(); len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+		t.Fatalf("unexpected key IDs %v", ids)
+	}
+
+	for _, s := range []string{
+		"",
+		"# no keys",
+		key1,
+		"x:" + key1,
+		"1:not base64",
+		"1:c2hvcnQ=", // too short for AES
+		"1:" + key1 + ",1:" + key2,
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+}
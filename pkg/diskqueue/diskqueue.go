@@ -26,14 +26,105 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"math/rand"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/bhojpur/ems/pkg/core/keyring"
+	"github.com/golang/snappy"
+)
+
+// Each record is prefixed with a 4 byte header, the top 4 bits of which
+// hold the format version of the record and the rest its size:
+//
+//	version 0: [size][data]                   (legacy, files written before checksums)
+//	version 1: [size][crc32c][data]           (the checksum covers data)
+//	version 2: [size][crc32c][codec][payload] (compressed, the checksum covers codec and payload)
+//	version 3: [size][crc32c][sealed]         (encrypted, the checksum covers sealed)
+//
+// where sealed is [key ID][nonce][codec][payload] encrypted and authenticated
+// with AES-GCM by a keyring.Keyring, the codec of encrypted records may be
+// codecNone.
+//
+// Files may contain every version, an upgraded diskqueue keeps appending to
+// its current file and compression and encryption can be changed between
+// restarts. Corrupt records are skipped by scanning forward to the next
+// valid version 1, 2 or 3 record.
+const (
+	recordVersionShift      = 28
+	recordSizeMask          = 1<<recordVersionShift - 1
+	recordVersion           = 1
+	recordVersionCompressed = 2
+	recordVersionEncrypted  = 3
+)
+
+// Compression is the codec used to compress records as they are written
+type Compression string
+
+const (
+	CompressionNone   = Compression("none")
+	CompressionSnappy = Compression("snappy")
+)
+
+// the codec byte of version 2 and 3 records
+const (
+	codecNone   = 0
+	codecSnappy = 1
 )
 
+// ErrKeyUnavailable is returned by readRecord (and set on a SegmentReader's
+// Record) for encrypted records which cannot be decrypted with the configured
+// keyring (if any), they are not corrupt so reading stops rather than
+// skipping them
+var ErrKeyUnavailable = errors.New("encrypted record key unavailable")
+
+// ParseCompression validates the name of a Compression
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case CompressionNone, CompressionSnappy:
+		return c, nil
+	case "":
+		return CompressionNone, nil
+	}
+	return "", fmt.Errorf("unknown compression %q, must be one of none, snappy", name)
+}
+
+// Option configures optional diskQueue behavior
+type Option func(d *diskQueue)
+
+// WithKeyring encrypts records written from now on with the active key of k,
+// records encrypted with any key in k can be read
+func WithKeyring(k *keyring.Keyring) Option {
+	return func(d *diskQueue) {
+		d.keyring = k
+	}
+}
+
+// WithCompression compresses records written from now on with c, records
+// which do not shrink are stored as is
+func WithCompression(c Compression) Option {
+	return func(d *diskQueue) {
+		d.compression = c
+	}
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptRecord is returned by readRecord when the record at the read
+// position cannot be trusted
+type errCorruptRecord struct {
+	reason string
+	size   int64 // the size of the record (including its header), if known
+}
+
+func (e *errCorruptRecord) Error() string {
+	return e.reason
+}
+
 type LogLevel int
 
 const (
@@ -64,8 +155,13 @@ func (l LogLevel) String() string {
 
 type Interface interface {
 	Put([]byte) error
+	PutBatch([][]byte) (int, error)
 	ReadChan() <-chan []byte // this is expected to be an *unbuffered* channel
 	PeekChan() <-chan []byte // this is expected to be an *unbuffered* channel
+	CorruptCount() int64
+	CompressionRatio() float64
+	DiskUsage() int64
+	Sync() error
 	Close() error
 	Delete() error
 	Depth() int64
@@ -82,6 +178,9 @@ type diskQueue struct {
 	readFileNum  int64
 	writeFileNum int64
 	depth        int64
+	corruptCount int64 // number of corrupt records (or runs of records) skipped
+	rawBytes     int64 // bytes of data written, before compression
+	storedBytes  int64 // bytes of (possibly compressed) data written
 
 	sync.RWMutex
 
@@ -94,8 +193,16 @@ type diskQueue struct {
 	maxMsgSize          int32
 	syncEvery           int64         // number of writes per fsync
 	syncTimeout         time.Duration // duration of time per fsync
+	compression         Compression
+	keyring             *keyring.Keyring
 	exitFlag            int32
 	needSync            bool
+	readBlocked         bool // an encrypted record could not be decrypted
+
+	// records buffered in writeBuf
+	pendingDepth       int64
+	pendingRawBytes    int64
+	pendingStoredBytes int64
 
 	// keeps track of the position where we have read
 	// (but not yet sent over readChan)
@@ -105,7 +212,9 @@ type diskQueue struct {
 	readFile  *os.File
 	writeFile *os.File
 	reader    *bufio.Reader
-	writeBuf  bytes.Buffer
+	writeBuf  bytes.Buffer // records not yet written to writeFile
+	snappyBuf []byte
+	sealBuf   []byte
 
 	// exposed via ReadChan()
 	readChan chan []byte
@@ -115,10 +224,11 @@ type diskQueue struct {
 
 	// internal channels
 	depthChan         chan int64
-	writeChan         chan []byte
-	writeResponseChan chan error
+	writeChan         chan *writeRequest
 	emptyChan         chan int
 	emptyResponseChan chan error
+	syncChan          chan int
+	syncResponseChan  chan error
 	exitChan          chan int
 	exitSyncChan      chan int
 
@@ -129,7 +239,7 @@ type diskQueue struct {
 // from the filesystem and starting the read ahead goroutine
 func New(name string, dataPath string, maxBytesPerFile int64,
 	minMsgSize int32, maxMsgSize int32,
-	syncEvery int64, syncTimeout time.Duration, logf AppLogFunc) Interface {
+	syncEvery int64, syncTimeout time.Duration, logf AppLogFunc, options ...Option) Interface {
 	d := diskQueue{
 		name:              name,
 		dataPath:          dataPath,
@@ -139,16 +249,21 @@ func New(name string, dataPath string, maxBytesPerFile int64,
 		readChan:          make(chan []byte),
 		peekChan:          make(chan []byte),
 		depthChan:         make(chan int64),
-		writeChan:         make(chan []byte),
-		writeResponseChan: make(chan error),
+		writeChan:         make(chan *writeRequest),
 		emptyChan:         make(chan int),
 		emptyResponseChan: make(chan error),
+		syncChan:          make(chan int),
+		syncResponseChan:  make(chan error),
 		exitChan:          make(chan int),
 		exitSyncChan:      make(chan int),
 		syncEvery:         syncEvery,
 		syncTimeout:       syncTimeout,
+		compression:       CompressionNone,
 		logf:              logf,
 	}
+	for _, option := range options {
+		option(&d)
+	}
 
 	// no need to lock here, nothing else could possibly be touching this instance
 	err := d.retrieveMetaData()
@@ -179,6 +294,26 @@ func (d *diskQueue) PeekChan() <-chan []byte {
 	return d.peekChan
 }
 
+// CompressionRatio returns the ratio of the size of the data written to its
+// size on disk, over the lifetime of the queue
+func (d *diskQueue) CompressionRatio() float64 {
+	stored := atomic.LoadInt64(&d.storedBytes)
+	if stored == 0 {
+		return 1
+	}
+	return float64(atomic.LoadInt64(&d.rawBytes)) / float64(stored)
+}
+
+// CorruptCount returns the number of times corrupt data was skipped
+func (d *diskQueue) CorruptCount() int64 {
+	return atomic.LoadInt64(&d.corruptCount)
+}
+
+// DiskUsage returns the size of all of the queue's files
+func (d *diskQueue) DiskUsage() int64 {
+	return filesSize(path.Join(d.dataPath, d.name+".diskqueue.*"))
+}
+
 // Put writes a []byte to the queue
 func (d *diskQueue) Put(data []byte) error {
 	d.RLock()
@@ -188,8 +323,43 @@ func (d *diskQueue) Put(data []byte) error {
 		return errors.New("exiting")
 	}
 
-	d.writeChan <- data
-	return <-d.writeResponseChan
+	_, err := d.put([][]byte{data})
+	return err
+}
+
+// PutBatch writes several messages at once and returns how many of them were
+// written, either all of them or an error is returned (in which case an I/O
+// error may have left the first of them written)
+func (d *diskQueue) PutBatch(data [][]byte) (int, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, errors.New("exiting")
+	}
+
+	return d.put(data)
+}
+
+func (d *diskQueue) put(data [][]byte) (int, error) {
+	for _, b := range data {
+		dataLen := int32(len(b))
+		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize || dataLen > recordSizeMask {
+			return 0, fmt.Errorf("invalid message write size (%d) minMsgSize=%d maxMsgSize=%d", dataLen, d.minMsgSize, d.maxMsgSize)
+		}
+	}
+
+	req := writeRequestPool.Get().(*writeRequest)
+	req.data = data
+	req.err = nil
+	req.buffered = 0
+	req.written = 0
+	d.writeChan <- req
+	err := <-req.done
+	written := req.written
+	req.data = nil
+	writeRequestPool.Put(req)
+	return written, err
 }
 
 // Close cleans up the queue and persists metadata
@@ -252,6 +422,20 @@ func (d *diskQueue) Empty() error {
 	return <-d.emptyResponseChan
 }
 
+// Sync fsyncs pending writes and persists metadata, once it returns the
+// queue's files can be copied consistently
+func (d *diskQueue) Sync() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.syncChan <- 1
+	return <-d.syncResponseChan
+}
+
 func (d *diskQueue) deleteAllFiles() error {
 	err := d.skipToNextRWFile()
 
@@ -293,125 +477,423 @@ func (d *diskQueue) skipToNextRWFile() error {
 	d.nextReadFileNum = d.writeFileNum
 	d.nextReadPos = 0
 	d.depth = 0
+	d.readBlocked = false
 
 	return err
 }
 
 // readOne performs a low level filesystem read for a single []byte
 // while advancing read positions and rolling files, if necessary
+//
+// corrupt records are skipped, if that leaves nothing to read errNoData is returned
 func (d *diskQueue) readOne() ([]byte, error) {
 	var err error
-	var msgSize int32
 
-	if d.readFile == nil {
-		curFileName := d.fileName(d.readFileNum)
-		d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
-		if err != nil {
-			return nil, err
-		}
-
-		d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
-
-		if d.readPos > 0 {
-			_, err = d.readFile.Seek(d.readPos, 0)
+	for {
+		if d.readFile == nil {
+			curFileName := d.fileName(d.readFileNum)
+			d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
 			if err != nil {
-				d.readFile.Close()
-				d.readFile = nil
 				return nil, err
 			}
+
+			d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
+
+			if d.readPos > 0 {
+				_, err = d.readFile.Seek(d.readPos, 0)
+				if err != nil {
+					d.readFile.Close()
+					d.readFile = nil
+					return nil, err
+				}
+			}
+
+			// for "complete" files (i.e. not the "current" file), maxBytesPerFileRead
+			// should be initialized to the file's size, or default to maxBytesPerFile
+			d.maxBytesPerFileRead = d.maxBytesPerFile
+			if d.readFileNum < d.writeFileNum {
+				stat, err := d.readFile.Stat()
+				if err == nil {
+					d.maxBytesPerFileRead = stat.Size()
+				}
+			}
+
+			d.reader = bufio.NewReader(d.readFile)
 		}
 
-		// for "complete" files (i.e. not the "current" file), maxBytesPerFileRead
-		// should be initialized to the file's size, or default to maxBytesPerFile
-		d.maxBytesPerFileRead = d.maxBytesPerFile
-		if d.readFileNum < d.writeFileNum {
-			stat, err := d.readFile.Stat()
-			if err == nil {
-				d.maxBytesPerFileRead = stat.Size()
+		readBuf, totalBytes, err := d.readRecord()
+		if err == nil {
+			// we only advance next* because we have not yet sent this to consumers
+			// (where readFileNum, readPos will actually be advanced)
+			d.nextReadPos = d.readPos + totalBytes
+			d.nextReadFileNum = d.readFileNum
+
+			// we only consider rotating if we're reading a "complete" file
+			// and since we cannot know the size at which it was rotated, we
+			// rely on maxBytesPerFileRead rather than maxBytesPerFile
+			if d.readFileNum < d.writeFileNum && d.nextReadPos >= d.maxBytesPerFileRead {
+				if d.readFile != nil {
+					d.readFile.Close()
+					d.readFile = nil
+				}
+
+				d.nextReadFileNum++
+				d.nextReadPos = 0
 			}
+
+			return readBuf, nil
+		}
+
+		corruptErr, ok := err.(*errCorruptRecord)
+		if !ok {
+			d.readFile.Close()
+			d.readFile = nil
+			return nil, err
 		}
 
-		d.reader = bufio.NewReader(d.readFile)
+		pos := d.findNextRecord(d.readPos + 1)
+		count := atomic.AddInt64(&d.corruptCount, 1)
+		d.logf(ERROR,
+			"DISKQUEUE(%s) corrupt record (%s) at %d of %s, skipped %d bytes to the next valid record (%d corruptions total)",
+			d.name, corruptErr, d.readPos, d.fileName(d.readFileNum), pos-d.readPos, count)
+		if corruptErr.size > 0 && pos == d.readPos+corruptErr.size {
+			// exactly one record was lost
+			d.depth--
+		}
+		d.skipTo(pos)
+
+		if d.readFileNum == d.writeFileNum && d.readPos >= d.writePos {
+			d.checkTailCorruption(d.depth)
+			return nil, errNoData
+		}
 	}
+}
 
-	err = binary.Read(d.reader, binary.BigEndian, &msgSize)
+var errNoData = errors.New("no data")
+
+// readRecord reads the record at the read position, returning its data and
+// total size on disk
+func (d *diskQueue) readRecord() ([]byte, int64, error) {
+	var header uint32
+
+	err := binary.Read(d.reader, binary.BigEndian, &header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the file ended before it was expected to
+		return nil, 0, &errCorruptRecord{reason: "truncated record header"}
+	}
 	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
+		return nil, 0, err
 	}
 
-	if msgSize < d.minMsgSize || msgSize > d.maxMsgSize {
-		// this file is corrupt and we have no reasonable guarantee on
-		// where a new message should begin
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, fmt.Errorf("invalid message read size (%d)", msgSize)
+	version := header >> recordVersionShift
+	msgSize := int32(header & recordSizeMask)
+	if version > recordVersionEncrypted {
+		return nil, 0, &errCorruptRecord{reason: fmt.Sprintf("unknown record version %d", version)}
+	}
+	if !d.validRecordSize(version, msgSize) {
+		return nil, 0, &errCorruptRecord{reason: fmt.Sprintf("invalid message read size (%d)", msgSize)}
+	}
+
+	var checksum uint32
+	totalBytes := int64(4 + msgSize)
+	if version >= recordVersion {
+		totalBytes += 4
+		err = binary.Read(d.reader, binary.BigEndian, &checksum)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, 0, &errCorruptRecord{reason: "truncated record header"}
+		}
+		if err != nil {
+			return nil, 0, err
+		}
 	}
 
 	readBuf := make([]byte, msgSize)
 	_, err = io.ReadFull(d.reader, readBuf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, 0, &errCorruptRecord{reason: "truncated record"}
+	}
 	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
+		return nil, 0, err
 	}
 
-	totalBytes := int64(4 + msgSize)
-
-	// we only advance next* because we have not yet sent this to consumers
-	// (where readFileNum, readPos will actually be advanced)
-	d.nextReadPos = d.readPos + totalBytes
-	d.nextReadFileNum = d.readFileNum
+	if version >= recordVersion && crc32.Checksum(readBuf, crcTable) != checksum {
+		return nil, 0, &errCorruptRecord{reason: "checksum mismatch", size: totalBytes}
+	}
 
-	// we only consider rotating if we're reading a "complete" file
-	// and since we cannot know the size at which it was rotated, we
-	// rely on maxBytesPerFileRead rather than maxBytesPerFile
-	if d.readFileNum < d.writeFileNum && d.nextReadPos >= d.maxBytesPerFileRead {
-		if d.readFile != nil {
-			d.readFile.Close()
-			d.readFile = nil
+	if version == recordVersionEncrypted {
+		if d.keyring == nil {
+			return nil, 0, ErrKeyUnavailable
 		}
+		readBuf, err = d.keyring.Open(nil, readBuf)
+		if errors.Is(err, keyring.ErrUnknownKey) {
+			return nil, 0, fmt.Errorf("%w - %s", ErrKeyUnavailable, err)
+		}
+		if err != nil {
+			return nil, 0, &errCorruptRecord{reason: "failed to decrypt record", size: totalBytes}
+		}
+	}
 
-		d.nextReadFileNum++
-		d.nextReadPos = 0
+	if version >= recordVersionCompressed {
+		readBuf, err = d.decompress(readBuf)
+		if err != nil {
+			return nil, 0, &errCorruptRecord{reason: err.Error(), size: totalBytes}
+		}
 	}
 
-	return readBuf, nil
+	return readBuf, totalBytes, nil
 }
 
-// writeOne performs a low level filesystem write for a single []byte
-// while advancing write positions and rolling files, if necessary
-func (d *diskQueue) writeOne(data []byte) error {
-	var err error
+// validRecordSize checks the size in a record header, compressed records
+// hold a codec byte followed by at most the encoded length of maxMsgSize and
+// encrypted records add the keyring overhead to that
+func (d *diskQueue) validRecordSize(version uint32, size int32) bool {
+	maxCompressed := int32(1 + snappy.MaxEncodedLen(int(d.maxMsgSize)))
+	switch version {
+	case recordVersionCompressed:
+		return size > 1 && size <= maxCompressed
+	case recordVersionEncrypted:
+		return size > keyring.Overhead+1 && size <= keyring.Overhead+maxCompressed
+	}
+	return size >= d.minMsgSize && size <= d.maxMsgSize
+}
 
+// decompress decodes the codec byte and payload of a compressed (or
+// decrypted) record
+func (d *diskQueue) decompress(record []byte) ([]byte, error) {
+	var data []byte
+	var err error
+	switch record[0] {
+	case codecNone:
+		data = record[1:]
+	case codecSnappy:
+		data, err = snappy.Decode(nil, record[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress record - %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown record codec %d", record[0])
+	}
 	dataLen := int32(len(data))
-	totalBytes := int64(4 + dataLen)
-
 	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
-		return fmt.Errorf("invalid message write size (%d) minMsgSize=%d maxMsgSize=%d", dataLen, d.minMsgSize, d.maxMsgSize)
+		return nil, fmt.Errorf("invalid decompressed message size (%d)", dataLen)
+	}
+	return data, nil
+}
+
+// findNextRecord scans the current read file from pos for the next valid
+// (version 1, 2 or 3) record, returning the end of the readable data if there is none
+func (d *diskQueue) findNextRecord(pos int64) int64 {
+	end := d.maxBytesPerFileRead
+	if d.readFileNum == d.writeFileNum {
+		end = d.writePos
 	}
 
-	// will not wrap-around if maxBytesPerFile + maxMsgSize < Int64Max
-	if d.writePos > 0 && d.writePos+totalBytes > d.maxBytesPerFile {
-		if d.readFileNum == d.writeFileNum {
-			d.maxBytesPerFileRead = d.writePos
+	buf := make([]byte, 64*1024)
+	for pos+8 <= end {
+		n := int64(len(buf))
+		if end-pos < n {
+			n = end - pos
+		}
+		n2, err := d.readFile.ReadAt(buf[:n], pos)
+		if n2 < 8 {
+			if err != nil && err != io.EOF {
+				d.logf(ERROR, "DISKQUEUE(%s) failed to scan %s - %s",
+					d.name, d.fileName(d.readFileNum), err)
+			}
+			break
+		}
+		for i := 0; i+8 <= n2; i++ {
+			header := binary.BigEndian.Uint32(buf[i:])
+			version := header >> recordVersionShift
+			msgSize := int32(header & recordSizeMask)
+			if version < recordVersion || version > recordVersionEncrypted ||
+				!d.validRecordSize(version, msgSize) ||
+				pos+int64(i)+8+int64(msgSize) > end {
+				continue
+			}
+			data := make([]byte, msgSize)
+			_, err := d.readFile.ReadAt(data, pos+int64(i)+8)
+			if err != nil {
+				continue
+			}
+			if crc32.Checksum(data, crcTable) == binary.BigEndian.Uint32(buf[i+4:]) {
+				return pos + int64(i)
+			}
 		}
+		// overlap windows so that headers spanning them are not missed
+		pos += int64(n2) - 7
+	}
+	return end
+}
 
-		d.writeFileNum++
-		d.writePos = 0
+// skipTo moves the read position forward to pos in the current read file,
+// or to the start of the next file when pos is past the end of a complete one
+func (d *diskQueue) skipTo(pos int64) {
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
 
-		// sync every time we start writing to a new file
-		err = d.sync()
+	if d.readFileNum < d.writeFileNum && pos >= d.maxBytesPerFileRead {
+		fn := d.fileName(d.readFileNum)
+		err := os.Remove(fn)
 		if err != nil {
-			d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, fn, err)
 		}
+		d.readFileNum++
+		pos = 0
+	}
 
-		if d.writeFile != nil {
-			d.writeFile.Close()
-			d.writeFile = nil
+	d.readPos = pos
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = pos
+
+	// significant state change, schedule a sync on the next iteration
+	d.needSync = true
+}
+
+// writeRequest is a Put or PutBatch waiting for its messages to be written
+// (and synced, when due) along with any other concurrent requests
+type writeRequest struct {
+	data [][]byte
+	err  error
+	done chan error
+
+	// messages of data appended to the write buffer and written to the file
+	buffered int
+	written  int
+}
+
+var writeRequestPool = sync.Pool{
+	New: func() interface{} {
+		return &writeRequest{done: make(chan error, 1)}
+	},
+}
+
+// maxWriteBatch bounds the number of requests written together
+const maxWriteBatch = 1024
+
+// writeBatch appends the messages of every request to the write file(s) with
+// as few writes as possible, returning the number of messages written, the
+// result of each request is left in its err
+func (d *diskQueue) writeBatch(reqs []*writeRequest) int64 {
+	var count int64
+	unflushed := reqs[:0:0]
+
+	flush := func() {
+		err := d.flush()
+		for _, req := range unflushed {
+			if req.err == nil {
+				req.err = err
+			}
+			if err == nil {
+				req.written += req.buffered
+			}
+			req.buffered = 0
+		}
+		unflushed = unflushed[:0]
+	}
+
+	for _, req := range reqs {
+		unflushed = append(unflushed, req)
+		for _, data := range req.data {
+			version, payload := d.encodeRecord(data)
+			totalBytes := int64(8 + len(payload))
+
+			// will not wrap-around if maxBytesPerFile + maxMsgSize < Int64Max
+			pos := d.writePos + int64(d.writeBuf.Len())
+			if pos > 0 && pos+totalBytes > d.maxBytesPerFile {
+				flush()
+				if req.err != nil {
+					break
+				}
+				unflushed = append(unflushed, req)
+				d.rollWriteFile()
+			}
+
+			binary.Write(&d.writeBuf, binary.BigEndian, version<<recordVersionShift|uint32(len(payload)))
+			binary.Write(&d.writeBuf, binary.BigEndian, crc32.Checksum(payload, crcTable))
+			d.writeBuf.Write(payload)
+			d.pendingDepth++
+			d.pendingRawBytes += int64(len(data))
+			d.pendingStoredBytes += int64(len(payload))
+			req.buffered++
+			count++
+		}
+	}
+	flush()
+
+	return count
+}
+
+// encodeRecord returns the version and payload of the record for data,
+// compressing and encrypting it as configured
+func (d *diskQueue) encodeRecord(data []byte) (uint32, []byte) {
+	version := uint32(recordVersion)
+	payload := data
+	if d.compression == CompressionSnappy {
+		n := 1 + snappy.MaxEncodedLen(len(data))
+		if cap(d.snappyBuf) < n {
+			d.snappyBuf = make([]byte, n)
+		}
+		d.snappyBuf[0] = codecSnappy
+		encoded := snappy.Encode(d.snappyBuf[1:n], data)
+		// only keep the compressed form if it is actually smaller
+		if 1+len(encoded) < len(data) {
+			version = recordVersionCompressed
+			payload = d.snappyBuf[:1+len(encoded)]
+		}
+	}
+	if d.keyring != nil {
+		if version == recordVersion {
+			d.snappyBuf = append(append(d.snappyBuf[:0], codecNone), data...)
+			payload = d.snappyBuf
 		}
+		d.sealBuf = d.keyring.Seal(d.sealBuf[:0], payload)
+		version = recordVersionEncrypted
+		payload = d.sealBuf
 	}
+	return version, payload
+}
+
+// rollWriteFile moves writes on to the next file, the current one must have
+// been flushed
+func (d *diskQueue) rollWriteFile() {
+	if d.readFileNum == d.writeFileNum {
+		d.maxBytesPerFileRead = d.writePos
+	}
+
+	d.writeFileNum++
+	d.writePos = 0
+
+	// sync every time we start writing to a new file
+	err := d.sync()
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+	}
+
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+}
+
+// flush performs a low level filesystem write of the buffered records,
+// advancing write positions, the buffered records are dropped on error
+func (d *diskQueue) flush() error {
+	var err error
+
+	if d.writeBuf.Len() == 0 {
+		return nil
+	}
+
+	defer func() {
+		d.writeBuf.Reset()
+		d.pendingDepth = 0
+		d.pendingRawBytes = 0
+		d.pendingStoredBytes = 0
+	}()
+
 	if d.writeFile == nil {
 		curFileName := d.fileName(d.writeFileNum)
 		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
@@ -419,7 +901,7 @@ func (d *diskQueue) writeOne(data []byte) error {
 			return err
 		}
 
-		d.logf(INFO, "DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
+		d.logf(INFO, "DISKQUEUE(%s): flush() opened %s", d.name, curFileName)
 
 		if d.writePos > 0 {
 			_, err = d.writeFile.Seek(d.writePos, 0)
@@ -431,18 +913,6 @@ func (d *diskQueue) writeOne(data []byte) error {
 		}
 	}
 
-	d.writeBuf.Reset()
-	err = binary.Write(&d.writeBuf, binary.BigEndian, dataLen)
-	if err != nil {
-		return err
-	}
-
-	_, err = d.writeBuf.Write(data)
-	if err != nil {
-		return err
-	}
-
-	// only write to the file once
 	_, err = d.writeFile.Write(d.writeBuf.Bytes())
 	if err != nil {
 		d.writeFile.Close()
@@ -450,10 +920,12 @@ func (d *diskQueue) writeOne(data []byte) error {
 		return err
 	}
 
-	d.writePos += totalBytes
-	d.depth += 1
+	d.writePos += int64(d.writeBuf.Len())
+	d.depth += d.pendingDepth
+	atomic.AddInt64(&d.rawBytes, d.pendingRawBytes)
+	atomic.AddInt64(&d.storedBytes, d.pendingStoredBytes)
 
-	return err
+	return nil
 }
 
 // sync fsyncs the current writeFile and persists metadata
@@ -478,25 +950,21 @@ func (d *diskQueue) sync() error {
 
 // retrieveMetaData initializes state from the filesystem
 func (d *diskQueue) retrieveMetaData() error {
-	var f *os.File
-	var err error
-
-	fileName := d.metaDataFileName()
-	f, err = os.OpenFile(fileName, os.O_RDONLY, 0600)
+	m, err := ReadMetaData(d.metaDataFileName())
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	var depth int64
-	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
-		&depth,
-		&d.readFileNum, &d.readPos,
-		&d.writeFileNum, &d.writePos)
-	if err != nil {
-		return err
+	d.depth = m.Depth
+	d.readFileNum, d.readPos = m.ReadFileNum, m.ReadPos
+	d.writeFileNum, d.writePos = m.WriteFileNum, m.WritePos
+	if m.Compression != "" {
+		if m.Compression != d.compression {
+			d.logf(INFO, "DISKQUEUE(%s) compression changed from %s to %s",
+				d.name, m.Compression, d.compression)
+		}
+		d.rawBytes = m.RawBytes
+		d.storedBytes = m.StoredBytes
 	}
-	d.depth = depth
 	d.nextReadFileNum = d.readFileNum
 	d.nextReadPos = d.readPos
 
@@ -505,7 +973,7 @@ func (d *diskQueue) retrieveMetaData() error {
 	// in which case the safest thing to do is skip to the next file for
 	// writes, and let the reader salvage what it can from the messages in the
 	// diskqueue beyond the metadata's likely also stale readPos
-	fileName = d.fileName(d.writeFileNum)
+	fileName := d.fileName(d.writeFileNum)
 	fileInfo, err := os.Stat(fileName)
 	if err != nil {
 		return err
@@ -528,39 +996,24 @@ func (d *diskQueue) retrieveMetaData() error {
 
 // persistMetaData atomically writes state to the filesystem
 func (d *diskQueue) persistMetaData() error {
-	var f *os.File
-	var err error
-
-	fileName := d.metaDataFileName()
-	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
-
-	// write to tmp file
-	f, err = os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return err
-	}
-
-	_, err = fmt.Fprintf(f, "%d\n%d,%d\n%d,%d\n",
-		d.depth,
-		d.readFileNum, d.readPos,
-		d.writeFileNum, d.writePos)
-	if err != nil {
-		f.Close()
-		return err
-	}
-	f.Sync()
-	f.Close()
-
-	// atomically rename
-	return os.Rename(tmpFileName, fileName)
+	return WriteMetaData(d.metaDataFileName(), &MetaData{
+		Depth:        d.depth,
+		ReadFileNum:  d.readFileNum,
+		ReadPos:      d.readPos,
+		WriteFileNum: d.writeFileNum,
+		WritePos:     d.writePos,
+		Compression:  d.compression,
+		RawBytes:     atomic.LoadInt64(&d.rawBytes),
+		StoredBytes:  atomic.LoadInt64(&d.storedBytes),
+	})
 }
 
 func (d *diskQueue) metaDataFileName() string {
-	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.dat"), d.name)
+	return MetaDataFileName(d.dataPath, d.name)
 }
 
 func (d *diskQueue) fileName(fileNum int64) string {
-	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.%06d.dat"), d.name, fileNum)
+	return SegmentFileName(d.dataPath, d.name, fileNum)
 }
 
 func (d *diskQueue) checkTailCorruption(depth int64) {
@@ -674,6 +1127,7 @@ func (d *diskQueue) ioLoop() {
 	var dataRead []byte
 	var err error
 	var count int64
+	var reqs []*writeRequest
 	var r chan []byte
 	var p chan []byte
 
@@ -681,7 +1135,7 @@ func (d *diskQueue) ioLoop() {
 
 	for {
 		// dont sync all the time :)
-		if count == d.syncEvery {
+		if count >= d.syncEvery {
 			d.needSync = true
 		}
 
@@ -693,9 +1147,18 @@ func (d *diskQueue) ioLoop() {
 			count = 0
 		}
 
-		if (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
+		if !d.readBlocked && ((d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos)) {
 			if d.nextReadPos == d.readPos {
 				dataRead, err = d.readOne()
+				if err == errNoData {
+					continue
+				}
+				if errors.Is(err, ErrKeyUnavailable) {
+					d.logf(ERROR, "DISKQUEUE(%s) cannot read at %d of %s - %s, reads are stopped until restarted with the key",
+						d.name, d.readPos, d.fileName(d.readFileNum), err)
+					d.readBlocked = true
+					continue
+				}
 				if err != nil {
 					d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
 						d.name, d.readPos, d.fileName(d.readFileNum), err)
@@ -722,9 +1185,38 @@ func (d *diskQueue) ioLoop() {
 		case <-d.emptyChan:
 			d.emptyResponseChan <- d.deleteAllFiles()
 			count = 0
-		case dataWrite := <-d.writeChan:
-			count++
-			d.writeResponseChan <- d.writeOne(dataWrite)
+		case <-d.syncChan:
+			d.syncResponseChan <- d.sync()
+			count = 0
+		case req := <-d.writeChan:
+			// group commit: every request already waiting is written (and
+			// synced, when due) together before any of them is released
+			reqs = append(reqs[:0], req)
+		gather:
+			for len(reqs) < maxWriteBatch {
+				select {
+				case req := <-d.writeChan:
+					reqs = append(reqs, req)
+				default:
+					break gather
+				}
+			}
+			count += d.writeBatch(reqs)
+			var syncErr error
+			if count >= d.syncEvery {
+				syncErr = d.sync()
+				if syncErr != nil {
+					d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, syncErr)
+				}
+				count = 0
+			}
+			for i, req := range reqs {
+				if req.err == nil {
+					req.err = syncErr
+				}
+				req.done <- req.err
+				reqs[i] = nil
+			}
 		case <-syncTicker.C:
 			if count == 0 {
 				// avoid sync when there's no activity
@@ -23,7 +23,10 @@ package diskqueue
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -35,6 +38,8 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/bhojpur/ems/pkg/core/keyring"
 )
 
 func Equal(t *testing.T, expected, actual interface{}) {
@@ -130,7 +135,7 @@ func TestDiskQueueRoll(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 	msg := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0}
 	ml := int64(len(msg))
-	dq := New(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, l)
+	dq := New(dqName, tmpDir, 10*(ml+8), int32(ml), 1<<10, 2500, 2*time.Second, l)
 	defer dq.Close()
 	NotNil(t, dq)
 	Equal(t, int64(0), dq.Depth())
@@ -142,7 +147,7 @@ func TestDiskQueueRoll(t *testing.T) {
 	}
 
 	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
-	Equal(t, int64(ml+4), dq.(*diskQueue).writePos)
+	Equal(t, int64(ml+8), dq.(*diskQueue).writePos)
 
 	for i := 11; i > 0; i-- {
 		Equal(t, msg, <-dq.ReadChan())
@@ -160,7 +165,7 @@ func TestDiskQueuePeek(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 	msg := bytes.Repeat([]byte{0}, 10)
 	ml := int64(len(msg))
-	dq := New(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, l)
+	dq := New(dqName, tmpDir, 10*(ml+8), int32(ml), 1<<10, 2500, 2*time.Second, l)
 	defer dq.Close()
 	NotNil(t, dq)
 	Equal(t, int64(0), dq.Depth())
@@ -310,10 +315,9 @@ func TestDiskQueueCorruption(t *testing.T) {
 	}
 	defer os.RemoveAll(tmpDir)
 	// require a non-zero message length for the corrupt (len 0) test below
-	dq := New(dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, l)
-	defer dq.Close()
+	dq := New(dqName, tmpDir, 1024, 10, 1<<10, 5, 2*time.Second, l)
 
-	msg := make([]byte, 120) // 124 bytes per message, 8 messages (992 bytes) per file
+	msg := make([]byte, 120) // 128 bytes per message, 8 messages (1024 bytes) per file
 	msg[0] = 91
 	msg[62] = 4
 	msg[119] = 211
@@ -328,31 +332,46 @@ func TestDiskQueueCorruption(t *testing.T) {
 	dqFn := dq.(*diskQueue).fileName(1)
 	os.Truncate(dqFn, 400) // 3 valid messages, 5 corrupted
 
-	for i := 0; i < 19; i++ { // 1 message leftover in 4th file
+	// stop short of the 3rd file's last message, so that the read ahead has
+	// not reached the 4th file
+	for i := 0; i < 18; i++ {
 		Equal(t, msg, <-dq.ReadChan())
 	}
+	Equal(t, int64(1), dq.CorruptCount())
 
 	// corrupt the 4th (current) file
 	dqFn = dq.(*diskQueue).fileName(3)
 	os.Truncate(dqFn, 100)
 
-	dq.Put(msg) // in 5th file
+	dq.Put(msg) // in 4th file, after the truncated message
 
 	Equal(t, msg, <-dq.ReadChan())
+	Equal(t, msg, <-dq.ReadChan())
+	Equal(t, int64(2), dq.CorruptCount())
 
-	// write a corrupt (len 0) message at the 5th (current) file
-	dq.(*diskQueue).writeFile.Write([]byte{0, 0, 0, 0})
-
-	// force a new 6th file - put into 5th, then readOne errors, then put into 6th
 	dq.Put(msg)
 	dq.Put(msg)
+	dq.Close()
 
+	// zero the size of the 1st of those messages while the queue is closed
+	dqFn = dq.(*diskQueue).fileName(3)
+	f, err := os.OpenFile(dqFn, os.O_RDWR, 0600)
+	Nil(t, err)
+	_, err = f.WriteAt([]byte{0, 0, 0, 0}, 256)
+	Nil(t, err)
+	f.Close()
+
+	dq = New(dqName, tmpDir, 1024, 10, 1<<10, 5, 2*time.Second, l)
+	defer dq.Close()
+
+	// the reader skips over the corrupt message to the next one
 	Equal(t, msg, <-dq.ReadChan())
+	Equal(t, int64(1), dq.CorruptCount())
 
 	dq.Put(msg)
 	dq.Put(msg)
 	// corrupt the last file
-	dqFn = dq.(*diskQueue).fileName(5)
+	dqFn = dq.(*diskQueue).fileName(dq.(*diskQueue).writeFileNum)
 	os.Truncate(dqFn, 100)
 
 	Equal(t, int64(2), dq.Depth())
@@ -365,6 +384,253 @@ func TestDiskQueueCorruption(t *testing.T) {
 
 	// the last log file is now considered corrupted leaving no more log messages
 	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(2), dq.CorruptCount())
+
+	// make sure there aren't "bad" files, corrupt data is skipped in place
+	files, err := filepath.Glob(filepath.Join(tmpDir, dqName+"*.bad"))
+	Nil(t, err)
+	Equal(t, 0, len(files))
+}
+
+func TestDiskQueueChecksum(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_checksum" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("ems-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 10, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	for i := 0; i < 5; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 120)
+		Nil(t, dq.Put(msg))
+	}
+
+	// flip a bit in the body of the 2nd message
+	f, err := os.OpenFile(dq.(*diskQueue).fileName(0), os.O_RDWR, 0600)
+	Nil(t, err)
+	b := make([]byte, 1)
+	f.ReadAt(b, 128+8+50)
+	b[0] ^= 0x10
+	f.WriteAt(b, 128+8+50)
+	f.Close()
+
+	for _, i := range []int{0, 2, 3, 4} {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 120), <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(1), dq.CorruptCount())
+}
+
+func TestDiskQueueLegacyFormat(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_legacy" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("ems-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// a file as written before records carried a version and checksum
+	var buf bytes.Buffer
+	for i := 0; i < 3; i++ {
+		buf.Write([]byte{0, 0, 0, 10})
+		buf.Write(bytes.Repeat([]byte{byte(i)}, 10))
+	}
+	fn := fmt.Sprintf(path.Join(tmpDir, "%s.diskqueue.%06d.dat"), dqName, 0)
+	Nil(t, ioutil.WriteFile(fn, buf.Bytes(), 0600))
+	metaFn := fmt.Sprintf(path.Join(tmpDir, "%s.diskqueue.meta.dat"), dqName)
+	Nil(t, ioutil.WriteFile(metaFn, []byte(fmt.Sprintf("3\n0,0\n0,%d\n", buf.Len())), 0600))
+
+	dq := New(dqName, tmpDir, 1024, 10, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(3), dq.Depth())
+
+	// new records are appended to the same file
+	Nil(t, dq.Put(bytes.Repeat([]byte{3}, 10)))
+
+	for i := 0; i < 4; i++ {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 10), <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(0), dq.CorruptCount())
+}
+
+func TestDiskQueueCompression(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_compression" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("ems-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	compressible := bytes.Repeat([]byte(`{"key":"value"}`), 20)
+	random := make([]byte, 300)
+	rand.Read(random)
+
+	// start out uncompressed
+	dq := New(dqName, tmpDir, 1024*1024, 10, 1<<10, 2500, 2*time.Second, l)
+	Nil(t, dq.Put(compressible))
+	Equal(t, 1.0, dq.CompressionRatio())
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 1024*1024, 10, 1<<10, 2500, 2*time.Second, l,
+		WithCompression(CompressionSnappy))
+	Nil(t, dq.Put(compressible))
+	Nil(t, dq.Put(random)) // does not shrink, stored as is
+	Nil(t, dq.Put(compressible))
+	dq.Close()
+
+	fi, err := os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+	Equal(t, true, fi.Size() < int64(4*8+3*len(compressible)+len(random)))
+
+	// the codec and ratio are kept in the metadata, records can be read
+	// back whatever compression is currently configured
+	dq = New(dqName, tmpDir, 1024*1024, 10, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, true, dq.CompressionRatio() > 1.5)
+	Equal(t, int64(4), dq.Depth())
+	for _, msg := range [][]byte{compressible, compressible, random, compressible} {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.CorruptCount())
+
+	_, err = ParseCompression("zip")
+	NotNil(t, err)
+}
+
+func TestDiskQueueEncryption(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_encryption" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("ems-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key1 := "1:MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTI="
+	key2 := "2:YWJjZGVmZ2hpamtsbW5vcA=="
+	keys1, err := keyring.Parse(key1)
+	Nil(t, err)
+	keys2, err := keyring.Parse(key1 + "," + key2)
+	Nil(t, err)
+
+	secret := bytes.Repeat([]byte("secret PII "), 10)
+	dq := New(dqName, tmpDir, 1024*1024, 10, 1<<10, 2500, 2*time.Second, l,
+		WithKeyring(keys1))
+	Nil(t, dq.Put(secret))
+	dq.Close()
+
+	// rotate the key, the old one stays readable
+	dq = New(dqName, tmpDir, 1024*1024, 10, 1<<10, 2500, 2*time.Second, l,
+		WithKeyring(keys2), WithCompression(CompressionSnappy))
+	Nil(t, dq.Put(secret))
+	dq.Close()
+
+	fn := dq.(*diskQueue).fileName(0)
+	data, err := ioutil.ReadFile(fn)
+	Nil(t, err)
+	Equal(t, false, bytes.Contains(data, []byte("secret")))
+
+	// offline inspection
+	sr, err := OpenSegment(fn, 10, 1<<10, WithKeyring(keys2))
+	Nil(t, err)
+	for _, keyID := range []uint32{1, 2} {
+		rec, err := sr.Next()
+		Nil(t, err)
+		Nil(t, rec.Err)
+		Equal(t, recordVersionEncrypted, rec.Version)
+		Equal(t, keyID, rec.KeyID)
+		Equal(t, secret, rec.Data)
+	}
+	_, err = sr.Next()
+	Equal(t, io.EOF, err)
+	sr.Close()
+
+	// without the key records are reported, not skipped
+	sr, err = OpenSegment(fn, 10, 1<<10, WithKeyring(keys1))
+	Nil(t, err)
+	rec, err := sr.Next()
+	Nil(t, err)
+	Equal(t, secret, rec.Data)
+	rec, err = sr.Next()
+	Nil(t, err)
+	Equal(t, true, errors.Is(rec.Err, ErrKeyUnavailable))
+	Equal(t, uint32(2), rec.KeyID)
+	_, err = sr.Next()
+	Equal(t, io.EOF, err)
+	sr.Close()
+
+	// nor does a diskqueue without the key skip them
+	dq = New(dqName, tmpDir, 1024*1024, 10, 1<<10, 2500, 2*time.Second, l)
+	select {
+	case <-dq.ReadChan():
+		t.Fatal("read an encrypted record without a keyring")
+	case <-time.After(100 * time.Millisecond):
+	}
+	Equal(t, int64(2), dq.Depth())
+	Equal(t, int64(0), dq.CorruptCount())
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 1024*1024, 10, 1<<10, 2500, 2*time.Second, l,
+		WithKeyring(keys2))
+	defer dq.Close()
+	Equal(t, secret, <-dq.ReadChan())
+	Equal(t, secret, <-dq.ReadChan())
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueuePutBatch(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_batch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("ems-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 10, 1<<10, 1, 2*time.Second, l)
+	defer dq.Close()
+
+	// 20 messages of 128 bytes span 3 files
+	batch := make([][]byte, 20)
+	for i := range batch {
+		batch[i] = bytes.Repeat([]byte{byte(i)}, 120)
+	}
+	n, err := dq.PutBatch(batch)
+	Nil(t, err)
+	Equal(t, 20, n)
+	Equal(t, int64(20), dq.Depth())
+	Equal(t, int64(2), dq.(*diskQueue).writeFileNum)
+
+	// a single invalid message rejects the whole batch
+	n, err = dq.PutBatch([][]byte{batch[0], make([]byte, 1)})
+	NotNil(t, err)
+	Equal(t, 0, n)
+	Equal(t, int64(20), dq.Depth())
+
+	// concurrent Puts are written together
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Nil(t, dq.Put(batch[0]))
+		}()
+	}
+	wg.Wait()
+	Equal(t, int64(30), dq.Depth())
+
+	for i := range batch {
+		Equal(t, batch[i], <-dq.ReadChan())
+	}
+	for i := 0; i < 10; i++ {
+		Equal(t, batch[0], <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
 }
 
 type md struct {
@@ -420,7 +686,7 @@ func TestDiskQueueSyncAfterRead(t *testing.T) {
 			d.readFileNum == 0 &&
 			d.writeFileNum == 0 &&
 			d.readPos == 0 &&
-			d.writePos == 1004 {
+			d.writePos == 1008 {
 			// success
 			goto next
 		}
@@ -437,8 +703,8 @@ next:
 		if d.depth == 1 &&
 			d.readFileNum == 0 &&
 			d.writeFileNum == 0 &&
-			d.readPos == 1004 &&
-			d.writePos == 2008 {
+			d.readPos == 1008 &&
+			d.writePos == 2016 {
 			// success
 			goto done
 		}
@@ -548,7 +814,7 @@ func TestDiskQueueResize(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 	msg := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
 	ml := int64(len(msg))
-	dq := New(dqName, tmpDir, 8*(ml+4), int32(ml), 1<<10, 2500, time.Second, l)
+	dq := New(dqName, tmpDir, 8*(ml+8), int32(ml), 1<<10, 2500, time.Second, l)
 	NotNil(t, dq)
 	Equal(t, int64(0), dq.Depth())
 
@@ -558,11 +824,11 @@ func TestDiskQueueResize(t *testing.T) {
 		Nil(t, err)
 	}
 	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
-	Equal(t, int64(ml+4), dq.(*diskQueue).writePos)
+	Equal(t, int64(ml+8), dq.(*diskQueue).writePos)
 	Equal(t, int64(9), dq.Depth())
 
 	dq.Close()
-	dq = New(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, time.Second, l)
+	dq = New(dqName, tmpDir, 10*(ml+8), int32(ml), 1<<10, 2500, time.Second, l)
 
 	for i := 0; i < 10; i++ {
 		msg[0] = byte(20 + i)
@@ -570,7 +836,7 @@ func TestDiskQueueResize(t *testing.T) {
 		Nil(t, err)
 	}
 	Equal(t, int64(2), dq.(*diskQueue).writeFileNum)
-	Equal(t, int64(ml+4), dq.(*diskQueue).writePos)
+	Equal(t, int64(ml+8), dq.(*diskQueue).writePos)
 	Equal(t, int64(19), dq.Depth())
 
 	for i := 0; i < 9; i++ {
@@ -643,6 +909,56 @@ func benchmarkDiskQueuePut(size int64, b *testing.B) {
 	}
 }
 
+// the SyncEvery=1 benchmarks measure durable throughput, concurrent Put
+// calls and PutBatch share a single fsync per group commit
+func BenchmarkDiskQueuePutSync1(b *testing.B) {
+	benchmarkDiskQueuePutSync1(1, 1, b)
+}
+func BenchmarkDiskQueuePutSync1Parallel16(b *testing.B) {
+	benchmarkDiskQueuePutSync1(16, 1, b)
+}
+func BenchmarkDiskQueuePutSync1Parallel64(b *testing.B) {
+	benchmarkDiskQueuePutSync1(64, 1, b)
+}
+func BenchmarkDiskQueuePutBatch100Sync1(b *testing.B) {
+	benchmarkDiskQueuePutSync1(1, 100, b)
+}
+func benchmarkDiskQueuePutSync1(parallelism int, batchSize int, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_put_sync" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("ems-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024768*100, 0, 1<<20, 1, 2*time.Second, l)
+	defer dq.Close()
+	b.SetBytes(256)
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		batch[i] = make([]byte, 256)
+	}
+	b.StartTimer()
+
+	// every batch counts as batchSize iterations
+	batches := int64((b.N + batchSize - 1) / batchSize)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&batches, -1) >= 0 {
+				_, err := dq.PutBatch(batch)
+				if err != nil {
+					panic(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func BenchmarkDiskWrite16(b *testing.B) {
 	benchmarkDiskWrite(16, b)
 }
@@ -0,0 +1,130 @@
+package diskqueue
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// MetaData is the state a diskqueue persists to its metadata file
+type MetaData struct {
+	Depth        int64
+	ReadFileNum  int64
+	ReadPos      int64
+	WriteFileNum int64
+	WritePos     int64
+
+	// not present in metadata written before compression was supported, in
+	// which case Compression is empty
+	Compression Compression
+	RawBytes    int64
+	StoredBytes int64
+}
+
+// MetaDataFileName returns the metadata file of the diskqueue name in dataPath
+func MetaDataFileName(dataPath string, name string) string {
+	return fmt.Sprintf(path.Join(dataPath, "%s.diskqueue.meta.dat"), name)
+}
+
+// SegmentFileName returns a segment file of the diskqueue name in dataPath
+func SegmentFileName(dataPath string, name string, fileNum int64) string {
+	return fmt.Sprintf(path.Join(dataPath, "%s.diskqueue.%06d.dat"), name, fileNum)
+}
+
+// ReadMetaData reads a diskqueue metadata file
+func ReadMetaData(fileName string) (*MetaData, error) {
+	f, err := os.OpenFile(fileName, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &MetaData{}
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+		&m.Depth,
+		&m.ReadFileNum, &m.ReadPos,
+		&m.WriteFileNum, &m.WritePos)
+	if err != nil {
+		return nil, err
+	}
+
+	// metadata written before compression was supported ends here
+	var compression Compression
+	var rawBytes, storedBytes int64
+	_, err = fmt.Fscanf(f, "%s %d,%d\n", &compression, &rawBytes, &storedBytes)
+	if err == nil {
+		m.Compression = compression
+		m.RawBytes = rawBytes
+		m.StoredBytes = storedBytes
+	}
+	return m, nil
+}
+
+// WriteMetaData atomically writes a diskqueue metadata file
+func WriteMetaData(fileName string, m *MetaData) error {
+	var f *os.File
+	var err error
+
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	// write to tmp file
+	f, err = os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	compression := m.Compression
+	if compression == "" {
+		compression = CompressionNone
+	}
+	_, err = fmt.Fprintf(f, "%d\n%d,%d\n%d,%d\n%s %d,%d\n",
+		m.Depth,
+		m.ReadFileNum, m.ReadPos,
+		m.WriteFileNum, m.WritePos,
+		compression, m.RawBytes, m.StoredBytes)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	// atomically rename
+	return os.Rename(tmpFileName, fileName)
+}
+
+// filesSize returns the total size of the files matching pattern
+func filesSize(pattern string) int64 {
+	matches, _ := filepath.Glob(pattern)
+	var size int64
+	for _, fn := range matches {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		size += fi.Size()
+	}
+	return size
+}
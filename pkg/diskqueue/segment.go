@@ -0,0 +1,133 @@
+package diskqueue
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/bhojpur/ems/pkg/core/keyring"
+)
+
+// Record is a record read from a segment file by a SegmentReader
+type Record struct {
+	Offset  int64  // of the record in the segment file
+	Size    int64  // of the record on disk, including its header
+	Version int    // of the record format
+	KeyID   uint32 // of the key an encrypted (version 3) record was sealed with
+	Data    []byte // the decompressed and decrypted data, nil if Err is set
+
+	// Err is set when the record is corrupt or cannot be decrypted, Size
+	// then spans the unreadable bytes up to the next valid record
+	Err error
+}
+
+// SegmentReader reads the records of a diskqueue segment file without a
+// running diskqueue, for offline inspection and recovery of queues (including
+// encrypted ones, given a keyring via WithKeyring)
+type SegmentReader struct {
+	d   *diskQueue
+	pos int64
+}
+
+// OpenSegment opens the segment file fileName for reading, minMsgSize and
+// maxMsgSize must match the values the diskqueue was written with
+func OpenSegment(fileName string, minMsgSize int32, maxMsgSize int32, options ...Option) (*SegmentReader, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	d := &diskQueue{
+		name:       fileName,
+		minMsgSize: minMsgSize,
+		maxMsgSize: maxMsgSize,
+		readFile:   f,
+		reader:     bufio.NewReader(f),
+		logf:       func(lvl LogLevel, f string, args ...interface{}) {},
+		// the segment is treated as a complete file ending at its size
+		writeFileNum:        1,
+		maxBytesPerFileRead: stat.Size(),
+	}
+	for _, option := range options {
+		option(d)
+	}
+	return &SegmentReader{d: d}, nil
+}
+
+// Next returns the next record in the segment, or io.EOF at its end
+func (s *SegmentReader) Next() (*Record, error) {
+	d := s.d
+	if s.pos >= d.maxBytesPerFileRead {
+		return nil, io.EOF
+	}
+
+	rec := &Record{Offset: s.pos}
+	var header [8]byte
+	n, _ := d.readFile.ReadAt(header[:], s.pos)
+	if n >= 4 {
+		rec.Version = int(binary.BigEndian.Uint32(header[:]) >> recordVersionShift)
+	}
+	if n == 8 && rec.Version == recordVersionEncrypted {
+		// the key ID is the first field of the sealed data
+		var keyID [4]byte
+		d.readFile.ReadAt(keyID[:], s.pos+8)
+		rec.KeyID = keyring.KeyID(keyID[:])
+	}
+
+	data, totalBytes, err := d.readRecord()
+	if err != nil {
+		var corruptErr *errCorruptRecord
+		if !errors.As(err, &corruptErr) && !errors.Is(err, ErrKeyUnavailable) {
+			return nil, err
+		}
+		rec.Err = err
+		if errors.Is(err, ErrKeyUnavailable) && rec.Version == recordVersionEncrypted {
+			totalBytes = 8 + int64(binary.BigEndian.Uint32(header[:])&recordSizeMask)
+		} else {
+			totalBytes = d.findNextRecord(s.pos+1) - s.pos
+		}
+		s.seek(s.pos + totalBytes)
+	}
+
+	rec.Size = totalBytes
+	rec.Data = data
+	s.pos += totalBytes
+	return rec, nil
+}
+
+func (s *SegmentReader) seek(pos int64) {
+	s.d.readFile.Seek(pos, io.SeekStart)
+	s.d.reader.Reset(s.d.readFile)
+}
+
+// Close closes the segment file
+func (s *SegmentReader) Close() error {
+	return s.d.readFile.Close()
+}
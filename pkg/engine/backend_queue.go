@@ -29,3 +29,74 @@ type BackendQueue interface {
 	Depth() int64
 	Empty() error
 }
+
+// RandomAccessBackendQueue is implemented by backends that can look up a
+// queued (not yet read) message by its ID
+type RandomAccessBackendQueue interface {
+	BackendQueue
+	Get(id []byte) ([]byte, error)
+}
+
+// BatchBackendQueue is implemented by backends that can write several
+// messages more cheaply at once than one at a time, PutBatch returns how
+// many of them were written
+type BatchBackendQueue interface {
+	BackendQueue
+	PutBatch([][]byte) (int, error)
+}
+
+// corruptCounter is implemented by backends that skip over corrupt data
+// rather than failing reads
+type corruptCounter interface {
+	CorruptCount() int64
+}
+
+// compressionRatioer is implemented by backends that compress stored data
+type compressionRatioer interface {
+	CompressionRatio() float64
+}
+
+// diskUsager is implemented by backends that store data on disk
+type diskUsager interface {
+	DiskUsage() int64
+}
+
+// syncer is implemented by backends that can persist their state on demand
+type syncer interface {
+	Sync() error
+}
+
+// backendSync persists b's pending writes and metadata, backends that do not
+// store data on disk have nothing to sync
+func backendSync(b BackendQueue) error {
+	if s, ok := b.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// backendDiskUsage returns the size of b's files, or 0 for backends that do
+// not store data on disk
+func backendDiskUsage(b BackendQueue) int64 {
+	if du, ok := b.(diskUsager); ok {
+		return du.DiskUsage()
+	}
+	return 0
+}
+
+// backendCompressionRatio returns the ratio of data written to b to its stored
+// size, or 0 for backends that do not compress
+func backendCompressionRatio(b BackendQueue) float64 {
+	if cr, ok := b.(compressionRatioer); ok {
+		return cr.CompressionRatio()
+	}
+	return 0
+}
+
+// backendCorruptCount returns the number of corrupt records skipped by b
+func backendCorruptCount(b BackendQueue) int64 {
+	if cc, ok := b.(corruptCounter); ok {
+		return cc.CorruptCount()
+	}
+	return 0
+}
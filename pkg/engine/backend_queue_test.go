@@ -0,0 +1,299 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+	"github.com/bhojpur/ems/pkg/diskqueue"
+)
+
+func newTestBackendQueueConfig(t *testing.T, dataPath string) *BackendQueueConfig {
+	return &BackendQueueConfig{
+		Name:            "test_backend_queue",
+		DataPath:        dataPath,
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      int32(minValidMsgLength),
+		MaxMsgSize:      1024,
+		SyncEvery:       1,
+		SyncTimeout:     time.Second,
+		MaxDepth:        100,
+		Logf: func(lvl diskqueue.LogLevel, f string, args ...interface{}) {
+			t.Log(fmt.Sprintf(lvl.String()+": "+f, args...))
+		},
+	}
+}
+
+func encodeTestMessage(t *testing.T, i int) (MessageID, []byte) {
+	var id MessageID
+	copy(id[:], fmt.Sprintf("%016d", i))
+	msg := NewMessage(id, []byte(fmt.Sprintf("body %d", i)))
+	buf := bufferPoolGet()
+	defer bufferPoolPut(buf)
+	_, err := msg.WriteTo(buf)
+	test.Nil(t, err)
+	// the buffer is reused, backends must copy what they keep
+	b := make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+	return id, b
+}
+
+func readBackendQueue(t *testing.T, bq BackendQueue) []byte {
+	select {
+	case b := <-bq.ReadChan():
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout reading from backend queue")
+	}
+	return nil
+}
+
+// TestBackendQueueConformance runs every registered BackendQueue through the
+// same behaviour, new backends get tested simply by registering them
+func TestBackendQueueConformance(t *testing.T) {
+	for _, name := range BackendQueueNames() {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			r, _ := getBackendQueueRegistration(name)
+			t.Run("FIFO", func(t *testing.T) { testBackendQueueFIFO(t, r) })
+			t.Run("Empty", func(t *testing.T) { testBackendQueueEmpty(t, r) })
+			t.Run("Concurrent", func(t *testing.T) { testBackendQueueConcurrent(t, r) })
+			t.Run("Reopen", func(t *testing.T) { testBackendQueueReopen(t, r) })
+			t.Run("RandomAccess", func(t *testing.T) { testBackendQueueRandomAccess(t, r) })
+		})
+	}
+}
+
+func testBackendQueueFIFO(t *testing.T, r backendQueueRegistration) {
+	tmpDir, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	bq := r.factory(newTestBackendQueueConfig(t, tmpDir))
+	defer bq.Close()
+	test.Equal(t, int64(0), bq.Depth())
+
+	var msgs [][]byte
+	for i := 0; i < 50; i++ {
+		_, b := encodeTestMessage(t, i)
+		test.Nil(t, bq.Put(b))
+		msgs = append(msgs, b)
+	}
+	test.Equal(t, int64(50), bq.Depth())
+
+	for i := 0; i < 50; i++ {
+		test.Equal(t, msgs[i], readBackendQueue(t, bq))
+	}
+	test.Equal(t, int64(0), bq.Depth())
+
+	select {
+	case <-bq.ReadChan():
+		t.Fatal("read from an empty backend queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func testBackendQueueEmpty(t *testing.T, r backendQueueRegistration) {
+	tmpDir, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	bq := r.factory(newTestBackendQueueConfig(t, tmpDir))
+	defer bq.Close()
+
+	for i := 0; i < 10; i++ {
+		_, b := encodeTestMessage(t, i)
+		test.Nil(t, bq.Put(b))
+	}
+	test.Nil(t, bq.Empty())
+	test.Equal(t, int64(0), bq.Depth())
+
+	_, b := encodeTestMessage(t, 10)
+	test.Nil(t, bq.Put(b))
+	test.Equal(t, b, readBackendQueue(t, bq))
+}
+
+func testBackendQueueConcurrent(t *testing.T, r backendQueueRegistration) {
+	tmpDir, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	bq := r.factory(newTestBackendQueueConfig(t, tmpDir))
+	defer bq.Close()
+
+	const writers, perWriter = 4, 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				_, b := encodeTestMessage(t, w*perWriter+i)
+				bq.Put(b)
+			}
+		}(w)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < writers*perWriter; i++ {
+		b := readBackendQueue(t, bq)
+		seen[string(b)] = true
+	}
+	wg.Wait()
+	test.Equal(t, writers*perWriter, len(seen))
+	test.Equal(t, int64(0), bq.Depth())
+}
+
+func testBackendQueueReopen(t *testing.T, r backendQueueRegistration) {
+	if !r.persistent {
+		t.Skip("not persistent")
+	}
+	tmpDir, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := newTestBackendQueueConfig(t, tmpDir)
+	bq := r.factory(cfg)
+	var msgs [][]byte
+	for i := 0; i < 30; i++ {
+		_, b := encodeTestMessage(t, i)
+		test.Nil(t, bq.Put(b))
+		msgs = append(msgs, b)
+	}
+	for i := 0; i < 10; i++ {
+		test.Equal(t, msgs[i], readBackendQueue(t, bq))
+	}
+	test.Nil(t, bq.Close())
+
+	bq = r.factory(cfg)
+	defer bq.Close()
+	test.Equal(t, int64(20), bq.Depth())
+	for i := 10; i < 30; i++ {
+		test.Equal(t, msgs[i], readBackendQueue(t, bq))
+	}
+}
+
+func testBackendQueueRandomAccess(t *testing.T, r backendQueueRegistration) {
+	tmpDir, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	bq, ok := r.factory(newTestBackendQueueConfig(t, tmpDir)).(RandomAccessBackendQueue)
+	if !ok {
+		t.Skip("no random access")
+	}
+	defer bq.Close()
+
+	var ids []MessageID
+	var msgs [][]byte
+	for i := 0; i < 5; i++ {
+		id, b := encodeTestMessage(t, i)
+		test.Nil(t, bq.Put(b))
+		ids = append(ids, id)
+		msgs = append(msgs, b)
+	}
+
+	b, err := bq.Get(ids[3][:])
+	test.Nil(t, err)
+	test.Equal(t, msgs[3], b)
+
+	readBackendQueue(t, bq)
+	_, err = bq.Get(ids[0][:])
+	test.NotNil(t, err)
+	test.Equal(t, int64(4), bq.Depth())
+}
+
+func TestMemoryBackendQueueBounded(t *testing.T) {
+	bq := newMemoryBackendQueue(2)
+	defer bq.Close()
+
+	_, b := encodeTestMessage(t, 0)
+	test.Nil(t, bq.Put(b))
+	test.Nil(t, bq.Put(b))
+	test.Equal(t, errMemoryBackendQueueFull, bq.Put(b))
+
+	readBackendQueue(t, bq)
+	test.Nil(t, bq.Put(b))
+}
+
+func TestTopicBackendQueueOverride(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TopicBackendQueues = []string{"logged=log", "mem_*=memory"}
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	_, ok := emsd.GetTopic("logged").backend.(RandomAccessBackendQueue)
+	test.Equal(t, true, ok)
+	_, ok = emsd.GetTopic("logged").GetChannel("ch").backend.(RandomAccessBackendQueue)
+	test.Equal(t, true, ok)
+	_, ok = emsd.GetTopic("mem_topic").backend.(*memoryBackendQueue)
+	test.Equal(t, true, ok)
+	_, ok = emsd.GetTopic("other").backend.(*memoryBackendQueue)
+	test.Equal(t, false, ok)
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "ems-test-")
+	defer os.RemoveAll(opts.DataPath)
+	opts.TopicBackendQueues = []string{"t=nonexistent"}
+	_, err := New(opts)
+	test.NotNil(t, err)
+}
+
+func TestTopicDiskQueueCompression(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.TopicDiskQueueCompressions = []string{"zipped=snappy"}
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	body := bytes.Repeat([]byte(`{"key":"value"}`), 20)
+	for _, topicName := range []string{"zipped", "plain"} {
+		topic := emsd.GetTopic(topicName)
+		for i := 0; i < 10; i++ {
+			test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), body)))
+		}
+	}
+
+	stats := emsd.GetStats("zipped", "", false)
+	test.Equal(t, true, stats.Topics[0].BackendCompressionRatio > 2)
+	stats = emsd.GetStats("plain", "", false)
+	test.Equal(t, 1.0, stats.Topics[0].BackendCompressionRatio)
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "ems-test-")
+	defer os.RemoveAll(opts.DataPath)
+	opts.TopicDiskQueueCompressions = []string{"t=zip"}
+	_, err := New(opts)
+	test.NotNil(t, err)
+}
@@ -0,0 +1,242 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/keyring"
+	"github.com/bhojpur/ems/pkg/core/lg"
+	"github.com/bhojpur/ems/pkg/diskqueue"
+	"github.com/bhojpur/ems/pkg/logqueue"
+)
+
+// BackendQueueConfig holds everything needed to create (or reopen) a BackendQueue
+type BackendQueueConfig struct {
+	Name            string // unique per emsd, either the topic or topic:channel
+	DataPath        string
+	MaxBytesPerFile int64
+	MinMsgSize      int32
+	MaxMsgSize      int32
+	SyncEvery       int64
+	SyncTimeout     time.Duration
+	Compression     diskqueue.Compression // for backends which support compression
+	Keyring         *keyring.Keyring      // for backends which support encryption, if enabled
+	MaxDepth        int64                 // for backends which are bounded in memory
+	Logf            diskqueue.AppLogFunc
+}
+
+// BackendQueueFactory creates a BackendQueue, persistent backends must pick up
+// whatever was previously stored under the same name
+type BackendQueueFactory func(cfg *BackendQueueConfig) BackendQueue
+
+type backendQueueRegistration struct {
+	factory    BackendQueueFactory
+	persistent bool
+}
+
+var backendQueueRegistry = struct {
+	sync.RWMutex
+	backends map[string]backendQueueRegistration
+}{
+	backends: map[string]backendQueueRegistration{
+		"disk":   {newDiskBackendQueue, true},
+		"log":    {newLogBackendQueue, true},
+		"memory": {newMemoryBackendQueueFromConfig, false},
+	},
+}
+
+// RegisterBackendQueue makes a BackendQueue implementation selectable by name
+// (via --backend-queue and --topic-backend-queue), it must be called before
+// emsd is started and every implementation must pass the conformance tests
+func RegisterBackendQueue(name string, factory BackendQueueFactory, persistent bool) {
+	backendQueueRegistry.Lock()
+	backendQueueRegistry.backends[name] = backendQueueRegistration{factory, persistent}
+	backendQueueRegistry.Unlock()
+}
+
+// BackendQueueNames returns the names of all registered backends
+func BackendQueueNames() []string {
+	backendQueueRegistry.RLock()
+	defer backendQueueRegistry.RUnlock()
+	names := make([]string, 0, len(backendQueueRegistry.backends))
+	for name := range backendQueueRegistry.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getBackendQueueRegistration(name string) (backendQueueRegistration, bool) {
+	backendQueueRegistry.RLock()
+	defer backendQueueRegistry.RUnlock()
+	r, ok := backendQueueRegistry.backends[name]
+	return r, ok
+}
+
+func newDiskBackendQueue(cfg *BackendQueueConfig) BackendQueue {
+	return diskqueue.New(
+		cfg.Name,
+		cfg.DataPath,
+		cfg.MaxBytesPerFile,
+		cfg.MinMsgSize,
+		cfg.MaxMsgSize,
+		cfg.SyncEvery,
+		cfg.SyncTimeout,
+		cfg.Logf,
+		diskqueue.WithCompression(cfg.Compression),
+		diskqueue.WithKeyring(cfg.Keyring),
+	)
+}
+
+// newLogBackendQueue creates a log structured queue indexed by message ID
+func newLogBackendQueue(cfg *BackendQueueConfig) BackendQueue {
+	return logqueue.New(
+		cfg.Name,
+		cfg.DataPath,
+		cfg.MaxBytesPerFile,
+		cfg.MinMsgSize,
+		cfg.MaxMsgSize,
+		cfg.SyncEvery,
+		cfg.SyncTimeout,
+		messageIDFromBytes,
+		cfg.Logf,
+	)
+}
+
+func newMemoryBackendQueueFromConfig(cfg *BackendQueueConfig) BackendQueue {
+	return newMemoryBackendQueue(cfg.MaxDepth)
+}
+
+// validateBackendQueueOptions checks that every configured backend is registered
+func validateBackendQueueOptions(opts *Options) error {
+	if _, ok := getBackendQueueRegistration(opts.BackendQueue); !ok {
+		return fmt.Errorf("--backend-queue %q is not one of %v", opts.BackendQueue, BackendQueueNames())
+	}
+	for _, override := range opts.TopicBackendQueues {
+		_, name, err := parseTopicOverride(override)
+		if err != nil {
+			return fmt.Errorf("--topic-backend-queue %s", err)
+		}
+		if _, ok := getBackendQueueRegistration(name); !ok {
+			return fmt.Errorf("--topic-backend-queue %q is not one of %v", name, BackendQueueNames())
+		}
+	}
+
+	if _, err := diskqueue.ParseCompression(opts.DiskQueueCompression); err != nil {
+		return fmt.Errorf("--diskqueue-compression %s", err)
+	}
+	for _, override := range opts.TopicDiskQueueCompressions {
+		_, name, err := parseTopicOverride(override)
+		if err != nil {
+			return fmt.Errorf("--topic-diskqueue-compression %s", err)
+		}
+		if _, err := diskqueue.ParseCompression(name); err != nil {
+			return fmt.Errorf("--topic-diskqueue-compression %s", err)
+		}
+	}
+
+	if err := validateFanoutStorage(opts.FanoutStorage); err != nil {
+		return fmt.Errorf("--fanout-storage %s", err)
+	}
+	for _, override := range opts.TopicFanoutStorages {
+		_, name, err := parseTopicOverride(override)
+		if err != nil {
+			return fmt.Errorf("--topic-fanout-storage %s", err)
+		}
+		if err := validateFanoutStorage(name); err != nil {
+			return fmt.Errorf("--topic-fanout-storage %s", err)
+		}
+	}
+
+	if opts.DiskHighWatermark != 0 {
+		if opts.DiskHighWatermark < 0 || opts.DiskHighWatermark > 100 {
+			return errors.New("--disk-high-watermark must be (0,100]")
+		}
+		if opts.DiskLowWatermark <= 0 || opts.DiskLowWatermark >= opts.DiskHighWatermark {
+			return errors.New("--disk-low-watermark must be (0,--disk-high-watermark)")
+		}
+		if opts.DiskCheckInterval <= 0 {
+			return errors.New("--disk-check-interval must be positive")
+		}
+	}
+	return nil
+}
+
+// newBackendQueue creates the backend for a topic (or one of its channels, in
+// which case backendName includes the channel), channels always use the same
+// backend as their topic
+func (n *EMSD) newBackendQueue(topicName string, backendName string) BackendQueue {
+	opts := n.getOpts()
+
+	name := opts.BackendQueue
+	if override, ok := topicOverride(opts.TopicBackendQueues, topicName); ok {
+		name = override
+	}
+	r, ok := getBackendQueueRegistration(name)
+	if !ok {
+		// backend options are validated on startup and cannot be changed at runtime
+		panic(fmt.Sprintf("unknown backend queue %q", name))
+	}
+
+	compression := opts.DiskQueueCompression
+	if override, ok := topicOverride(opts.TopicDiskQueueCompressions, topicName); ok {
+		compression = override
+	}
+	// validated on startup
+	dqCompression, _ := diskqueue.ParseCompression(compression)
+
+	return r.factory(&BackendQueueConfig{
+		Name:            backendName,
+		DataPath:        opts.DataPath,
+		MaxBytesPerFile: opts.MaxBytesPerFile,
+		MinMsgSize:      int32(minValidMsgLength),
+		MaxMsgSize:      int32(opts.MaxMsgSize) + minValidMsgLength,
+		SyncEvery:       opts.SyncEvery,
+		SyncTimeout:     opts.SyncTimeout,
+		Compression:     dqCompression,
+		Keyring:         n.keyring,
+		MaxDepth:        opts.MemoryBackendMaxDepth,
+		Logf:            n.diskQueueLogf,
+	})
+}
+
+// backendQueuePersistent returns true if the topic's backend stores messages
+// on disk
+func (n *EMSD) backendQueuePersistent(topicName string) bool {
+	opts := n.getOpts()
+	name := opts.BackendQueue
+	if override, ok := topicOverride(opts.TopicBackendQueues, topicName); ok {
+		name = override
+	}
+	r, _ := getBackendQueueRegistration(name)
+	return r.persistent
+}
+
+// diskQueueLogf logs on behalf of backends
+func (n *EMSD) diskQueueLogf(level diskqueue.LogLevel, f string, args ...interface{}) {
+	opts := n.getOpts()
+	lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
+}
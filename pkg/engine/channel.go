@@ -30,9 +30,7 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/bhojpur/ems/pkg/diskqueue"
 
-	"github.com/bhojpur/ems/pkg/core/lg"
 	"github.com/bhojpur/ems/pkg/core/pqueue"
 	"github.com/bhojpur/ems/pkg/core/quantile"
 )
@@ -41,7 +39,7 @@ type Consumer interface {
 	UnPause()
 	Pause()
 	Close() error
-	TimedOutMessage()
+	TimedOutMessage(MessageID)
 	Stats(string) ClientStats
 	Empty()
 }
@@ -66,6 +64,8 @@ type Channel struct {
 	name      string
 	emsd      *EMSD
 
+	rate messageRate
+
 	backend BackendQueue
 
 	memoryMsgChan chan *Message
@@ -79,6 +79,14 @@ type Channel struct {
 	deleteCallback func(*Channel)
 	deleter        sync.Once
 
+	// replication
+	replicaAckChan chan replicaAck // the topic's, when it's replicated
+	replica        int32           // holds a copy of a leader's channel
+	replicaMtx     sync.Mutex
+	replicaAcked   map[MessageID]struct{}
+	replicaHead    *Message // read off the queue, not finished on the leader yet
+	replicaHeld    int64    // 1 while replicaHead is set, for Depth
+
 	// Stats tracking
 	e2eProcessingLatencyStream *quantile.Quantile
 
@@ -116,26 +124,20 @@ func NewChannel(topicName string, channelName string, emsd *EMSD,
 
 	c.initPQ()
 
+	if emsd.replicaLeader(topicName) != "" {
+		// consumers are served by the leader, it's only stored
+		c.memoryMsgChan = nil
+		c.replica = 1
+		c.replicaAcked = make(map[MessageID]struct{})
+	}
+
 	if strings.HasSuffix(channelName, "#ephemeral") {
 		c.ephemeral = true
 		c.backend = newDummyBackendQueue()
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := emsd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
-		}
 		// backend names, for uniqueness, automatically include the topic...
 		backendName := getBackendName(topicName, channelName)
-		c.backend = diskqueue.New(
-			backendName,
-			emsd.getOpts().DataPath,
-			emsd.getOpts().MaxBytesPerFile,
-			int32(minValidMsgLength),
-			int32(emsd.getOpts().MaxMsgSize)+minValidMsgLength,
-			emsd.getOpts().SyncEvery,
-			emsd.getOpts().SyncTimeout,
-			dqLogf,
-		)
+		c.backend = emsd.newBackendQueue(topicName, backendName)
 	}
 
 	c.emsd.Notify(c, !c.ephemeral)
@@ -226,6 +228,9 @@ func (c *Channel) Empty() error {
 	}
 
 finish:
+	c.replicaMtx.Lock()
+	c.setReplicaHead(nil)
+	c.replicaMtx.Unlock()
 	return c.backend.Empty()
 }
 
@@ -269,11 +274,21 @@ finish:
 	}
 	c.deferredMutex.Unlock()
 
+	c.replicaMtx.Lock()
+	if c.replicaHead != nil {
+		err := writeMessageToBackend(c.replicaHead, c.backend)
+		if err != nil {
+			c.emsd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+		}
+		c.setReplicaHead(nil)
+	}
+	c.replicaMtx.Unlock()
+
 	return nil
 }
 
 func (c *Channel) Depth() int64 {
-	return int64(len(c.memoryMsgChan)) + c.backend.Depth()
+	return int64(len(c.memoryMsgChan)) + c.backend.Depth() + atomic.LoadInt64(&c.replicaHeld)
 }
 
 func (c *Channel) Pause() error {
@@ -303,6 +318,10 @@ func (c *Channel) doPause(pause bool) error {
 	return nil
 }
 
+func (c *Channel) isReplica() bool {
+	return atomic.LoadInt32(&c.replica) == 1
+}
+
 func (c *Channel) IsPaused() bool {
 	return atomic.LoadInt32(&c.paused) == 1
 }
@@ -323,6 +342,11 @@ func (c *Channel) PutMessage(m *Message) error {
 }
 
 func (c *Channel) put(m *Message) error {
+	if c.isReplica() {
+		// not while the queue is compacted
+		c.replicaMtx.Lock()
+		defer c.replicaMtx.Unlock()
+	}
 	select {
 	case c.memoryMsgChan <- m:
 	default:
@@ -376,6 +400,13 @@ func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(msg.Timestamp)
 	}
+	if c.replicaAckChan != nil && !c.ephemeral {
+		select {
+		case c.replicaAckChan <- replicaAck{c.name, id}:
+		default:
+			// a promoted replica delivers it again
+		}
+	}
 	return nil
 }
 
@@ -417,6 +448,9 @@ func (c *Channel) AddClient(clientID int64, client Consumer) error {
 	if c.Exiting() {
 		return errors.New("exiting")
 	}
+	if c.isReplica() {
+		return errReplica
+	}
 
 	c.RLock()
 	_, ok := c.clients[clientID]
@@ -561,6 +595,20 @@ func (c *Channel) popDeferredMessage(id MessageID) (*pqueue.Item, error) {
 	return item, nil
 }
 
+// takeDeferredMessages removes all deferred messages from the channel and
+// returns them, the item priority is when they were due to be delivered
+func (c *Channel) takeDeferredMessages() []*pqueue.Item {
+	c.deferredMutex.Lock()
+	defer c.deferredMutex.Unlock()
+	items := make([]*pqueue.Item, 0, len(c.deferredMessages))
+	for _, item := range c.deferredMessages {
+		items = append(items, item)
+	}
+	c.deferredMessages = make(map[MessageID]*pqueue.Item)
+	c.deferredPQ = pqueue.New(int(math.Max(1, float64(c.emsd.getOpts().MemQueueSize)/10)))
+	return items
+}
+
 func (c *Channel) addToDeferredPQ(item *pqueue.Item) {
 	c.deferredMutex.Lock()
 	heap.Push(&c.deferredPQ, item)
@@ -626,7 +674,7 @@ func (c *Channel) processInFlightQueue(t int64) bool {
 		client, ok := c.clients[msg.clientID]
 		c.RUnlock()
 		if ok {
-			client.TimedOutMessage()
+			client.TimedOutMessage(msg.ID)
 		}
 		c.put(msg)
 	}
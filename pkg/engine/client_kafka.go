@@ -0,0 +1,113 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// kafkaClient is a single Kafka producer connection
+type kafkaClient struct {
+	pubCounts map[string]uint64
+
+	metaLock sync.RWMutex
+
+	net.Conn
+	Reader *bufio.Reader
+
+	State       int32
+	ConnectTime time.Time
+
+	ClientID string
+	Hostname string
+}
+
+func newKafkaClient(conn net.Conn) *kafkaClient {
+	identifier, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return &kafkaClient{
+		Conn:        conn,
+		Reader:      bufio.NewReaderSize(conn, defaultBufferSize),
+		ConnectTime: time.Now(),
+		State:       stateInit,
+		ClientID:    identifier,
+		Hostname:    identifier,
+		pubCounts:   make(map[string]uint64),
+	}
+}
+
+func (c *kafkaClient) String() string {
+	return c.RemoteAddr().String()
+}
+
+func (c *kafkaClient) Type() int {
+	return typeProducer
+}
+
+func (c *kafkaClient) PublishedMessage(topic string, count uint64) {
+	c.metaLock.Lock()
+	c.pubCounts[topic] += count
+	c.metaLock.Unlock()
+}
+
+// SetClientID records the client.id sent in each request header, the
+// last non-empty value wins
+func (c *kafkaClient) SetClientID(clientID string) {
+	if clientID == "" {
+		return
+	}
+	c.metaLock.Lock()
+	c.ClientID = clientID
+	c.metaLock.Unlock()
+}
+
+func (c *kafkaClient) Send(data []byte) error {
+	_, err := c.Write(data)
+	return err
+}
+
+func (c *kafkaClient) Stats(topicName string) ClientStats {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	pubCounts := make([]PubCount, 0, len(c.pubCounts))
+	for topic, count := range c.pubCounts {
+		if len(topicName) > 0 && topic != topicName {
+			continue
+		}
+		pubCounts = append(pubCounts, PubCount{
+			Topic: topic,
+			Count: count,
+		})
+	}
+	return ClientV2Stats{
+		Version:       "KAFKA",
+		RemoteAddress: c.RemoteAddr().String(),
+		ClientID:      c.ClientID,
+		Hostname:      c.Hostname,
+		UserAgent:     "kafka",
+		State:         atomic.LoadInt32(&c.State),
+		ConnectTime:   c.ConnectTime.Unix(),
+		PubCounts:     pubCounts,
+	}
+}
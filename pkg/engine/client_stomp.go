@@ -0,0 +1,341 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/auth"
+)
+
+const (
+	stompAckAuto             = "auto"
+	stompAckClient           = "client"
+	stompAckClientIndividual = "client-individual"
+)
+
+// stompClient is a single STOMP connection, it can publish to any number of
+// topics and hold any number of subscriptions
+type stompClient struct {
+	pubCounts map[string]uint64
+
+	writeLock sync.Mutex
+	metaLock  sync.RWMutex
+
+	emsd *EMSD
+
+	net.Conn
+	Reader *bufio.Reader
+	Writer *bufio.Writer
+
+	State       int32
+	ConnectTime time.Time
+	ExitChan    chan int
+
+	ClientID string
+	Hostname string
+
+	HeartbeatInterval time.Duration // how often we send heart-beats
+	ReadTimeout       time.Duration // how long we wait for client heart-beats
+
+	subscriptions map[string]*stompSubscription
+
+	AuthState *auth.State
+}
+
+func newStompClient(conn net.Conn, emsd *EMSD) *stompClient {
+	identifier, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return &stompClient{
+		emsd:          emsd,
+		Conn:          conn,
+		Reader:        bufio.NewReaderSize(conn, defaultBufferSize),
+		Writer:        bufio.NewWriterSize(conn, defaultBufferSize),
+		ConnectTime:   time.Now(),
+		ExitChan:      make(chan int),
+		State:         stateInit,
+		ClientID:      identifier,
+		Hostname:      identifier,
+		subscriptions: make(map[string]*stompSubscription),
+		pubCounts:     make(map[string]uint64),
+	}
+}
+
+func (c *stompClient) String() string {
+	return c.RemoteAddr().String()
+}
+
+func (c *stompClient) Type() int {
+	c.metaLock.RLock()
+	hasPublished := len(c.pubCounts) > 0
+	c.metaLock.RUnlock()
+	if hasPublished {
+		return typeProducer
+	}
+	return typeConsumer
+}
+
+func (c *stompClient) PublishedMessage(topic string, count uint64) {
+	c.metaLock.Lock()
+	c.pubCounts[topic] += count
+	c.metaLock.Unlock()
+}
+
+func (c *stompClient) Send(f *stompFrame) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	var zeroTime time.Time
+	if c.HeartbeatInterval > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.HeartbeatInterval))
+	} else {
+		c.SetWriteDeadline(zeroTime)
+	}
+
+	err := writeStompFrame(c.Writer, f)
+	if err != nil {
+		return err
+	}
+	return c.Writer.Flush()
+}
+
+func (c *stompClient) SendHeartbeat() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.SetWriteDeadline(time.Now().Add(c.HeartbeatInterval))
+	_, err := c.Writer.Write([]byte("\n"))
+	if err != nil {
+		return err
+	}
+	return c.Writer.Flush()
+}
+
+func (c *stompClient) IsAuthorized(topic, channel string) (bool, error) {
+	if c.AuthState == nil {
+		return false, nil
+	}
+	if c.AuthState.IsExpired() {
+		return false, nil
+	}
+	return c.AuthState.IsAllowed(topic, channel), nil
+}
+
+func (c *stompClient) Stats(topicName string) ClientStats {
+	c.metaLock.RLock()
+	pubCounts := make([]PubCount, 0, len(c.pubCounts))
+	for topic, count := range c.pubCounts {
+		if len(topicName) > 0 && topic != topicName {
+			continue
+		}
+		pubCounts = append(pubCounts, PubCount{
+			Topic: topic,
+			Count: count,
+		})
+	}
+	c.metaLock.RUnlock()
+	return c.baseStats(pubCounts)
+}
+
+func (c *stompClient) baseStats(pubCounts []PubCount) ClientV2Stats {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	stats := ClientV2Stats{
+		Version:       "STOMP1.2",
+		RemoteAddress: c.RemoteAddr().String(),
+		ClientID:      c.ClientID,
+		Hostname:      c.Hostname,
+		UserAgent:     "stomp",
+		State:         atomic.LoadInt32(&c.State),
+		ConnectTime:   c.ConnectTime.Unix(),
+		PubCounts:     pubCounts,
+	}
+	if c.AuthState != nil {
+		stats.Authed = true
+		stats.AuthIdentity = c.AuthState.Identity
+		stats.AuthIdentityURL = c.AuthState.IdentityURL
+	}
+	return stats
+}
+
+// stompSubscription is a single SUBSCRIBE on a stompClient, it is registered
+// with its Channel as an ordinary consumer
+type stompSubscription struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	ReadyCount    int64
+	InFlightCount int64
+	MessageCount  uint64
+	FinishCount   uint64
+	RequeueCount  uint64
+
+	ID      int64
+	SubID   string
+	AckMode string
+	Channel *Channel
+	client  *stompClient
+
+	ReadyStateChan chan int
+	ExitChan       chan int
+	exitOnce       sync.Once
+
+	// delivery ordered message IDs awaiting acknowledgement,
+	// used to resolve cumulative acknowledgements in "client" mode
+	pendingLock sync.Mutex
+	pending     []MessageID
+}
+
+func newStompSubscription(id int64, subID string, ackMode string, readyCount int64,
+	channel *Channel, client *stompClient) *stompSubscription {
+	return &stompSubscription{
+		ID:             id,
+		SubID:          subID,
+		AckMode:        ackMode,
+		ReadyCount:     readyCount,
+		Channel:        channel,
+		client:         client,
+		ReadyStateChan: make(chan int, 1),
+		ExitChan:       make(chan int),
+	}
+}
+
+func (s *stompSubscription) IsReadyForMessages() bool {
+	if s.Channel.IsPaused() {
+		return false
+	}
+
+	readyCount := atomic.LoadInt64(&s.ReadyCount)
+	inFlightCount := atomic.LoadInt64(&s.InFlightCount)
+	if inFlightCount >= readyCount || readyCount <= 0 {
+		return false
+	}
+
+	return true
+}
+
+func (s *stompSubscription) tryUpdateReadyState() {
+	select {
+	case s.ReadyStateChan <- 1:
+	default:
+	}
+}
+
+func (s *stompSubscription) SendingMessage(id MessageID) {
+	atomic.AddInt64(&s.InFlightCount, 1)
+	atomic.AddUint64(&s.MessageCount, 1)
+	if s.AckMode == stompAckClient {
+		s.pendingLock.Lock()
+		s.pending = append(s.pending, id)
+		s.pendingLock.Unlock()
+	}
+}
+
+func (s *stompSubscription) FinishedMessage() {
+	atomic.AddUint64(&s.FinishCount, 1)
+	atomic.AddInt64(&s.InFlightCount, -1)
+	s.tryUpdateReadyState()
+}
+
+func (s *stompSubscription) RequeuedMessage() {
+	atomic.AddUint64(&s.RequeueCount, 1)
+	atomic.AddInt64(&s.InFlightCount, -1)
+	s.tryUpdateReadyState()
+}
+
+// popPending returns all pending message IDs delivered up to and including id
+// (for "client-individual" mode only id itself is returned)
+func (s *stompSubscription) popPending(id MessageID) []MessageID {
+	if s.AckMode != stompAckClient {
+		return []MessageID{id}
+	}
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	for i, pid := range s.pending {
+		if pid == id {
+			ids := make([]MessageID, i+1)
+			copy(ids, s.pending[:i+1])
+			s.pending = s.pending[i+1:]
+			return ids
+		}
+	}
+	return []MessageID{id}
+}
+
+// dropPending forgets a message that isn't in flight anymore, a cumulative
+// acknowledgement then skips it (it's pending again once redelivered)
+func (s *stompSubscription) dropPending(id MessageID) {
+	if s.AckMode != stompAckClient {
+		return
+	}
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	for i, pid := range s.pending {
+		if pid == id {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *stompSubscription) exit() {
+	s.exitOnce.Do(func() {
+		close(s.ExitChan)
+	})
+}
+
+func (s *stompSubscription) UnPause() {
+	s.tryUpdateReadyState()
+}
+
+func (s *stompSubscription) Pause() {
+	s.tryUpdateReadyState()
+}
+
+func (s *stompSubscription) Close() error {
+	return s.client.Close()
+}
+
+func (s *stompSubscription) TimedOutMessage(id MessageID) {
+	s.dropPending(id)
+	atomic.AddInt64(&s.InFlightCount, -1)
+	s.tryUpdateReadyState()
+}
+
+func (s *stompSubscription) Empty() {
+	atomic.StoreInt64(&s.InFlightCount, 0)
+	s.pendingLock.Lock()
+	s.pending = nil
+	s.pendingLock.Unlock()
+	s.tryUpdateReadyState()
+}
+
+func (s *stompSubscription) Stats(topicName string) ClientStats {
+	stats := s.client.baseStats(nil)
+	stats.State = stateSubscribed
+	stats.ReadyCount = atomic.LoadInt64(&s.ReadyCount)
+	stats.InFlightCount = atomic.LoadInt64(&s.InFlightCount)
+	stats.MessageCount = atomic.LoadUint64(&s.MessageCount)
+	stats.FinishCount = atomic.LoadUint64(&s.FinishCount)
+	stats.RequeueCount = atomic.LoadUint64(&s.RequeueCount)
+	return stats
+}
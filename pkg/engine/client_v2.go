@@ -466,7 +466,7 @@ func (c *clientV2) PublishedMessage(topic string, count uint64) {
 	c.metaLock.Unlock()
 }
 
-func (c *clientV2) TimedOutMessage() {
+func (c *clientV2) TimedOutMessage(id MessageID) {
 	atomic.AddInt64(&c.InFlightCount, -1)
 	c.tryUpdateReadyState()
 }
@@ -0,0 +1,217 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errDiskFull = errors.New("disk usage of the data path is above the high watermark")
+
+// diskUsage is the usage of the filesystem holding the data path
+type diskUsage struct {
+	TotalBytes uint64 `json:"total_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"` // available to emsd
+}
+
+// usedPercent is the used share of the space available to emsd, like df(1)
+func (u diskUsage) usedPercent() float64 {
+	if u.UsedBytes+u.FreeBytes == 0 {
+		return 0
+	}
+	return 100 * float64(u.UsedBytes) / float64(u.UsedBytes+u.FreeBytes)
+}
+
+// DiskStats is the state of the data path's filesystem, as last checked
+type DiskStats struct {
+	DataPath      string  `json:"data_path"`
+	TotalBytes    uint64  `json:"total_bytes"`
+	UsedBytes     uint64  `json:"used_bytes"`
+	FreeBytes     uint64  `json:"free_bytes"`
+	UsedPercent   float64 `json:"used_percent"`
+	HighWatermark float64 `json:"high_watermark"`
+	LowWatermark  float64 `json:"low_watermark"`
+	Full          bool    `json:"full"`
+	PausedTopics  int     `json:"paused_topics"`
+}
+
+// GetDiskStats returns the usage of the data path's filesystem, measured now
+// if it isn't being watched
+func (n *EMSD) GetDiskStats() DiskStats {
+	opts := n.getOpts()
+	usage, ok := n.diskUsage.Load().(diskUsage)
+	if !ok {
+		usage, _ = getDiskUsage(opts.DataPath)
+	}
+	n.diskMtx.Lock()
+	pausedTopics := len(n.diskPausedTopics)
+	n.diskMtx.Unlock()
+	return DiskStats{
+		DataPath:      opts.DataPath,
+		TotalBytes:    usage.TotalBytes,
+		UsedBytes:     usage.UsedBytes,
+		FreeBytes:     usage.FreeBytes,
+		UsedPercent:   usage.usedPercent(),
+		HighWatermark: opts.DiskHighWatermark,
+		LowWatermark:  opts.DiskLowWatermark,
+		Full:          n.isDiskFull(),
+		PausedTopics:  pausedTopics,
+	}
+}
+
+func (n *EMSD) isDiskFull() bool {
+	return atomic.LoadInt32(&n.diskFull) == 1
+}
+
+// diskWatchLoop checks the usage of the data path's filesystem every
+// --disk-check-interval against the watermarks
+func (n *EMSD) diskWatchLoop() {
+	ticker := time.NewTicker(n.getOpts().DiskCheckInterval)
+	for {
+		n.checkDiskUsage()
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "DISKWATCH: closing")
+	ticker.Stop()
+}
+
+// checkDiskUsage handles crossing the watermarks, above the high watermark
+// publishes to the topics in --disk-full-pause-topic are rejected, one entry
+// per check in the order given, and once there are none left (or none were
+// given) publishes to all disk backed topics are. Below the low watermark
+// publishes are accepted again.
+func (n *EMSD) checkDiskUsage() {
+	opts := n.getOpts()
+	usage, err := getDiskUsage(opts.DataPath)
+	if err != nil {
+		n.logf(LOG_ERROR, "DISKWATCH: failed to get disk usage of %s - %s", opts.DataPath, err)
+		return
+	}
+	n.diskUsage.Store(usage)
+
+	used := usage.usedPercent()
+	switch {
+	case used >= opts.DiskHighWatermark:
+		if n.pauseNextDiskTopics() {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&n.diskFull, 0, 1) {
+			n.logf(LOG_WARN, "DISKWATCH: %s is %.1f%% used (--disk-high-watermark=%.1f), rejecting publishes to disk backed topics",
+				opts.DataPath, used, opts.DiskHighWatermark)
+		}
+	case used <= opts.DiskLowWatermark:
+		if atomic.CompareAndSwapInt32(&n.diskFull, 1, 0) {
+			n.logf(LOG_INFO, "DISKWATCH: %s is %.1f%% used (--disk-low-watermark=%.1f), accepting publishes again",
+				opts.DataPath, used, opts.DiskLowWatermark)
+		}
+		n.unpauseDiskTopics()
+	}
+}
+
+// pauseNextDiskTopics rejects publishes to the topics matching the next entry
+// of --disk-full-pause-topic, it returns false once every entry was applied
+func (n *EMSD) pauseNextDiskTopics() bool {
+	patterns := n.getOpts().DiskFullPauseTopics
+
+	n.diskMtx.Lock()
+	if n.diskPauseLevel >= len(patterns) {
+		n.diskMtx.Unlock()
+		return false
+	}
+	pattern := patterns[n.diskPauseLevel]
+	n.diskPauseLevel++
+
+	n.RLock()
+	var topics []*Topic
+	for _, t := range n.topicMap {
+		if topicMatches(pattern, t.name) && !n.diskPausedTopics[t.name] {
+			topics = append(topics, t)
+		}
+	}
+	n.RUnlock()
+
+	for _, t := range topics {
+		n.logf(LOG_WARN, "DISKWATCH: rejecting publishes to topic %s (%s)", t.name, pattern)
+		atomic.StoreInt32(&t.diskFull, 1)
+		n.diskPausedTopics[t.name] = true
+	}
+	n.diskMtx.Unlock()
+
+	if len(topics) > 0 {
+		n.persistDiskTopics()
+	}
+	return true
+}
+
+// unpauseDiskTopics accepts publishes again to the topics rejected by
+// pauseNextDiskTopics
+func (n *EMSD) unpauseDiskTopics() {
+	n.diskMtx.Lock()
+	changed := len(n.diskPausedTopics) > 0
+	for topicName := range n.diskPausedTopics {
+		t, err := n.GetExistingTopic(topicName)
+		if err == nil {
+			n.logf(LOG_INFO, "DISKWATCH: accepting publishes to topic %s again", topicName)
+			atomic.StoreInt32(&t.diskFull, 0)
+		}
+		delete(n.diskPausedTopics, topicName)
+	}
+	n.diskPauseLevel = 0
+	n.diskMtx.Unlock()
+
+	if changed {
+		n.persistDiskTopics()
+	}
+}
+
+// persistDiskTopics persists the metadata so that the topics rejecting
+// publishes still do after a restart, until the usage falls below the low
+// watermark
+func (n *EMSD) persistDiskTopics() {
+	n.Lock()
+	err := n.PersistMetadata()
+	if err != nil {
+		n.logf(LOG_ERROR, "failed to persist metadata - %s", err)
+	}
+	n.Unlock()
+}
+
+// restoreDiskTopic rejects publishes to a topic that did before a restart,
+// unless the disk usage isn't watched anymore
+func (n *EMSD) restoreDiskTopic(t *Topic) {
+	if n.getOpts().DiskHighWatermark <= 0 {
+		n.logf(LOG_INFO, "DISKWATCH: accepting publishes to topic %s, --disk-high-watermark is disabled", t.name)
+		return
+	}
+	n.diskMtx.Lock()
+	atomic.StoreInt32(&t.diskFull, 1)
+	n.diskPausedTopics[t.name] = true
+	n.diskMtx.Unlock()
+}
@@ -0,0 +1,165 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+// setDiskWatermarks swaps in watermarks relative to the measured usage of the
+// data path so that tests don't depend on how full the disk is
+func setDiskWatermarks(t *testing.T, emsd *EMSD, full bool, pauseTopics ...string) {
+	usage, err := getDiskUsage(emsd.getOpts().DataPath)
+	test.Nil(t, err)
+	used := usage.usedPercent()
+
+	opts := *emsd.getOpts()
+	if full {
+		opts.DiskHighWatermark = used / 2
+		opts.DiskLowWatermark = used / 4
+	} else {
+		opts.DiskHighWatermark = 100
+		opts.DiskLowWatermark = 100
+	}
+	opts.DiskFullPauseTopics = pauseTopics
+	emsd.swapOpts(&opts)
+	emsd.checkDiskUsage()
+}
+
+func TestDiskFullRejectsPublishes(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TopicBackendQueues = []string{"memory_topic=memory"}
+	_, httpAddr, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	diskTopic := emsd.GetTopic("disk_topic")
+	memoryTopic := emsd.GetTopic("memory_topic")
+	ephemeralTopic := emsd.GetTopic("ephemeral_topic#ephemeral")
+
+	setDiskWatermarks(t, emsd, true)
+	test.Equal(t, true, emsd.GetDiskStats().Full)
+
+	msg := NewMessage(diskTopic.GenerateID(), []byte("test"))
+	test.Equal(t, errDiskFull, diskTopic.PutMessage(msg))
+	test.Equal(t, errDiskFull, diskTopic.PutMessages([]*Message{msg}))
+	test.Nil(t, memoryTopic.PutMessage(NewMessage(memoryTopic.GenerateID(), []byte("test"))))
+	test.Nil(t, ephemeralTopic.PutMessage(NewMessage(ephemeralTopic.GenerateID(), []byte("test"))))
+
+	url := fmt.Sprintf("http://%s/pub?topic=disk_topic", httpAddr)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 507, resp.StatusCode)
+
+	setDiskWatermarks(t, emsd, false)
+	test.Equal(t, false, emsd.GetDiskStats().Full)
+	test.Nil(t, diskTopic.PutMessage(NewMessage(diskTopic.GenerateID(), []byte("test"))))
+}
+
+func TestDiskFullPausesTopicsInOrder(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = t.TempDir()
+	// not started so diskWatchLoop doesn't check concurrently
+	emsd, err := New(opts)
+	test.Nil(t, err)
+
+	logsA := emsd.GetTopic("logs_a")
+	logsB := emsd.GetTopic("logs_b")
+	metrics := emsd.GetTopic("metrics")
+	orders := emsd.GetTopic("orders")
+	put := func(topic *Topic) error {
+		return topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+
+	setDiskWatermarks(t, emsd, true, "logs_*", "metrics")
+	test.Equal(t, errDiskFull, put(logsA))
+	test.Equal(t, errDiskFull, put(logsB))
+	test.Nil(t, put(metrics))
+	test.Equal(t, false, emsd.isDiskFull())
+	// only publishes are rejected, delivery goes on
+	test.Equal(t, false, logsA.IsPaused())
+
+	emsd.checkDiskUsage()
+	test.Equal(t, errDiskFull, put(metrics))
+	test.Nil(t, put(orders))
+	test.Equal(t, false, emsd.isDiskFull())
+	test.Equal(t, 3, emsd.GetDiskStats().PausedTopics)
+
+	emsd.checkDiskUsage()
+	test.Equal(t, true, emsd.isDiskFull())
+	test.Equal(t, errDiskFull, put(orders))
+
+	// the topics still reject publishes after a restart, until the usage
+	// falls below the low watermark
+	emsd.Exit()
+	opts.DiskHighWatermark = 100
+	emsd, err = New(opts)
+	test.Nil(t, err)
+	defer emsd.Exit()
+	test.Nil(t, emsd.LoadMetadata())
+	logsA, _ = emsd.GetExistingTopic("logs_a")
+	metrics, _ = emsd.GetExistingTopic("metrics")
+	orders, _ = emsd.GetExistingTopic("orders")
+	test.Equal(t, errDiskFull, put(logsA))
+	test.Equal(t, errDiskFull, put(metrics))
+	test.Nil(t, put(orders))
+	test.Equal(t, false, logsA.IsPaused())
+	test.Equal(t, 3, emsd.GetDiskStats().PausedTopics)
+
+	setDiskWatermarks(t, emsd, false, "logs_*", "metrics")
+	test.Nil(t, put(logsA))
+	test.Nil(t, put(metrics))
+	test.Equal(t, 0, emsd.GetDiskStats().PausedTopics)
+}
+
+func TestDiskUsageStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("disk_usage_stats")
+	topic.GetChannel("ch")
+	for i := 0; i < 10; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	waitForDepth(t, topic.GetChannel("ch"), 10)
+
+	stats := emsd.GetStats("disk_usage_stats", "", false)
+	test.Equal(t, 1, len(stats.Topics))
+	test.Equal(t, true, stats.Topics[0].DiskBytes > 0)
+	test.Equal(t, true, stats.Topics[0].Channels[0].DiskBytes > 0)
+
+	disk := emsd.GetDiskStats()
+	test.Equal(t, opts.DataPath, disk.DataPath)
+	test.Equal(t, true, disk.TotalBytes > 0)
+}
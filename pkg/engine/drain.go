@@ -0,0 +1,337 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	emsctl "github.com/bhojpur/ems/pkg/client"
+)
+
+var errDraining = errors.New("emsd is draining, publish to another node")
+
+// drain phases, in order
+const (
+	drainPhaseUnregistering = "unregistering"
+	drainPhaseWaiting       = "waiting"
+	drainPhaseForwarding    = "forwarding"
+	drainPhaseExiting       = "exiting"
+)
+
+// drainChannelName is the ephemeral channel used to forward the backlog of
+// topics which have no channels
+const drainChannelName = "drain#ephemeral"
+
+// forwarding the backlog is retried with exponential backoff between these
+// intervals until it succeeds or emsd is stopped
+const (
+	drainRetryInterval    = time.Second
+	drainMaxRetryInterval = time.Minute
+)
+
+// DrainStats is the progress of draining emsd
+type DrainStats struct {
+	Phase          string `json:"phase"`
+	StartTime      int64  `json:"start_time"`
+	ForwardAddress string `json:"forward_address,omitempty"`
+	Depth          int64  `json:"depth"`
+	InFlightCount  int    `json:"in_flight_count"`
+	DeferredCount  int    `json:"deferred_count"`
+	ForwardedCount uint64 `json:"forwarded_count"`
+	Error          string `json:"error,omitempty"`
+}
+
+func (n *EMSD) isDraining() bool {
+	return atomic.LoadInt32(&n.draining) == 1
+}
+
+// GetDrainStats returns the progress of draining emsd, or nil if it isn't
+func (n *EMSD) GetDrainStats() *DrainStats {
+	n.drainMtx.Lock()
+	defer n.drainMtx.Unlock()
+	if n.drainStats == nil {
+		return nil
+	}
+	stats := *n.drainStats
+	return &stats
+}
+
+func (n *EMSD) updateDrainStats(f func(*DrainStats)) {
+	n.drainMtx.Lock()
+	f(n.drainStats)
+	n.drainMtx.Unlock()
+}
+
+// Drain retires emsd, publishes are rejected with a retryable error, every
+// topic is unregistered from lookupd and once channels are empty (or after
+// timeout, when the remaining backlog is forwarded to forwardAddress if
+// given, retrying with backoff until it succeeds) emsd exits. Forwarding
+// errors are reported in the drain stats. Empty arguments default to --drain-forward-address and
+// --drain-timeout.
+func (n *EMSD) Drain(forwardAddress string, timeout time.Duration) error {
+	opts := n.getOpts()
+	if forwardAddress == "" {
+		forwardAddress = opts.DrainForwardAddress
+	}
+	if timeout <= 0 {
+		timeout = opts.DrainTimeout
+	}
+	if !atomic.CompareAndSwapInt32(&n.draining, 0, 1) {
+		return errors.New("already draining")
+	}
+
+	n.logf(LOG_INFO, "DRAIN: draining (timeout %s, forward address %q)", timeout, forwardAddress)
+	n.drainMtx.Lock()
+	n.drainStats = &DrainStats{
+		Phase:          drainPhaseUnregistering,
+		StartTime:      time.Now().Unix(),
+		ForwardAddress: forwardAddress,
+	}
+	n.drainMtx.Unlock()
+
+	// not part of n.waitGroup, it ends by calling Exit()
+	go n.drainLoop(forwardAddress, timeout)
+	return nil
+}
+
+func (n *EMSD) drainLoop(forwardAddress string, timeout time.Duration) {
+	done := make(lookupdUnregisterAll)
+	select {
+	case n.notifyChan <- done:
+	case <-n.exitChan:
+		return
+	}
+	select {
+	case <-done:
+	case <-n.exitChan:
+		return
+	}
+
+	n.updateDrainStats(func(s *DrainStats) { s.Phase = drainPhaseWaiting })
+	n.logf(LOG_INFO, "DRAIN: waiting up to %s for channels to empty", timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.Now().Add(timeout)
+	for !n.updateDrainProgress() && time.Now().Before(deadline) {
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			return
+		}
+	}
+
+	if !n.updateDrainProgress() {
+		if forwardAddress == "" {
+			stats := n.GetDrainStats()
+			n.logf(LOG_WARN, "DRAIN: exiting with %d messages (%d in-flight, %d deferred) left in the data path",
+				stats.Depth, stats.InFlightCount, stats.DeferredCount)
+		} else {
+			n.updateDrainStats(func(s *DrainStats) { s.Phase = drainPhaseForwarding })
+			n.logf(LOG_INFO, "DRAIN: forwarding remaining messages to %s", forwardAddress)
+			retryInterval := drainRetryInterval
+			for {
+				err := n.drainForward(forwardAddress, ticker)
+				if err == nil {
+					n.updateDrainStats(func(s *DrainStats) { s.Error = "" })
+					break
+				}
+				n.logf(LOG_ERROR, "DRAIN: failed to forward messages to %s - %s, retrying in %s",
+					forwardAddress, err, retryInterval)
+				n.updateDrainStats(func(s *DrainStats) { s.Error = err.Error() })
+				select {
+				case <-time.After(retryInterval):
+				case <-n.exitChan:
+					return
+				}
+				retryInterval *= 2
+				if retryInterval > drainMaxRetryInterval {
+					retryInterval = drainMaxRetryInterval
+				}
+			}
+		}
+	}
+
+	n.updateDrainStats(func(s *DrainStats) { s.Phase = drainPhaseExiting })
+	n.logf(LOG_INFO, "DRAIN: done, exiting")
+	n.Exit()
+}
+
+// updateDrainProgress counts the messages left in topics and channels, it
+// returns true once there are none
+func (n *EMSD) updateDrainProgress() bool {
+	var depth int64
+	var inFlight, deferred int
+	for _, t := range n.drainTopics() {
+		depth += t.Depth()
+		for _, c := range t.drainChannels() {
+			depth += c.Depth()
+			c.inFlightMutex.Lock()
+			inFlight += len(c.inFlightMessages)
+			c.inFlightMutex.Unlock()
+			c.deferredMutex.Lock()
+			deferred += len(c.deferredMessages)
+			c.deferredMutex.Unlock()
+		}
+	}
+	n.updateDrainStats(func(s *DrainStats) {
+		s.Depth = depth
+		s.InFlightCount = inFlight
+		s.DeferredCount = deferred
+	})
+	return depth == 0 && inFlight == 0 && deferred == 0
+}
+
+func (n *EMSD) drainTopics() []*Topic {
+	n.RLock()
+	defer n.RUnlock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	return topics
+}
+
+func (t *Topic) drainChannels() []*Channel {
+	t.RLock()
+	defer t.RUnlock()
+	channels := make([]*Channel, 0, len(t.channelMap))
+	for _, c := range t.channelMap {
+		channels = append(channels, c)
+	}
+	return channels
+}
+
+// drainForward publishes every remaining message to the same topic on another
+// emsd until none are left, channels are paused so that consumers don't get
+// them as well. A message left in several channels of a topic is published
+// once, channels which had already processed it on the other node would get
+// it again.
+func (n *EMSD) drainForward(forwardAddress string, ticker *time.Ticker) error {
+	cfg := emsctl.NewConfig()
+	producer, err := emsctl.NewProducer(forwardAddress, cfg)
+	if err != nil {
+		return err
+	}
+	defer producer.Stop()
+	producer.SetLogger(n.getOpts().Logger, emsctl.LogLevelWarning)
+
+	forwarded := make(map[string]map[MessageID]bool)
+	for {
+		for _, t := range n.drainTopics() {
+			if t.IsPaused() {
+				// the backlog of a paused topic is forwarded as well
+				t.UnPause()
+			}
+			channels := t.drainChannels()
+			if len(channels) == 0 && t.Depth() > 0 {
+				// the topic only passes messages on to channels
+				channels = append(channels, t.GetChannel(drainChannelName))
+			}
+			if forwarded[t.name] == nil {
+				forwarded[t.name] = make(map[MessageID]bool)
+			}
+			for _, c := range channels {
+				err := n.drainForwardChannel(producer, c, forwarded[t.name])
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// in-flight messages are forwarded once they time out
+		if n.updateDrainProgress() {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			return errors.New("exiting")
+		}
+	}
+}
+
+// drainForwardChannel publishes the deferred and queued messages of a channel
+func (n *EMSD) drainForwardChannel(producer *emsctl.Producer, c *Channel, forwarded map[MessageID]bool) error {
+	c.Pause()
+
+	publish := func(msg *Message, delay time.Duration) error {
+		if forwarded[msg.ID] {
+			return nil
+		}
+		var err error
+		if delay > 0 {
+			err = producer.DeferredPublish(c.topicName, delay, msg.Body)
+		} else {
+			err = producer.Publish(c.topicName, msg.Body)
+		}
+		if err != nil {
+			return err
+		}
+		forwarded[msg.ID] = true
+		n.updateDrainStats(func(s *DrainStats) { s.ForwardedCount++ })
+		return nil
+	}
+
+	items := c.takeDeferredMessages()
+	for i, item := range items {
+		msg := item.Value.(*Message)
+		delay := time.Until(time.Unix(0, item.Priority))
+		err := publish(msg, delay)
+		if err != nil {
+			// put back what wasn't forwarded
+			for _, item := range items[i:] {
+				msg := item.Value.(*Message)
+				c.StartDeferredTimeout(msg, time.Until(time.Unix(0, item.Priority)))
+			}
+			return fmt.Errorf("failed to forward deferred message - %s", err)
+		}
+	}
+
+	idle := time.NewTimer(100 * time.Millisecond)
+	defer idle.Stop()
+	for {
+		var msg *Message
+		select {
+		case msg = <-c.memoryMsgChan:
+		case buf := <-c.backend.ReadChan():
+			var err error
+			msg, err = decodeMessage(buf)
+			if err != nil {
+				n.logf(LOG_ERROR, "DRAIN: failed to decode message - %s", err)
+				continue
+			}
+		case <-idle.C:
+			return nil
+		}
+		err := publish(msg, 0)
+		if err != nil {
+			c.put(msg)
+			return fmt.Errorf("failed to forward message - %s", err)
+		}
+		if !idle.Stop() {
+			<-idle.C
+		}
+		idle.Reset(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,170 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func waitForExit(t *testing.T, emsd *EMSD) {
+	select {
+	case <-emsd.exitChan:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for emsd to exit")
+	}
+}
+
+func TestDrainEmpty(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("drain_empty")
+	topic.GetChannel("ch")
+	test.Equal(t, true, emsd.GetDrainStats() == nil)
+
+	test.Nil(t, emsd.Drain("", time.Minute))
+	test.NotNil(t, emsd.Drain("", time.Minute))
+	test.Equal(t, errDraining, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Equal(t, errDraining, topic.PutMessages([]*Message{NewMessage(topic.GenerateID(), []byte("test"))}))
+
+	waitForExit(t, emsd)
+	test.Equal(t, drainPhaseExiting, emsd.GetDrainStats().Phase)
+}
+
+func TestDrainTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("drain_timeout")
+	channel := topic.GetChannel("ch")
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	waitForDepth(t, channel, 1)
+
+	test.Nil(t, emsd.Drain("", 200*time.Millisecond))
+	waitForExit(t, emsd)
+
+	stats := emsd.GetDrainStats()
+	test.Equal(t, drainPhaseExiting, stats.Phase)
+	test.Equal(t, int64(1), stats.Depth)
+	test.Equal(t, uint64(0), stats.ForwardedCount)
+}
+
+func TestDrainForward(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	targetOpts := NewOptions()
+	targetOpts.Logger = test.NewTestLogger(t)
+	targetTCPAddr, _, target := mustStartEMSD(targetOpts)
+	defer os.RemoveAll(targetOpts.DataPath)
+	defer target.Exit()
+
+	// the same message queued in two channels is forwarded once
+	topic := emsd.GetTopic("drain_forward")
+	ch1 := topic.GetChannel("ch1")
+	ch2 := topic.GetChannel("ch2")
+	for i := 0; i < 3; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	waitForDepth(t, ch1, 3)
+	waitForDepth(t, ch2, 3)
+	msg := NewMessage(topic.GenerateID(), []byte("deferred"))
+	ch1.StartDeferredTimeout(msg, time.Hour)
+
+	// a topic without channels keeps its messages
+	paused := emsd.GetTopic("drain_forward_paused")
+	paused.Pause()
+	test.Nil(t, paused.PutMessage(NewMessage(paused.GenerateID(), []byte("test"))))
+
+	test.Nil(t, emsd.Drain(targetTCPAddr.String(), 100*time.Millisecond))
+	waitForExit(t, emsd)
+
+	stats := emsd.GetDrainStats()
+	test.Equal(t, drainPhaseExiting, stats.Phase)
+	test.Equal(t, "", stats.Error)
+	test.Equal(t, uint64(5), stats.ForwardedCount)
+
+	test.Equal(t, int64(4), target.GetTopic("drain_forward").Depth())
+	test.Equal(t, int64(1), target.GetTopic("drain_forward_paused").Depth())
+}
+
+func TestDrainForwardRetry(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	// reserve an address with nothing listening on it yet
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	targetAddr := listener.Addr().String()
+	listener.Close()
+
+	topic := emsd.GetTopic("drain_forward_retry")
+	channel := topic.GetChannel("ch")
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	waitForDepth(t, channel, 1)
+
+	test.Nil(t, emsd.Drain(targetAddr, 100*time.Millisecond))
+	deadline := time.Now().Add(5 * time.Second)
+	for emsd.GetDrainStats().Error == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the forwarding error")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := emsd.GetDrainStats()
+	test.Equal(t, drainPhaseForwarding, stats.Phase)
+	test.Equal(t, int64(1), stats.Depth)
+
+	// forwarding is retried once the target is up
+	targetOpts := NewOptions()
+	targetOpts.Logger = test.NewTestLogger(t)
+	targetOpts.TCPAddress = targetAddr
+	targetOpts.HTTPAddress = "127.0.0.1:0"
+	targetOpts.DataPath = t.TempDir()
+	target, err := New(targetOpts)
+	test.Nil(t, err)
+	go target.Main()
+	defer target.Exit()
+
+	waitForExit(t, emsd)
+	stats = emsd.GetDrainStats()
+	test.Equal(t, drainPhaseExiting, stats.Phase)
+	test.Equal(t, "", stats.Error)
+	test.Equal(t, uint64(1), stats.ForwardedCount)
+	test.Equal(t, int64(1), target.GetTopic("drain_forward_retry").Depth())
+}
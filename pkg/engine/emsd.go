@@ -33,6 +33,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -41,6 +42,7 @@ import (
 	"github.com/bhojpur/ems/pkg/core/clusterinfo"
 	"github.com/bhojpur/ems/pkg/core/dirlock"
 	"github.com/bhojpur/ems/pkg/core/http_api"
+	"github.com/bhojpur/ems/pkg/core/keyring"
 	"github.com/bhojpur/ems/pkg/core/protocol"
 	"github.com/bhojpur/ems/pkg/core/statsd"
 	"github.com/bhojpur/ems/pkg/core/util"
@@ -82,7 +84,32 @@ type EMSD struct {
 	tcpListener   net.Listener
 	httpListener  net.Listener
 	httpsListener net.Listener
+	stompServer   *stompServer
+	stompListener net.Listener
+	kafkaServer   *kafkaServer
+	kafkaListener net.Listener
 	tlsConfig     *tls.Config
+	keyring       *keyring.Keyring
+
+	lookupdTLSConfig *tls.Config
+
+	diskFull         int32
+	diskUsage        atomic.Value // diskUsage
+	diskMtx          sync.Mutex
+	diskPauseLevel   int
+	diskPausedTopics map[string]bool
+
+	snapshotMtx  sync.Mutex
+	lastSnapshot []byte
+
+	draining   int32
+	drainMtx   sync.Mutex
+	drainStats *DrainStats
+
+	replicaMtx     sync.RWMutex
+	replicaLeaders map[string]string // replica topics, to the HTTP address of their leader
+
+	assignedNodeID *metaNodeID // guarded by the EMSD lock
 
 	poolSize int
 
@@ -91,7 +118,8 @@ type EMSD struct {
 	exitChan             chan int
 	waitGroup            util.WaitGroupWrapper
 
-	ci *clusterinfo.ClusterInfo
+	httpcli *http_api.Client
+	ci      *clusterinfo.ClusterInfo
 }
 
 func New(opts *Options) (*EMSD, error) {
@@ -113,10 +141,12 @@ func New(opts *Options) (*EMSD, error) {
 		notifyChan:           make(chan interface{}),
 		optsNotificationChan: make(chan struct{}, 1),
 		dl:                   dirlock.New(dataPath),
+		diskPausedTopics:     make(map[string]bool),
+		replicaLeaders:       make(map[string]string),
 	}
 	n.ctx, n.ctxCancel = context.WithCancel(context.Background())
-	httpcli := http_api.NewClient(nil, opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
-	n.ci = clusterinfo.New(n.logf, httpcli)
+	n.httpcli = http_api.NewClient(nil, opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
+	n.ci = clusterinfo.New(n.logf, n.httpcli)
 
 	n.lookupPeers.Store([]*lookupPeer{})
 
@@ -136,6 +166,26 @@ func New(opts *Options) (*EMSD, error) {
 		return nil, errors.New("--node-id must be [0,1024)")
 	}
 
+	err = validateBackendQueueOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateReplicationOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = parseLabels(opts.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("--label %s", err)
+	}
+
+	n.keyring, err = loadKeyring(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	if opts.TLSClientAuthPolicy != "" && opts.TLSRequired == TLSNotRequired {
 		opts.TLSRequired = TLSRequired
 	}
@@ -149,6 +199,16 @@ func New(opts *Options) (*EMSD, error) {
 	}
 	n.tlsConfig = tlsConfig
 
+	n.lookupdTLSConfig, err = buildLookupdTLSConfig(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build lookupd TLS config - %s", err)
+	}
+
+	// Kafka clients authenticate with SASL which is not supported
+	if opts.KafkaAddress != "" && len(opts.AuthHTTPAddresses) != 0 {
+		return nil, errors.New("--kafka-address cannot be used with --auth-http-address")
+	}
+
 	for _, v := range opts.E2EProcessingLatencyPercentiles {
 		if v <= 0 || v > 1 {
 			return nil, fmt.Errorf("invalid E2E processing latency percentile: %v", v)
@@ -175,6 +235,26 @@ func New(opts *Options) (*EMSD, error) {
 			return nil, fmt.Errorf("listen (%s) failed - %s", opts.HTTPSAddress, err)
 		}
 	}
+	if opts.STOMPAddress != "" {
+		n.stompServer = &stompServer{emsd: n}
+		n.stompListener, err = net.Listen("tcp", opts.STOMPAddress)
+		if err != nil {
+			return nil, fmt.Errorf("listen (%s) failed - %s", opts.STOMPAddress, err)
+		}
+		if n.tlsConfig != nil && opts.TLSRequired != TLSNotRequired {
+			n.stompListener = tls.NewListener(n.stompListener, n.tlsConfig)
+		}
+	}
+	if opts.KafkaAddress != "" {
+		n.kafkaServer = &kafkaServer{emsd: n}
+		n.kafkaListener, err = net.Listen("tcp", opts.KafkaAddress)
+		if err != nil {
+			return nil, fmt.Errorf("listen (%s) failed - %s", opts.KafkaAddress, err)
+		}
+		if n.tlsConfig != nil && opts.TLSRequired != TLSNotRequired {
+			n.kafkaListener = tls.NewListener(n.kafkaListener, n.tlsConfig)
+		}
+	}
 	if opts.BroadcastHTTPPort == 0 {
 		opts.BroadcastHTTPPort = n.RealHTTPAddr().Port
 	}
@@ -233,6 +313,20 @@ func (n *EMSD) RealHTTPSAddr() *net.TCPAddr {
 	return n.httpsListener.Addr().(*net.TCPAddr)
 }
 
+func (n *EMSD) RealSTOMPAddr() *net.TCPAddr {
+	if n.stompListener == nil {
+		return &net.TCPAddr{}
+	}
+	return n.stompListener.Addr().(*net.TCPAddr)
+}
+
+func (n *EMSD) RealKafkaAddr() *net.TCPAddr {
+	if n.kafkaListener == nil {
+		return &net.TCPAddr{}
+	}
+	return n.kafkaListener.Addr().(*net.TCPAddr)
+}
+
 func (n *EMSD) SetHealth(err error) {
 	n.errValue.Store(errStore{err: err})
 }
@@ -286,8 +380,24 @@ func (n *EMSD) Main() error {
 		})
 	}
 
+	if n.stompListener != nil {
+		n.waitGroup.Wrap(func() {
+			exitFunc(protocol.TCPServer(n.stompListener, n.stompServer, n.logf))
+		})
+	}
+
+	if n.kafkaListener != nil {
+		n.waitGroup.Wrap(func() {
+			exitFunc(protocol.TCPServer(n.kafkaListener, n.kafkaServer, n.logf))
+		})
+	}
+
 	n.waitGroup.Wrap(n.queueScanLoop)
 	n.waitGroup.Wrap(n.lookupLoop)
+	n.waitGroup.Wrap(n.rateLoop)
+	if n.getOpts().DiskHighWatermark > 0 {
+		n.waitGroup.Wrap(n.diskWatchLoop)
+	}
 	if n.getOpts().StatsdAddress != "" {
 		n.waitGroup.Wrap(n.statsdLoop)
 	}
@@ -297,14 +407,38 @@ func (n *EMSD) Main() error {
 }
 
 type meta struct {
-	Topics []struct {
-		Name     string `json:"name"`
-		Paused   bool   `json:"paused"`
-		Channels []struct {
-			Name   string `json:"name"`
-			Paused bool   `json:"paused"`
-		} `json:"channels"`
-	} `json:"topics"`
+	Version string      `json:"version"`
+	Topics  []metaTopic `json:"topics"`
+	NodeID  *metaNodeID `json:"node_id,omitempty"`
+}
+
+// metaNodeID is the node ID lookupd assigned in place of --node-id
+type metaNodeID struct {
+	Configured int64 `json:"configured"` // the --node-id it replaces
+	Assigned   int64 `json:"assigned"`
+}
+
+type metaTopic struct {
+	Name      string        `json:"name"`
+	Paused    bool          `json:"paused"`
+	DiskFull  bool          `json:"disk_full,omitempty"` // from --disk-full-pause-topic
+	MigrateTo string        `json:"migrate_to,omitempty"`
+	Leader    string        `json:"leader,omitempty"`
+	Channels  []metaChannel `json:"channels"`
+}
+
+type metaChannel struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused"`
+}
+
+// dropLocalState clears the state that belongs to the node the metadata was
+// persisted by, its node ID and disk usage
+func (m *meta) dropLocalState() {
+	m.NodeID = nil
+	for i := range m.Topics {
+		m.Topics[i].DiskFull = false
+	}
 }
 
 func newMetadataFile(opts *Options) string {
@@ -349,20 +483,65 @@ func (n *EMSD) LoadMetadata() error {
 		return nil // fresh start
 	}
 
+	data, err = openMetadata(n.keyring, fn, data)
+	if err != nil {
+		return err
+	}
+
 	var m meta
 	err = json.Unmarshal(data, &m)
 	if err != nil {
 		return fmt.Errorf("failed to parse metadata in %s - %s", fn, err)
 	}
 
+	if m.NodeID != nil {
+		n.loadNodeID(m.NodeID)
+	}
+	n.applyMetadata(&m)
+	return nil
+}
+
+// loadNodeID switches to the node ID lookupd assigned before a restart, unless
+// --node-id changed since
+func (n *EMSD) loadNodeID(m *metaNodeID) {
+	n.Lock()
+	defer n.Unlock()
+	opts := *n.getOpts()
+	if opts.ID != m.Configured {
+		n.logf(LOG_INFO, "ID: dropping node ID %d assigned by lookupd in place of %d, --node-id is now %d",
+			m.Assigned, m.Configured, opts.ID)
+		return
+	}
+	n.logf(LOG_INFO, "ID: %d (assigned by lookupd in place of %d)", m.Assigned, m.Configured)
+	opts.ID = m.Assigned
+	n.swapOpts(&opts)
+	n.assignedNodeID = m
+	for _, t := range n.topicMap {
+		t.idFactory.setNodeID(m.Assigned)
+	}
+}
+
+// applyMetadata creates the topics and channels in m (which may already
+// exist) and sets their paused state
+func (n *EMSD) applyMetadata(m *meta) {
 	for _, t := range m.Topics {
 		if !protocol.IsValidTopicName(t.Name) {
 			n.logf(LOG_WARN, "skipping creation of invalid topic %s", t.Name)
 			continue
 		}
+		if t.Leader != "" {
+			n.replicaMtx.Lock()
+			n.replicaLeaders[t.Name] = t.Leader
+			n.replicaMtx.Unlock()
+		}
 		topic := n.GetTopic(t.Name)
-		if t.Paused {
+		if t.DiskFull {
+			n.restoreDiskTopic(topic)
+		}
+		if t.Paused && !topic.IsPaused() {
 			topic.Pause()
+		} else if !t.Paused && topic.IsPaused() {
+			topic.UnPause()
 		}
 		for _, c := range t.Channels {
 			if !protocol.IsValidChannelName(c.Name) {
@@ -370,58 +549,75 @@ func (n *EMSD) LoadMetadata() error {
 				continue
 			}
 			channel := topic.GetChannel(c.Name)
-			if c.Paused {
+			if c.Paused && !channel.IsPaused() {
 				channel.Pause()
+			} else if !c.Paused && channel.IsPaused() {
+				channel.UnPause()
 			}
 		}
 		topic.Start()
+		if t.MigrateTo != "" {
+			topic.Migrate(t.MigrateTo, true)
+		}
 	}
-	return nil
 }
 
-func (n *EMSD) PersistMetadata() error {
-	// persist metadata about what topics/channels we have, across restarts
-	fileName := newMetadataFile(n.getOpts())
-
-	n.logf(LOG_INFO, "EMS: persisting topic/channel metadata to %s", fileName)
-
-	js := make(map[string]interface{})
-	topics := []interface{}{}
+// metadata returns the topics and channels to persist, sorted by name, the
+// caller must hold n's lock
+func (n *EMSD) metadata() *meta {
+	m := &meta{
+		Version: version.Binary,
+		Topics:  []metaTopic{},
+		NodeID:  n.assignedNodeID,
+	}
 	for _, topic := range n.topicMap {
 		if topic.ephemeral {
 			continue
 		}
-		topicData := make(map[string]interface{})
-		topicData["name"] = topic.name
-		topicData["paused"] = topic.IsPaused()
-		channels := []interface{}{}
+		t := metaTopic{
+			Name:     topic.name,
+			Paused:   topic.IsPaused(),
+			DiskFull: atomic.LoadInt32(&topic.diskFull) == 1,
+			Channels: []metaChannel{},
+		}
 		topic.Lock()
 		for _, channel := range topic.channelMap {
 			if channel.ephemeral {
 				continue
 			}
 			channel.Lock()
-			channelData := make(map[string]interface{})
-			channelData["name"] = channel.name
-			channelData["paused"] = channel.IsPaused()
+			t.Channels = append(t.Channels, metaChannel{
+				Name:   channel.name,
+				Paused: channel.IsPaused(),
+			})
 			channel.Unlock()
-			channels = append(channels, channelData)
 		}
+		if topic.migration != nil {
+			t.MigrateTo = topic.migration.stats.Target
+		}
+		t.Leader = topic.replicaOf
 		topic.Unlock()
-		topicData["channels"] = channels
-		topics = append(topics, topicData)
+		sort.Slice(t.Channels, func(i, j int) bool { return t.Channels[i].Name < t.Channels[j].Name })
+		m.Topics = append(m.Topics, t)
 	}
-	js["version"] = version.Binary
-	js["topics"] = topics
+	sort.Slice(m.Topics, func(i, j int) bool { return m.Topics[i].Name < m.Topics[j].Name })
+	return m
+}
+
+func (n *EMSD) PersistMetadata() error {
+	// persist metadata about what topics/channels we have, across restarts
+	fileName := newMetadataFile(n.getOpts())
+
+	n.logf(LOG_INFO, "EMS: persisting topic/channel metadata to %s", fileName)
 
-	data, err := json.Marshal(&js)
+	data, err := json.Marshal(n.metadata())
 	if err != nil {
 		return err
 	}
 
 	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
 
-	err = writeSyncFile(tmpFileName, data)
+	err = writeSyncFile(tmpFileName, sealMetadata(n.keyring, data))
 	if err != nil {
 		return err
 	}
@@ -431,7 +627,7 @@ func (n *EMSD) PersistMetadata() error {
 	}
 	// technically should fsync DataPath here
 
-	return nil
+	return n.snapshotMetadata(data)
 }
 
 func (n *EMSD) Exit() {
@@ -455,6 +651,22 @@ func (n *EMSD) Exit() {
 		n.httpsListener.Close()
 	}
 
+	if n.stompListener != nil {
+		n.stompListener.Close()
+	}
+
+	if n.stompServer != nil {
+		n.stompServer.Close()
+	}
+
+	if n.kafkaListener != nil {
+		n.kafkaListener.Close()
+	}
+
+	if n.kafkaServer != nil {
+		n.kafkaServer.Close()
+	}
+
 	n.Lock()
 	err := n.PersistMetadata()
 	if err != nil {
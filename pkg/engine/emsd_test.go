@@ -298,6 +298,7 @@ func TestReconfigure(t *testing.T) {
 
 	newOpts := NewOptions()
 	newOpts.Logger = opts.Logger
+	newOpts.DataPath = opts.DataPath
 	newOpts.EMSLookupdTCPAddresses = []string{lookupd1.RealTCPAddr().String()}
 	emsd.swapOpts(newOpts)
 	emsd.triggerOptsNotification()
@@ -315,6 +316,7 @@ func TestReconfigure(t *testing.T) {
 
 	newOpts = NewOptions()
 	newOpts.Logger = opts.Logger
+	newOpts.DataPath = opts.DataPath
 	newOpts.EMSLookupdTCPAddresses = []string{lookupd2.RealTCPAddr().String(), lookupd3.RealTCPAddr().String()}
 	emsd.swapOpts(newOpts)
 	emsd.triggerOptsNotification()
@@ -435,9 +437,149 @@ func TestCluster(t *testing.T) {
 	test.Equal(t, 0, len(dd["channel:"+topicName+":ch"]))
 }
 
+func TestClusterLabels(t *testing.T) {
+	lopts := emslookupd.NewOptions()
+	lopts.Logger = test.NewTestLogger(t)
+	lopts.BroadcastAddress = "127.0.0.1"
+	_, _, lookupd := mustStartEMSLookupd(lopts)
+	defer lookupd.Exit()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.EMSLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	opts.BroadcastAddress = "127.0.0.1"
+	opts.Labels = []string{"zone=a", "rack=r1"}
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topicName := "cluster_labels" + strconv.Itoa(int(time.Now().Unix()))
+	emsd.GetTopic(topicName)
+
+	// allow some time for emsd to push info to emslookupd
+	time.Sleep(350 * time.Millisecond)
+
+	var lr struct {
+		Producers []struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"producers"`
+	}
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s&prefer=zone:a", lookupd.RealHTTPAddr(), topicName)
+	err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lr.Producers))
+	test.Equal(t, map[string]string{"zone": "a", "rack": "r1"}, lr.Producers[0].Labels)
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "ems-test-")
+	defer os.RemoveAll(opts.DataPath)
+	opts.Labels = []string{"zone"}
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
+
+func TestClusterTLS(t *testing.T) {
+	lopts := emslookupd.NewOptions()
+	lopts.Logger = test.NewTestLogger(t)
+	lopts.BroadcastAddress = "127.0.0.1"
+	lopts.TLSCert = "./test/certs/server.pem"
+	lopts.TLSKey = "./test/certs/server.key"
+	lopts.TLSRootCAFile = "./test/certs/ca.pem"
+	lopts.TLSClientAuthPolicy = "require-verify"
+	lopts.RegistrationSecret = "s3cr3t"
+	lopts.AllowedNodes = []string{"nsq.io"}
+	_, _, lookupd := mustStartEMSLookupd(lopts)
+	defer lookupd.Exit()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.EMSLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	opts.BroadcastAddress = "127.0.0.1"
+	opts.EMSLookupdTLS = true
+	opts.EMSLookupdTLSCert = "./test/certs/client.pem"
+	opts.EMSLookupdTLSKey = "./test/certs/client.key"
+	opts.EMSLookupdTLSRootCAFile = "./test/certs/ca.pem"
+	opts.EMSLookupdSecret = "s3cr3t"
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topicName := "cluster_tls" + strconv.Itoa(int(time.Now().Unix()))
+	emsd.GetTopic(topicName)
+
+	// allow some time for emsd to push info to emslookupd
+	time.Sleep(350 * time.Millisecond)
+
+	var lr struct {
+		Producers []struct {
+			TCPPort int `json:"tcp_port"`
+		} `json:"producers"`
+	}
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", lookupd.RealHTTPAddr(), topicName)
+	err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lr.Producers))
+	test.Equal(t, emsd.RealTCPAddr().Port, lr.Producers[0].TCPPort)
+}
+
+func TestClusterNodeIDAssign(t *testing.T) {
+	lopts := emslookupd.NewOptions()
+	lopts.Logger = test.NewTestLogger(t)
+	lopts.BroadcastAddress = "127.0.0.1"
+	lopts.NodeIDPolicy = "assign"
+	_, _, lookupd := mustStartEMSLookupd(lopts)
+	defer lookupd.Exit()
+
+	var emsds []*EMSD
+	var opts *Options
+	for i := 0; i < 2; i++ {
+		opts = NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		opts.EMSLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+		opts.BroadcastAddress = "127.0.0.1"
+		opts.ID = 7
+		_, _, emsd := mustStartEMSD(opts)
+		defer os.RemoveAll(opts.DataPath)
+		defer emsd.Exit()
+		emsds = append(emsds, emsd)
+
+		// allow some time for emsd to identify with emslookupd
+		time.Sleep(350 * time.Millisecond)
+	}
+
+	test.Equal(t, int64(7), emsds[0].getOpts().ID)
+	test.Equal(t, int64(0), emsds[1].getOpts().ID)
+	topic := emsds[1].GetTopic("node_id" + strconv.Itoa(int(time.Now().Unix())))
+	test.Equal(t, int64(0), topic.idFactory.nodeID)
+
+	// only the first lookupd assigns node IDs
+	emsds[1].setNodeID(&lookupPeer{addr: "127.0.0.1:1"}, 5)
+	test.Equal(t, int64(0), emsds[1].getOpts().ID)
+
+	// the assigned node ID is kept across restarts, unless --node-id changes
+	emsds[1].Exit()
+	for _, id := range []int64{7, 8} {
+		restartOpts := *opts
+		restartOpts.ID = id
+		restartOpts.EMSLookupdTCPAddresses = nil
+		emsd, err := New(&restartOpts)
+		test.Nil(t, err)
+		test.Nil(t, emsd.LoadMetadata())
+		if id == 7 {
+			test.Equal(t, int64(0), emsd.getOpts().ID)
+		} else {
+			test.Equal(t, id, emsd.getOpts().ID)
+		}
+		emsd.Exit()
+	}
+}
+
 func TestSetHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "ems-test-")
+	defer os.RemoveAll(opts.DataPath)
 	emsd, err := New(opts)
 	test.Nil(t, err)
 	defer emsd.Exit()
@@ -0,0 +1,121 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bhojpur/ems/pkg/core/keyring"
+)
+
+// encryptedMetadataMagic prefixes a metadata file sealed with the data keyring
+var encryptedMetadataMagic = []byte("EMSDENC1")
+
+// loadKeyring returns the keyring used to encrypt data at rest, or nil if
+// encryption is not configured
+func loadKeyring(opts *Options) (*keyring.Keyring, error) {
+	if opts.DataKeyFile != "" && opts.DataKeyringEnv != "" {
+		return nil, errors.New("cannot use both --data-key-file and --data-keyring-env")
+	}
+
+	var k *keyring.Keyring
+	var err error
+	switch {
+	case opts.DataKeyFile != "":
+		k, err = keyring.Load(opts.DataKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load --data-key-file - %s", err)
+		}
+	case opts.DataKeyringEnv != "":
+		s, ok := os.LookupEnv(opts.DataKeyringEnv)
+		if !ok {
+			return nil, fmt.Errorf("--data-keyring-env %s is not set", opts.DataKeyringEnv)
+		}
+		k, err = keyring.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse --data-keyring-env %s - %s", opts.DataKeyringEnv, err)
+		}
+	default:
+		return nil, nil
+	}
+
+	// every backend that stores data on disk must be able to encrypt it
+	backends := []string{opts.BackendQueue}
+	for _, override := range opts.TopicBackendQueues {
+		_, name, _ := parseTopicOverride(override)
+		backends = append(backends, name)
+	}
+	for _, name := range backends {
+		if name == "log" {
+			return nil, errors.New("the log backend queue does not support encryption at rest")
+		}
+	}
+	storages := []string{opts.FanoutStorage}
+	for _, override := range opts.TopicFanoutStorages {
+		_, name, _ := parseTopicOverride(override)
+		storages = append(storages, name)
+	}
+	for _, name := range storages {
+		if name == fanoutStorageShared {
+			return nil, errors.New("shared fanout storage does not support encryption at rest")
+		}
+	}
+	return k, nil
+}
+
+// sealMetadata encrypts the metadata file contents if a keyring is configured
+func sealMetadata(k *keyring.Keyring, data []byte) []byte {
+	if k == nil {
+		return data
+	}
+	return k.Seal(append([]byte(nil), encryptedMetadataMagic...), data)
+}
+
+// openMetadata decrypts the metadata file contents if they were encrypted,
+// plaintext metadata is returned as is so that encryption can be enabled
+// on an existing data path
+func openMetadata(k *keyring.Keyring, fileName string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMetadataMagic) {
+		return data, nil
+	}
+	if k == nil {
+		return nil, fmt.Errorf("metadata in %s is encrypted but no data keyring is configured", fileName)
+	}
+	data, err := k.Open(nil, data[len(encryptedMetadataMagic):])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt metadata in %s - %s", fileName, err)
+	}
+	return data, nil
+}
+
+// ReadMetadataFile returns the (decrypted) JSON contents of an emsd metadata
+// file, for offline inspection
+func ReadMetadataFile(fileName string, k *keyring.Keyring) ([]byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return openMetadata(k, fileName, data)
+}
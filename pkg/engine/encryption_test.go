@@ -0,0 +1,89 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bhojpur/ems/pkg/core/keyring"
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func TestEncryptedMetadata(t *testing.T) {
+	os.Setenv("EMSD_TEST_KEYRING", "1:MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTI=")
+	defer os.Unsetenv("EMSD_TEST_KEYRING")
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataKeyringEnv = "EMSD_TEST_KEYRING"
+	opts.MemQueueSize = 0
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := emsd.GetTopic("encrypted_topic")
+	topic.GetChannel("ch")
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("secret body"))))
+	test.Nil(t, emsd.PersistMetadata())
+
+	fn := newMetadataFile(opts)
+	data, err := ioutil.ReadFile(fn)
+	test.Nil(t, err)
+	test.Equal(t, false, bytes.Contains(data, []byte("encrypted_topic")))
+
+	k, err := keyring.Parse(os.Getenv("EMSD_TEST_KEYRING"))
+	test.Nil(t, err)
+	data, err = ReadMetadataFile(fn, k)
+	test.Nil(t, err)
+	test.Equal(t, true, bytes.Contains(data, []byte("encrypted_topic")))
+	_, err = ReadMetadataFile(fn, nil)
+	test.NotNil(t, err)
+
+	emsd.Exit()
+
+	// the metadata cannot be loaded without the keyring
+	opts.DataKeyringEnv = ""
+	emsd, err = New(opts)
+	test.Nil(t, err)
+	test.NotNil(t, emsd.LoadMetadata())
+	// emsd fails to start here, Exit() would persist the (empty) metadata
+	emsd.dl.Unlock()
+
+	opts.DataKeyringEnv = "EMSD_TEST_KEYRING"
+	emsd, err = New(opts)
+	test.Nil(t, err)
+	defer emsd.Exit()
+	test.Nil(t, emsd.LoadMetadata())
+	channel, err := emsd.GetTopic("encrypted_topic").GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), channel.Depth())
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "ems-test-")
+	defer os.RemoveAll(opts.DataPath)
+	opts.DataKeyringEnv = "EMSD_TEST_KEYRING"
+	opts.TopicBackendQueues = []string{"logged=log"}
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
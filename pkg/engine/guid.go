@@ -63,6 +63,13 @@ func NewGUIDFactory(nodeID int64) *guidFactory {
 	}
 }
 
+// setNodeID changes the node ID of the GUIDs created from now on
+func (f *guidFactory) setNodeID(nodeID int64) {
+	f.Lock()
+	f.nodeID = nodeID
+	f.Unlock()
+}
+
 func (f *guidFactory) NewGUID() (guid, error) {
 	f.Lock()
 
@@ -94,6 +94,20 @@ func newHTTPServer(emsd *EMSD, tlsEnabled bool, tlsRequired bool) *httpServer {
 	router.Handle("POST", "/channel/unpause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
+	router.Handle("GET", "/topology/export", http_api.Decorate(s.doExportTopology, log, http_api.V1))
+	router.Handle("POST", "/topology/import", http_api.Decorate(s.doImportTopology, log, http_api.V1))
+	router.Handle("GET", "/topology/snapshots", http_api.Decorate(s.doTopologySnapshots, log, http_api.V1))
+	router.Handle("GET", "/backup", http_api.Decorate(s.doBackup, log))
+	router.Handle("POST", "/drain", http_api.Decorate(s.doDrain, log, http_api.V1))
+	router.Handle("GET", "/topic/migrate", http_api.Decorate(s.doTopicMigration, log, http_api.V1))
+	router.Handle("POST", "/topic/migrate", http_api.Decorate(s.doMigrateTopic, log, http_api.V1))
+	router.Handle("POST", "/topic/migrate/cancel", http_api.Decorate(s.doCancelTopicMigration, log, http_api.V1))
+	router.Handle("POST", "/topic/import", http_api.Decorate(s.doImportMessages, log, http_api.V1))
+	router.Handle("POST", "/replica/create", http_api.Decorate(s.doCreateReplica, log, http_api.V1))
+	router.Handle("POST", "/replica/append", http_api.Decorate(s.doAppendReplica, log, http_api.V1))
+	router.Handle("POST", "/replica/ack", http_api.Decorate(s.doAckReplica, log, http_api.V1))
+	router.Handle("POST", "/replica/rollback", http_api.Decorate(s.doRollbackReplica, log, http_api.V1))
+	router.Handle("POST", "/replica/promote", http_api.Decorate(s.doPromoteReplica, log, http_api.V1))
 
 	// debug
 	router.HandlerFunc("GET", "/debug/pprof/", pprof.Index)
@@ -145,20 +159,27 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 	if err != nil {
 		return nil, http_api.Err{500, err.Error()}
 	}
+	labels, _ := parseLabels(s.emsd.getOpts().Labels)
 	return struct {
-		Version          string `json:"version"`
-		BroadcastAddress string `json:"broadcast_address"`
-		Hostname         string `json:"hostname"`
-		HTTPPort         int    `json:"http_port"`
-		TCPPort          int    `json:"tcp_port"`
-		StartTime        int64  `json:"start_time"`
+		Version          string            `json:"version"`
+		BroadcastAddress string            `json:"broadcast_address"`
+		Hostname         string            `json:"hostname"`
+		Labels           map[string]string `json:"labels,omitempty"`
+		HTTPPort         int               `json:"http_port"`
+		TCPPort          int               `json:"tcp_port"`
+		StartTime        int64             `json:"start_time"`
+		Disk             DiskStats         `json:"disk"`
+		Drain            *DrainStats       `json:"drain,omitempty"`
 	}{
 		Version:          version.Binary,
 		BroadcastAddress: s.emsd.getOpts().BroadcastAddress,
 		Hostname:         hostname,
+		Labels:           labels,
 		TCPPort:          s.emsd.RealTCPAddr().Port,
 		HTTPPort:         s.emsd.RealHTTPAddr().Port,
 		StartTime:        s.emsd.GetStartTime().Unix(),
+		Disk:             s.emsd.GetDiskStats(),
+		Drain:            s.emsd.GetDrainStats(),
 	}, nil
 }
 
@@ -182,6 +203,28 @@ func (s *httpServer) getExistingTopicFromQuery(req *http.Request) (*http_api.Req
 	return reqParams, topic, channelName, err
 }
 
+// getExistingMigrationTopic looks up the topic of a /topic/migrate request,
+// which unlike the channel endpoints takes no channel argument
+func (s *httpServer) getExistingMigrationTopic(req *http.Request) (*http_api.ReqParams, *Topic, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.emsd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	return reqParams, topic, nil
+}
+
 func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
@@ -245,6 +288,18 @@ func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprout
 	msg := NewMessage(topic.GenerateID(), body)
 	msg.deferred = deferred
 	err = topic.PutMessage(msg)
+	if err == errDiskFull {
+		return nil, http_api.Err{507, "DISK_FULL"}
+	}
+	if err == errDraining {
+		return nil, http_api.Err{503, "DRAINING"}
+	}
+	if err == errReplica {
+		return nil, http_api.Err{409, "TOPIC_IS_REPLICA"}
+	}
+	if err == errReplicationFailed {
+		return nil, http_api.Err{503, "REPLICATION_FAILED"}
+	}
 	if err != nil {
 		return nil, http_api.Err{503, "EXITING"}
 	}
@@ -323,6 +378,18 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 	}
 
 	err = topic.PutMessages(msgs)
+	if err == errDiskFull {
+		return nil, http_api.Err{507, "DISK_FULL"}
+	}
+	if err == errDraining {
+		return nil, http_api.Err{503, "DRAINING"}
+	}
+	if err == errReplica {
+		return nil, http_api.Err{409, "TOPIC_IS_REPLICA"}
+	}
+	if err == errReplicationFailed {
+		return nil, http_api.Err{503, "REPLICATION_FAILED"}
+	}
 	if err != nil {
 		return nil, http_api.Err{503, "EXITING"}
 	}
@@ -512,8 +579,22 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 		includeMem = true
 	}
 
-	stats := s.emsd.GetStats(topicName, channelName, includeClients)
+	// the topics, or the channels of the given topic, are filtered, sorted and paged
+	listParams, err := http_api.NewListParams(reqParams, "depth", "message_count", "message_rate")
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+
+	stats := s.emsd.getStats(topicName, channelName, includeClients, listParams.Match)
+	var nextCursor string
+	if topicName == "" {
+		stats.Topics, nextCursor = pageTopicStats(stats.Topics, listParams)
+	} else if len(stats.Topics) == 1 {
+		stats.Topics[0].Channels, nextCursor = pageChannelStats(stats.Topics[0].Channels, listParams)
+	}
+
 	health := s.emsd.GetHealth()
+	disk := s.emsd.GetDiskStats()
 	startTime := s.emsd.GetStartTime()
 	uptime := time.Since(startTime)
 
@@ -523,21 +604,126 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 		ms = &m
 	}
 	if !jsonFormat {
-		return s.printStats(stats, ms, health, startTime, uptime), nil
+		buf := s.printStats(stats, ms, health, disk, startTime, uptime)
+		if nextCursor != "" {
+			buf = append(buf, fmt.Sprintf("\nNext cursor: %s\n", nextCursor)...)
+		}
+		return buf, nil
+	}
+
+	var topics interface{} = stats.Topics
+	if fieldsParam, _ := reqParams.Get("fields"); fieldsParam != "" {
+		topics, err = selectStatsFields(stats.Topics, strings.Split(fieldsParam, ","))
+		if err != nil {
+			s.emsd.logf(LOG_ERROR, "failed to select stats fields - %s", err)
+			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		}
 	}
 
 	// TODO: should producer stats be hung off topics?
 	return struct {
-		Version   string        `json:"version"`
-		Health    string        `json:"health"`
-		StartTime int64         `json:"start_time"`
-		Topics    []TopicStats  `json:"topics"`
-		Memory    *memStats     `json:"memory,omitempty"`
-		Producers []ClientStats `json:"producers"`
-	}{version.Binary, health, startTime.Unix(), stats.Topics, ms, stats.Producers}, nil
+		Version    string        `json:"version"`
+		Health     string        `json:"health"`
+		StartTime  int64         `json:"start_time"`
+		Topics     interface{}   `json:"topics"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+		Memory     *memStats     `json:"memory,omitempty"`
+		Disk       DiskStats     `json:"disk"`
+		Producers  []ClientStats `json:"producers"`
+	}{version.Binary, health, startTime.Unix(), topics, nextCursor, ms, disk, stats.Producers}, nil
 }
 
-func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startTime time.Time, uptime time.Duration) []byte {
+// pageTopicStats sorts the topic stats, in name order, by the requested field
+// and returns the requested page
+func pageTopicStats(topics []TopicStats, listParams *http_api.ListParams) ([]TopicStats, string) {
+	var key func(i int) interface{}
+	switch listParams.Sort {
+	case "name":
+		listParams.SortSlice(topics, func(i, j int) bool { return topics[i].TopicName < topics[j].TopicName })
+	case "depth":
+		listParams.SortSlice(topics, func(i, j int) bool { return topics[i].Depth < topics[j].Depth })
+		key = func(i int) interface{} { return topics[i].Depth }
+	case "message_count":
+		listParams.SortSlice(topics, func(i, j int) bool { return topics[i].MessageCount < topics[j].MessageCount })
+		key = func(i int) interface{} { return topics[i].MessageCount }
+	case "message_rate":
+		listParams.SortSlice(topics, func(i, j int) bool { return topics[i].MessageRate < topics[j].MessageRate })
+		key = func(i int) interface{} { return topics[i].MessageRate }
+	}
+	start, end, next := listParams.Page(len(topics), func(i int) string { return topics[i].TopicName }, key)
+	return topics[start:end], next
+}
+
+// pageChannelStats sorts the channel stats, in name order, by the requested
+// field and returns the requested page
+func pageChannelStats(channels []ChannelStats, listParams *http_api.ListParams) ([]ChannelStats, string) {
+	var key func(i int) interface{}
+	switch listParams.Sort {
+	case "name":
+		listParams.SortSlice(channels, func(i, j int) bool { return channels[i].ChannelName < channels[j].ChannelName })
+	case "depth":
+		listParams.SortSlice(channels, func(i, j int) bool { return channels[i].Depth < channels[j].Depth })
+		key = func(i int) interface{} { return channels[i].Depth }
+	case "message_count":
+		listParams.SortSlice(channels, func(i, j int) bool { return channels[i].MessageCount < channels[j].MessageCount })
+		key = func(i int) interface{} { return channels[i].MessageCount }
+	case "message_rate":
+		listParams.SortSlice(channels, func(i, j int) bool { return channels[i].MessageRate < channels[j].MessageRate })
+		key = func(i int) interface{} { return channels[i].MessageRate }
+	}
+	start, end, next := listParams.Page(len(channels), func(i int) string { return channels[i].ChannelName }, key)
+	return channels[start:end], next
+}
+
+// selectStatsFields trims the topic stats down to the given fields, the JSON
+// keys of the topics, or channels.<key> for the ones of their channels (the
+// names are always kept)
+func selectStatsFields(topics []TopicStats, fields []string) ([]map[string]interface{}, error) {
+	topicFields := map[string]bool{"topic_name": true}
+	channelFields := map[string]bool{"channel_name": true}
+	for _, field := range fields {
+		if strings.HasPrefix(field, "channels.") {
+			channelFields[strings.TrimPrefix(field, "channels.")] = true
+			topicFields["channels"] = true
+			continue
+		}
+		topicFields[field] = true
+	}
+	// listing "channels" keeps them whole
+	wholeChannels := len(channelFields) == 1
+
+	data, err := json.Marshal(topics)
+	if err != nil {
+		return nil, err
+	}
+	var selected []map[string]interface{}
+	if err := json.Unmarshal(data, &selected); err != nil {
+		return nil, err
+	}
+
+	for _, t := range selected {
+		for k := range t {
+			if !topicFields[k] {
+				delete(t, k)
+			}
+		}
+		if wholeChannels {
+			continue
+		}
+		channels, _ := t["channels"].([]interface{})
+		for _, c := range channels {
+			c := c.(map[string]interface{})
+			for k := range c {
+				if !channelFields[k] {
+					delete(c, k)
+				}
+			}
+		}
+	}
+	return selected, nil
+}
+
+func (s *httpServer) printStats(stats Stats, ms *memStats, health string, disk DiskStats, startTime time.Time, uptime time.Duration) []byte {
 	var buf bytes.Buffer
 	w := &buf
 
@@ -560,6 +746,13 @@ func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startT
 		fmt.Fprintf(w, "   %-25s\t%d\n", "gc_total_runs", ms.GCTotalRuns)
 	}
 
+	fmt.Fprintf(w, "\nDisk: %s\n", disk.DataPath)
+	fmt.Fprintf(w, "   %-25s\t%d\n", "total_bytes", disk.TotalBytes)
+	fmt.Fprintf(w, "   %-25s\t%d\n", "used_bytes", disk.UsedBytes)
+	fmt.Fprintf(w, "   %-25s\t%d\n", "free_bytes", disk.FreeBytes)
+	fmt.Fprintf(w, "   %-25s\t%.1f\n", "used_percent", disk.UsedPercent)
+	fmt.Fprintf(w, "   %-25s\t%t\n", "full", disk.Full)
+
 	if len(stats.Topics) == 0 {
 		fmt.Fprintf(w, "\nTopics: None\n")
 	} else {
@@ -573,25 +766,33 @@ func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startT
 		} else {
 			pausedPrefix = "   "
 		}
-		fmt.Fprintf(w, "\n%s[%-15s] depth: %-5d be-depth: %-5d msgs: %-8d e2e%%: %s\n",
+		fmt.Fprintf(w, "\n%s[%-15s] depth: %-5d be-depth: %-5d disk: %-8d msgs: %-8d e2e%%: %s\n",
 			pausedPrefix,
 			t.TopicName,
 			t.Depth,
 			t.BackendDepth,
+			t.DiskBytes,
 			t.MessageCount,
 			t.E2eProcessingLatency,
 		)
+		if t.Leader != "" {
+			fmt.Fprintf(w, "      replica of: %s\n", t.Leader)
+		}
+		if len(t.Replicas) > 0 {
+			fmt.Fprintf(w, "      replicas: %s (failures: %d)\n", strings.Join(t.Replicas, ", "), t.ReplicationFailures)
+		}
 		for _, c := range t.Channels {
 			if c.Paused {
 				pausedPrefix = "   *P "
 			} else {
 				pausedPrefix = "      "
 			}
-			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d e2e%%: %s\n",
+			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d disk: %-8d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d e2e%%: %s\n",
 				pausedPrefix,
 				c.ChannelName,
 				c.Depth,
 				c.BackendDepth,
+				c.DiskBytes,
 				c.InFlightCount,
 				c.DeferredCount,
 				c.RequeueCount,
@@ -617,6 +818,388 @@ func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startT
 	return buf.Bytes()
 }
 
+// doDrain starts draining emsd, progress is reported in /info
+func (s *httpServer) doDrain(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	forwardAddress, _ := reqParams.Get("forward")
+	var timeout time.Duration
+	if timeoutStr, _ := reqParams.Get("timeout"); timeoutStr != "" {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil || timeout <= 0 {
+			return nil, http_api.Err{400, "INVALID_TIMEOUT"}
+		}
+	}
+
+	err = s.emsd.Drain(forwardAddress, timeout)
+	if err != nil {
+		return nil, http_api.Err{409, "ALREADY_DRAINING"}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doTopicMigration(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingMigrationTopic(req)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := topic.GetMigrationStats()
+	if stats == nil {
+		return nil, http_api.Err{404, "MIGRATION_NOT_FOUND"}
+	}
+	return stats, nil
+}
+
+// doMigrateTopic starts moving a topic to the emsd with the given HTTP address,
+// it's a no-op when already migrating there
+func (s *httpServer) doMigrateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingMigrationTopic(req)
+	if err != nil {
+		return nil, err
+	}
+
+	target, _ := reqParams.Get("target")
+	if target == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TARGET"}
+	}
+
+	err = topic.Migrate(target, false)
+	if err != nil {
+		return nil, http_api.Err{409, "ALREADY_MIGRATING"}
+	}
+
+	// persist metadata so that the migration resumes after a restart
+	s.emsd.Lock()
+	s.emsd.PersistMetadata()
+	s.emsd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doCancelTopicMigration(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingMigrationTopic(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = topic.CancelMigration()
+	if err != nil {
+		return nil, http_api.Err{404, "MIGRATION_NOT_FOUND"}
+	}
+
+	s.emsd.Lock()
+	s.emsd.PersistMetadata()
+	s.emsd.Unlock()
+	return nil, nil
+}
+
+// doImportMessages receives messages migrated from another emsd
+func (s *httpServer) doImportMessages(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if req.ContentLength > s.emsd.getOpts().MaxBodySize {
+		return nil, http_api.Err{413, "BODY_TOO_BIG"}
+	}
+
+	reqParams, topic, err := s.getTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channelName := reqParams.Get("channel")
+	if channelName != "" && !protocol.IsValidChannelName(channelName) {
+		return nil, http_api.Err{400, "INVALID_CHANNEL"}
+	}
+
+	readMax := s.emsd.getOpts().MaxBodySize + 1
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, readMax))
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	if int64(len(body)) == readMax {
+		return nil, http_api.Err{413, "BODY_TOO_BIG"}
+	}
+
+	batch, err := decodeMigrateBatch(bytes.NewReader(body), s.emsd.getOpts().MaxMsgSize)
+	if err != nil {
+		return nil, http_api.Err{400, "BAD_BODY"}
+	}
+
+	err = topic.importMessages(channelName, batch)
+	if err == errDiskFull {
+		return nil, http_api.Err{507, "DISK_FULL"}
+	}
+	if err == errDraining {
+		return nil, http_api.Err{503, "DRAINING"}
+	}
+	if err == errReplica {
+		return nil, http_api.Err{409, "TOPIC_IS_REPLICA"}
+	}
+	if err == errReplicationFailed {
+		return nil, http_api.Err{503, "REPLICATION_FAILED"}
+	}
+	if err != nil {
+		return nil, http_api.Err{503, "EXITING"}
+	}
+	return nil, nil
+}
+
+// doCreateReplica creates (or updates) the replica of a topic, with the
+// leader's channels
+func (s *httpServer) doCreateReplica(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	if !protocol.IsValidTopicName(topicName) || strings.HasSuffix(topicName, "#ephemeral") {
+		return nil, http_api.Err{400, "INVALID_TOPIC"}
+	}
+
+	leader, _ := reqParams.Get("leader")
+	if leader == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_LEADER"}
+	}
+
+	channelNames, _ := reqParams.GetAll("channel")
+	for _, channelName := range channelNames {
+		if !protocol.IsValidChannelName(channelName) {
+			return nil, http_api.Err{400, "INVALID_CHANNEL"}
+		}
+	}
+
+	_, err = s.emsd.GetReplicaTopic(topicName, leader, channelNames)
+	if err != nil {
+		return nil, http_api.Err{409, "TOPIC_EXISTS"}
+	}
+
+	s.emsd.Lock()
+	s.emsd.PersistMetadata()
+	s.emsd.Unlock()
+	return nil, nil
+}
+
+// getReplicaTopicFromQuery leaves the body unread
+func (s *httpServer) getReplicaTopicFromQuery(req *http.Request) (url.Values, *Topic, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicNames, ok := reqParams["topic"]
+	if !ok {
+		return nil, nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.emsd.GetExistingTopic(topicNames[0])
+	if err != nil || !topic.isReplica() {
+		return nil, nil, http_api.Err{404, "REPLICA_NOT_FOUND"}
+	}
+	return reqParams, topic, nil
+}
+
+// doAppendReplica stores messages published to the leader, it returns once
+// they are on disk
+func (s *httpServer) doAppendReplica(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if req.ContentLength > s.emsd.getOpts().MaxBodySize {
+		return nil, http_api.Err{413, "BODY_TOO_BIG"}
+	}
+
+	_, topic, err := s.getReplicaTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	readMax := s.emsd.getOpts().MaxBodySize + 1
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, readMax))
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	if int64(len(body)) == readMax {
+		return nil, http_api.Err{413, "BODY_TOO_BIG"}
+	}
+
+	batch, err := decodeMigrateBatch(bytes.NewReader(body), s.emsd.getOpts().MaxMsgSize)
+	if err != nil {
+		return nil, http_api.Err{400, "BAD_BODY"}
+	}
+
+	err = topic.appendReplica(batch)
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to append replica - %s", topic.name, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	return nil, nil
+}
+
+// doAckReplica drops messages finished on the leader from a channel
+func (s *httpServer) doAckReplica(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getReplicaTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channelName := reqParams.Get("channel")
+	if channelName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_CHANNEL"}
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	ids, err := decodeReplicaAcks(io.LimitReader(req.Body, s.emsd.getOpts().MaxBodySize))
+	if err != nil {
+		return nil, http_api.Err{400, "BAD_BODY"}
+	}
+
+	channel.replicaAck(ids)
+	return nil, nil
+}
+
+// doRollbackReplica drops messages which the leader failed to store after
+// they were appended
+func (s *httpServer) doRollbackReplica(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getReplicaTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := decodeReplicaAcks(io.LimitReader(req.Body, s.emsd.getOpts().MaxBodySize))
+	if err != nil {
+		return nil, http_api.Err{400, "BAD_BODY"}
+	}
+
+	topic.rollbackReplica(ids)
+	return nil, nil
+}
+
+// doPromoteReplica turns a replica into a regular topic, i.e. once its leader
+// is gone
+func (s *httpServer) doPromoteReplica(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getReplicaTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.emsd.PromoteReplica(topic.name)
+	if err != nil {
+		return nil, http_api.Err{409, "NOT_A_REPLICA"}
+	}
+	return nil, nil
+}
+
+// doExportTopology returns the topics and channels of this node (or of one of
+// its metadata snapshots), in the format accepted by /topology/import
+func (s *httpServer) doExportTopology(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	snapshot, _ := reqParams.Get("snapshot")
+	if snapshot == "" {
+		s.emsd.RLock()
+		m := s.emsd.metadata()
+		s.emsd.RUnlock()
+		m.dropLocalState()
+		return m, nil
+	}
+
+	id, err := strconv.ParseInt(snapshot, 10, 64)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_SNAPSHOT"}
+	}
+	m, err := s.emsd.readMetadataSnapshot(id)
+	if os.IsNotExist(err) {
+		return nil, http_api.Err{404, "SNAPSHOT_NOT_FOUND"}
+	}
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "failed to read metadata snapshot %d - %s", id, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	m.dropLocalState()
+	return m, nil
+}
+
+// doImportTopology creates the topics and channels of an exported topology
+// and applies their paused state, existing topics and channels are kept
+func (s *httpServer) doImportTopology(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	var m meta
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_TOPOLOGY"}
+	}
+	for _, t := range m.Topics {
+		if !protocol.IsValidTopicName(t.Name) {
+			return nil, http_api.Err{400, "INVALID_TOPIC"}
+		}
+		for _, c := range t.Channels {
+			if !protocol.IsValidChannelName(c.Name) {
+				return nil, http_api.Err{400, "INVALID_CHANNEL"}
+			}
+		}
+	}
+
+	m.dropLocalState()
+	s.emsd.applyMetadata(&m)
+
+	s.emsd.Lock()
+	err = s.emsd.PersistMetadata()
+	s.emsd.Unlock()
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "failed to persist metadata - %s", err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doTopologySnapshots(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	snapshots, err := s.emsd.metadataSnapshots()
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "failed to list metadata snapshots - %s", err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	return struct {
+		Snapshots []metadataSnapshot `json:"snapshots"`
+	}{snapshots}, nil
+}
+
+// doBackup streams a tar archive of the data path, taken after a checkpoint
+func (s *httpServer) doBackup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	err := s.emsd.Checkpoint()
+	if err != nil {
+		s.emsd.logf(LOG_ERROR, "failed to checkpoint for backup - %s", err)
+		err = http_api.Err{500, "INTERNAL_ERROR"}
+		http_api.RespondV1(w, 500, err)
+		return nil, err
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=emsd-backup-%d.tar", time.Now().Unix()))
+	err = s.emsd.writeBackup(w)
+	if err != nil {
+		// the response is already underway, the archive will be truncated
+		s.emsd.logf(LOG_ERROR, "failed to write backup - %s", err)
+	}
+	return nil, nil
+}
+
 func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	opt := ps.ByName("opt")
 
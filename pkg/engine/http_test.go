@@ -623,6 +623,91 @@ func TestHTTPgetStatusText(t *testing.T) {
 	test.NotNil(t, body)
 }
 
+func TestHTTPgetStatusList(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	for name, depth := range map[string]int{"list_a": 3, "list_b": 1, "list_c": 2} {
+		topic := emsd.GetTopic(name)
+		for i := 0; i < depth; i++ {
+			test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+		}
+	}
+	topic := emsd.GetTopic("other")
+	for i, name := range []string{"ch3", "ch1", "ch2"} {
+		channel := topic.GetChannel(name)
+		for j := 0; j <= i; j++ {
+			test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+		}
+	}
+
+	type statsDoc struct {
+		Topics     []map[string]interface{} `json:"topics"`
+		NextCursor string                   `json:"next_cursor"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	getStats := func(query string) statsDoc {
+		var doc statsDoc
+		endpoint := fmt.Sprintf("http://%s/stats?format=json&%s", httpAddr, query)
+		err := client.GETV1(endpoint, &doc)
+		test.Nil(t, err)
+		return doc
+	}
+	names := func(objs []map[string]interface{}, key string) []string {
+		var names []string
+		for _, o := range objs {
+			names = append(names, o[key].(string))
+		}
+		return names
+	}
+
+	doc := getStats("prefix=list_&sort=-depth")
+	test.Equal(t, []string{"list_a", "list_c", "list_b"}, names(doc.Topics, "topic_name"))
+	test.Equal(t, "", doc.NextCursor)
+
+	doc = getStats("regex=%5El&limit=2")
+	test.Equal(t, []string{"list_a", "list_b"}, names(doc.Topics, "topic_name"))
+	doc = getStats("regex=%5El&limit=2&cursor=" + doc.NextCursor)
+	test.Equal(t, []string{"list_c"}, names(doc.Topics, "topic_name"))
+	test.Equal(t, "", doc.NextCursor)
+
+	// paging by depth resumes after the depth and name of the last topic
+	// listed, a topic added meanwhile doesn't shift the next page
+	doc = getStats("prefix=list_&sort=-depth&limit=1")
+	test.Equal(t, []string{"list_a"}, names(doc.Topics, "topic_name"))
+	added := emsd.GetTopic("list_d")
+	for i := 0; i < 3; i++ {
+		test.Nil(t, added.PutMessage(NewMessage(added.GenerateID(), []byte("test"))))
+	}
+	doc = getStats("prefix=list_&sort=-depth&limit=2&cursor=" + doc.NextCursor)
+	test.Equal(t, []string{"list_d", "list_c"}, names(doc.Topics, "topic_name"))
+	doc = getStats("prefix=list_&sort=-depth&limit=2&cursor=" + doc.NextCursor)
+	test.Equal(t, []string{"list_b"}, names(doc.Topics, "topic_name"))
+	test.Equal(t, "", doc.NextCursor)
+	emsd.DeleteExistingTopic("list_d")
+
+	doc = getStats("prefix=list_a&fields=depth,message_count")
+	test.Equal(t, []map[string]interface{}{
+		{"topic_name": "list_a", "depth": float64(3), "message_count": float64(3)},
+	}, doc.Topics)
+
+	// with a topic the channels are listed
+	doc = getStats("topic=other&sort=-depth&limit=2&fields=channels.depth")
+	test.Equal(t, 1, len(doc.Topics))
+	test.Equal(t, []interface{}{
+		map[string]interface{}{"channel_name": "ch2", "depth": float64(3)},
+		map[string]interface{}{"channel_name": "ch1", "depth": float64(2)},
+	}, doc.Topics[0]["channels"])
+	test.NotEqual(t, "", doc.NextCursor)
+
+	err := client.GETV1(fmt.Sprintf("http://%s/stats?format=json&sort=clients", httpAddr), nil)
+	test.NotNil(t, err)
+	test.Equal(t, true, strings.Contains(err.Error(), "INVALID_ARG_SORT"))
+}
+
 func TestHTTPconfig(t *testing.T) {
 	lopts := emslookupd.NewOptions()
 	lopts.Logger = test.NewTestLogger(t)
@@ -0,0 +1,415 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/bhojpur/ems/pkg/core/protocol"
+	"github.com/golang/snappy"
+)
+
+// Kafka API keys
+const (
+	kafkaAPIProduce     int16 = 0
+	kafkaAPIMetadata    int16 = 3
+	kafkaAPIApiVersions int16 = 18
+)
+
+// Kafka error codes
+const (
+	kafkaErrUnknownServerError         int16 = -1
+	kafkaErrNone                       int16 = 0
+	kafkaErrCorruptMessage             int16 = 2
+	kafkaErrUnknownTopicOrPartition    int16 = 3
+	kafkaErrNotLeaderForPartition      int16 = 6
+	kafkaErrMessageTooLarge            int16 = 10
+	kafkaErrInvalidTopic               int16 = 17
+	kafkaErrNotEnoughReplicas          int16 = 19
+	kafkaErrInvalidRequiredAcks        int16 = 21
+	kafkaErrUnsupportedVersion         int16 = 35
+	kafkaErrKafkaStorageError          int16 = 56
+	kafkaErrUnsupportedCompressionType int16 = 76
+	kafkaErrInvalidRecord              int16 = 87
+)
+
+var errKafkaShortBuffer = errors.New("short buffer")
+
+var kafkaCRC32C = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaReader decodes Kafka primitive types, the first error is sticky
+// and all subsequent reads return zero values
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errKafkaShortBuffer
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return int8(b[0])
+}
+
+func (r *kafkaReader) int16() int16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (r *kafkaReader) int32() int32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (r *kafkaReader) int64() int64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (r *kafkaReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errKafkaShortBuffer
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) bool() bool {
+	return r.int8() != 0
+}
+
+// nullableString returns the string and whether it was non-null
+func (r *kafkaReader) nullableString() (string, bool) {
+	n := r.int16()
+	if n < 0 {
+		return "", false
+	}
+	return string(r.next(int(n))), true
+}
+
+func (r *kafkaReader) string() string {
+	s, _ := r.nullableString()
+	return s
+}
+
+func (r *kafkaReader) bytes() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *kafkaReader) varbytes() []byte {
+	n := r.varint()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+// arrayLen returns the number of array elements, -1 for a null array
+func (r *kafkaReader) arrayLen() int {
+	n := r.int32()
+	// every element is at least one byte, so this bounds allocations
+	if r.err == nil && int(n) > len(r.b) {
+		r.err = errKafkaShortBuffer
+		return 0
+	}
+	return int(n)
+}
+
+// kafkaWriter encodes Kafka primitive types
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8) {
+	w.WriteByte(byte(v))
+}
+
+func (w *kafkaWriter) bool(v bool) {
+	if v {
+		w.int8(1)
+	} else {
+		w.int8(0)
+	}
+}
+
+func (w *kafkaWriter) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	w.Write(b[:])
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	w.Write(b[:])
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.Write(b[:])
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *kafkaWriter) nullString() {
+	w.int16(-1)
+}
+
+func (w *kafkaWriter) arrayLen(n int) {
+	w.int32(int32(n))
+}
+
+// kafkaRecord is a single record from a v2 record batch
+type kafkaRecord struct {
+	Timestamp int64 // milliseconds
+	Key       []byte
+	Value     []byte
+	Headers   []kafkaRecordHeader
+}
+
+type kafkaRecordHeader struct {
+	Key   string
+	Value []byte
+}
+
+// kafkaRecordError is returned by decodeKafkaRecordBatches with the Kafka error
+// code that should be reported for the partition
+type kafkaRecordError struct {
+	Code int16
+	Msg  string
+}
+
+func (e *kafkaRecordError) Error() string {
+	return e.Msg
+}
+
+// decodeKafkaRecordBatches decodes one or more concatenated v2 record batches,
+// see https://kafka.apache.org/documentation/#recordbatch
+func decodeKafkaRecordBatches(b []byte) ([]kafkaRecord, error) {
+	var records []kafkaRecord
+	for len(b) > 0 {
+		r := &kafkaReader{b: b}
+		r.int64() // base offset
+		batchLength := r.int32()
+		if r.err != nil || batchLength < 0 || int(batchLength) > len(r.b) {
+			return nil, &kafkaRecordError{kafkaErrCorruptMessage, "truncated record batch"}
+		}
+		batch := &kafkaReader{b: r.next(int(batchLength))}
+		b = r.b
+
+		batch.int32() // partition leader epoch
+		magic := batch.int8()
+		if magic != 2 {
+			return nil, &kafkaRecordError{kafkaErrCorruptMessage,
+				fmt.Sprintf("unsupported record batch magic %d", magic)}
+		}
+		crc := uint32(batch.int32())
+		if batch.err != nil || crc32.Checksum(batch.b, kafkaCRC32C) != crc {
+			return nil, &kafkaRecordError{kafkaErrCorruptMessage, "record batch CRC mismatch"}
+		}
+		attributes := batch.int16()
+		batch.int32() // last offset delta
+		firstTimestamp := batch.int64()
+		batch.int64() // max timestamp
+		batch.int64() // producer id
+		batch.int16() // producer epoch
+		batch.int32() // base sequence
+		numRecords := batch.int32()
+		if batch.err != nil || numRecords < 0 {
+			return nil, &kafkaRecordError{kafkaErrCorruptMessage, "truncated record batch header"}
+		}
+
+		if attributes&0x20 != 0 {
+			// control batch (transaction markers) carry no data
+			continue
+		}
+
+		data, err := kafkaDecompress(attributes&0x07, batch.b)
+		if err != nil {
+			return nil, err
+		}
+
+		rr := &kafkaReader{b: data}
+		for i := int32(0); i < numRecords; i++ {
+			length := rr.varint()
+			rec := &kafkaReader{b: rr.next(int(length))}
+			rec.int8() // attributes
+			timestampDelta := rec.varint()
+			rec.varint() // offset delta
+			record := kafkaRecord{
+				Timestamp: firstTimestamp + timestampDelta,
+				Key:       rec.varbytes(),
+				Value:     rec.varbytes(),
+			}
+			numHeaders := rec.varint()
+			for j := int64(0); j < numHeaders && rec.err == nil; j++ {
+				record.Headers = append(record.Headers, kafkaRecordHeader{
+					Key:   string(rec.varbytes()),
+					Value: rec.varbytes(),
+				})
+			}
+			if rr.err != nil || rec.err != nil {
+				return nil, &kafkaRecordError{kafkaErrCorruptMessage, "truncated record"}
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// xerial framing is used by the Java (and most other) clients for snappy
+var xerialHeader = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0}
+
+func kafkaDecompress(codec int16, b []byte) ([]byte, error) {
+	switch codec {
+	case 0:
+		return b, nil
+	case 1:
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, &kafkaRecordError{kafkaErrCorruptMessage, err.Error()}
+		}
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, &kafkaRecordError{kafkaErrCorruptMessage, err.Error()}
+		}
+		return data, nil
+	case 2:
+		if !bytes.HasPrefix(b, xerialHeader) {
+			data, err := snappy.Decode(nil, b)
+			if err != nil {
+				return nil, &kafkaRecordError{kafkaErrCorruptMessage, err.Error()}
+			}
+			return data, nil
+		}
+		// skip the header, version and compatible version
+		r := &kafkaReader{b: b[len(xerialHeader):]}
+		r.int32()
+		r.int32()
+		var out []byte
+		for r.err == nil && len(r.b) > 0 {
+			chunk := r.bytes()
+			data, err := snappy.Decode(nil, chunk)
+			if err != nil {
+				return nil, &kafkaRecordError{kafkaErrCorruptMessage, err.Error()}
+			}
+			out = append(out, data...)
+		}
+		if r.err != nil {
+			return nil, &kafkaRecordError{kafkaErrCorruptMessage, "truncated snappy block"}
+		}
+		return out, nil
+	}
+	return nil, &kafkaRecordError{kafkaErrUnsupportedCompressionType,
+		fmt.Sprintf("unsupported compression codec %d", codec)}
+}
+
+// readKafkaRequest reads a single size delimited request
+func readKafkaRequest(r io.Reader, tmp []byte, maxSize int64) ([]byte, error) {
+	_, err := io.ReadFull(r, tmp)
+	if err != nil {
+		return nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(tmp))
+	if size <= 0 || int64(size) > maxSize {
+		return nil, fmt.Errorf("invalid request size %d", size)
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+type kafkaServer struct {
+	emsd  *EMSD
+	conns sync.Map
+}
+
+func (p *kafkaServer) Handle(conn net.Conn) {
+	p.emsd.logf(LOG_INFO, "KAFKA: new client(%s)", conn.RemoteAddr())
+
+	var prot protocol.Protocol = &protocolKafka{emsd: p.emsd}
+
+	client := prot.NewClient(conn)
+	p.conns.Store(conn.RemoteAddr(), client)
+
+	err := prot.IOLoop(client)
+	if err != nil {
+		p.emsd.logf(LOG_ERROR, "client(%s) - %s", conn.RemoteAddr(), err)
+	}
+
+	p.conns.Delete(conn.RemoteAddr())
+	client.Close()
+}
+
+func (p *kafkaServer) Close() {
+	p.conns.Range(func(k, v interface{}) bool {
+		v.(protocol.Client).Close()
+		return true
+	})
+}
@@ -22,7 +22,11 @@ package engine
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
@@ -40,6 +44,13 @@ func connectCallback(n *EMSD, hostname string) func(*lookupPeer) {
 		ci["http_port"] = n.getOpts().BroadcastHTTPPort
 		ci["hostname"] = hostname
 		ci["broadcast_address"] = n.getOpts().BroadcastAddress
+		ci["node_id"] = n.getOpts().ID
+		if n.getOpts().EMSLookupdSecret != "" {
+			ci["secret"] = n.getOpts().EMSLookupdSecret
+		}
+		if labels, _ := parseLabels(n.getOpts().Labels); len(labels) > 0 {
+			ci["labels"] = labels
+		}
 
 		cmd, err := emsctl.Identify(ci)
 		if err != nil {
@@ -54,6 +65,11 @@ func connectCallback(n *EMSD, hostname string) func(*lookupPeer) {
 			n.logf(LOG_INFO, "LOOKUPD(%s): lookupd returned %s", lp, resp)
 			lp.Close()
 			return
+		} else if bytes.HasPrefix(resp, []byte("E_UNAUTHORIZED")) ||
+			bytes.HasPrefix(resp, []byte("E_NODE_ID_CONFLICT")) {
+			n.logf(LOG_ERROR, "LOOKUPD(%s): lookupd returned %s", lp, resp)
+			lp.Close()
+			return
 		} else {
 			err = json.Unmarshal(resp, &lp.Info)
 			if err != nil {
@@ -61,19 +77,34 @@ func connectCallback(n *EMSD, hostname string) func(*lookupPeer) {
 				lp.Close()
 				return
 			} else {
-				n.logf(LOG_INFO, "LOOKUPD(%s): peer info %+v", lp, lp.Info)
+				nodeID := "none"
+				if lp.Info.NodeID != nil {
+					nodeID = strconv.FormatInt(*lp.Info.NodeID, 10)
+				}
+				n.logf(LOG_INFO, "LOOKUPD(%s): peer info {TCPPort:%d HTTPPort:%d Version:%s BroadcastAddress:%s NodeID:%s}",
+					lp, lp.Info.TCPPort, lp.Info.HTTPPort, lp.Info.Version, lp.Info.BroadcastAddress, nodeID)
 				if lp.Info.BroadcastAddress == "" {
 					n.logf(LOG_ERROR, "LOOKUPD(%s): no broadcast address", lp)
 				}
+				if lp.Info.NodeID != nil {
+					n.setNodeID(lp, *lp.Info.NodeID)
+				}
 			}
 		}
 
+		if n.isDraining() {
+			// a draining node is no longer advertised
+			return
+		}
+
 		// build all the commands first so we exit the lock(s) as fast as possible
 		var commands []*emsctl.Command
 		n.RLock()
 		for _, topic := range n.topicMap {
 			topic.RLock()
-			if len(topic.channelMap) == 0 {
+			if topic.replicaOf != "" {
+				commands = append(commands, emsctl.RegisterReplica(topic.name))
+			} else if len(topic.channelMap) == 0 {
 				commands = append(commands, emsctl.Register(topic.name, ""))
 			} else {
 				for _, channel := range topic.channelMap {
@@ -95,6 +126,89 @@ func connectCallback(n *EMSD, hostname string) func(*lookupPeer) {
 	}
 }
 
+// setNodeID switches to the node ID lookupd assigned (see its --node-id-policy),
+// for the message IDs generated from now on, and persists it. Only the first
+// lookupd in --lookupd-tcp-address assigns it, lookupd which aren't clustered
+// could otherwise keep assigning different ones.
+func (n *EMSD) setNodeID(lp *lookupPeer, id int64) {
+	if id < 0 || id >= 1024 {
+		n.logf(LOG_ERROR, "LOOKUPD(%s): invalid node ID %d", lp, id)
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	opts := *n.getOpts()
+	if opts.ID == id {
+		return
+	}
+	if len(opts.EMSLookupdTCPAddresses) == 0 || lp.addr != opts.EMSLookupdTCPAddresses[0] {
+		n.logf(LOG_WARN, "LOOKUPD(%s): ignoring node ID %d, only the first lookupd assigns it",
+			lp, id)
+		return
+	}
+	n.logf(LOG_WARN, "LOOKUPD(%s): node ID %d already used by another node, switching to %d",
+		lp, opts.ID, id)
+	configured := opts.ID
+	if n.assignedNodeID != nil {
+		configured = n.assignedNodeID.Configured
+	}
+	n.assignedNodeID = &metaNodeID{Configured: configured, Assigned: id}
+	opts.ID = id
+	n.swapOpts(&opts)
+	for _, t := range n.topicMap {
+		t.idFactory.setNodeID(id)
+	}
+	err := n.PersistMetadata()
+	if err != nil {
+		n.logf(LOG_ERROR, "failed to persist metadata - %s", err)
+	}
+
+	// the other lookupd get the new ID when it reconnects (this runs in the
+	// lookupLoop like all the lookupPeer commands)
+	if lookupPeers, ok := n.lookupPeers.Load().([]*lookupPeer); ok {
+		for _, other := range lookupPeers {
+			if other != lp {
+				other.Close()
+			}
+		}
+	}
+}
+
+// buildLookupdTLSConfig returns the TLS config emsd connects to lookupd with,
+// nil without --lookupd-tls
+func buildLookupdTLSConfig(opts *Options) (*tls.Config, error) {
+	if !opts.EMSLookupdTLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if opts.EMSLookupdTLSCert != "" || opts.EMSLookupdTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.EMSLookupdTLSCert, opts.EMSLookupdTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.EMSLookupdTLSRootCAFile != "" {
+		tlsCertPool := x509.NewCertPool()
+		caCertFile, err := ioutil.ReadFile(opts.EMSLookupdTLSRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
+			return nil, errors.New("failed to append certificate to pool")
+		}
+		tlsConfig.RootCAs = tlsCertPool
+	}
+
+	return tlsConfig, nil
+}
+
 func (n *EMSD) lookupLoop() {
 	var lookupPeers []*lookupPeer
 	var lookupAddrs []string
@@ -115,8 +229,8 @@ func (n *EMSD) lookupLoop() {
 					continue
 				}
 				n.logf(LOG_INFO, "LOOKUP(%s): adding peer", host)
-				lookupPeer := newLookupPeer(host, n.getOpts().MaxBodySize, n.logf,
-					connectCallback(n, hostname))
+				lookupPeer := newLookupPeer(host, n.getOpts().MaxBodySize, n.lookupdTLSConfig,
+					n.logf, connectCallback(n, hostname))
 				lookupPeer.Command(nil) // start the connection
 				lookupPeers = append(lookupPeers, lookupPeer)
 				lookupAddrs = append(lookupAddrs, host)
@@ -140,26 +254,49 @@ func (n *EMSD) lookupLoop() {
 			var cmd *emsctl.Command
 			var branch string
 
+			if done, ok := val.(lookupdUnregisterAll); ok {
+				n.unregisterAll(lookupPeers)
+				close(done)
+				continue
+			}
+			if p, ok := val.(replicaPromotion); ok {
+				n.registerPromoted(lookupPeers, p.topic)
+				continue
+			}
+
 			switch val.(type) {
 			case *Channel:
 				// notify all emslookupds that a new channel exists, or that it's removed
 				branch = "channel"
 				channel := val.(*Channel)
+				if channel.isReplica() {
+					// only the topic of a replica is registered
+					break
+				}
 				if channel.Exiting() == true {
 					cmd = emsctl.UnRegister(channel.topicName, channel.name)
-				} else {
+				} else if !n.isDraining() {
 					cmd = emsctl.Register(channel.topicName, channel.name)
 				}
 			case *Topic:
 				// notify all emslookupds that a new topic exists, or that it's removed
 				branch = "topic"
 				topic := val.(*Topic)
-				if topic.Exiting() == true {
+				if topic.isReplica() {
+					if topic.Exiting() == true {
+						cmd = emsctl.UnRegisterReplica(topic.name)
+					} else {
+						cmd = emsctl.RegisterReplica(topic.name)
+					}
+				} else if topic.Exiting() == true {
 					cmd = emsctl.UnRegister(topic.name, "")
-				} else {
+				} else if !n.isDraining() {
 					cmd = emsctl.Register(topic.name, "")
 				}
 			}
+			if cmd == nil {
+				continue
+			}
 
 			for _, lookupPeer := range lookupPeers {
 				n.logf(LOG_INFO, "LOOKUPD(%s): %s %s", lookupPeer, branch, cmd)
@@ -192,6 +329,65 @@ exit:
 	n.logf(LOG_INFO, "LOOKUP: closing")
 }
 
+// lookupdUnregisterAll asks lookupLoop to unregister every topic and channel
+// from every lookupd peer, it is closed once done
+type lookupdUnregisterAll chan struct{}
+
+// unregisterAll unregisters every topic and channel from the lookupd peers
+func (n *EMSD) unregisterAll(lookupPeers []*lookupPeer) {
+	// build all the commands first so we exit the lock(s) as fast as possible
+	var commands []*emsctl.Command
+	n.RLock()
+	for _, topic := range n.topicMap {
+		topic.RLock()
+		if topic.replicaOf != "" {
+			commands = append(commands, emsctl.UnRegisterReplica(topic.name))
+			topic.RUnlock()
+			continue
+		}
+		for _, channel := range topic.channelMap {
+			commands = append(commands, emsctl.UnRegister(channel.topicName, channel.name))
+		}
+		topic.RUnlock()
+		commands = append(commands, emsctl.UnRegister(topic.name, ""))
+	}
+	n.RUnlock()
+
+	for _, lookupPeer := range lookupPeers {
+		for _, cmd := range commands {
+			n.logf(LOG_INFO, "LOOKUPD(%s): %s", lookupPeer, cmd)
+			_, err := lookupPeer.Command(cmd)
+			if err != nil {
+				n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lookupPeer, cmd, err)
+				break
+			}
+		}
+	}
+}
+
+// registerPromoted replaces the replica registration of a promoted topic with
+// the topic and its channels
+func (n *EMSD) registerPromoted(lookupPeers []*lookupPeer, topic *Topic) {
+	commands := []*emsctl.Command{
+		emsctl.UnRegisterReplica(topic.name),
+		emsctl.Register(topic.name, ""),
+	}
+	for _, channel := range topic.drainChannels() {
+		commands = append(commands, emsctl.Register(topic.name, channel.name))
+	}
+
+	for _, lookupPeer := range lookupPeers {
+		for _, cmd := range commands {
+			n.logf(LOG_INFO, "LOOKUPD(%s): %s", lookupPeer, cmd)
+			_, err := lookupPeer.Command(cmd)
+			if err != nil {
+				n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lookupPeer, cmd, err)
+				break
+			}
+		}
+	}
+}
+
 func in(s string, lst []string) bool {
 	for _, v := range lst {
 		if s == v {
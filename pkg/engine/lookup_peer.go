@@ -21,6 +21,7 @@ package engine
 // THE SOFTWARE.
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -40,6 +41,7 @@ type lookupPeer struct {
 	logf            lg.AppLogFunc
 	addr            string
 	conn            net.Conn
+	tlsConfig       *tls.Config
 	state           int32
 	connectCallback func(*lookupPeer)
 	maxBodySize     int64
@@ -52,25 +54,35 @@ type peerInfo struct {
 	HTTPPort         int    `json:"http_port"`
 	Version          string `json:"version"`
 	BroadcastAddress string `json:"broadcast_address"`
+	NodeID           *int64 `json:"node_id,omitempty"` // as accepted or assigned by lookupd
 }
 
 // newLookupPeer creates a new lookupPeer instance connecting to the supplied address.
 //
 // The supplied connectCallback will be called *every* time the instance connects.
-func newLookupPeer(addr string, maxBodySize int64, l lg.AppLogFunc, connectCallback func(*lookupPeer)) *lookupPeer {
+func newLookupPeer(addr string, maxBodySize int64, tlsConfig *tls.Config, l lg.AppLogFunc, connectCallback func(*lookupPeer)) *lookupPeer {
 	return &lookupPeer{
 		logf:            l,
 		addr:            addr,
+		tlsConfig:       tlsConfig,
 		state:           stateDisconnected,
 		maxBodySize:     maxBodySize,
 		connectCallback: connectCallback,
 	}
 }
 
-// Connect will Dial the specified address, with timeouts
+// Connect will Dial the specified address, with timeouts, over TLS if
+// configured
 func (lp *lookupPeer) Connect() error {
 	lp.logf(lg.INFO, "LOOKUP connecting to %s", lp.addr)
-	conn, err := net.DialTimeout("tcp", lp.addr, time.Second)
+	var conn net.Conn
+	var err error
+	if lp.tlsConfig != nil {
+		dialer := &net.Dialer{Timeout: time.Second}
+		conn, err = tls.DialWithDialer(dialer, "tcp", lp.addr, lp.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", lp.addr, time.Second)
+	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,155 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"errors"
+	"sync"
+)
+
+var errMemoryBackendQueueFull = errors.New("memory backend queue full")
+
+// memoryBackendQueue is a bounded, non-persistent BackendQueue, messages
+// beyond maxDepth are rejected rather than spilled anywhere
+type memoryBackendQueue struct {
+	sync.RWMutex
+
+	maxDepth int64
+	exitFlag int32
+	buf      [][]byte // owned by ioLoop
+
+	readChan          chan []byte
+	depthChan         chan int64
+	writeChan         chan []byte
+	writeResponseChan chan error
+	emptyChan         chan int
+	exitChan          chan int
+	exitSyncChan      chan int
+}
+
+func newMemoryBackendQueue(maxDepth int64) BackendQueue {
+	q := &memoryBackendQueue{
+		maxDepth:          maxDepth,
+		readChan:          make(chan []byte),
+		depthChan:         make(chan int64),
+		writeChan:         make(chan []byte),
+		writeResponseChan: make(chan error),
+		emptyChan:         make(chan int),
+		exitChan:          make(chan int),
+		exitSyncChan:      make(chan int),
+	}
+	go q.ioLoop()
+	return q
+}
+
+func (q *memoryBackendQueue) Put(data []byte) error {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	// callers reuse their buffers
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	q.writeChan <- buf
+	return <-q.writeResponseChan
+}
+
+func (q *memoryBackendQueue) ReadChan() <-chan []byte {
+	return q.readChan
+}
+
+func (q *memoryBackendQueue) Close() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.exitFlag == 1 {
+		return nil
+	}
+	q.exitFlag = 1
+	close(q.exitChan)
+	<-q.exitSyncChan
+	close(q.depthChan)
+	return nil
+}
+
+func (q *memoryBackendQueue) Delete() error {
+	return q.Close()
+}
+
+func (q *memoryBackendQueue) Depth() int64 {
+	depth, ok := <-q.depthChan
+	if !ok {
+		// ioLoop exited
+		depth = int64(len(q.buf))
+	}
+	return depth
+}
+
+func (q *memoryBackendQueue) Empty() error {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	q.emptyChan <- 1
+	return nil
+}
+
+func (q *memoryBackendQueue) ioLoop() {
+	var r chan []byte
+	var head []byte
+
+	for {
+		if len(q.buf) > 0 {
+			r = q.readChan
+			head = q.buf[0]
+		} else {
+			r = nil
+			head = nil
+		}
+
+		select {
+		case r <- head:
+			q.buf[0] = nil
+			q.buf = q.buf[1:]
+		case q.depthChan <- int64(len(q.buf)):
+		case data := <-q.writeChan:
+			if int64(len(q.buf)) >= q.maxDepth {
+				q.writeResponseChan <- errMemoryBackendQueueFull
+				continue
+			}
+			q.buf = append(q.buf, data)
+			q.writeResponseChan <- nil
+		case <-q.emptyChan:
+			q.buf = nil
+		case <-q.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	q.exitSyncChan <- 1
+}
@@ -109,6 +109,24 @@ func decodeMessage(b []byte) (*Message, error) {
 	return &msg, nil
 }
 
+// DecodeMessage decodes a message as it is stored by backend queues, for
+// tools which read them offline
+func DecodeMessage(b []byte) (*Message, error) {
+	return decodeMessage(b)
+}
+
+// MinValidMsgLength is the size of a stored message with an empty body
+const MinValidMsgLength = minValidMsgLength
+
+// messageIDFromBytes returns the ID of a message encoded with WriteTo
+// without decoding the rest of it
+func messageIDFromBytes(b []byte) []byte {
+	if len(b) < 10+MsgIDLength {
+		return nil
+	}
+	return b[10 : 10+MsgIDLength]
+}
+
 func writeMessageToBackend(msg *Message, bq BackendQueue) error {
 	buf := bufferPoolGet()
 	defer bufferPoolPut(buf)
@@ -118,3 +136,37 @@ func writeMessageToBackend(msg *Message, bq BackendQueue) error {
 	}
 	return bq.Put(buf.Bytes())
 }
+
+// writeMessagesToBackend writes msgs with a single PutBatch if bq supports it
+// and returns how many of them were written
+func writeMessagesToBackend(msgs []*Message, bq BackendQueue) (int, error) {
+	bbq, ok := bq.(BatchBackendQueue)
+	if !ok || len(msgs) == 1 {
+		for i, msg := range msgs {
+			err := writeMessageToBackend(msg, bq)
+			if err != nil {
+				return i, err
+			}
+		}
+		return len(msgs), nil
+	}
+
+	buf := bufferPoolGet()
+	defer bufferPoolPut(buf)
+	ends := make([]int, len(msgs))
+	for i, msg := range msgs {
+		_, err := msg.WriteTo(buf)
+		if err != nil {
+			return 0, err
+		}
+		ends[i] = buf.Len()
+	}
+	b := buf.Bytes()
+	batch := make([][]byte, len(msgs))
+	start := 0
+	for i, end := range ends {
+		batch[i] = b[start:end]
+		start = end
+	}
+	return bbq.PutBatch(batch)
+}
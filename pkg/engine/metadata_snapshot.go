@@ -0,0 +1,233 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadataSnapshot is a previous version of emsd.dat
+type metadataSnapshot struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+func metadataSnapshotFileName(opts *Options, id int64) string {
+	return fmt.Sprintf("%s.snapshot.%019d", newMetadataFile(opts), id)
+}
+
+// snapshotMetadata keeps a copy of the metadata just persisted, if it changed,
+// and removes all but the last --metadata-snapshots copies
+func (n *EMSD) snapshotMetadata(data []byte) error {
+	opts := n.getOpts()
+	if opts.MetadataSnapshots <= 0 {
+		return nil
+	}
+
+	n.snapshotMtx.Lock()
+	defer n.snapshotMtx.Unlock()
+	if bytes.Equal(data, n.lastSnapshot) {
+		return nil
+	}
+
+	fileName := metadataSnapshotFileName(opts, time.Now().UnixNano())
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err := writeSyncFile(tmpFileName, sealMetadata(n.keyring, data))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		return err
+	}
+	n.lastSnapshot = data
+
+	snapshots, err := n.metadataSnapshots()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(snapshots)-opts.MetadataSnapshots; i++ {
+		fn := metadataSnapshotFileName(opts, snapshots[i].ID)
+		err := os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			n.logf(LOG_ERROR, "failed to remove metadata snapshot %s - %s", fn, err)
+		}
+	}
+	return nil
+}
+
+// metadataSnapshots returns the metadata snapshots on disk, oldest first
+func (n *EMSD) metadataSnapshots() ([]metadataSnapshot, error) {
+	prefix := newMetadataFile(n.getOpts()) + ".snapshot."
+	fileNames, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []metadataSnapshot{}
+	for _, fn := range fileNames {
+		id, err := strconv.ParseInt(strings.TrimPrefix(fn, prefix), 10, 64)
+		if err != nil {
+			continue // a temporary file
+		}
+		snapshots = append(snapshots, metadataSnapshot{id, time.Unix(0, id).UTC()})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots, nil
+}
+
+// readMetadataSnapshot returns the topology stored in a metadata snapshot
+func (n *EMSD) readMetadataSnapshot(id int64) (*meta, error) {
+	fn := metadataSnapshotFileName(n.getOpts(), id)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	data, err = openMetadata(n.keyring, fn, data)
+	if err != nil {
+		return nil, err
+	}
+	var m meta
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata in %s - %s", fn, err)
+	}
+	return &m, nil
+}
+
+// Checkpoint persists emsd's metadata and syncs every topic and channel
+// backend, once it returns the data path can be copied consistently while
+// emsd is running (messages held in memory are not included)
+func (n *EMSD) Checkpoint() error {
+	n.Lock()
+	err := n.PersistMetadata()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to persist metadata - %s", err)
+	}
+
+	for _, t := range topics {
+		err := backendSync(t.backend)
+		if err != nil && !t.Exiting() {
+			return fmt.Errorf("failed to sync topic %s - %s", t.name, err)
+		}
+		t.RLock()
+		channels := make([]*Channel, 0, len(t.channelMap))
+		for _, c := range t.channelMap {
+			channels = append(channels, c)
+		}
+		t.RUnlock()
+		for _, c := range channels {
+			err := backendSync(c.backend)
+			if err != nil && !c.Exiting() {
+				return fmt.Errorf("failed to sync channel %s:%s - %s", t.name, c.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Backup checkpoints emsd and writes a tar archive of the data path to w,
+// restoring it is a matter of extracting it into the data path of a stopped
+// emsd
+func (n *EMSD) Backup(w io.Writer) error {
+	err := n.Checkpoint()
+	if err != nil {
+		return err
+	}
+	return n.writeBackup(w)
+}
+
+// writeBackup writes a tar archive of the data path to w, metadata files go
+// first so that data files are at least as recent as the positions they hold
+func (n *EMSD) writeBackup(w io.Writer) error {
+	dataPath := n.getOpts().DataPath
+	fileInfos, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+
+	var metaFiles, dataFiles []string
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		switch {
+		case !fi.Mode().IsRegular(), strings.HasSuffix(name, ".tmp"):
+		case strings.HasPrefix(name, "emsd.dat"), strings.Contains(name, ".meta.dat"):
+			metaFiles = append(metaFiles, name)
+		default:
+			dataFiles = append(dataFiles, name)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for _, name := range append(metaFiles, dataFiles...) {
+		err := writeBackupFile(tw, path.Join(dataPath, name))
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeBackupFile adds a file to the archive as of when it is opened, files
+// removed since the data path was listed (i.e. segments that were consumed)
+// are skipped
+func writeBackupFile(tw *tar.Writer, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
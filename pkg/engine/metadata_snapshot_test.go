@@ -0,0 +1,180 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func TestMetadataSnapshots(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MetadataSnapshots = 2
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	// avoid concurrency issue of async PersistMetadata() calls
+	atomic.StoreInt32(&emsd.isLoading, 1)
+	for i := 0; i < 3; i++ {
+		emsd.GetTopic(fmt.Sprintf("snapshot_%d", i))
+		test.Nil(t, emsd.PersistMetadata())
+	}
+	// unchanged metadata is not snapshotted again
+	test.Nil(t, emsd.PersistMetadata())
+	atomic.StoreInt32(&emsd.isLoading, 0)
+
+	snapshots, err := emsd.metadataSnapshots()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(snapshots))
+
+	m, err := emsd.readMetadataSnapshot(snapshots[0].ID)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(m.Topics))
+	m, err = emsd.readMetadataSnapshot(snapshots[1].ID)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(m.Topics))
+	test.Equal(t, "snapshot_2", m.Topics[2].Name)
+}
+
+func TestTopologyExportImport(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("export_topic")
+	topic.GetChannel("ch1")
+	topic.GetChannel("ch2").Pause()
+	emsd.GetTopic("paused_topic").Pause()
+	emsd.GetTopic("skipped#ephemeral")
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/topology/export", httpAddr))
+	test.Nil(t, err)
+	topology, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	var m meta
+	test.Nil(t, json.Unmarshal(topology, &m))
+	test.Equal(t, 2, len(m.Topics))
+
+	opts2 := NewOptions()
+	opts2.Logger = test.NewTestLogger(t)
+	_, httpAddr2, emsd2 := mustStartEMSD(opts2)
+	defer os.RemoveAll(opts2.DataPath)
+	defer emsd2.Exit()
+
+	url := fmt.Sprintf("http://%s/topology/import", httpAddr2)
+	resp, err = http.Post(url, "application/json", bytes.NewReader(topology))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	imported, err := emsd2.GetExistingTopic("export_topic")
+	test.Nil(t, err)
+	test.Equal(t, false, imported.IsPaused())
+	ch1, err := imported.GetExistingChannel("ch1")
+	test.Nil(t, err)
+	test.Equal(t, false, ch1.IsPaused())
+	ch2, err := imported.GetExistingChannel("ch2")
+	test.Nil(t, err)
+	test.Equal(t, true, ch2.IsPaused())
+	paused, err := emsd2.GetExistingTopic("paused_topic")
+	test.Nil(t, err)
+	test.Equal(t, true, paused.IsPaused())
+	_, err = emsd2.GetExistingTopic("skipped#ephemeral")
+	test.NotNil(t, err)
+
+	resp, err = http.Post(url, "application/json", bytes.NewBufferString(`{"topics":[{"name":"bad/name"}]}`))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestBackupRestore(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, httpAddr, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("backup_topic")
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 10; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	waitForDepth(t, channel, 10)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/backup", httpAddr))
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	restorePath, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(restorePath)
+
+	tr := tar.NewReader(resp.Body)
+	seenData := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		test.Nil(t, err)
+		// metadata goes before any data
+		isMeta := strings.HasPrefix(hdr.Name, "emsd.dat") || strings.Contains(hdr.Name, ".meta.dat")
+		test.Equal(t, false, isMeta && seenData)
+		seenData = seenData || !isMeta
+		data, err := ioutil.ReadAll(tr)
+		test.Nil(t, err)
+		test.Nil(t, ioutil.WriteFile(path.Join(restorePath, hdr.Name), data, 0600))
+	}
+
+	opts2 := NewOptions()
+	opts2.Logger = test.NewTestLogger(t)
+	opts2.DataPath = restorePath
+	_, _, emsd2 := mustStartEMSD(opts2)
+	defer emsd2.Exit()
+	test.Nil(t, emsd2.LoadMetadata())
+
+	restored, err := emsd2.GetExistingTopic("backup_topic")
+	test.Nil(t, err)
+	restoredChannel, err := restored.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(10), restoredChannel.Depth())
+}
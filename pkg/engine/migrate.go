@@ -0,0 +1,482 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// topic migration phases
+const (
+	migrationPhaseMigrating = "migrating"
+	migrationPhaseEmpty     = "empty"
+)
+
+// migrateChannelName is the ephemeral channel used to migrate the backlog of
+// topics which have no channels, it's imported into the target's topic
+const migrateChannelName = "migrate#ephemeral"
+
+const (
+	// maximum number of messages sent to the target per request
+	migrateBatchSize = 100
+	// number of recently imported message IDs remembered per topic
+	importedIDsSize = 16384
+)
+
+// TopicMigrationStats is the progress of moving a topic to another emsd
+type TopicMigrationStats struct {
+	Target        string `json:"target"`
+	Phase         string `json:"phase"`
+	StartTime     int64  `json:"start_time"`
+	Depth         int64  `json:"depth"`
+	InFlightCount int    `json:"in_flight_count"`
+	DeferredCount int    `json:"deferred_count"`
+	MigratedCount uint64 `json:"migrated_count"`
+	Error         string `json:"error,omitempty"`
+}
+
+type topicMigration struct {
+	stats    TopicMigrationStats
+	exitChan chan int
+}
+
+// migrateMessage is a message sent to the target, deadline is when a deferred
+// message becomes ready (UnixNano), 0 otherwise
+type migrateMessage struct {
+	msg      *Message
+	deadline int64
+}
+
+// Migrate moves the topic to the emsd with the given HTTP address: the topic
+// and its channels are created on the target, local channels are paused and
+// their queued and deferred messages are sent to the target with their
+// original IDs and timestamps until none are left. It keeps forwarding
+// whatever is published locally until the topic is deleted (once it's empty
+// the caller tombstones it) or the migration cancelled. A resumed migration
+// (after a restart) doesn't copy the pause state to the target again.
+func (t *Topic) Migrate(target string, resume bool) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.migration != nil {
+		if t.migration.stats.Target == target {
+			return nil
+		}
+		return fmt.Errorf("already migrating to %s", t.migration.stats.Target)
+	}
+	if t.Exiting() {
+		return errors.New("exiting")
+	}
+
+	t.emsd.logf(LOG_INFO, "TOPIC(%s): migrating to %s", t.name, target)
+	m := &topicMigration{
+		stats: TopicMigrationStats{
+			Target:    target,
+			Phase:     migrationPhaseMigrating,
+			StartTime: time.Now().Unix(),
+		},
+		exitChan: make(chan int),
+	}
+	t.migration = m
+	t.waitGroup.Wrap(func() { t.migrateLoop(m, resume) })
+	return nil
+}
+
+// CancelMigration stops migrating the topic, its channels are left paused
+func (t *Topic) CancelMigration() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.migration == nil {
+		return errors.New("not migrating")
+	}
+	t.emsd.logf(LOG_INFO, "TOPIC(%s): cancelling migration to %s", t.name, t.migration.stats.Target)
+	close(t.migration.exitChan)
+	t.migration = nil
+	return nil
+}
+
+// GetMigrationStats returns the progress of migrating the topic, or nil if it
+// isn't
+func (t *Topic) GetMigrationStats() *TopicMigrationStats {
+	t.RLock()
+	defer t.RUnlock()
+	if t.migration == nil {
+		return nil
+	}
+	stats := t.migration.stats
+	return &stats
+}
+
+func (t *Topic) updateMigrationStats(m *topicMigration, f func(*TopicMigrationStats)) {
+	t.Lock()
+	f(&m.stats)
+	t.Unlock()
+}
+
+func (t *Topic) migrateLoop(m *topicMigration, resume bool) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	wait := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-m.exitChan:
+		case <-t.exitChan:
+		}
+		return false
+	}
+
+	for {
+		err := t.migrateSetup(m.stats.Target, resume)
+		if err == nil {
+			break
+		}
+		t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to set up migration to %s - %s", t.name, m.stats.Target, err)
+		t.updateMigrationStats(m, func(s *TopicMigrationStats) { s.Error = err.Error() })
+		if !wait(time.Second) {
+			return
+		}
+	}
+
+	for {
+		for _, c := range t.drainChannels() {
+			if !c.IsPaused() {
+				// created since the migration started
+				err := t.migrateChannelSetup(m.stats.Target, c, false)
+				if err != nil {
+					t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to create channel %s on %s - %s",
+						t.name, c.name, m.stats.Target, err)
+					continue
+				}
+			}
+			if !t.migrateChannel(m, c, wait) {
+				return
+			}
+		}
+		t.updateMigrationProgress(m)
+
+		select {
+		case <-ticker.C:
+		case <-m.exitChan:
+			return
+		case <-t.exitChan:
+			return
+		}
+	}
+}
+
+// migrateSetup creates the topic and its channels on the target and pauses
+// the local channels, the topic itself is unpaused so that its backlog moves
+// on to the channels
+func (t *Topic) migrateSetup(target string, resume bool) error {
+	qs := fmt.Sprintf("topic=%s", url.QueryEscape(t.name))
+	err := t.emsd.httpcli.POSTV1(fmt.Sprintf("http://%s/topic/create?%s", target, qs))
+	if err != nil {
+		return err
+	}
+	if t.IsPaused() {
+		if !resume {
+			err = t.emsd.httpcli.POSTV1(fmt.Sprintf("http://%s/topic/pause?%s", target, qs))
+			if err != nil {
+				return err
+			}
+		}
+		t.UnPause()
+	}
+
+	channels := t.drainChannels()
+	if len(channels) == 0 {
+		t.GetChannel(migrateChannelName)
+	}
+	for _, c := range channels {
+		err := t.migrateChannelSetup(target, c, !resume)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Topic) migrateChannelSetup(target string, c *Channel, copyPause bool) error {
+	if c.name != migrateChannelName {
+		qs := fmt.Sprintf("topic=%s&channel=%s", url.QueryEscape(t.name), url.QueryEscape(c.name))
+		err := t.emsd.httpcli.POSTV1(fmt.Sprintf("http://%s/channel/create?%s", target, qs))
+		if err != nil {
+			return err
+		}
+		if copyPause && c.IsPaused() {
+			err = t.emsd.httpcli.POSTV1(fmt.Sprintf("http://%s/channel/pause?%s", target, qs))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return c.Pause()
+}
+
+// migrateChannel sends the deferred and queued messages of a channel to the
+// target, it returns false once the migration is stopped
+func (t *Topic) migrateChannel(m *topicMigration, c *Channel, wait func(time.Duration) bool) bool {
+	var batch []migrateMessage
+	for _, item := range c.takeDeferredMessages() {
+		batch = append(batch, migrateMessage{item.Value.(*Message), item.Priority})
+	}
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > migrateBatchSize {
+			n = migrateBatchSize
+		}
+		if !t.migrateSend(m, c, batch[:n], wait) {
+			for _, mm := range batch[n:] {
+				c.StartDeferredTimeout(mm.msg, time.Until(time.Unix(0, mm.deadline)))
+			}
+			return false
+		}
+		batch = batch[n:]
+	}
+
+	maxBodySize := t.emsd.getOpts().MaxBodySize
+	for {
+		var size int64
+	read:
+		for len(batch) < migrateBatchSize && size < maxBodySize/2 {
+			var msg *Message
+			select {
+			case msg = <-c.memoryMsgChan:
+			case buf := <-c.backend.ReadChan():
+				var err error
+				msg, err = decodeMessage(buf)
+				if err != nil {
+					t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to decode message - %s", t.name, err)
+					continue
+				}
+			default:
+				break read
+			}
+			batch = append(batch, migrateMessage{msg: msg})
+			size += int64(len(msg.Body))
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		if !t.migrateSend(m, c, batch, wait) {
+			return false
+		}
+		batch = batch[:0]
+	}
+}
+
+// migrateSend sends a batch to the target, retrying until it succeeds. When the
+// migration is stopped first the batch is put back and it returns false.
+func (t *Topic) migrateSend(m *topicMigration, c *Channel, batch []migrateMessage, wait func(time.Duration) bool) bool {
+	channelName := c.name
+	if channelName == migrateChannelName {
+		channelName = ""
+	}
+	endpoint := fmt.Sprintf("http://%s/topic/import?topic=%s&channel=%s",
+		m.stats.Target, url.QueryEscape(t.name), url.QueryEscape(channelName))
+	body := encodeMigrateBatch(batch)
+	for {
+		err := t.emsd.httpcli.POSTV1Body(endpoint, body)
+		if err == nil {
+			break
+		}
+		t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to send %d messages to %s - %s",
+			t.name, len(batch), m.stats.Target, err)
+		t.updateMigrationStats(m, func(s *TopicMigrationStats) { s.Error = err.Error() })
+		if !wait(time.Second) {
+			for _, mm := range batch {
+				if mm.deadline != 0 {
+					c.StartDeferredTimeout(mm.msg, time.Until(time.Unix(0, mm.deadline)))
+				} else {
+					c.put(mm.msg)
+				}
+			}
+			return false
+		}
+	}
+	t.updateMigrationStats(m, func(s *TopicMigrationStats) {
+		s.MigratedCount += uint64(len(batch))
+		s.Error = ""
+	})
+	return true
+}
+
+// updateMigrationProgress counts the messages left in the topic and its
+// channels, in-flight messages are migrated once they're requeued or time out
+func (t *Topic) updateMigrationProgress(m *topicMigration) {
+	depth := t.Depth()
+	var inFlight, deferred int
+	for _, c := range t.drainChannels() {
+		depth += c.Depth()
+		c.inFlightMutex.Lock()
+		inFlight += len(c.inFlightMessages)
+		c.inFlightMutex.Unlock()
+		c.deferredMutex.Lock()
+		deferred += len(c.deferredMessages)
+		c.deferredMutex.Unlock()
+	}
+	t.updateMigrationStats(m, func(s *TopicMigrationStats) {
+		s.Depth = depth
+		s.InFlightCount = inFlight
+		s.DeferredCount = deferred
+		if depth == 0 && inFlight == 0 && deferred == 0 {
+			s.Phase = migrationPhaseEmpty
+		} else {
+			s.Phase = migrationPhaseMigrating
+		}
+	})
+}
+
+// encodeMigrateBatch encodes messages as
+//
+//	[8-byte deadline][4-byte size][message (as written to the backend)]...
+func encodeMigrateBatch(batch []migrateMessage) []byte {
+	var buf bytes.Buffer
+	var hdr [12]byte
+	for _, mm := range batch {
+		binary.BigEndian.PutUint64(hdr[:8], uint64(mm.deadline))
+		binary.BigEndian.PutUint32(hdr[8:], uint32(minValidMsgLength+len(mm.msg.Body)))
+		buf.Write(hdr[:])
+		mm.msg.WriteTo(&buf)
+	}
+	return buf.Bytes()
+}
+
+func decodeMigrateBatch(r io.Reader, maxMessageSize int64) ([]migrateMessage, error) {
+	var batch []migrateMessage
+	var hdr [12]byte
+	for {
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF {
+			return batch, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[8:]))
+		if size < minValidMsgLength || size > maxMessageSize+minValidMsgLength {
+			return nil, fmt.Errorf("invalid message size %d", size)
+		}
+		buf := make([]byte, size)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, migrateMessage{msg, int64(binary.BigEndian.Uint64(hdr[:8]))})
+	}
+}
+
+// importMessages puts messages migrated from another emsd into the given
+// channel (or the topic itself), keeping their IDs and timestamps. Messages
+// imported recently are skipped so that a batch resent after a lost response
+// isn't queued twice.
+func (t *Topic) importMessages(channelName string, batch []migrateMessage) error {
+	if t.emsd.isDraining() {
+		return errDraining
+	}
+	if t.diskBacked && t.emsd.isDiskFull() {
+		return errDiskFull
+	}
+
+	var channel *Channel
+	if channelName != "" {
+		channel = t.GetChannel(channelName)
+	}
+	for _, mm := range batch {
+		if t.imported.contains(channelName, mm.msg.ID) {
+			continue
+		}
+		var delay time.Duration
+		if mm.deadline != 0 {
+			delay = time.Until(time.Unix(0, mm.deadline))
+		}
+		if channel == nil {
+			if delay > 0 {
+				mm.msg.deferred = delay
+			}
+			err := t.PutMessage(mm.msg)
+			if err != nil {
+				return err
+			}
+		} else if delay > 0 {
+			channel.PutMessageDeferred(mm.msg, delay)
+		} else {
+			err := channel.PutMessage(mm.msg)
+			if err != nil {
+				return err
+			}
+		}
+		t.imported.add(channelName, mm.msg.ID)
+	}
+	return nil
+}
+
+type importedID struct {
+	channel string
+	id      MessageID
+}
+
+// importedIDs remembers the IDs of the most recently imported messages
+type importedIDs struct {
+	sync.Mutex
+	ids  map[importedID]struct{}
+	ring []importedID
+	pos  int
+}
+
+func (r *importedIDs) contains(channel string, id MessageID) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, ok := r.ids[importedID{channel, id}]
+	return ok
+}
+
+func (r *importedIDs) add(channel string, id MessageID) {
+	r.Lock()
+	defer r.Unlock()
+	if r.ids == nil {
+		r.ids = make(map[importedID]struct{})
+		r.ring = make([]importedID, importedIDsSize)
+	}
+	key := importedID{channel, id}
+	if _, ok := r.ids[key]; ok {
+		return
+	}
+	if len(r.ids) >= importedIDsSize {
+		// forget the oldest
+		delete(r.ids, r.ring[r.pos])
+	}
+	r.ring[r.pos] = key
+	r.pos = (r.pos + 1) % importedIDsSize
+	r.ids[key] = struct{}{}
+}
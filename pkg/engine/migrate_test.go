@@ -0,0 +1,176 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func waitForMigration(t *testing.T, topic *Topic) *TopicMigrationStats {
+	for i := 0; i < 500; i++ {
+		stats := topic.GetMigrationStats()
+		if stats != nil && stats.Phase == migrationPhaseEmpty {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for migration - %+v", topic.GetMigrationStats())
+	return nil
+}
+
+func TestMigrateTopic(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	targetOpts := NewOptions()
+	targetOpts.Logger = test.NewTestLogger(t)
+	_, targetHTTPAddr, target := mustStartEMSD(targetOpts)
+	defer os.RemoveAll(targetOpts.DataPath)
+	defer target.Exit()
+
+	topic := emsd.GetTopic("migrate_topic")
+	ch1 := topic.GetChannel("ch1")
+	ch2 := topic.GetChannel("ch2")
+	ch2.Pause()
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msgs = append(msgs, msg)
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	waitForDepth(t, ch1, 3)
+	waitForDepth(t, ch2, 3)
+	deferred := NewMessage(topic.GenerateID(), []byte("deferred"))
+	ch1.StartDeferredTimeout(deferred, time.Hour)
+
+	test.Nil(t, topic.Migrate(targetHTTPAddr.String(), false))
+	test.Nil(t, topic.Migrate(targetHTTPAddr.String(), false))
+	test.NotNil(t, topic.Migrate("127.0.0.1:1", false))
+
+	emsd.Lock()
+	m := emsd.metadata()
+	emsd.Unlock()
+	test.Equal(t, targetHTTPAddr.String(), m.Topics[0].MigrateTo)
+
+	stats := waitForMigration(t, topic)
+	test.Equal(t, uint64(7), stats.MigratedCount)
+	test.Equal(t, true, ch1.IsPaused())
+	test.Equal(t, int64(0), ch1.Depth())
+
+	targetTopic, err := target.GetExistingTopic("migrate_topic")
+	test.Nil(t, err)
+	targetCh1, err := targetTopic.GetExistingChannel("ch1")
+	test.Nil(t, err)
+	targetCh2, err := targetTopic.GetExistingChannel("ch2")
+	test.Nil(t, err)
+	test.Equal(t, false, targetCh1.IsPaused())
+	test.Equal(t, true, targetCh2.IsPaused())
+	test.Equal(t, int64(3), targetCh1.Depth())
+	test.Equal(t, int64(3), targetCh2.Depth())
+	test.Equal(t, 1, len(targetCh1.deferredMessages))
+
+	for _, msg := range msgs {
+		got := readChannelMessage(t, targetCh1)
+		test.Equal(t, msg.ID, got.ID)
+		test.Equal(t, msg.Timestamp, got.Timestamp)
+	}
+	item, err := targetCh1.popDeferredMessage(deferred.ID)
+	test.Nil(t, err)
+	test.Equal(t, deferred.Timestamp, item.Value.(*Message).Timestamp)
+
+	// published after the topic is empty
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("late"))))
+	for i := 0; i < 100 && targetCh2.Depth() != 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(4), targetCh2.Depth())
+
+	test.Nil(t, topic.CancelMigration())
+	test.Equal(t, true, topic.GetMigrationStats() == nil)
+	test.NotNil(t, topic.CancelMigration())
+}
+
+func TestMigrateTopicWithoutChannels(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	targetOpts := NewOptions()
+	targetOpts.Logger = test.NewTestLogger(t)
+	_, targetHTTPAddr, target := mustStartEMSD(targetOpts)
+	defer os.RemoveAll(targetOpts.DataPath)
+	defer target.Exit()
+
+	topic := emsd.GetTopic("migrate_topic")
+	topic.Pause()
+	for i := 0; i < 5; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+
+	test.Nil(t, topic.Migrate(targetHTTPAddr.String(), false))
+	stats := waitForMigration(t, topic)
+	test.Equal(t, uint64(5), stats.MigratedCount)
+
+	targetTopic, err := target.GetExistingTopic("migrate_topic")
+	test.Nil(t, err)
+	test.Equal(t, true, targetTopic.IsPaused())
+	test.Equal(t, int64(5), targetTopic.Depth())
+	_, err = targetTopic.GetExistingChannel(migrateChannelName)
+	test.NotNil(t, err)
+}
+
+func TestImportMessagesDedupe(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("import_topic")
+	var batch []migrateMessage
+	for i := 0; i < 3; i++ {
+		batch = append(batch, migrateMessage{msg: NewMessage(topic.GenerateID(), []byte("test"))})
+	}
+	body := encodeMigrateBatch(batch)
+
+	for i := 0; i < 2; i++ {
+		decoded, err := decodeMigrateBatch(bytes.NewReader(body), opts.MaxMsgSize)
+		test.Nil(t, err)
+		test.Equal(t, 3, len(decoded))
+		test.Nil(t, topic.importMessages("ch", decoded))
+	}
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(3), channel.Depth())
+
+	_, err = decodeMigrateBatch(bytes.NewReader(body[:len(body)-1]), opts.MaxMsgSize)
+	test.NotNil(t, err)
+}
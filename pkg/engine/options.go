@@ -23,10 +23,12 @@ package engine
 import (
 	"crypto/md5"
 	"crypto/tls"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/bhojpur/ems/pkg/core/lg"
@@ -42,10 +44,18 @@ type Options struct {
 	TCPAddress               string        `flag:"tcp-address"`
 	HTTPAddress              string        `flag:"http-address"`
 	HTTPSAddress             string        `flag:"https-address"`
+	STOMPAddress             string        `flag:"stomp-address"`
+	KafkaAddress             string        `flag:"kafka-address"`
 	BroadcastAddress         string        `flag:"broadcast-address"`
 	BroadcastTCPPort         int           `flag:"broadcast-tcp-port"`
 	BroadcastHTTPPort        int           `flag:"broadcast-http-port"`
+	Labels                   []string      `flag:"label" cfg:"labels"`
 	EMSLookupdTCPAddresses   []string      `flag:"lookupd-tcp-address" cfg:"emslookupd_tcp_addresses"`
+	EMSLookupdTLS            bool          `flag:"lookupd-tls" cfg:"emslookupd_tls"`
+	EMSLookupdTLSCert        string        `flag:"lookupd-tls-cert" cfg:"emslookupd_tls_cert"`
+	EMSLookupdTLSKey         string        `flag:"lookupd-tls-key" cfg:"emslookupd_tls_key"`
+	EMSLookupdTLSRootCAFile  string        `flag:"lookupd-tls-root-ca-file" cfg:"emslookupd_tls_root_ca_file"`
+	EMSLookupdSecret         string        `flag:"lookupd-secret" cfg:"emslookupd_secret"`
 	AuthHTTPAddresses        []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout" cfg:"http_client_connect_timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout" cfg:"http_client_request_timeout"`
@@ -57,6 +67,38 @@ type Options struct {
 	SyncEvery       int64         `flag:"sync-every"`
 	SyncTimeout     time.Duration `flag:"sync-timeout"`
 
+	MetadataSnapshots int `flag:"metadata-snapshots"`
+
+	DiskQueueCompression       string   `flag:"diskqueue-compression"`
+	TopicDiskQueueCompressions []string `flag:"topic-diskqueue-compression" cfg:"topic_diskqueue_compressions"`
+
+	// encryption at rest
+	DataKeyFile    string `flag:"data-key-file"`
+	DataKeyringEnv string `flag:"data-keyring-env"`
+
+	// backend queue options
+	BackendQueue          string   `flag:"backend-queue"`
+	TopicBackendQueues    []string `flag:"topic-backend-queue" cfg:"topic_backend_queues"`
+	MemoryBackendMaxDepth int64    `flag:"memory-backend-max-depth"`
+
+	// fanout storage options
+	FanoutStorage       string   `flag:"fanout-storage"`
+	TopicFanoutStorages []string `flag:"topic-fanout-storage" cfg:"topic_fanout_storages"`
+
+	// disk space guardrails
+	DiskHighWatermark   float64       `flag:"disk-high-watermark"`
+	DiskLowWatermark    float64       `flag:"disk-low-watermark"`
+	DiskCheckInterval   time.Duration `flag:"disk-check-interval"`
+	DiskFullPauseTopics []string      `flag:"disk-full-pause-topic" cfg:"disk_full_pause_topics"`
+
+	// drain options
+	DrainTimeout        time.Duration `flag:"drain-timeout"`
+	DrainForwardAddress string        `flag:"drain-forward-address"`
+
+	// replication options
+	TopicReplicas []string `flag:"topic-replicas" cfg:"topic_replicas"`
+	ReplicaAcks   int      `flag:"replica-acks"`
+
 	QueueScanInterval        time.Duration
 	QueueScanRefreshInterval time.Duration
 	QueueScanSelectionCount  int `flag:"queue-scan-selection-count"`
@@ -129,6 +171,7 @@ func NewOptions() *Options {
 		BroadcastHTTPPort: 0,
 
 		EMSLookupdTCPAddresses: make([]string, 0),
+		Labels:                 make([]string, 0),
 		AuthHTTPAddresses:      make([]string, 0),
 
 		HTTPClientConnectTimeout: 2 * time.Second,
@@ -139,6 +182,28 @@ func NewOptions() *Options {
 		SyncEvery:       2500,
 		SyncTimeout:     2 * time.Second,
 
+		MetadataSnapshots: 10,
+
+		DiskQueueCompression:       "none",
+		TopicDiskQueueCompressions: make([]string, 0),
+
+		BackendQueue:          "disk",
+		TopicBackendQueues:    make([]string, 0),
+		MemoryBackendMaxDepth: 10000,
+
+		FanoutStorage:       "copy",
+		TopicFanoutStorages: make([]string, 0),
+
+		DiskHighWatermark:   0,
+		DiskLowWatermark:    85,
+		DiskCheckInterval:   5 * time.Second,
+		DiskFullPauseTopics: make([]string, 0),
+
+		DrainTimeout: 5 * time.Minute,
+
+		TopicReplicas: make([]string, 0),
+		ReplicaAcks:   0,
+
 		QueueScanInterval:        100 * time.Millisecond,
 		QueueScanRefreshInterval: 5 * time.Second,
 		QueueScanSelectionCount:  20,
@@ -174,3 +239,47 @@ func NewOptions() *Options {
 		TLSMinVersion: tls.VersionTLS10,
 	}
 }
+
+// parseTopicOverride splits a "<topic>=<value>" per-topic override
+func parseTopicOverride(override string) (string, string, error) {
+	idx := strings.IndexByte(override, '=')
+	if idx <= 0 || idx == len(override)-1 {
+		return "", "", fmt.Errorf("invalid topic override %q, must be <topic>=<value>", override)
+	}
+	return override[:idx], override[idx+1:], nil
+}
+
+// parseLabels parses the "<key>=<value>" topology labels (e.g. zone=a)
+func parseLabels(labels []string) (map[string]string, error) {
+	m := make(map[string]string, len(labels))
+	for _, label := range labels {
+		idx := strings.IndexByte(label, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid label %q, must be <key>=<value>", label)
+		}
+		m[label[:idx]] = label[idx+1:]
+	}
+	return m, nil
+}
+
+// topicOverride returns the value overridden for topicName, a trailing '*'
+// matches every topic with that prefix and the first match wins
+func topicOverride(overrides []string, topicName string) (string, bool) {
+	for _, override := range overrides {
+		pattern, value, err := parseTopicOverride(override)
+		if err != nil {
+			continue
+		}
+		if topicMatches(pattern, topicName) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// topicMatches returns true if the topic name matches the pattern, a trailing
+// * matches a topic prefix
+func topicMatches(pattern string, topicName string) bool {
+	return pattern == topicName ||
+		(strings.HasSuffix(pattern, "*") && strings.HasPrefix(topicName, pattern[:len(pattern)-1]))
+}
@@ -0,0 +1,405 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/protocol"
+)
+
+// Kafka brokers close connections that have been idle for this long
+// (connections.max.idle.ms), clients reconnect transparently
+const kafkaIdleTimeout = 10 * time.Minute
+
+// kafkaAPIVersions are the supported [min, max] versions of each API, these
+// are the newest non-"flexible" versions which every current client speaks
+var kafkaAPIVersions = []struct {
+	Key, Min, Max int16
+}{
+	{kafkaAPIProduce, 3, 8},
+	{kafkaAPIMetadata, 0, 8},
+	{kafkaAPIApiVersions, 0, 2},
+}
+
+// protocolKafka implements the subset of the Kafka protocol needed by producers
+//
+//	ApiVersions -> the APIs below
+//	Metadata    -> every topic has a single partition 0 led by this emsd
+//	Produce     -> MPUB of each record value to the topic of the same name
+//
+// Only v2 record batches (Kafka 0.11+) are accepted, compressed with gzip,
+// snappy or not at all. Messages have no headers so record keys and headers
+// are dropped. Offsets in produce responses are the topic message count and
+// only indicative.
+type protocolKafka struct {
+	emsd *EMSD
+}
+
+func (p *protocolKafka) NewClient(conn net.Conn) protocol.Client {
+	return newKafkaClient(conn)
+}
+
+func (p *protocolKafka) IOLoop(c protocol.Client) error {
+	var err error
+	var req []byte
+
+	client := c.(*kafkaClient)
+	tmp := make([]byte, 4)
+
+	for {
+		client.SetReadDeadline(time.Now().Add(kafkaIdleTimeout))
+		req, err = readKafkaRequest(client.Reader, tmp, p.emsd.getOpts().MaxBodySize)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			} else {
+				err = fmt.Errorf("failed to read request - %s", err)
+			}
+			break
+		}
+
+		var resp []byte
+		resp, err = p.Exec(client, req)
+		if err != nil {
+			// Kafka brokers simply disconnect clients sending requests they don't understand
+			break
+		}
+
+		if resp != nil {
+			err = client.Send(resp)
+			if err != nil {
+				err = fmt.Errorf("failed to send response - %s", err)
+				break
+			}
+		}
+	}
+
+	p.emsd.logf(LOG_INFO, "PROTOCOL(KAFKA): [%s] exiting ioloop", client)
+	atomic.StoreInt32(&client.State, stateClosing)
+
+	return err
+}
+
+// Exec handles a single request, returning the size delimited response or
+// nil if no response should be sent
+func (p *protocolKafka) Exec(client *kafkaClient, req []byte) ([]byte, error) {
+	r := &kafkaReader{b: req}
+	apiKey := r.int16()
+	apiVersion := r.int16()
+	correlationID := r.int32()
+	clientID, _ := r.nullableString()
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid request header - %s", r.err)
+	}
+	client.SetClientID(clientID)
+
+	p.emsd.logf(LOG_DEBUG, "PROTOCOL(KAFKA): [%s] api %d v%d", client, apiKey, apiVersion)
+
+	// ApiVersions must be answered (in v0) even when the version is too new
+	// so that the client can discover what is supported
+	if apiKey != kafkaAPIApiVersions && !kafkaVersionSupported(apiKey, apiVersion) {
+		return nil, fmt.Errorf("unsupported api %d version %d", apiKey, apiVersion)
+	}
+
+	w := &kafkaWriter{}
+	w.int32(0) // size, filled in below
+	w.int32(correlationID)
+
+	var err error
+	switch apiKey {
+	case kafkaAPIApiVersions:
+		p.ApiVersions(w, apiVersion)
+	case kafkaAPIMetadata:
+		err = p.Metadata(w, apiVersion, r)
+	case kafkaAPIProduce:
+		var noResponse bool
+		noResponse, err = p.Produce(client, w, apiVersion, r)
+		if noResponse {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := w.Bytes()
+	binary.BigEndian.PutUint32(resp, uint32(len(resp)-4))
+	return resp, nil
+}
+
+func kafkaVersionSupported(apiKey int16, apiVersion int16) bool {
+	for _, v := range kafkaAPIVersions {
+		if v.Key == apiKey {
+			return apiVersion >= v.Min && apiVersion <= v.Max
+		}
+	}
+	return false
+}
+
+func (p *protocolKafka) ApiVersions(w *kafkaWriter, version int16) {
+	if kafkaVersionSupported(kafkaAPIApiVersions, version) {
+		w.int16(kafkaErrNone)
+	} else {
+		w.int16(kafkaErrUnsupportedVersion)
+		version = 0
+	}
+	w.arrayLen(len(kafkaAPIVersions))
+	for _, v := range kafkaAPIVersions {
+		w.int16(v.Key)
+		w.int16(v.Min)
+		w.int16(v.Max)
+	}
+	if version >= 1 {
+		w.int32(0) // throttle time
+	}
+}
+
+func (p *protocolKafka) Metadata(w *kafkaWriter, version int16, r *kafkaReader) error {
+	var topicNames []string
+	n := r.arrayLen()
+	for i := 0; i < n; i++ {
+		topicNames = append(topicNames, r.string())
+	}
+	if r.err != nil {
+		return fmt.Errorf("invalid Metadata request - %s", r.err)
+	}
+	if n < 0 || (n == 0 && version == 0) {
+		p.emsd.RLock()
+		for name := range p.emsd.topicMap {
+			topicNames = append(topicNames, name)
+		}
+		p.emsd.RUnlock()
+		sort.Strings(topicNames)
+	}
+
+	opts := p.emsd.getOpts()
+	nodeID := int32(opts.ID)
+
+	if version >= 3 {
+		w.int32(0) // throttle time
+	}
+
+	// brokers
+	w.arrayLen(1)
+	w.int32(nodeID)
+	w.string(opts.BroadcastAddress)
+	w.int32(int32(p.emsd.RealKafkaAddr().Port))
+	if version >= 1 {
+		w.nullString() // rack
+	}
+	if version >= 2 {
+		w.nullString() // cluster id
+	}
+	if version >= 1 {
+		w.int32(nodeID) // controller id
+	}
+
+	// topics are reported whether or not they exist yet, they are
+	// created on the first produce just like PUB
+	w.arrayLen(len(topicNames))
+	for _, name := range topicNames {
+		if !protocol.IsValidTopicName(name) {
+			w.int16(kafkaErrInvalidTopic)
+			w.string(name)
+			if version >= 1 {
+				w.bool(false) // is internal
+			}
+			w.arrayLen(0)
+			if version >= 8 {
+				w.int32(0) // topic authorized operations
+			}
+			continue
+		}
+
+		w.int16(kafkaErrNone)
+		w.string(name)
+		if version >= 1 {
+			w.bool(false) // is internal
+		}
+		w.arrayLen(1)
+		w.int16(kafkaErrNone)
+		w.int32(0) // partition index
+		w.int32(nodeID)
+		if version >= 7 {
+			w.int32(0) // leader epoch
+		}
+		w.arrayLen(1) // replicas
+		w.int32(nodeID)
+		w.arrayLen(1) // isr
+		w.int32(nodeID)
+		if version >= 5 {
+			w.arrayLen(0) // offline replicas
+		}
+		if version >= 8 {
+			w.int32(0) // topic authorized operations
+		}
+	}
+
+	if version >= 8 {
+		w.int32(0) // cluster authorized operations
+	}
+	return nil
+}
+
+type kafkaPartitionResult struct {
+	Index      int32
+	ErrorCode  int16
+	ErrorMsg   string
+	BaseOffset int64
+}
+
+// Produce publishes the records of each partition, noResponse is true for acks=0
+func (p *protocolKafka) Produce(client *kafkaClient, w *kafkaWriter, version int16, r *kafkaReader) (bool, error) {
+	r.nullableString() // transactional id
+	acks := r.int16()
+	r.int32() // timeout
+
+	type topicResult struct {
+		Name       string
+		Partitions []kafkaPartitionResult
+	}
+	var results []topicResult
+
+	numTopics := r.arrayLen()
+	for i := 0; i < numTopics && r.err == nil; i++ {
+		tr := topicResult{Name: r.string()}
+		numPartitions := r.arrayLen()
+		for j := 0; j < numPartitions && r.err == nil; j++ {
+			index := r.int32()
+			records := r.bytes()
+			if r.err != nil {
+				break
+			}
+			pr := kafkaPartitionResult{Index: index, BaseOffset: -1}
+			if acks != 0 && acks != 1 && acks != -1 {
+				pr.ErrorCode = kafkaErrInvalidRequiredAcks
+			} else {
+				p.produce(client, tr.Name, records, &pr)
+			}
+			if pr.ErrorCode != kafkaErrNone {
+				p.emsd.logf(LOG_ERROR, "PROTOCOL(KAFKA): [%s] produce to %s[%d] failed (%d) %s",
+					client, tr.Name, index, pr.ErrorCode, pr.ErrorMsg)
+			}
+			tr.Partitions = append(tr.Partitions, pr)
+		}
+		results = append(results, tr)
+	}
+	if r.err != nil {
+		return true, fmt.Errorf("invalid Produce request - %s", r.err)
+	}
+
+	if acks == 0 {
+		return true, nil
+	}
+
+	w.arrayLen(len(results))
+	for _, tr := range results {
+		w.string(tr.Name)
+		w.arrayLen(len(tr.Partitions))
+		for _, pr := range tr.Partitions {
+			w.int32(pr.Index)
+			w.int16(pr.ErrorCode)
+			w.int64(pr.BaseOffset)
+			w.int64(-1) // log append time
+			if version >= 5 {
+				w.int64(0) // log start offset
+			}
+			if version >= 8 {
+				w.arrayLen(0) // record errors
+				if pr.ErrorMsg == "" {
+					w.nullString()
+				} else {
+					w.string(pr.ErrorMsg)
+				}
+			}
+		}
+	}
+	w.int32(0) // throttle time
+	return false, nil
+}
+
+func (p *protocolKafka) produce(client *kafkaClient, topicName string, data []byte, pr *kafkaPartitionResult) {
+	if !protocol.IsValidTopicName(topicName) {
+		pr.ErrorCode = kafkaErrInvalidTopic
+		return
+	}
+	if pr.Index != 0 {
+		pr.ErrorCode = kafkaErrUnknownTopicOrPartition
+		return
+	}
+
+	records, err := decodeKafkaRecordBatches(data)
+	if err != nil {
+		pr.ErrorCode = err.(*kafkaRecordError).Code
+		pr.ErrorMsg = err.Error()
+		return
+	}
+
+	maxMsgSize := p.emsd.getOpts().MaxMsgSize
+	for _, record := range records {
+		if len(record.Value) == 0 {
+			pr.ErrorCode = kafkaErrInvalidRecord
+			pr.ErrorMsg = "record value must not be empty"
+			return
+		}
+		if int64(len(record.Value)) > maxMsgSize {
+			pr.ErrorCode = kafkaErrMessageTooLarge
+			pr.ErrorMsg = fmt.Sprintf("record too big %d > %d", len(record.Value), maxMsgSize)
+			return
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	topic := p.emsd.GetTopic(topicName)
+	msgs := make([]*Message, 0, len(records))
+	for _, record := range records {
+		msgs = append(msgs, NewMessage(topic.GenerateID(), record.Value))
+	}
+
+	pr.BaseOffset = int64(atomic.LoadUint64(&topic.messageCount))
+	err = topic.PutMessages(msgs)
+	if err != nil {
+		pr.ErrorCode = kafkaErrUnknownServerError
+		switch err {
+		case errDiskFull:
+			pr.ErrorCode = kafkaErrKafkaStorageError
+		case errDraining, errReplica:
+			// retriable, clients refresh metadata and find another node
+			pr.ErrorCode = kafkaErrNotLeaderForPartition
+		case errReplicationFailed:
+			pr.ErrorCode = kafkaErrNotEnoughReplicas
+		}
+		pr.ErrorMsg = err.Error()
+		pr.BaseOffset = -1
+		return
+	}
+
+	client.PublishedMessage(topicName, uint64(len(msgs)))
+}
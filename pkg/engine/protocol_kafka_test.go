@@ -0,0 +1,307 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+	"github.com/golang/snappy"
+)
+
+func mustStartKafkaEMSD(t *testing.T, opts *Options) (*net.TCPAddr, *EMSD) {
+	opts.KafkaAddress = "127.0.0.1:0"
+	_, _, emsd := mustStartEMSD(opts)
+	return emsd.RealKafkaAddr(), emsd
+}
+
+// encodeKafkaRecordBatch builds a v2 record batch of values
+func encodeKafkaRecordBatch(codec int16, values ...string) []byte {
+	var records bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	putVarint := func(w *bytes.Buffer, v int64) {
+		w.Write(tmp[:binary.PutVarint(tmp[:], v)])
+	}
+	for i, v := range values {
+		var rec bytes.Buffer
+		rec.WriteByte(0)   // attributes
+		putVarint(&rec, 0) // timestamp delta
+		putVarint(&rec, int64(i))
+		putVarint(&rec, 1) // key length
+		rec.WriteByte('k')
+		putVarint(&rec, int64(len(v)))
+		rec.WriteString(v)
+		putVarint(&rec, 1) // headers
+		putVarint(&rec, 1)
+		rec.WriteByte('h')
+		putVarint(&rec, 1)
+		rec.WriteByte('v')
+		putVarint(&records, int64(rec.Len()))
+		records.Write(rec.Bytes())
+	}
+
+	data := records.Bytes()
+	switch codec {
+	case 1:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		data = buf.Bytes()
+	case 2:
+		w := &kafkaWriter{}
+		w.Write(xerialHeader)
+		w.int32(1)
+		w.int32(1)
+		block := snappy.Encode(nil, data)
+		w.int32(int32(len(block)))
+		w.Write(block)
+		data = w.Bytes()
+	}
+
+	body := &kafkaWriter{}
+	body.int16(codec) // attributes
+	body.int32(int32(len(values) - 1))
+	body.int64(time.Now().UnixNano() / int64(time.Millisecond))
+	body.int64(time.Now().UnixNano() / int64(time.Millisecond))
+	body.int64(-1) // producer id
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(values)))
+	body.Write(data)
+
+	w := &kafkaWriter{}
+	w.int64(0)                             // base offset
+	w.int32(int32(4 + 1 + 4 + body.Len())) // batch length
+	w.int32(0)                             // partition leader epoch
+	w.int8(2)                              // magic
+	w.int32(int32(crc32.Checksum(body.Bytes(), kafkaCRC32C)))
+	w.Write(body.Bytes())
+	return w.Bytes()
+}
+
+func kafkaRequest(t *testing.T, conn net.Conn, apiKey, version int16, body []byte) *kafkaReader {
+	w := &kafkaWriter{}
+	w.int32(0)
+	w.int16(apiKey)
+	w.int16(version)
+	w.int32(42) // correlation id
+	w.string("test-client")
+	w.Write(body)
+	req := w.Bytes()
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+	_, err := conn.Write(req)
+	test.Nil(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := readKafkaRequest(conn, make([]byte, 4), 1024*1024)
+	test.Nil(t, err)
+	r := &kafkaReader{b: resp}
+	test.Equal(t, int32(42), r.int32())
+	return r
+}
+
+func kafkaProduceRequest(acks int16, topicName string, partition int32, records []byte) []byte {
+	w := &kafkaWriter{}
+	w.nullString() // transactional id
+	w.int16(acks)
+	w.int32(1000)
+	w.arrayLen(1)
+	w.string(topicName)
+	w.arrayLen(1)
+	w.int32(partition)
+	w.int32(int32(len(records)))
+	w.Write(records)
+	return w.Bytes()
+}
+
+func TestKafkaRecordBatchDecode(t *testing.T) {
+	for _, codec := range []int16{0, 1, 2} {
+		b := append(encodeKafkaRecordBatch(codec, "a", "bb"), encodeKafkaRecordBatch(codec, "ccc")...)
+		records, err := decodeKafkaRecordBatches(b)
+		test.Nil(t, err)
+		test.Equal(t, 3, len(records))
+		test.Equal(t, []byte("bb"), records[1].Value)
+		test.Equal(t, []byte("ccc"), records[2].Value)
+		test.Equal(t, []byte("k"), records[0].Key)
+		test.Equal(t, []kafkaRecordHeader{{"h", []byte("v")}}, records[0].Headers)
+	}
+
+	b := encodeKafkaRecordBatch(0, "a")
+	b[len(b)-1] ^= 0xff
+	_, err := decodeKafkaRecordBatches(b)
+	test.Equal(t, kafkaErrCorruptMessage, err.(*kafkaRecordError).Code)
+
+	_, err = decodeKafkaRecordBatches(b[:20])
+	test.Equal(t, kafkaErrCorruptMessage, err.(*kafkaRecordError).Code)
+
+	// lz4
+	b = encodeKafkaRecordBatch(3, "a")
+	_, err = decodeKafkaRecordBatches(b)
+	test.Equal(t, kafkaErrUnsupportedCompressionType, err.(*kafkaRecordError).Code)
+}
+
+func TestKafkaApiVersions(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	addr, emsd := mustStartKafkaEMSD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Second)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	r := kafkaRequest(t, conn, kafkaAPIApiVersions, 2, nil)
+	test.Equal(t, kafkaErrNone, r.int16())
+	test.Equal(t, len(kafkaAPIVersions), r.arrayLen())
+
+	// too new versions are answered in v0 with the supported range
+	r = kafkaRequest(t, conn, kafkaAPIApiVersions, 3, nil)
+	test.Equal(t, kafkaErrUnsupportedVersion, r.int16())
+	test.Equal(t, len(kafkaAPIVersions), r.arrayLen())
+	test.Equal(t, kafkaAPIProduce, r.int16())
+	test.Equal(t, int16(3), r.int16())
+	test.Equal(t, int16(8), r.int16())
+}
+
+func TestKafkaProduce(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	addr, emsd := mustStartKafkaEMSD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topicName := "test_kafka" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Second)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	meta := &kafkaWriter{}
+	meta.arrayLen(2)
+	meta.string(topicName)
+	meta.string("invalid/name")
+	r := kafkaRequest(t, conn, kafkaAPIMetadata, 1, meta.Bytes())
+	test.Equal(t, 1, r.arrayLen())
+	test.Equal(t, int32(opts.ID), r.int32())
+	r.string()
+	test.Equal(t, int32(addr.Port), r.int32())
+	r.nullableString()
+	r.int32() // controller
+	test.Equal(t, 2, r.arrayLen())
+	test.Equal(t, kafkaErrNone, r.int16())
+	test.Equal(t, topicName, r.string())
+	r.bool()
+	test.Equal(t, 1, r.arrayLen())
+	r.int16()
+	test.Equal(t, int32(0), r.int32())
+	test.Equal(t, int32(opts.ID), r.int32())
+	r.int32()
+	r.int32()
+	r.int32()
+	r.int32()
+	test.Equal(t, kafkaErrInvalidTopic, r.int16())
+	test.Nil(t, r.err)
+
+	topic := emsd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	r = kafkaRequest(t, conn, kafkaAPIProduce, 8,
+		kafkaProduceRequest(1, topicName, 0, encodeKafkaRecordBatch(1, "one", "two")))
+	test.Equal(t, 1, r.arrayLen())
+	test.Equal(t, topicName, r.string())
+	test.Equal(t, 1, r.arrayLen())
+	test.Equal(t, int32(0), r.int32())
+	test.Equal(t, kafkaErrNone, r.int16())
+	test.Equal(t, int64(0), r.int64())
+
+	// partition 1 does not exist
+	r = kafkaRequest(t, conn, kafkaAPIProduce, 3,
+		kafkaProduceRequest(-1, topicName, 1, encodeKafkaRecordBatch(0, "three")))
+	r.arrayLen()
+	r.string()
+	r.arrayLen()
+	r.int32()
+	test.Equal(t, kafkaErrUnknownTopicOrPartition, r.int16())
+
+	test.Equal(t, int64(2), channel.Depth())
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, []byte("one"), msg.Body)
+
+	stats := emsd.GetStats(topicName, "", true)
+	test.Equal(t, 1, len(stats.Producers))
+	clientStats := stats.Producers[0].(ClientV2Stats)
+	test.Equal(t, "test-client", clientStats.ClientID)
+	test.Equal(t, uint64(2), clientStats.PubCounts[0].Count)
+
+	// acks=0 requests are not answered, the next response must be for ApiVersions
+	w := &kafkaWriter{}
+	w.int32(0)
+	w.int16(kafkaAPIProduce)
+	w.int16(3)
+	w.int32(7)
+	w.nullString()
+	w.Write(kafkaProduceRequest(0, topicName, 0, encodeKafkaRecordBatch(0, "four")))
+	req := w.Bytes()
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+	_, err = conn.Write(req)
+	test.Nil(t, err)
+	r = kafkaRequest(t, conn, kafkaAPIApiVersions, 0, nil)
+	test.Equal(t, kafkaErrNone, r.int16())
+	test.Equal(t, int64(2), channel.Depth()) // "one" was read above
+
+	// unsupported versions disconnect the client
+	kafkaRequestNoReply := &kafkaWriter{}
+	kafkaRequestNoReply.int32(10)
+	kafkaRequestNoReply.int16(kafkaAPIProduce)
+	kafkaRequestNoReply.int16(9)
+	kafkaRequestNoReply.int32(1)
+	kafkaRequestNoReply.nullString()
+	_, err = conn.Write(kafkaRequestNoReply.Bytes())
+	test.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	test.Equal(t, io.EOF, err)
+}
+
+func TestKafkaAuthRequired(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "ems-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
+	opts.KafkaAddress = "127.0.0.1:0"
+	opts.AuthHTTPAddresses = []string{"127.0.0.1:1"}
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
@@ -0,0 +1,689 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/auth"
+	"github.com/bhojpur/ems/pkg/core/protocol"
+	"github.com/bhojpur/ems/pkg/core/version"
+)
+
+// protocolSTOMP implements a STOMP 1.1/1.2 server on top of topics and channels
+//
+//	SEND        -> PUB (or DPUB with an `ems-defer` header, in milliseconds)
+//	SUBSCRIBE   -> SUB (the `destination` is the topic, the `ems-channel` header the channel)
+//	ACK         -> FIN
+//	NACK        -> REQ (optionally delayed by an `ems-requeue-delay` header, in milliseconds)
+//
+// A SUBSCRIBE `ems-rdy` header sets how many messages may be in-flight
+// (default 1, bounded by --max-rdy-count). In "auto" ack mode messages are
+// finished as soon as they are written, "client" acknowledgements are
+// cumulative and "client-individual" acknowledgements are not.
+type protocolSTOMP struct {
+	emsd *EMSD
+}
+
+func (p *protocolSTOMP) NewClient(conn net.Conn) protocol.Client {
+	return newStompClient(conn, p.emsd)
+}
+
+func (p *protocolSTOMP) IOLoop(c protocol.Client) error {
+	var err error
+	var frame *stompFrame
+	var zeroTime time.Time
+
+	client := c.(*stompClient)
+
+	for {
+		switch {
+		case client.ReadTimeout > 0:
+			client.SetReadDeadline(time.Now().Add(client.ReadTimeout))
+		case atomic.LoadInt32(&client.State) == stateInit:
+			// bound how long a connection can sit idle before CONNECT
+			client.SetReadDeadline(time.Now().Add(p.emsd.getOpts().ClientTimeout))
+		default:
+			client.SetReadDeadline(zeroTime)
+		}
+
+		frame, err = readStompFrame(client.Reader, p.emsd.getOpts().MaxBodySize)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			} else {
+				err = fmt.Errorf("failed to read frame - %s", err)
+				p.sendError(client, nil, protocol.NewFatalClientErr(nil, "E_BAD_FRAME", err.Error()))
+			}
+			break
+		}
+		if frame == nil {
+			// heart-beat
+			continue
+		}
+
+		p.emsd.logf(LOG_DEBUG, "PROTOCOL(STOMP): [%s] %s %v", client, frame.Command, frame.Headers)
+
+		var response *stompFrame
+		response, err = p.Exec(client, frame)
+		if err != nil {
+			ctx := ""
+			if parentErr := err.(protocol.ChildErr).Parent(); parentErr != nil {
+				ctx = " - " + parentErr.Error()
+			}
+			p.emsd.logf(LOG_ERROR, "[%s] - %s%s", client, err, ctx)
+
+			// STOMP requires that the connection is closed after an ERROR frame
+			// so only fatal errors are reported, others are just logged
+			if _, ok := err.(*protocol.FatalClientErr); ok {
+				p.sendError(client, frame, err.(*protocol.FatalClientErr))
+				break
+			}
+			err = nil
+			continue
+		}
+
+		if response != nil {
+			err = client.Send(response)
+			if err != nil {
+				err = fmt.Errorf("failed to send response - %s", err)
+				break
+			}
+		}
+
+		if receipt, ok := frame.Header("receipt"); ok {
+			err = client.Send(newStompFrame("RECEIPT", "receipt-id", receipt))
+			if err != nil {
+				err = fmt.Errorf("failed to send receipt - %s", err)
+				break
+			}
+		}
+
+		if frame.Command == "DISCONNECT" {
+			break
+		}
+	}
+
+	p.emsd.logf(LOG_INFO, "PROTOCOL(STOMP): [%s] exiting ioloop", client)
+	atomic.StoreInt32(&client.State, stateClosing)
+	close(client.ExitChan)
+	client.metaLock.Lock()
+	subs := make([]*stompSubscription, 0, len(client.subscriptions))
+	for id, sub := range client.subscriptions {
+		subs = append(subs, sub)
+		delete(client.subscriptions, id)
+	}
+	client.metaLock.Unlock()
+	for _, sub := range subs {
+		sub.exit()
+		sub.Channel.RemoveClient(sub.ID)
+	}
+
+	return err
+}
+
+func (p *protocolSTOMP) sendError(client *stompClient, frame *stompFrame, err *protocol.FatalClientErr) {
+	resp := newStompFrame("ERROR", "message", err.Code, "content-type", "text/plain")
+	if frame != nil {
+		if receipt, ok := frame.Header("receipt"); ok {
+			resp.AddHeader("receipt-id", receipt)
+		}
+	}
+	resp.Body = []byte(err.Desc)
+	sendErr := client.Send(resp)
+	if sendErr != nil {
+		p.emsd.logf(LOG_ERROR, "[%s] - %s", client, sendErr)
+	}
+}
+
+func (p *protocolSTOMP) Exec(client *stompClient, frame *stompFrame) (*stompFrame, error) {
+	switch frame.Command {
+	case "CONNECT", "STOMP":
+		return p.CONNECT(client, frame)
+	}
+	if atomic.LoadInt32(&client.State) != stateConnected {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("cannot %s before CONNECT", frame.Command))
+	}
+	switch frame.Command {
+	case "SEND":
+		return p.SEND(client, frame)
+	case "SUBSCRIBE":
+		return p.SUBSCRIBE(client, frame)
+	case "UNSUBSCRIBE":
+		return p.UNSUBSCRIBE(client, frame)
+	case "ACK":
+		return p.ACK(client, frame)
+	case "NACK":
+		return p.NACK(client, frame)
+	case "DISCONNECT":
+		return nil, nil
+	case "BEGIN", "COMMIT", "ABORT":
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "transactions are not supported")
+	}
+	return nil, protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", frame.Command))
+}
+
+func (p *protocolSTOMP) CONNECT(client *stompClient, frame *stompFrame) (*stompFrame, error) {
+	if atomic.LoadInt32(&client.State) != stateInit {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot CONNECT in current state")
+	}
+
+	acceptVersion, _ := frame.Header("accept-version")
+	var stompVersion string
+	for _, v := range strings.Split(acceptVersion, ",") {
+		switch v {
+		case "1.2":
+			stompVersion = v
+		case "1.1":
+			if stompVersion == "" {
+				stompVersion = v
+			}
+		}
+	}
+	if stompVersion == "" {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_PROTOCOL",
+			fmt.Sprintf("unsupported protocol version(s) %q, supported versions are 1.1,1.2", acceptVersion))
+	}
+
+	if clientID, ok := frame.Header("client-id"); ok {
+		client.metaLock.Lock()
+		client.ClientID = clientID
+		client.metaLock.Unlock()
+	}
+
+	if p.emsd.IsAuthEnabled() {
+		secret, ok := frame.Header("passcode")
+		if !ok {
+			return nil, protocol.NewFatalClientErr(nil, "E_AUTH_FIRST", "CONNECT requires a passcode")
+		}
+		remoteIP, _, err := net.SplitHostPort(client.String())
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_AUTH_FAILED", "AUTH failed")
+		}
+		opts := p.emsd.getOpts()
+		authState, err := auth.QueryAnyAuthd(opts.AuthHTTPAddresses, remoteIP,
+			opts.TLSRequired != TLSNotRequired, "", secret,
+			opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
+		if err != nil {
+			// we don't want to leak errors contacting the auth server to untrusted clients
+			p.emsd.logf(LOG_WARN, "PROTOCOL(STOMP): [%s] AUTH failed %s", client, err)
+			return nil, protocol.NewFatalClientErr(err, "E_AUTH_FAILED", "AUTH failed")
+		}
+		if len(authState.Authorizations) == 0 {
+			return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED", "AUTH no authorizations found")
+		}
+		client.metaLock.Lock()
+		client.AuthState = authState
+		client.metaLock.Unlock()
+	}
+
+	// negotiate heart-beats, see https://stomp.github.io/stomp-specification-1.2.html#Heart-beating
+	var cx, cy int64
+	if hb, ok := frame.Header("heart-beat"); ok {
+		parts := strings.Split(hb, ",")
+		var err error
+		if len(parts) == 2 {
+			cx, err = strconv.ParseInt(parts[0], 10, 64)
+			if err == nil {
+				cy, err = strconv.ParseInt(parts[1], 10, 64)
+			}
+		}
+		if len(parts) != 2 || err != nil || cx < 0 || cy < 0 {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_HEADER",
+				fmt.Sprintf("invalid heart-beat header %q", hb))
+		}
+	}
+	desired := int64(p.emsd.getOpts().ClientTimeout / 2 / time.Millisecond)
+	var sx, sy int64
+	if cy > 0 {
+		sx = cy
+		if sx < desired {
+			sx = desired
+		}
+	}
+	if cx > 0 {
+		sy = cx
+		if sy < desired {
+			sy = desired
+		}
+	}
+	client.HeartbeatInterval = time.Duration(sx) * time.Millisecond
+	client.ReadTimeout = time.Duration(sy) * time.Millisecond * 2
+
+	if client.HeartbeatInterval > 0 {
+		go p.heartbeatLoop(client)
+	}
+
+	atomic.StoreInt32(&client.State, stateConnected)
+
+	return newStompFrame("CONNECTED",
+		"version", stompVersion,
+		"server", "emsd/"+version.Binary,
+		"heart-beat", fmt.Sprintf("%d,%d", sx, sy),
+	), nil
+}
+
+func (p *protocolSTOMP) heartbeatLoop(client *stompClient) {
+	ticker := time.NewTicker(client.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := client.SendHeartbeat()
+			if err != nil {
+				p.emsd.logf(LOG_ERROR, "PROTOCOL(STOMP): [%s] failed to send heart-beat - %s", client, err)
+				client.Close()
+				return
+			}
+		case <-client.ExitChan:
+			return
+		}
+	}
+}
+
+func (p *protocolSTOMP) CheckAuth(client *stompClient, cmd, topicName, channelName string) error {
+	if !p.emsd.IsAuthEnabled() {
+		return nil
+	}
+	client.metaLock.RLock()
+	ok, _ := client.IsAuthorized(topicName, channelName)
+	client.metaLock.RUnlock()
+	if !ok {
+		return protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("AUTH failed for %s on %q %q", cmd, topicName, channelName))
+	}
+	return nil
+}
+
+// destinationTopic maps a STOMP destination (`/topic/<name>` or `<name>`) to a topic name
+func destinationTopic(frame *stompFrame) (string, error) {
+	destination, ok := frame.Header("destination")
+	if !ok {
+		return "", protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("%s missing destination header", frame.Command))
+	}
+	topicName := strings.TrimPrefix(destination, "/topic/")
+	if !protocol.IsValidTopicName(topicName) {
+		return "", protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("%s topic name %q is not valid", frame.Command, topicName))
+	}
+	return topicName, nil
+}
+
+func (p *protocolSTOMP) SEND(client *stompClient, frame *stompFrame) (*stompFrame, error) {
+	if _, ok := frame.Header("transaction"); ok {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "transactions are not supported")
+	}
+
+	topicName, err := destinationTopic(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(frame.Body) == 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE", "SEND invalid message body size 0")
+	}
+
+	if int64(len(frame.Body)) > p.emsd.getOpts().MaxMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("SEND message too big %d > %d", len(frame.Body), p.emsd.getOpts().MaxMsgSize))
+	}
+
+	var deferred time.Duration
+	if ds, ok := frame.Header("ems-defer"); ok {
+		timeoutMs, err := strconv.ParseInt(ds, 10, 64)
+		deferred = time.Duration(timeoutMs) * time.Millisecond
+		if err != nil || deferred < 0 || deferred > p.emsd.getOpts().MaxReqTimeout {
+			return nil, protocol.NewFatalClientErr(err, "E_INVALID",
+				fmt.Sprintf("SEND ems-defer %q out of range 0-%d",
+					ds, p.emsd.getOpts().MaxReqTimeout/time.Millisecond))
+		}
+	}
+
+	if err := p.CheckAuth(client, "SEND", topicName, ""); err != nil {
+		return nil, err
+	}
+
+	topic := p.emsd.GetTopic(topicName)
+	msg := NewMessage(topic.GenerateID(), frame.Body)
+	msg.deferred = deferred
+	err = topic.PutMessage(msg)
+	if err != nil {
+		return nil, publishErr(err, "E_PUB_FAILED", "SEND failed")
+	}
+
+	client.PublishedMessage(topicName, 1)
+
+	return nil, nil
+}
+
+func (p *protocolSTOMP) SUBSCRIBE(client *stompClient, frame *stompFrame) (*stompFrame, error) {
+	subID, ok := frame.Header("id")
+	if !ok {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "SUBSCRIBE missing id header")
+	}
+
+	topicName, err := destinationTopic(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	channelName, _ := frame.Header("ems-channel")
+	if !protocol.IsValidChannelName(channelName) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_CHANNEL",
+			fmt.Sprintf("SUBSCRIBE channel name %q is not valid", channelName))
+	}
+
+	ackMode, ok := frame.Header("ack")
+	if !ok {
+		ackMode = stompAckAuto
+	}
+	switch ackMode {
+	case stompAckAuto, stompAckClient, stompAckClientIndividual:
+	default:
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("SUBSCRIBE invalid ack mode %q", ackMode))
+	}
+
+	count := int64(1)
+	if rdy, ok := frame.Header("ems-rdy"); ok {
+		count, err = strconv.ParseInt(rdy, 10, 64)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_INVALID",
+				fmt.Sprintf("SUBSCRIBE could not parse ems-rdy %s", rdy))
+		}
+	}
+	if count < 1 || count > p.emsd.getOpts().MaxRdyCount {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("SUBSCRIBE ems-rdy %d out of range 1-%d", count, p.emsd.getOpts().MaxRdyCount))
+	}
+
+	client.metaLock.RLock()
+	_, exists := client.subscriptions[subID]
+	client.metaLock.RUnlock()
+	if exists {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("SUBSCRIBE id %q already in use", subID))
+	}
+
+	if err := p.CheckAuth(client, "SUBSCRIBE", topicName, channelName); err != nil {
+		return nil, err
+	}
+
+	// every subscription is registered with its channel as a distinct consumer
+	id := atomic.AddInt64(&p.emsd.clientIDSequence, 1)
+
+	// see protocolV2.SUB for the reasoning behind this retry-loop
+	var sub *stompSubscription
+	for i := 1; ; i++ {
+		topic := p.emsd.GetTopic(topicName)
+		channel := topic.GetChannel(channelName)
+		sub = newStompSubscription(id, subID, ackMode, count, channel, client)
+		if err := channel.AddClient(id, sub); err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_SUB_FAILED", "SUBSCRIBE failed "+err.Error())
+		}
+
+		if (channel.ephemeral && channel.Exiting()) || (topic.ephemeral && topic.Exiting()) {
+			channel.RemoveClient(id)
+			if i < 2 {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return nil, protocol.NewFatalClientErr(nil, "E_SUB_FAILED", "SUBSCRIBE failed to deleted topic/channel")
+		}
+		break
+	}
+
+	client.metaLock.Lock()
+	client.subscriptions[subID] = sub
+	client.metaLock.Unlock()
+
+	destination, _ := frame.Header("destination")
+	go p.messagePump(client, sub, destination)
+
+	return nil, nil
+}
+
+func (p *protocolSTOMP) UNSUBSCRIBE(client *stompClient, frame *stompFrame) (*stompFrame, error) {
+	subID, ok := frame.Header("id")
+	if !ok {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "UNSUBSCRIBE missing id header")
+	}
+
+	client.metaLock.Lock()
+	sub, ok := client.subscriptions[subID]
+	delete(client.subscriptions, subID)
+	client.metaLock.Unlock()
+	if !ok {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("UNSUBSCRIBE unknown subscription %q", subID))
+	}
+
+	sub.exit()
+	sub.Channel.RemoveClient(sub.ID)
+
+	return nil, nil
+}
+
+// stompAckID is the value of the MESSAGE `ack` header (and the ACK/NACK `id` header)
+func stompAckID(sub *stompSubscription, id MessageID) string {
+	return fmt.Sprintf("%d-%s", sub.ID, id[:])
+}
+
+// getAckTarget resolves the subscription and message referenced by an ACK or NACK
+func (p *protocolSTOMP) getAckTarget(client *stompClient, frame *stompFrame) (*stompSubscription, *MessageID, error) {
+	var sub *stompSubscription
+	var msgID string
+
+	client.metaLock.RLock()
+	defer client.metaLock.RUnlock()
+
+	if ackID, ok := frame.Header("id"); ok {
+		// STOMP 1.2
+		idx := strings.IndexByte(ackID, '-')
+		if idx == -1 {
+			return nil, nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+				fmt.Sprintf("%s invalid id %q", frame.Command, ackID))
+		}
+		id, err := strconv.ParseInt(ackID[:idx], 10, 64)
+		if err != nil {
+			return nil, nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+				fmt.Sprintf("%s invalid id %q", frame.Command, ackID))
+		}
+		for _, s := range client.subscriptions {
+			if s.ID == id {
+				sub = s
+				break
+			}
+		}
+		msgID = ackID[idx+1:]
+	} else {
+		// STOMP 1.1
+		subID, _ := frame.Header("subscription")
+		sub = client.subscriptions[subID]
+		msgID, _ = frame.Header("message-id")
+	}
+
+	if sub == nil {
+		return nil, nil, protocol.NewClientErr(nil, "E_INVALID",
+			fmt.Sprintf("%s for unknown subscription", frame.Command))
+	}
+	if sub.AckMode == stompAckAuto {
+		return nil, nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("cannot %s in auto ack mode", frame.Command))
+	}
+
+	id, err := getMessageID([]byte(msgID))
+	if err != nil {
+		return nil, nil, protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+	}
+	return sub, id, nil
+}
+
+func (p *protocolSTOMP) ACK(client *stompClient, frame *stompFrame) (*stompFrame, error) {
+	sub, id, err := p.getAckTarget(client, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	// finish all of them even if some fail
+	var failed []string
+	for _, pid := range sub.popPending(*id) {
+		err := sub.Channel.FinishMessage(sub.ID, pid)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s %s", pid, err))
+			continue
+		}
+		sub.FinishedMessage()
+	}
+	if len(failed) > 0 {
+		return nil, protocol.NewClientErr(nil, "E_FIN_FAILED",
+			fmt.Sprintf("ACK failed %s", strings.Join(failed, ", ")))
+	}
+
+	return nil, nil
+}
+
+func (p *protocolSTOMP) NACK(client *stompClient, frame *stompFrame) (*stompFrame, error) {
+	sub, id, err := p.getAckTarget(client, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	var timeoutDuration time.Duration
+	if ds, ok := frame.Header("ems-requeue-delay"); ok {
+		timeoutMs, err := strconv.ParseInt(ds, 10, 64)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_INVALID",
+				fmt.Sprintf("NACK could not parse ems-requeue-delay %s", ds))
+		}
+		timeoutDuration = time.Duration(timeoutMs) * time.Millisecond
+		maxReqTimeout := p.emsd.getOpts().MaxReqTimeout
+		if timeoutDuration < 0 {
+			timeoutDuration = 0
+		} else if timeoutDuration > maxReqTimeout {
+			timeoutDuration = maxReqTimeout
+		}
+	}
+
+	// requeue all of them even if some fail
+	var failed []string
+	for _, pid := range sub.popPending(*id) {
+		err := sub.Channel.RequeueMessage(sub.ID, pid, timeoutDuration)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s %s", pid, err))
+			continue
+		}
+		sub.RequeuedMessage()
+	}
+	if len(failed) > 0 {
+		return nil, protocol.NewClientErr(nil, "E_REQ_FAILED",
+			fmt.Sprintf("NACK failed %s", strings.Join(failed, ", ")))
+	}
+
+	return nil, nil
+}
+
+func (p *protocolSTOMP) messagePump(client *stompClient, sub *stompSubscription, destination string) {
+	var err error
+	var memoryMsgChan chan *Message
+	var backendMsgChan <-chan []byte
+
+	msgTimeout := p.emsd.getOpts().MsgTimeout
+
+	for {
+		if sub.IsReadyForMessages() {
+			memoryMsgChan = sub.Channel.memoryMsgChan
+			backendMsgChan = sub.Channel.backend.ReadChan()
+		} else {
+			memoryMsgChan = nil
+			backendMsgChan = nil
+		}
+
+		select {
+		case <-sub.ReadyStateChan:
+		case b := <-backendMsgChan:
+			msg, decodeErr := decodeMessage(b)
+			if decodeErr != nil {
+				p.emsd.logf(LOG_ERROR, "failed to decode message - %s", decodeErr)
+				continue
+			}
+			err = p.sendMessage(client, sub, destination, msg, msgTimeout)
+		case msg := <-memoryMsgChan:
+			err = p.sendMessage(client, sub, destination, msg, msgTimeout)
+		case <-sub.ExitChan:
+			goto exit
+		}
+		if err != nil {
+			goto exit
+		}
+	}
+
+exit:
+	p.emsd.logf(LOG_INFO, "PROTOCOL(STOMP): [%s] exiting messagePump for subscription %s", client, sub.SubID)
+	if err != nil {
+		p.emsd.logf(LOG_ERROR, "PROTOCOL(STOMP): [%s] messagePump error - %s", client, err)
+		client.Close()
+	}
+}
+
+func (p *protocolSTOMP) sendMessage(client *stompClient, sub *stompSubscription,
+	destination string, msg *Message, msgTimeout time.Duration) error {
+	msg.Attempts++
+
+	sub.Channel.StartInFlightTimeout(msg, sub.ID, msgTimeout)
+	sub.SendingMessage(msg.ID)
+
+	frame := newStompFrame("MESSAGE",
+		"subscription", sub.SubID,
+		"message-id", string(msg.ID[:]),
+		"destination", destination,
+		"ems-attempts", strconv.Itoa(int(msg.Attempts)),
+		"ems-timestamp", strconv.FormatInt(msg.Timestamp, 10),
+	)
+	if sub.AckMode != stompAckAuto {
+		frame.AddHeader("ack", stompAckID(sub, msg.ID))
+	}
+	frame.Body = msg.Body
+
+	err := client.Send(frame)
+	if err != nil {
+		return err
+	}
+
+	if sub.AckMode == stompAckAuto {
+		// messages are only finished once written, if the write fails
+		// they time out and are redelivered like any other in-flight message
+		err = sub.Channel.FinishMessage(sub.ID, msg.ID)
+		if err != nil {
+			p.emsd.logf(LOG_ERROR, "PROTOCOL(STOMP): [%s] failed to finish msg(%s) - %s", client, msg.ID, err)
+		}
+		sub.FinishedMessage()
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func mustStartSTOMPEMSD(t *testing.T, opts *Options) (*net.TCPAddr, *EMSD) {
+	opts.STOMPAddress = "127.0.0.1:0"
+	_, _, emsd := mustStartEMSD(opts)
+	return emsd.RealSTOMPAddr(), emsd
+}
+
+type stompTestConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func stompConnect(t *testing.T, addr *net.TCPAddr) *stompTestConn {
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Second)
+	test.Nil(t, err)
+	c := &stompTestConn{Conn: conn, r: bufio.NewReader(conn)}
+	c.send(t, newStompFrame("CONNECT", "accept-version", "1.2", "host", "localhost"))
+	f := c.read(t)
+	test.Equal(t, "CONNECTED", f.Command)
+	v, _ := f.Header("version")
+	test.Equal(t, "1.2", v)
+	return c
+}
+
+func (c *stompTestConn) send(t *testing.T, f *stompFrame) {
+	err := writeStompFrame(c, f)
+	test.Nil(t, err)
+}
+
+func (c *stompTestConn) read(t *testing.T) *stompFrame {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		f, err := readStompFrame(c.r, 1024*1024)
+		test.Nil(t, err)
+		if f != nil {
+			return f
+		}
+	}
+}
+
+func TestStompFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	f := newStompFrame("MESSAGE", "weird:key", "line\nbreak", "back\\slash", "x")
+	f.Body = []byte("body\x00with null")
+	test.Nil(t, writeStompFrame(&buf, f))
+
+	r := bufio.NewReader(&buf)
+	rf, err := readStompFrame(r, 1024)
+	test.Nil(t, err)
+	test.Equal(t, "MESSAGE", rf.Command)
+	v, _ := rf.Header("weird:key")
+	test.Equal(t, "line\nbreak", v)
+	v, _ = rf.Header("back\\slash")
+	test.Equal(t, "x", v)
+	test.Equal(t, f.Body, rf.Body)
+
+	// NULL terminated body without a content-length, preceded by heart-beats
+	r = bufio.NewReader(bytes.NewBufferString("\n\r\nSEND\ndestination:t\n\nhello\x00"))
+	rf, err = readStompFrame(r, 1024)
+	test.Nil(t, err)
+	test.Equal(t, (*stompFrame)(nil), rf)
+	rf, err = readStompFrame(r, 1024)
+	test.Nil(t, err)
+	rf, err = readStompFrame(r, 1024)
+	test.Nil(t, err)
+	test.Equal(t, "SEND", rf.Command)
+	test.Equal(t, []byte("hello"), rf.Body)
+
+	r = bufio.NewReader(bytes.NewBufferString("SEND\ncontent-length:2048\n\n"))
+	_, err = readStompFrame(r, 1024)
+	test.Equal(t, errStompFrameTooBig, err)
+}
+
+func TestStompSendSubscribe(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	addr, emsd := mustStartSTOMPEMSD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topicName := "test_stomp" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn := stompConnect(t, addr)
+	defer conn.Close()
+
+	conn.send(t, newStompFrame("SUBSCRIBE", "id", "0", "destination", "/topic/"+topicName,
+		"ems-channel", "ch", "ack", "client-individual", "receipt", "r1"))
+	f := conn.read(t)
+	test.Equal(t, "RECEIPT", f.Command)
+
+	send := newStompFrame("SEND", "destination", "/topic/"+topicName, "receipt", "r2")
+	send.Body = []byte("test body")
+	conn.send(t, send)
+
+	// the RECEIPT and MESSAGE frames can race
+	var msg *stompFrame
+	for i := 0; i < 2; i++ {
+		f = conn.read(t)
+		if f.Command == "MESSAGE" {
+			msg = f
+		} else {
+			test.Equal(t, "RECEIPT", f.Command)
+		}
+	}
+	test.NotNil(t, msg)
+	test.Equal(t, []byte("test body"), msg.Body)
+	sub, _ := msg.Header("subscription")
+	test.Equal(t, "0", sub)
+	attempts, _ := msg.Header("ems-attempts")
+	test.Equal(t, "1", attempts)
+
+	stats := emsd.GetStats(topicName, "ch", true)
+	test.Equal(t, 1, len(stats.Topics[0].Channels[0].Clients))
+	test.Equal(t, 1, stats.Topics[0].Channels[0].InFlightCount)
+	test.Equal(t, 1, len(stats.Producers))
+
+	ackID, _ := msg.Header("ack")
+	conn.send(t, newStompFrame("ACK", "id", ackID, "receipt", "r3"))
+	f = conn.read(t)
+	test.Equal(t, "RECEIPT", f.Command)
+
+	stats = emsd.GetStats(topicName, "ch", true)
+	test.Equal(t, 0, stats.Topics[0].Channels[0].InFlightCount)
+	clientStats := stats.Topics[0].Channels[0].Clients[0].(ClientV2Stats)
+	test.Equal(t, uint64(1), clientStats.FinishCount)
+}
+
+func TestStompNackRequeue(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	addr, emsd := mustStartSTOMPEMSD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topicName := "test_stomp_nack" + strconv.Itoa(int(time.Now().Unix()))
+	topic := emsd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	conn := stompConnect(t, addr)
+	defer conn.Close()
+
+	conn.send(t, newStompFrame("SUBSCRIBE", "id", "0", "destination", topicName,
+		"ems-channel", "ch", "ack", "client"))
+	msg := conn.read(t)
+	test.Equal(t, "MESSAGE", msg.Command)
+
+	ackID, _ := msg.Header("ack")
+	conn.send(t, newStompFrame("NACK", "id", ackID))
+
+	msg = conn.read(t)
+	test.Equal(t, "MESSAGE", msg.Command)
+	attempts, _ := msg.Header("ems-attempts")
+	test.Equal(t, "2", attempts)
+
+	channel, _ := topic.GetExistingChannel("ch")
+	test.Equal(t, uint64(1), channel.requeueCount)
+}
+
+func TestStompMaxRdyCount(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxRdyCount = 50
+	addr, emsd := mustStartSTOMPEMSD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	conn := stompConnect(t, addr)
+	defer conn.Close()
+
+	conn.send(t, newStompFrame("SUBSCRIBE", "id", "0", "destination", "test_stomp_rdy",
+		"ems-channel", "ch", "ack", "client", "ems-rdy", "51"))
+	f := conn.read(t)
+	test.Equal(t, "ERROR", f.Command)
+	code, _ := f.Header("message")
+	test.Equal(t, "E_INVALID", code)
+}
+
+func TestStompMaxChannelConsumers(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxChannelConsumers = 1
+	addr, emsd := mustStartSTOMPEMSD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	conn := stompConnect(t, addr)
+	defer conn.Close()
+
+	conn.send(t, newStompFrame("SUBSCRIBE", "id", "0", "destination", "test_stomp_consumers",
+		"ems-channel", "ch", "receipt", "r1"))
+	f := conn.read(t)
+	test.Equal(t, "RECEIPT", f.Command)
+
+	conn.send(t, newStompFrame("SUBSCRIBE", "id", "1", "destination", "test_stomp_consumers",
+		"ems-channel", "ch"))
+	f = conn.read(t)
+	test.Equal(t, "ERROR", f.Command)
+	code, _ := f.Header("message")
+	test.Equal(t, "E_SUB_FAILED", code)
+}
+
+func TestStompCumulativeAck(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	addr, emsd := mustStartSTOMPEMSD(t, opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topicName := "test_stomp_ack" + strconv.Itoa(int(time.Now().Unix()))
+	topic := emsd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+
+	conn := stompConnect(t, addr)
+	defer conn.Close()
+
+	conn.send(t, newStompFrame("SUBSCRIBE", "id", "0", "destination", topicName,
+		"ems-channel", "ch", "ack", "client", "ems-rdy", "3"))
+	var ids []MessageID
+	var ackID string
+	for i := 0; i < 3; i++ {
+		msg := conn.read(t)
+		test.Equal(t, "MESSAGE", msg.Command)
+		msgID, _ := msg.Header("message-id")
+		id, err := getMessageID([]byte(msgID))
+		test.Nil(t, err)
+		ids = append(ids, *id)
+		ackID, _ = msg.Header("ack")
+	}
+
+	var sub *stompSubscription
+	channel.RLock()
+	for _, c := range channel.clients {
+		sub = c.(*stompSubscription)
+	}
+	channel.RUnlock()
+
+	// the first one times out, it's no longer pending
+	msg, err := channel.popInFlightMessage(sub.ID, ids[0])
+	test.Nil(t, err)
+	channel.removeFromInFlightPQ(msg)
+	sub.TimedOutMessage(ids[0])
+	test.Equal(t, []MessageID{ids[1], ids[2]}, sub.pending)
+
+	// the second one can't be finished anymore, the third one still is
+	msg, err = channel.popInFlightMessage(sub.ID, ids[1])
+	test.Nil(t, err)
+	channel.removeFromInFlightPQ(msg)
+	conn.send(t, newStompFrame("ACK", "id", ackID, "receipt", "r1"))
+	// the failure is only logged, without a receipt
+	send := newStompFrame("SEND", "destination", topicName+"_other", "receipt", "r2")
+	send.Body = []byte("test body")
+	conn.send(t, send)
+	f := conn.read(t)
+	test.Equal(t, "RECEIPT", f.Command)
+	receipt, _ := f.Header("receipt-id")
+	test.Equal(t, "r2", receipt)
+
+	test.Equal(t, 0, len(sub.pending))
+	test.Equal(t, uint64(1), atomic.LoadUint64(&sub.FinishCount))
+	stats := emsd.GetStats(topicName, "ch", false)
+	test.Equal(t, 0, stats.Topics[0].Channels[0].InFlightCount)
+}
@@ -826,7 +826,7 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 	msg := NewMessage(topic.GenerateID(), messageBody)
 	err = topic.PutMessage(msg)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
+		return nil, publishErr(err, "E_PUB_FAILED", "PUB failed")
 	}
 
 	client.PublishedMessage(topicName, 1)
@@ -879,7 +879,7 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	// this next call (and no messages will be queued in that case)
 	err = topic.PutMessages(messages)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
+		return nil, publishErr(err, "E_MPUB_FAILED", "MPUB failed")
 	}
 
 	client.PublishedMessage(topicName, uint64(len(messages)))
@@ -887,6 +887,20 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	return okBytes, nil
 }
 
+// publishErr returns the client error for a failed publish, publishes which
+// can be retried (later, or on another node) don't close the connection
+func publishErr(err error, code string, desc string) error {
+	switch err {
+	case errDiskFull:
+		return protocol.NewClientErr(err, "E_DISK_FULL", desc+" "+err.Error())
+	case errDraining:
+		return protocol.NewClientErr(err, "E_DRAINING", desc+" "+err.Error())
+	case errReplicationFailed:
+		return protocol.NewClientErr(err, "E_REPLICATION_FAILED", desc+" "+err.Error())
+	}
+	return protocol.NewFatalClientErr(err, code, desc+" "+err.Error())
+}
+
 func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	var err error
 
@@ -943,7 +957,7 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	msg.deferred = timeoutDuration
 	err = topic.PutMessage(msg)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_DPUB_FAILED", "DPUB failed "+err.Error())
+		return nil, publishErr(err, "E_DPUB_FAILED", "DPUB failed")
 	}
 
 	client.PublishedMessage(topicName, 1)
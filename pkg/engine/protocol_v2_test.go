@@ -1622,6 +1622,8 @@ func testIOLoopReturnsClientErr(t *testing.T, fakeConn test.FakeNetConn) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
 	opts.LogLevel = LOG_DEBUG
+	opts.DataPath, _ = ioutil.TempDir("", "ems-test-")
+	defer os.RemoveAll(opts.DataPath)
 
 	emsd, err := New(opts)
 	test.Nil(t, err)
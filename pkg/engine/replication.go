@@ -0,0 +1,502 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errReplica           = errors.New("topic is a replica, publish to its leader")
+	errReplicationFailed = errors.New("not enough replicas appended the message")
+)
+
+const (
+	// finished messages queued to be sent to the replicas, beyond that they
+	// are dropped (and redelivered if a replica is promoted)
+	replicaAckQueueSize = 4096
+	// maximum time finished messages are held before sending them
+	replicaAckInterval = 100 * time.Millisecond
+	// messages finished out of order a replica's channel collects at least
+	// before compacting its queue, or half its depth if that's more
+	replicaCompactMin = 1024
+)
+
+type replicaAck struct {
+	channel string
+	id      MessageID
+}
+
+func validateReplicationOptions(opts *Options) error {
+	for _, override := range opts.TopicReplicas {
+		_, addrs, err := parseTopicOverride(override)
+		if err != nil {
+			return fmt.Errorf("--topic-replicas %s", err)
+		}
+		replicas := strings.Split(addrs, ",")
+		for _, addr := range replicas {
+			_, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return fmt.Errorf("--topic-replicas %q invalid address %q", override, addr)
+			}
+		}
+		if opts.ReplicaAcks > len(replicas) {
+			return fmt.Errorf("--replica-acks %d greater than the number of replicas of %q",
+				opts.ReplicaAcks, override)
+		}
+	}
+	if opts.ReplicaAcks < 0 {
+		return errors.New("--replica-acks must be >= 0")
+	}
+	return nil
+}
+
+// topicReplicas returns the HTTP addresses of the emsd topicName is replicated to
+func (n *EMSD) topicReplicas(topicName string) []string {
+	addrs, ok := topicOverride(n.getOpts().TopicReplicas, topicName)
+	if !ok {
+		return nil
+	}
+	return strings.Split(addrs, ",")
+}
+
+// replicaLeader returns the HTTP address of the leader of topicName when this
+// node holds a replica of it
+func (n *EMSD) replicaLeader(topicName string) string {
+	n.replicaMtx.RLock()
+	defer n.replicaMtx.RUnlock()
+	return n.replicaLeaders[topicName]
+}
+
+// httpAddress is the address other emsd reach this one at
+func (n *EMSD) httpAddress() string {
+	opts := n.getOpts()
+	return net.JoinHostPort(opts.BroadcastAddress, strconv.Itoa(opts.BroadcastHTTPPort))
+}
+
+// GetReplicaTopic returns the replica of a topic led by the emsd at leader,
+// creating it (and its channels) if needed. A replica only stores messages,
+// it can't be published to or consumed from until it's promoted.
+func (n *EMSD) GetReplicaTopic(topicName string, leader string, channelNames []string) (*Topic, error) {
+	n.replicaMtx.Lock()
+	n.RLock()
+	t, ok := n.topicMap[topicName]
+	n.RUnlock()
+	if ok && n.replicaLeaders[topicName] == "" {
+		n.replicaMtx.Unlock()
+		return nil, fmt.Errorf("topic %s already exists", topicName)
+	}
+	n.replicaLeaders[topicName] = leader
+	n.replicaMtx.Unlock()
+
+	if ok {
+		t.Lock()
+		t.replicaOf = leader
+		t.Unlock()
+	} else {
+		t = n.GetTopic(topicName)
+	}
+
+	// same channels as the leader
+	for _, name := range channelNames {
+		t.GetChannel(name)
+	}
+	for _, c := range t.drainChannels() {
+		if !in(c.name, channelNames) {
+			t.DeleteExistingChannel(c.name)
+		}
+	}
+	return t, nil
+}
+
+// PromoteReplica turns the replica of a topic into a regular topic which can
+// be published to and consumed from (i.e. when its leader is gone), messages
+// finished on the leader are dropped from its channels
+func (n *EMSD) PromoteReplica(topicName string) error {
+	t, err := n.GetExistingTopic(topicName)
+	if err != nil {
+		return err
+	}
+
+	n.replicaMtx.Lock()
+	delete(n.replicaLeaders, topicName)
+	n.replicaMtx.Unlock()
+
+	t.Lock()
+	leader := t.replicaOf
+	t.replicaOf = ""
+	t.Unlock()
+	if leader == "" {
+		return errors.New("topic is not a replica")
+	}
+
+	n.logf(LOG_INFO, "TOPIC(%s): promoting replica of %s", t.name, leader)
+	for _, c := range t.drainChannels() {
+		c.promoteReplica()
+	}
+	n.Notify(replicaPromotion{t}, true)
+	return nil
+}
+
+// replicaPromotion re-registers a promoted replica with lookupd
+type replicaPromotion struct {
+	topic *Topic
+}
+
+func (t *Topic) isReplica() bool {
+	return t.replicaLeader() != ""
+}
+
+// replicaLeader returns the HTTP address of the leader of a replica
+func (t *Topic) replicaLeader() string {
+	t.RLock()
+	defer t.RUnlock()
+	return t.replicaOf
+}
+
+// setupReplicas creates the topic on the replicas with the current channels,
+// only logging failures (appends retry it)
+func (t *Topic) setupReplicas() {
+	for _, addr := range t.replicas {
+		err := t.setupReplica(addr)
+		if err != nil {
+			t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to set up replica %s - %s", t.name, addr, err)
+		}
+	}
+}
+
+func (t *Topic) setupReplica(addr string) error {
+	qs := url.Values{}
+	qs.Set("topic", t.name)
+	qs.Set("leader", t.emsd.httpAddress())
+	for _, c := range t.drainChannels() {
+		if !c.ephemeral {
+			qs.Add("channel", c.name)
+		}
+	}
+	return t.emsd.httpcli.POSTV1(fmt.Sprintf("http://%s/replica/create?%s", addr, qs.Encode()))
+}
+
+// replicate synchronously appends msgs to the replicas, it fails unless
+// --replica-acks of them (or all) stored them
+func (t *Topic) replicate(msgs []*Message) error {
+	t.RLock()
+	err := t.putAllowed()
+	t.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	batch := make([]migrateMessage, len(msgs))
+	now := time.Now()
+	for i, msg := range msgs {
+		batch[i].msg = msg
+		if msg.deferred != 0 {
+			batch[i].deadline = now.Add(msg.deferred).UnixNano()
+		}
+	}
+	body := encodeMigrateBatch(batch)
+	endpoint := fmt.Sprintf("/replica/append?topic=%s", url.QueryEscape(t.name))
+
+	var wg sync.WaitGroup
+	var acks int32
+	for _, addr := range t.replicas {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := t.emsd.httpcli.POSTV1Body("http://"+addr+endpoint, body)
+			if err != nil && strings.Contains(err.Error(), "REPLICA_NOT_FOUND") {
+				// new (or wiped) replica
+				err = t.setupReplica(addr)
+				if err == nil {
+					err = t.emsd.httpcli.POSTV1Body("http://"+addr+endpoint, body)
+				}
+			}
+			if err != nil {
+				t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to replicate %d messages to %s - %s",
+					t.name, len(msgs), addr, err)
+				return
+			}
+			atomic.AddInt32(&acks, 1)
+		}(addr)
+	}
+	wg.Wait()
+
+	required := t.emsd.getOpts().ReplicaAcks
+	if required == 0 || required > len(t.replicas) {
+		required = len(t.replicas)
+	}
+	if int(acks) < required {
+		atomic.AddUint64(&t.replicationFailures, 1)
+		return errReplicationFailed
+	}
+	return nil
+}
+
+// rollbackReplicas drops msgs from the replicas when the leader failed to
+// store them after they were replicated, only logging failures (a replica
+// promoted before it's rolled back delivers them)
+func (t *Topic) rollbackReplicas(msgs []*Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		buf.Write(msg.ID[:])
+	}
+	endpoint := fmt.Sprintf("/replica/rollback?topic=%s", url.QueryEscape(t.name))
+	for _, addr := range t.replicas {
+		err := t.emsd.httpcli.POSTV1Body("http://"+addr+endpoint, buf.Bytes())
+		if err != nil {
+			t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to roll back %d messages on replica %s - %s",
+				t.name, len(msgs), addr, err)
+		}
+	}
+}
+
+// replicaAckLoop streams the IDs of finished messages to the replicas
+func (t *Topic) replicaAckLoop() {
+	ticker := time.NewTicker(replicaAckInterval)
+	defer ticker.Stop()
+
+	pending := make(map[string][]MessageID)
+	for {
+		select {
+		case ack := <-t.replicaAckChan:
+			pending[ack.channel] = append(pending[ack.channel], ack.id)
+			continue
+		case <-ticker.C:
+		case <-t.exitChan:
+			return
+		}
+
+		for channelName, ids := range pending {
+			var buf bytes.Buffer
+			for _, id := range ids {
+				buf.Write(id[:])
+			}
+			endpoint := fmt.Sprintf("/replica/ack?topic=%s&channel=%s",
+				url.QueryEscape(t.name), url.QueryEscape(channelName))
+			for _, addr := range t.replicas {
+				err := t.emsd.httpcli.POSTV1Body("http://"+addr+endpoint, buf.Bytes())
+				if err != nil {
+					// the replica would deliver them again if promoted
+					t.emsd.logf(LOG_WARN, "TOPIC(%s): failed to send %d acks to replica %s - %s",
+						t.name, len(ids), addr, err)
+				}
+			}
+			delete(pending, channelName)
+		}
+	}
+}
+
+// appendReplica stores messages from the leader, they are on disk when it
+// returns. Deferred messages are stored without their delay.
+func (t *Topic) appendReplica(batch []migrateMessage) error {
+	t.RLock()
+	defer t.RUnlock()
+	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		return errors.New("exiting")
+	}
+	for _, mm := range batch {
+		err := t.put(mm.msg)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&t.messageCount, 1)
+		atomic.AddUint64(&t.messageBytes, uint64(len(mm.msg.Body)))
+	}
+	return backendSync(t.backend)
+}
+
+// rollbackReplica drops messages appended to the replica which the leader
+// then failed to store
+func (t *Topic) rollbackReplica(ids []MessageID) {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.channelMap) > 0 {
+		for _, c := range t.channelMap {
+			c.replicaAck(ids)
+		}
+		return
+	}
+
+	// without channels they're still queued in the topic
+	drop := make(map[MessageID]struct{}, len(ids))
+	for _, id := range ids {
+		drop[id] = struct{}{}
+	}
+	for depth := t.Depth(); depth > 0 && len(drop) > 0; depth-- {
+		var msg *Message
+		select {
+		case msg = <-t.memoryMsgChan:
+		case buf := <-t.backend.ReadChan():
+			var err error
+			msg, err = decodeMessage(buf)
+			if err != nil {
+				t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to decode message - %s", t.name, err)
+				continue
+			}
+		case <-time.After(time.Second):
+			t.emsd.logf(LOG_ERROR, "TOPIC(%s): timeout reading %d messages to roll back", t.name, depth)
+			return
+		}
+		if _, ok := drop[msg.ID]; ok {
+			delete(drop, msg.ID)
+			continue
+		}
+		err := t.put(msg)
+		if err != nil {
+			t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to put back message - %s", t.name, err)
+		}
+	}
+}
+
+func decodeReplicaAcks(r io.Reader) ([]MessageID, error) {
+	var ids []MessageID
+	for {
+		var id MessageID
+		_, err := io.ReadFull(r, id[:])
+		if err == io.EOF {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+}
+
+// replicaAck drops messages finished on the leader. They're dropped from the
+// head of the queue as long as it's finished, the ones finished out of order
+// are dropped once they make up a good share of the queue.
+func (c *Channel) replicaAck(ids []MessageID) {
+	c.replicaMtx.Lock()
+	defer c.replicaMtx.Unlock()
+	if !c.isReplica() {
+		return
+	}
+	for _, id := range ids {
+		c.replicaAcked[id] = struct{}{}
+	}
+
+	for len(c.replicaAcked) > 0 {
+		if c.replicaHead == nil {
+			var buf []byte
+			select {
+			case buf = <-c.backend.ReadChan():
+			default:
+				return
+			}
+			msg, err := decodeMessage(buf)
+			if err != nil {
+				c.emsd.logf(LOG_ERROR, "CHANNEL(%s): failed to decode message - %s", c.name, err)
+				continue
+			}
+			c.setReplicaHead(msg)
+		}
+		if _, ok := c.replicaAcked[c.replicaHead.ID]; !ok {
+			break
+		}
+		delete(c.replicaAcked, c.replicaHead.ID)
+		c.setReplicaHead(nil)
+	}
+
+	threshold := c.backend.Depth() / 2
+	if threshold < replicaCompactMin {
+		threshold = replicaCompactMin
+	}
+	if int64(len(c.replicaAcked)) >= threshold {
+		c.compactReplica()
+	}
+}
+
+// compactReplica drops the messages finished on the leader from the queue in
+// one pass, which keeps the order of the others, the caller must hold
+// replicaMtx (so nothing is queued meanwhile)
+func (c *Channel) compactReplica() {
+	depth := c.backend.Depth()
+	if c.replicaHead != nil {
+		err := writeMessageToBackend(c.replicaHead, c.backend)
+		if err != nil {
+			c.emsd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s", c.name, err)
+		}
+		c.setReplicaHead(nil)
+	}
+	for ; depth > 0; depth-- {
+		var buf []byte
+		select {
+		case buf = <-c.backend.ReadChan():
+		case <-time.After(time.Second):
+			c.emsd.logf(LOG_ERROR, "CHANNEL(%s): timeout reading %d messages to compact", c.name, depth)
+			return
+		}
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			c.emsd.logf(LOG_ERROR, "CHANNEL(%s): failed to decode message - %s", c.name, err)
+			continue
+		}
+		if _, ok := c.replicaAcked[msg.ID]; ok {
+			continue
+		}
+		err = writeMessageToBackend(msg, c.backend)
+		if err != nil {
+			c.emsd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s", c.name, err)
+		}
+	}
+	// the others weren't (or aren't anymore) in the queue
+	c.replicaAcked = make(map[MessageID]struct{})
+}
+
+// setReplicaHead holds msg, or nothing, in front of the queue, the caller must
+// hold replicaMtx
+func (c *Channel) setReplicaHead(msg *Message) {
+	c.replicaHead = msg
+	if msg != nil {
+		atomic.StoreInt64(&c.replicaHeld, 1)
+	} else {
+		atomic.StoreInt64(&c.replicaHeld, 0)
+	}
+}
+
+// promoteReplica drops every message already finished on the leader
+func (c *Channel) promoteReplica() {
+	c.replicaMtx.Lock()
+	defer c.replicaMtx.Unlock()
+	if !c.isReplica() {
+		return
+	}
+	if len(c.replicaAcked) > 0 || c.replicaHead != nil {
+		c.compactReplica()
+	}
+	atomic.StoreInt32(&c.replica, 0)
+	c.replicaAcked = nil
+}
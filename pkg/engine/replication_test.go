@@ -0,0 +1,246 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func TestReplicateTopic(t *testing.T) {
+	replicaOpts := NewOptions()
+	replicaOpts.Logger = test.NewTestLogger(t)
+	_, replicaHTTPAddr, replica := mustStartEMSD(replicaOpts)
+	defer os.RemoveAll(replicaOpts.DataPath)
+	defer replica.Exit()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TopicReplicas = []string{"repl_*=" + replicaHTTPAddr.String()}
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("repl_topic")
+	ch := topic.GetChannel("ch")
+	test.Equal(t, []string{replicaHTTPAddr.String()}, topic.replicas)
+
+	replicaTopic, err := replica.GetExistingTopic("repl_topic")
+	test.Nil(t, err)
+	test.Equal(t, true, replicaTopic.isReplica())
+	replicaCh, err := replicaTopic.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msgs = append(msgs, msg)
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	waitForDepth(t, ch, 3)
+	waitForDepth(t, replicaCh, 3)
+
+	test.Equal(t, errReplica, replicaTopic.PutMessage(NewMessage(replicaTopic.GenerateID(), []byte("test"))))
+	test.Equal(t, errReplica, replicaCh.AddClient(1, nil))
+
+	stats := NewTopicStats(replicaTopic, nil)
+	test.Equal(t, replicaTopic.replicaLeader(), stats.Leader)
+	test.NotEqual(t, "", stats.Leader)
+	stats = NewTopicStats(topic, nil)
+	test.Equal(t, []string{replicaHTTPAddr.String()}, stats.Replicas)
+
+	// finishing the first message on the leader drops it from the replica
+	msg := readChannelMessage(t, ch)
+	test.Equal(t, msgs[0].ID, msg.ID)
+	test.Nil(t, ch.StartInFlightTimeout(msg, 1, time.Minute))
+	test.Nil(t, ch.FinishMessage(1, msg.ID))
+	waitForDepth(t, replicaCh, 2)
+
+	// the second one is finished but stuck behind the third
+	msg = readChannelMessage(t, ch)
+	test.Nil(t, ch.StartInFlightTimeout(msg, 1, time.Minute))
+	msg = readChannelMessage(t, ch)
+	test.Nil(t, ch.StartInFlightTimeout(msg, 1, time.Minute))
+	test.Nil(t, ch.FinishMessage(1, msgs[2].ID))
+	time.Sleep(2 * replicaAckInterval)
+	test.Equal(t, int64(2), replicaCh.Depth())
+
+	test.Nil(t, replica.PromoteReplica("repl_topic"))
+	test.NotNil(t, replica.PromoteReplica("repl_topic"))
+	test.Equal(t, false, replicaTopic.isReplica())
+	test.Equal(t, int64(1), replicaCh.Depth())
+	test.Equal(t, msgs[1].ID, readChannelMessage(t, replicaCh).ID)
+	test.Nil(t, replicaCh.AddClient(1, nil))
+	replicaCh.RemoveClient(1)
+	test.Nil(t, replicaTopic.PutMessage(NewMessage(replicaTopic.GenerateID(), []byte("test"))))
+}
+
+func TestReplicaAckOutOfOrder(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic, err := emsd.GetReplicaTopic("repl_topic", "127.0.0.1:1", []string{"ch"})
+	test.Nil(t, err)
+	ch, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	n := replicaCompactMin + 4
+	var msgs []*Message
+	for i := 0; i < n; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msgs = append(msgs, msg)
+		test.Nil(t, ch.PutMessage(msg))
+	}
+	waitForDepth(t, ch, int64(n))
+	ack := func(i int) {
+		ch.replicaAck([]MessageID{msgs[i].ID})
+	}
+
+	// finished behind the unfinished head they're kept
+	ack(3)
+	ack(2)
+	test.Equal(t, int64(n), ch.Depth())
+	test.Equal(t, 2, len(ch.replicaAcked))
+
+	ack(0)
+	test.Equal(t, int64(n-1), ch.Depth())
+	test.Equal(t, 2, len(ch.replicaAcked))
+
+	// until there are enough of them to compact the queue
+	for i := n - 1; i >= 4; i-- {
+		if i != 5 && i != 10 {
+			ack(i)
+		}
+	}
+	test.Equal(t, 0, len(ch.replicaAcked))
+	test.Equal(t, int64(3), ch.Depth())
+
+	test.Nil(t, emsd.PromoteReplica("repl_topic"))
+	test.Equal(t, msgs[1].ID, readChannelMessage(t, ch).ID)
+	test.Equal(t, msgs[5].ID, readChannelMessage(t, ch).ID)
+	test.Equal(t, msgs[10].ID, readChannelMessage(t, ch).ID)
+	test.Equal(t, int64(0), ch.Depth())
+}
+
+func TestReplicateTopicFailure(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TopicReplicas = []string{"repl_topic=127.0.0.1:1"}
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("repl_topic")
+	ch := topic.GetChannel("ch")
+	test.Equal(t, errReplicationFailed, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Equal(t, int64(0), ch.Depth())
+	test.Equal(t, uint64(1), NewTopicStats(topic, nil).ReplicationFailures)
+
+	// other topics aren't replicated
+	other := emsd.GetTopic("other_topic")
+	test.Nil(t, other.PutMessage(NewMessage(other.GenerateID(), []byte("test"))))
+}
+
+func TestReplicateTopicLeaderFailure(t *testing.T) {
+	replicaOpts := NewOptions()
+	replicaOpts.Logger = test.NewTestLogger(t)
+	_, replicaHTTPAddr, replica := mustStartEMSD(replicaOpts)
+	defer os.RemoveAll(replicaOpts.DataPath)
+	defer replica.Exit()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.TopicReplicas = []string{"repl_*=" + replicaHTTPAddr.String()}
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("repl_topic")
+	topic.GetChannel("ch")
+	noChannels := emsd.GetTopic("repl_no_channels")
+
+	replicaTopic, err := replica.GetExistingTopic("repl_topic")
+	test.Nil(t, err)
+	replicaCh, err := replicaTopic.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	stored := NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, topic.PutMessage(stored))
+	test.Nil(t, noChannels.PutMessage(NewMessage(noChannels.GenerateID(), []byte("test"))))
+	waitForDepth(t, replicaCh, 1)
+	replicaNoChannels, err := replica.GetExistingTopic("repl_no_channels")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), replicaNoChannels.Depth())
+
+	// the leader fails to write what the replicas appended
+	for _, leaderTopic := range []*Topic{topic, noChannels} {
+		leaderTopic.Lock()
+		leaderTopic.backend = &errorBackendQueue{}
+		leaderTopic.Unlock()
+	}
+	test.NotNil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.NotNil(t, noChannels.PutMessages([]*Message{
+		NewMessage(noChannels.GenerateID(), []byte("test")),
+		NewMessage(noChannels.GenerateID(), []byte("test")),
+	}))
+
+	test.Equal(t, int64(1), replicaNoChannels.Depth())
+	waitForDepth(t, replicaCh, 2)
+	test.Nil(t, replica.PromoteReplica("repl_topic"))
+	test.Equal(t, int64(1), replicaCh.Depth())
+	test.Equal(t, stored.ID, readChannelMessage(t, replicaCh).ID)
+}
+
+func TestReplicateTopicCreateConflict(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	emsd.GetTopic("repl_topic")
+	_, err := emsd.GetReplicaTopic("repl_topic", "127.0.0.1:4151", nil)
+	test.NotNil(t, err)
+
+	_, err = emsd.GetReplicaTopic("repl_other", "127.0.0.1:4151", []string{"ch1", "ch2"})
+	test.Nil(t, err)
+	topic, err := emsd.GetReplicaTopic("repl_other", "127.0.0.1:4151", []string{"ch1"})
+	test.Nil(t, err)
+	test.Equal(t, 1, len(topic.drainChannels()))
+
+	emsd.Lock()
+	m := emsd.metadata()
+	emsd.Unlock()
+	for _, mt := range m.Topics {
+		if mt.Name == "repl_other" {
+			test.Equal(t, "127.0.0.1:4151", mt.Leader)
+		} else {
+			test.Equal(t, "", mt.Leader)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bhojpur/ems/pkg/topiclog"
+)
+
+// fanout storage modes, see --fanout-storage
+const (
+	// every channel gets its own copy of each message
+	fanoutStorageCopy = "copy"
+	// the topic keeps a single log which every channel reads with a cursor
+	fanoutStorageShared = "shared"
+)
+
+func validateFanoutStorage(name string) error {
+	switch name {
+	case fanoutStorageCopy, fanoutStorageShared:
+		return nil
+	}
+	return fmt.Errorf("%q is not one of [%s %s]", name, fanoutStorageCopy, fanoutStorageShared)
+}
+
+// fanoutStorage returns the fanout storage mode for a topic
+func (n *EMSD) fanoutStorage(topicName string) string {
+	opts := n.getOpts()
+	if override, ok := topicOverride(opts.TopicFanoutStorages, topicName); ok {
+		return override
+	}
+	return opts.FanoutStorage
+}
+
+// newTopicLog opens the shared log for a topic
+func (n *EMSD) newTopicLog(topicName string) *topiclog.Log {
+	opts := n.getOpts()
+	return topiclog.New(
+		topicName,
+		opts.DataPath,
+		opts.MaxBytesPerFile,
+		int32(minValidMsgLength),
+		int32(opts.MaxMsgSize)+minValidMsgLength,
+		opts.SyncEvery,
+		opts.SyncTimeout,
+		n.diskQueueLogf,
+	)
+}
+
+// sharedLogTopicBackend appends a topic's messages to its shared log, there
+// is nothing to read since channels read the log through their own cursors
+type sharedLogTopicBackend struct {
+	log *topiclog.Log
+}
+
+func (b *sharedLogTopicBackend) Put(data []byte) error               { return b.log.Put(data) }
+func (b *sharedLogTopicBackend) PutBatch(data [][]byte) (int, error) { return b.log.PutBatch(data) }
+func (b *sharedLogTopicBackend) ReadChan() <-chan []byte             { return nil }
+func (b *sharedLogTopicBackend) Close() error                        { return b.log.Close() }
+func (b *sharedLogTopicBackend) Delete() error                       { return b.log.Delete() }
+func (b *sharedLogTopicBackend) Depth() int64                        { return b.log.Depth() }
+func (b *sharedLogTopicBackend) Empty() error                        { return b.log.Empty() }
+func (b *sharedLogTopicBackend) DiskUsage() int64                    { return b.log.DiskUsage() }
+func (b *sharedLogTopicBackend) Sync() error                         { return b.log.Sync() }
+
+// sharedLogChannelBackend reads a channel's messages from its cursor on the
+// topic's shared log, messages which are put back (requeued, or in-flight
+// when closing) go to the channel's own backend queue and both are read from
+// the same ReadChan
+type sharedLogChannelBackend struct {
+	sync.RWMutex
+
+	cursor *topiclog.Cursor
+	queue  BackendQueue
+
+	held     int64 // 1 while forwardLoop holds a message
+	exitFlag int32
+
+	readChan     chan []byte
+	emptyChan    chan chan error
+	exitChan     chan int
+	exitSyncChan chan []byte
+}
+
+func newSharedLogChannelBackend(cursor *topiclog.Cursor, queue BackendQueue) *sharedLogChannelBackend {
+	b := &sharedLogChannelBackend{
+		cursor:       cursor,
+		queue:        queue,
+		readChan:     make(chan []byte),
+		emptyChan:    make(chan chan error),
+		exitChan:     make(chan int),
+		exitSyncChan: make(chan []byte),
+	}
+	go b.forwardLoop()
+	return b
+}
+
+func (b *sharedLogChannelBackend) Put(data []byte) error {
+	return b.queue.Put(data)
+}
+
+func (b *sharedLogChannelBackend) ReadChan() <-chan []byte {
+	return b.readChan
+}
+
+func (b *sharedLogChannelBackend) Depth() int64 {
+	return b.cursor.Depth() + b.queue.Depth() + atomic.LoadInt64(&b.held)
+}
+
+// DiskUsage only counts the channel's own queue, the log belongs to the topic
+func (b *sharedLogChannelBackend) DiskUsage() int64 {
+	return backendDiskUsage(b.queue)
+}
+
+// Sync only syncs the channel's own queue, the cursor is persisted with the log
+func (b *sharedLogChannelBackend) Sync() error {
+	return backendSync(b.queue)
+}
+
+func (b *sharedLogChannelBackend) Empty() error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	resp := make(chan error)
+	b.emptyChan <- resp
+	return <-resp
+}
+
+// Close stops reading, a message that was already read from the cursor is put
+// back in the channel's queue so that it isn't lost
+func (b *sharedLogChannelBackend) Close() error {
+	held, err := b.exit()
+	if err != nil {
+		return err
+	}
+	if held != nil {
+		err = b.queue.Put(held)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.cursor.Close()
+	if err != nil {
+		return err
+	}
+	return b.queue.Close()
+}
+
+func (b *sharedLogChannelBackend) Delete() error {
+	_, err := b.exit()
+	if err != nil {
+		return err
+	}
+	err = b.cursor.Delete()
+	if err != nil {
+		return err
+	}
+	return b.queue.Delete()
+}
+
+func (b *sharedLogChannelBackend) exit() ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.exitFlag == 1 {
+		return nil, errors.New("exiting")
+	}
+	b.exitFlag = 1
+	close(b.exitChan)
+	return <-b.exitSyncChan, nil
+}
+
+// forwardLoop merges the cursor and the channel's queue into readChan
+func (b *sharedLogChannelBackend) forwardLoop() {
+	var data []byte
+	var cursorChan, queueChan <-chan []byte
+	var r chan []byte
+
+	for {
+		if data == nil {
+			cursorChan = b.cursor.ReadChan()
+			queueChan = b.queue.ReadChan()
+			r = nil
+		} else {
+			cursorChan = nil
+			queueChan = nil
+			r = b.readChan
+		}
+
+		select {
+		case data = <-cursorChan:
+			atomic.StoreInt64(&b.held, 1)
+		case data = <-queueChan:
+			atomic.StoreInt64(&b.held, 1)
+		case r <- data:
+			data = nil
+			atomic.StoreInt64(&b.held, 0)
+		case resp := <-b.emptyChan:
+			data = nil
+			atomic.StoreInt64(&b.held, 0)
+			err := b.cursor.Empty()
+			if err == nil {
+				err = b.queue.Empty()
+			}
+			resp <- err
+		case <-b.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	atomic.StoreInt64(&b.held, 0)
+	b.exitSyncChan <- data
+}
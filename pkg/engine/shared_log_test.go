@@ -0,0 +1,203 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func readChannelMessage(t *testing.T, c *Channel) *Message {
+	select {
+	case msg := <-c.memoryMsgChan:
+		return msg
+	case b := <-c.backend.ReadChan():
+		msg, err := decodeMessage(b)
+		test.Nil(t, err)
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout reading from channel")
+	}
+	return nil
+}
+
+func assertNoChannelMessage(t *testing.T, c *Channel) {
+	select {
+	case <-c.memoryMsgChan:
+		t.Fatal("unexpected message")
+	case <-c.backend.ReadChan():
+		t.Fatal("unexpected message")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// waitForDepth waits for a channel's depth to settle, a message being handed
+// from the cursor to the channel's backend can briefly be counted twice (or not at all)
+func waitForDepth(t *testing.T, c *Channel, depth int64) {
+	for i := 0; i < 100; i++ {
+		if c.Depth() == depth {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, depth, c.Depth())
+}
+
+func TestSharedFanoutStorage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.TopicFanoutStorages = []string{"shared_*=shared"}
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("shared_topic")
+	test.NotNil(t, topic.log)
+	test.Equal(t, true, emsd.GetTopic("other").log == nil)
+
+	// retained for the first channel
+	for i := 0; i < 5; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte(fmt.Sprintf("%d", i)))))
+	}
+	test.Equal(t, int64(5), topic.Depth())
+
+	ch1 := topic.GetChannel("ch1")
+	ch2 := topic.GetChannel("ch2")
+	test.Equal(t, int64(0), topic.Depth())
+	waitForDepth(t, ch1, 5)
+	waitForDepth(t, ch2, 0)
+
+	var msgs []*Message
+	for i := 5; i < 10; i++ {
+		msgs = append(msgs, NewMessage(topic.GenerateID(), []byte(fmt.Sprintf("%d", i))))
+	}
+	test.Nil(t, topic.PutMessages(msgs))
+	waitForDepth(t, ch1, 10)
+	waitForDepth(t, ch2, 5)
+
+	for i := 0; i < 10; i++ {
+		test.Equal(t, []byte(fmt.Sprintf("%d", i)), readChannelMessage(t, ch1).Body)
+	}
+	for i := 5; i < 10; i++ {
+		test.Equal(t, []byte(fmt.Sprintf("%d", i)), readChannelMessage(t, ch2).Body)
+	}
+
+	// requeues go to the channel's own queue
+	msg := msgs[0]
+	test.Nil(t, ch2.PutMessage(msg))
+	waitForDepth(t, ch2, 1)
+	waitForDepth(t, ch1, 0)
+	test.Equal(t, msg.ID, readChannelMessage(t, ch2).ID)
+	assertNoChannelMessage(t, ch1)
+
+	// pausing the topic stops delivery to every channel
+	topic.Pause()
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("paused"))))
+	assertNoChannelMessage(t, ch1)
+	waitForDepth(t, ch1, 1)
+	topic.UnPause()
+	test.Equal(t, []byte("paused"), readChannelMessage(t, ch1).Body)
+	test.Equal(t, []byte("paused"), readChannelMessage(t, ch2).Body)
+
+	// emptying one channel leaves the others alone
+	for i := 0; i < 3; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("x"))))
+	}
+	test.Nil(t, ch1.Empty())
+	waitForDepth(t, ch1, 0)
+	waitForDepth(t, ch2, 3)
+
+	// deferred messages are deferred by every channel
+	deferred := NewMessage(topic.GenerateID(), []byte("deferred"))
+	deferred.deferred = time.Hour
+	test.Nil(t, topic.PutMessage(deferred))
+	test.Equal(t, 1, len(ch1.deferredMessages))
+	test.Equal(t, 1, len(ch2.deferredMessages))
+}
+
+func TestSharedFanoutStorageRestart(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.FanoutStorage = "shared"
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := emsd.GetTopic("t")
+	ch1 := topic.GetChannel("ch1")
+	ch2 := topic.GetChannel("ch2")
+	for i := 0; i < 10; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte(fmt.Sprintf("%d", i)))))
+	}
+	for i := 0; i < 4; i++ {
+		readChannelMessage(t, ch1)
+	}
+	// in-flight when closing
+	msg := readChannelMessage(t, ch2)
+	test.Nil(t, ch2.StartInFlightTimeout(msg, 1, time.Minute))
+	emsd.Exit()
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.FanoutStorage = "shared"
+	opts.DataPath = emsd.getOpts().DataPath
+	_, _, emsd = mustStartEMSD(opts)
+	defer emsd.Exit()
+
+	topic = emsd.GetTopic("t")
+	ch1 = topic.GetChannel("ch1")
+	ch2 = topic.GetChannel("ch2")
+	waitForDepth(t, ch1, 6)
+	waitForDepth(t, ch2, 10)
+	// a message read ahead when closing was put back in the channel's queue,
+	// so it may not come back in order
+	bodies := make(map[string]bool)
+	for i := 4; i < 10; i++ {
+		bodies[string(readChannelMessage(t, ch1).Body)] = true
+	}
+	for i := 4; i < 10; i++ {
+		test.Equal(t, true, bodies[fmt.Sprintf("%d", i)])
+	}
+
+	// deleting a channel removes its cursor
+	test.Nil(t, topic.DeleteExistingChannel("ch2"))
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("new"))))
+	test.Equal(t, []byte("new"), readChannelMessage(t, ch1).Body)
+	ch2 = topic.GetChannel("ch2")
+	waitForDepth(t, ch2, 0)
+}
+
+func TestSharedFanoutStorageOptions(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "ems-test-")
+	defer os.RemoveAll(opts.DataPath)
+	opts.TopicFanoutStorages = []string{"t=copies"}
+	_, err := New(opts)
+	test.NotNil(t, err)
+}
@@ -23,7 +23,9 @@ package engine
 import (
 	"runtime"
 	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/bhojpur/ems/pkg/core/quantile"
 )
@@ -38,43 +40,61 @@ type ClientStats interface {
 }
 
 type TopicStats struct {
-	TopicName    string         `json:"topic_name"`
-	Channels     []ChannelStats `json:"channels"`
-	Depth        int64          `json:"depth"`
-	BackendDepth int64          `json:"backend_depth"`
-	MessageCount uint64         `json:"message_count"`
-	MessageBytes uint64         `json:"message_bytes"`
-	Paused       bool           `json:"paused"`
+	TopicName               string         `json:"topic_name"`
+	Channels                []ChannelStats `json:"channels"`
+	Depth                   int64          `json:"depth"`
+	BackendDepth            int64          `json:"backend_depth"`
+	BackendCorruptCount     int64          `json:"backend_corrupt_count"`
+	BackendCompressionRatio float64        `json:"backend_compression_ratio"`
+	DiskBytes               int64          `json:"disk_bytes"`
+	MessageCount            uint64         `json:"message_count"`
+	MessageBytes            uint64         `json:"message_bytes"`
+	MessageRate             float64        `json:"message_rate"`
+	Paused                  bool           `json:"paused"`
+	Leader                  string         `json:"leader,omitempty"`
+	Replicas                []string       `json:"replicas,omitempty"`
+	ReplicationFailures     uint64         `json:"replication_failures"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
 	return TopicStats{
-		TopicName:    t.name,
-		Channels:     channels,
-		Depth:        t.Depth(),
-		BackendDepth: t.backend.Depth(),
-		MessageCount: atomic.LoadUint64(&t.messageCount),
-		MessageBytes: atomic.LoadUint64(&t.messageBytes),
-		Paused:       t.IsPaused(),
+		TopicName:               t.name,
+		Channels:                channels,
+		Depth:                   t.Depth(),
+		BackendDepth:            t.backend.Depth(),
+		BackendCorruptCount:     backendCorruptCount(t.backend),
+		BackendCompressionRatio: backendCompressionRatio(t.backend),
+		DiskBytes:               backendDiskUsage(t.backend),
+		MessageCount:            atomic.LoadUint64(&t.messageCount),
+		MessageBytes:            atomic.LoadUint64(&t.messageBytes),
+		MessageRate:             t.rate.get(),
+		Paused:                  t.IsPaused(),
+		Leader:                  t.replicaLeader(),
+		Replicas:                t.replicas,
+		ReplicationFailures:     atomic.LoadUint64(&t.replicationFailures),
 
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
 }
 
 type ChannelStats struct {
-	ChannelName   string        `json:"channel_name"`
-	Depth         int64         `json:"depth"`
-	BackendDepth  int64         `json:"backend_depth"`
-	InFlightCount int           `json:"in_flight_count"`
-	DeferredCount int           `json:"deferred_count"`
-	MessageCount  uint64        `json:"message_count"`
-	RequeueCount  uint64        `json:"requeue_count"`
-	TimeoutCount  uint64        `json:"timeout_count"`
-	ClientCount   int           `json:"client_count"`
-	Clients       []ClientStats `json:"clients"`
-	Paused        bool          `json:"paused"`
+	ChannelName             string        `json:"channel_name"`
+	Depth                   int64         `json:"depth"`
+	BackendDepth            int64         `json:"backend_depth"`
+	BackendCorruptCount     int64         `json:"backend_corrupt_count"`
+	BackendCompressionRatio float64       `json:"backend_compression_ratio"`
+	DiskBytes               int64         `json:"disk_bytes"`
+	InFlightCount           int           `json:"in_flight_count"`
+	DeferredCount           int           `json:"deferred_count"`
+	MessageCount            uint64        `json:"message_count"`
+	MessageRate             float64       `json:"message_rate"`
+	RequeueCount            uint64        `json:"requeue_count"`
+	TimeoutCount            uint64        `json:"timeout_count"`
+	ClientCount             int           `json:"client_count"`
+	Clients                 []ClientStats `json:"clients"`
+	Paused                  bool          `json:"paused"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
@@ -88,22 +108,94 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) Channel
 	c.deferredMutex.Unlock()
 
 	return ChannelStats{
-		ChannelName:   c.name,
-		Depth:         c.Depth(),
-		BackendDepth:  c.backend.Depth(),
-		InFlightCount: inflight,
-		DeferredCount: deferred,
-		MessageCount:  atomic.LoadUint64(&c.messageCount),
-		RequeueCount:  atomic.LoadUint64(&c.requeueCount),
-		TimeoutCount:  atomic.LoadUint64(&c.timeoutCount),
-		ClientCount:   clientCount,
-		Clients:       clients,
-		Paused:        c.IsPaused(),
+		ChannelName:             c.name,
+		Depth:                   c.Depth(),
+		BackendDepth:            c.backend.Depth(),
+		BackendCorruptCount:     backendCorruptCount(c.backend),
+		BackendCompressionRatio: backendCompressionRatio(c.backend),
+		DiskBytes:               backendDiskUsage(c.backend),
+		InFlightCount:           inflight,
+		DeferredCount:           deferred,
+		MessageCount:            atomic.LoadUint64(&c.messageCount),
+		MessageRate:             c.rate.get(),
+		RequeueCount:            atomic.LoadUint64(&c.requeueCount),
+		TimeoutCount:            atomic.LoadUint64(&c.timeoutCount),
+		ClientCount:             clientCount,
+		Clients:                 clients,
+		Paused:                  c.IsPaused(),
 
 		E2eProcessingLatency: c.e2eProcessingLatencyStream.Result(),
 	}
 }
 
+// rateInterval is the window message rates are measured over
+const rateInterval = 5 * time.Second
+
+// messageRate is the per second rate of a message count, measured by
+// rateLoop between samples rateInterval apart
+type messageRate struct {
+	sync.Mutex
+	count uint64
+	at    time.Time
+	rate  float64
+}
+
+func (r *messageRate) sample(count uint64, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.at.IsZero() {
+		r.rate = 0
+		if elapsed := now.Sub(r.at); count > r.count && elapsed > 0 {
+			r.rate = float64(count-r.count) / elapsed.Seconds()
+		}
+	}
+	r.count = count
+	r.at = now
+}
+
+func (r *messageRate) get() float64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.rate
+}
+
+// rateLoop samples the message counts of all topics and channels every
+// rateInterval so the rates reported in stats don't depend on how often (or
+// whether) they are polled
+func (n *EMSD) rateLoop() {
+	ticker := time.NewTicker(rateInterval)
+	for {
+		n.sampleRates(time.Now())
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	ticker.Stop()
+}
+
+func (n *EMSD) sampleRates(now time.Time) {
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+
+	for _, t := range topics {
+		t.rate.sample(atomic.LoadUint64(&t.messageCount), now)
+		t.RLock()
+		for _, c := range t.channelMap {
+			c.rate.sample(atomic.LoadUint64(&c.messageCount), now)
+		}
+		t.RUnlock()
+	}
+}
+
 type Topics []*Topic
 
 func (t Topics) Len() int      { return len(t) }
@@ -127,6 +219,12 @@ type ChannelsByName struct {
 func (c ChannelsByName) Less(i, j int) bool { return c.Channels[i].name < c.Channels[j].name }
 
 func (n *EMSD) GetStats(topic string, channel string, includeClients bool) Stats {
+	return n.getStats(topic, channel, includeClients, nil)
+}
+
+// getStats is GetStats limited to the topics (or the channels of the topic,
+// when given) whose name passes match
+func (n *EMSD) getStats(topic string, channel string, includeClients bool, match func(string) bool) Stats {
 	var stats Stats
 
 	n.RLock()
@@ -134,6 +232,9 @@ func (n *EMSD) GetStats(topic string, channel string, includeClients bool) Stats
 	if topic == "" {
 		realTopics = make([]*Topic, 0, len(n.topicMap))
 		for _, t := range n.topicMap {
+			if match != nil && !match(t.name) {
+				continue
+			}
 			realTopics = append(realTopics, t)
 		}
 	} else if val, exists := n.topicMap[topic]; exists {
@@ -153,6 +254,9 @@ func (n *EMSD) GetStats(topic string, channel string, includeClients bool) Stats
 		if channel == "" {
 			realChannels = make([]*Channel, 0, len(t.channelMap))
 			for _, c := range t.channelMap {
+				if topic != "" && match != nil && !match(c.name) {
+					continue
+				}
 				realChannels = append(realChannels, c)
 			}
 		} else if val, exists := t.channelMap[channel]; exists {
@@ -191,6 +295,21 @@ func (n *EMSD) GetStats(topic string, channel string, includeClients bool) Stats
 			}
 			return true
 		})
+		if n.stompServer != nil {
+			n.stompServer.conns.Range(func(k, v interface{}) bool {
+				c := v.(Client)
+				if c.Type() == typeProducer {
+					producerStats = append(producerStats, c.Stats(topic))
+				}
+				return true
+			})
+		}
+		if n.kafkaServer != nil {
+			n.kafkaServer.conns.Range(func(k, v interface{}) bool {
+				producerStats = append(producerStats, v.(Client).Stats(topic))
+				return true
+			})
+		}
 		stats.Producers = producerStats
 	}
 
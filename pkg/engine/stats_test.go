@@ -177,3 +177,43 @@ func TestStatsChannelLocking(t *testing.T) {
 	test.Equal(t, 1, len(stats[0].Channels))
 	test.Equal(t, 25, stats[0].Channels[0].InFlightCount)
 }
+
+func TestMessageRate(t *testing.T) {
+	var r messageRate
+	now := time.Now()
+
+	// the first sample starts the window
+	r.sample(100, now)
+	test.Equal(t, float64(0), r.get())
+	r.sample(300, now.Add(rateInterval))
+	test.Equal(t, float64(200)/rateInterval.Seconds(), r.get())
+	// reading the rate doesn't change it
+	test.Equal(t, float64(200)/rateInterval.Seconds(), r.get())
+	r.sample(300, now.Add(2*rateInterval))
+	test.Equal(t, float64(0), r.get())
+}
+
+func TestSampleRates(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = t.TempDir()
+	// not started so rateLoop doesn't sample concurrently
+	emsd, err := New(opts)
+	test.Nil(t, err)
+	defer emsd.Exit()
+
+	topicName := "test_sample_rates" + strconv.Itoa(int(time.Now().Unix()))
+	topic := emsd.GetTopic(topicName)
+	topic.GetChannel("ch")
+
+	now := time.Now()
+	emsd.sampleRates(now)
+	for i := 0; i < 10; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+	emsd.sampleRates(now.Add(rateInterval))
+
+	stats := emsd.GetStats(topicName, "", false).Topics
+	test.Equal(t, 1, len(stats))
+	test.Equal(t, float64(10)/rateInterval.Seconds(), stats[0].MessageRate)
+}
@@ -97,6 +97,9 @@ func (n *EMSD) statsdLoop() {
 				stat = fmt.Sprintf("topic.%s.backend_depth", topic.TopicName)
 				client.Gauge(stat, topic.BackendDepth)
 
+				stat = fmt.Sprintf("topic.%s.backend_corrupt_count", topic.TopicName)
+				client.Incr(stat, topic.BackendCorruptCount-lastTopic.BackendCorruptCount)
+
 				for _, item := range topic.E2eProcessingLatency.Percentiles {
 					stat = fmt.Sprintf("topic.%s.e2e_processing_latency_%.0f", topic.TopicName, item["quantile"]*100.0)
 					// We can cast the value to int64 since a value of 1 is the
@@ -128,6 +131,9 @@ func (n *EMSD) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.backend_depth", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, channel.BackendDepth)
 
+					stat = fmt.Sprintf("topic.%s.channel.%s.backend_corrupt_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, channel.BackendCorruptCount-lastChannel.BackendCorruptCount)
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.in_flight_count", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, int64(channel.InFlightCount))
 
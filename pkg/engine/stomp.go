@@ -0,0 +1,265 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bhojpur/ems/pkg/core/protocol"
+)
+
+// maximum size of a single STOMP header line, this bounds the memory a
+// misbehaving client can make us allocate before we have seen a body
+const stompMaxHeaderSize = 16 * 1024
+
+var errStompFrameTooBig = errors.New("frame too big")
+
+// stompFrame is a single STOMP 1.2 frame
+type stompFrame struct {
+	Command string
+	Headers []string // alternating key/value pairs, order is preserved
+	Body    []byte
+}
+
+func newStompFrame(command string, headers ...string) *stompFrame {
+	return &stompFrame{Command: command, Headers: headers}
+}
+
+// Header returns the value of the first occurrence of key (as per the spec,
+// repeated headers are allowed and only the first one is significant)
+func (f *stompFrame) Header(key string) (string, bool) {
+	for i := 0; i+1 < len(f.Headers); i += 2 {
+		if f.Headers[i] == key {
+			return f.Headers[i+1], true
+		}
+	}
+	return "", false
+}
+
+func (f *stompFrame) AddHeader(key string, value string) {
+	f.Headers = append(f.Headers, key, value)
+}
+
+// connect frames are exempt from header escaping for 1.0 compatibility
+func (f *stompFrame) escapesHeaders() bool {
+	return f.Command != "CONNECT" && f.Command != "CONNECTED" && f.Command != "STOMP"
+}
+
+var stompHeaderEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"\r", "\\r",
+	"\n", "\\n",
+	":", "\\c",
+)
+
+func stompUnescape(s string) (string, error) {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", errors.New("invalid escape sequence")
+		}
+		switch s[i] {
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			return "", fmt.Errorf("invalid escape sequence \\%c", s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// readStompLine reads a single EOL terminated line, trimming the optional '\r'
+func readStompLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errStompFrameTooBig
+	}
+	if err != nil {
+		return "", err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return string(line), nil
+}
+
+// readStompFrame reads the next frame from r, skipping heart-beat EOLs
+//
+// a nil frame and nil error indicates a heart-beat was received
+func readStompFrame(r *bufio.Reader, maxBodySize int64) (*stompFrame, error) {
+	command, err := readStompLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if command == "" {
+		return nil, nil
+	}
+
+	f := &stompFrame{Command: command}
+	headerSize := 0
+	for {
+		line, err := readStompLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		headerSize += len(line)
+		if headerSize > stompMaxHeaderSize {
+			return nil, errStompFrameTooBig
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx == -1 {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		key, value := line[:idx], line[idx+1:]
+		if f.escapesHeaders() {
+			key, err = stompUnescape(key)
+			if err != nil {
+				return nil, err
+			}
+			value, err = stompUnescape(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		f.AddHeader(key, value)
+	}
+
+	if cl, ok := f.Header("content-length"); ok {
+		size, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid content-length %q", cl)
+		}
+		if size > maxBodySize {
+			return nil, errStompFrameTooBig
+		}
+		f.Body = make([]byte, size)
+		_, err = io.ReadFull(r, f.Body)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0 {
+			return nil, errors.New("frame not NULL terminated")
+		}
+		return f, nil
+	}
+
+	var body bytes.Buffer
+	for {
+		chunk, err := r.ReadSlice(0)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if int64(body.Len()+len(chunk)) > maxBodySize+1 {
+			return nil, errStompFrameTooBig
+		}
+		body.Write(chunk)
+		if err == nil {
+			break
+		}
+	}
+	f.Body = body.Bytes()[:body.Len()-1]
+	return f, nil
+}
+
+func writeStompFrame(w io.Writer, f *stompFrame) error {
+	var buf bytes.Buffer
+	buf.WriteString(f.Command)
+	buf.WriteByte('\n')
+	escape := f.escapesHeaders()
+	for i := 0; i+1 < len(f.Headers); i += 2 {
+		key, value := f.Headers[i], f.Headers[i+1]
+		if escape {
+			key = stompHeaderEscaper.Replace(key)
+			value = stompHeaderEscaper.Replace(value)
+		}
+		buf.WriteString(key)
+		buf.WriteByte(':')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+	}
+	if f.Body != nil {
+		fmt.Fprintf(&buf, "content-length:%d\n", len(f.Body))
+	}
+	buf.WriteByte('\n')
+	buf.Write(f.Body)
+	buf.WriteByte(0)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+type stompServer struct {
+	emsd  *EMSD
+	conns sync.Map
+}
+
+func (p *stompServer) Handle(conn net.Conn) {
+	p.emsd.logf(LOG_INFO, "STOMP: new client(%s)", conn.RemoteAddr())
+
+	var prot protocol.Protocol = &protocolSTOMP{emsd: p.emsd}
+
+	client := prot.NewClient(conn)
+	p.conns.Store(conn.RemoteAddr(), client)
+
+	err := prot.IOLoop(client)
+	if err != nil {
+		p.emsd.logf(LOG_ERROR, "client(%s) - %s", conn.RemoteAddr(), err)
+	}
+
+	p.conns.Delete(conn.RemoteAddr())
+	client.Close()
+}
+
+func (p *stompServer) Close() {
+	p.conns.Range(func(k, v interface{}) bool {
+		v.(protocol.Client).Close()
+		return true
+	})
+}
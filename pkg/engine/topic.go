@@ -27,22 +27,23 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/bhojpur/ems/pkg/core/lg"
 	"github.com/bhojpur/ems/pkg/core/quantile"
 	"github.com/bhojpur/ems/pkg/core/util"
-	diskqueue "github.com/bhojpur/ems/pkg/diskqueue"
+	"github.com/bhojpur/ems/pkg/topiclog"
 )
 
 type Topic struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	messageCount uint64
-	messageBytes uint64
+	messageCount        uint64
+	messageBytes        uint64
+	replicationFailures uint64
 
 	sync.RWMutex
 
 	name              string
 	channelMap        map[string]*Channel
 	backend           BackendQueue
+	log               *topiclog.Log // with shared fanout storage
 	memoryMsgChan     chan *Message
 	startChan         chan int
 	exitChan          chan int
@@ -52,12 +53,23 @@ type Topic struct {
 	idFactory         *guidFactory
 
 	ephemeral      bool
+	diskBacked     bool  // rejects publishes while the data path is full
+	diskFull       int32 // rejects publishes, from --disk-full-pause-topic
 	deleteCallback func(*Topic)
 	deleter        sync.Once
 
 	paused    int32
 	pauseChan chan int
 
+	migration *topicMigration // moving the topic to another emsd
+	imported  importedIDs     // messages migrated from another emsd
+
+	replicas       []string        // HTTP addresses of the emsd replicating the topic
+	replicaAckChan chan replicaAck // finished messages to send to the replicas
+	replicaOf      string          // HTTP address of the leader, when a replica
+
+	rate messageRate
+
 	emsd *EMSD
 }
 
@@ -83,21 +95,26 @@ func NewTopic(topicName string, emsd *EMSD, deleteCallback func(*Topic)) *Topic
 	if strings.HasSuffix(topicName, "#ephemeral") {
 		t.ephemeral = true
 		t.backend = newDummyBackendQueue()
+	} else if emsd.fanoutStorage(topicName) == fanoutStorageShared {
+		// every message goes straight to the log, channels read it themselves
+		t.memoryMsgChan = nil
+		t.log = emsd.newTopicLog(topicName)
+		t.backend = &sharedLogTopicBackend{t.log}
+		t.diskBacked = true
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := emsd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
-		}
-		t.backend = diskqueue.New(
-			topicName,
-			emsd.getOpts().DataPath,
-			emsd.getOpts().MaxBytesPerFile,
-			int32(minValidMsgLength),
-			int32(emsd.getOpts().MaxMsgSize)+minValidMsgLength,
-			emsd.getOpts().SyncEvery,
-			emsd.getOpts().SyncTimeout,
-			dqLogf,
-		)
+		t.backend = emsd.newBackendQueue(topicName, topicName)
+		t.diskBacked = emsd.backendQueuePersistent(topicName)
+	}
+
+	if t.replicaOf = emsd.replicaLeader(topicName); t.replicaOf != "" {
+		// appends are acknowledged once on disk
+		t.memoryMsgChan = nil
+	} else if !t.ephemeral {
+		t.replicas = emsd.topicReplicas(topicName)
+	}
+	if len(t.replicas) > 0 {
+		t.replicaAckChan = make(chan replicaAck, replicaAckQueueSize)
+		t.waitGroup.Wrap(t.replicaAckLoop)
 	}
 
 	t.waitGroup.Wrap(t.messagePump)
@@ -133,6 +150,9 @@ func (t *Topic) GetChannel(channelName string) *Channel {
 		case t.channelUpdateChan <- 1:
 		case <-t.exitChan:
 		}
+		if len(t.replicas) > 0 && !channel.ephemeral {
+			t.setupReplicas()
+		}
 	}
 
 	return channel
@@ -146,6 +166,16 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 			t.DeleteExistingChannel(c.name)
 		}
 		channel = NewChannel(t.name, channelName, t.emsd, deleteCallback)
+		channel.replicaAckChan = t.replicaAckChan
+		if t.log != nil {
+			cursor, err := t.log.OpenCursor(channelName, channel.ephemeral)
+			if err != nil {
+				t.emsd.logf(LOG_ERROR, "TOPIC(%s): failed to open cursor for channel(%s) - %s",
+					t.name, channelName, err)
+			} else {
+				channel.backend = newSharedLogChannelBackend(cursor, channel.backend)
+			}
+		}
 		t.channelMap[channelName] = channel
 		t.emsd.logf(LOG_INFO, "TOPIC(%s): new channel(%s)", t.name, channel.name)
 		return channel, true
@@ -193,6 +223,10 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 	case <-t.exitChan:
 	}
 
+	if len(t.replicas) > 0 && !channel.ephemeral {
+		t.setupReplicas()
+	}
+
 	if numChannels == 0 && t.ephemeral == true {
 		go t.deleter.Do(func() { t.deleteCallback(t) })
 	}
@@ -200,12 +234,46 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 	return nil
 }
 
+// putAllowed returns why messages can't be published to the topic, the caller
+// must hold t's lock
+func (t *Topic) putAllowed() error {
+	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		return errors.New("exiting")
+	}
+	if t.replicaOf != "" {
+		return errReplica
+	}
+	if t.emsd.isDraining() {
+		return errDraining
+	}
+	if atomic.LoadInt32(&t.diskFull) == 1 || t.diskBacked && t.emsd.isDiskFull() {
+		return errDiskFull
+	}
+	return nil
+}
+
 // PutMessage writes a Message to the queue
 func (t *Topic) PutMessage(m *Message) error {
+	if len(t.replicas) > 0 {
+		// replicas get it first, they may hold messages the leader doesn't
+		err := t.replicate([]*Message{m})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := t.putMessage(m)
+	if err != nil && len(t.replicas) > 0 {
+		t.rollbackReplicas([]*Message{m})
+	}
+	return err
+}
+
+func (t *Topic) putMessage(m *Message) error {
 	t.RLock()
 	defer t.RUnlock()
-	if atomic.LoadInt32(&t.exitFlag) == 1 {
-		return errors.New("exiting")
+	if err := t.putAllowed(); err != nil {
+		return err
 	}
 	err := t.put(m)
 	if err != nil {
@@ -218,30 +286,72 @@ func (t *Topic) PutMessage(m *Message) error {
 
 // PutMessages writes multiple Messages to the queue
 func (t *Topic) PutMessages(msgs []*Message) error {
+	if len(t.replicas) > 0 {
+		err := t.replicate(msgs)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := t.putMessages(msgs)
+	if err != nil && len(t.replicas) > 0 {
+		t.rollbackReplicas(msgs[n:])
+	}
+	return err
+}
+
+// putMessages returns how many of msgs were stored, even when it fails
+func (t *Topic) putMessages(msgs []*Message) (int, error) {
 	t.RLock()
 	defer t.RUnlock()
-	if atomic.LoadInt32(&t.exitFlag) == 1 {
-		return errors.New("exiting")
+	if err := t.putAllowed(); err != nil {
+		return 0, err
 	}
 
 	messageTotalBytes := 0
 
 	for i, m := range msgs {
-		err := t.put(m)
-		if err != nil {
-			atomic.AddUint64(&t.messageCount, uint64(i))
+		select {
+		case t.memoryMsgChan <- m:
+		default:
+			// the rest are written to the backend together
+			n, err := writeMessagesToBackend(msgs[i:], t.backend)
+			for _, m := range msgs[i : i+n] {
+				messageTotalBytes += len(m.Body)
+			}
+			t.emsd.SetHealth(err)
+			if err != nil {
+				t.emsd.logf(LOG_ERROR,
+					"TOPIC(%s) ERROR: failed to write messages to backend - %s",
+					t.name, err)
+				// the messages which were written are counted, they'll be delivered
+				atomic.AddUint64(&t.messageCount, uint64(i+n))
+				atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
+				return i + n, err
+			}
 			atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
-			return err
+			atomic.AddUint64(&t.messageCount, uint64(len(msgs)))
+			return len(msgs), nil
 		}
 		messageTotalBytes += len(m.Body)
 	}
 
 	atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
 	atomic.AddUint64(&t.messageCount, uint64(len(msgs)))
-	return nil
+	return len(msgs), nil
 }
 
 func (t *Topic) put(m *Message) error {
+	if t.log != nil && m.deferred != 0 && len(t.channelMap) > 0 {
+		// the log can't hold back messages, deferring is up to each channel
+		for _, channel := range t.channelMap {
+			chanMsg := NewMessage(m.ID, m.Body)
+			chanMsg.Timestamp = m.Timestamp
+			channel.PutMessageDeferred(chanMsg, m.deferred)
+		}
+		return nil
+	}
+
 	select {
 	case t.memoryMsgChan <- m:
 	default:
@@ -492,6 +602,9 @@ func (t *Topic) doPause(pause bool) error {
 	} else {
 		atomic.StoreInt32(&t.paused, 0)
 	}
+	if t.log != nil {
+		t.log.SetPaused(pause)
+	}
 
 	select {
 	case t.pauseChan <- 1:
@@ -134,6 +134,81 @@ func TestHealth(t *testing.T) {
 	test.Equal(t, "OK", string(body))
 }
 
+type batchCountingBackendQueue struct {
+	BackendQueue
+	batches [][][]byte
+	// failAfter fails a batch after writing that many of its messages
+	failAfter int
+}
+
+func (d *batchCountingBackendQueue) PutBatch(data [][]byte) (int, error) {
+	d.batches = append(d.batches, data)
+	for i, b := range data {
+		if d.failAfter > 0 && i == d.failAfter {
+			return i, errors.New("never gonna happen")
+		}
+		err := d.Put(b)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(data), nil
+}
+
+func TestPutMessagesBatch(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("test_put_messages_batch")
+	bq := &batchCountingBackendQueue{BackendQueue: topic.backend}
+	topic.backend = bq
+
+	var msgs []*Message
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i))))
+	}
+	test.Nil(t, topic.PutMessages(msgs))
+
+	// the messages overflowing the memory queue are written at once
+	test.Equal(t, 1, len(bq.batches))
+	test.Equal(t, 3, len(bq.batches[0]))
+	test.Equal(t, int64(5), topic.Depth())
+	test.Equal(t, uint64(5), topic.messageCount)
+	for i, b := range bq.batches[0] {
+		msg, err := decodeMessage(b)
+		test.Nil(t, err)
+		test.Equal(t, msgs[2+i].ID, msg.ID)
+	}
+}
+
+func TestPutMessagesBatchPartialFailure(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, emsd := mustStartEMSD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer emsd.Exit()
+
+	topic := emsd.GetTopic("test_put_messages_batch_partial")
+	bq := &batchCountingBackendQueue{BackendQueue: topic.backend, failAfter: 1}
+	topic.backend = bq
+
+	var msgs []*Message
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i))))
+	}
+	test.NotNil(t, topic.PutMessages(msgs))
+
+	// only the messages in memory and the one written are counted
+	test.Equal(t, int64(3), topic.Depth())
+	test.Equal(t, uint64(3), topic.messageCount)
+	test.Equal(t, uint64(3), topic.messageBytes)
+}
+
 func TestDeletes(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
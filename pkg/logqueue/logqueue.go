@@ -0,0 +1,758 @@
+package logqueue
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/diskqueue"
+)
+
+// ErrNotFound is returned by Get for keys which are not (or no longer) queued
+var ErrNotFound = errors.New("not found")
+
+// record header: size (of everything after it), crc32c, sequence, key length
+const headerSize = 4 + 4 + 8 + 2
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// KeyFunc extracts the key a record is indexed by, for random access via Get
+type KeyFunc func(data []byte) []byte
+
+type Interface interface {
+	Put([]byte) error
+	ReadChan() <-chan []byte // this is expected to be an *unbuffered* channel
+	Get(key []byte) ([]byte, error)
+	Sync() error
+	Close() error
+	Delete() error
+	Depth() int64
+	DiskUsage() int64
+	Empty() error
+}
+
+// entry locates a single record
+type entry struct {
+	seq     uint64
+	fileNum int64
+	pos     int64
+	size    int64 // including the header
+	keyLen  int64
+}
+
+type getRequest struct {
+	key  string
+	resp chan getResponse
+}
+
+type getResponse struct {
+	data []byte
+	err  error
+}
+
+// logQueue implements a log-structured FIFO queue
+//
+// records are appended to segment files, each one carrying its own sequence
+// number, key and checksum so that the whole state (other than the read
+// position) can be rebuilt by scanning the segments on startup. An in-memory
+// index of all unread records, in order and by key, is kept which is what
+// allows random access. Segments are removed once every record in them has
+// been read.
+type logQueue struct {
+	sync.RWMutex
+
+	// instantiation time metadata
+	name            string
+	dataPath        string
+	maxBytesPerFile int64
+	minMsgSize      int32
+	maxMsgSize      int32
+	syncEvery       int64         // number of writes per fsync
+	syncTimeout     time.Duration // duration of time per fsync
+	keyFunc         KeyFunc
+	exitFlag        int32
+	needSync        bool
+
+	// run-time state, only readSeq is persisted (to the metadata file)
+	readSeq      uint64 // sequence number of the next record to read
+	writeSeq     uint64 // sequence number of the next record to write
+	writeFileNum int64
+	writePos     int64
+	entries      []entry          // unread records in order
+	keys         map[string]entry // unread records by key
+	fileCounts   map[int64]int    // number of unread records per segment
+	files        map[int64]*os.File
+
+	writeBuf bytes.Buffer
+
+	// exposed via ReadChan()
+	readChan chan []byte
+
+	// internal channels
+	depthChan         chan int64
+	getChan           chan getRequest
+	writeChan         chan []byte
+	writeResponseChan chan error
+	emptyChan         chan int
+	emptyResponseChan chan error
+	syncChan          chan int
+	syncResponseChan  chan error
+	exitChan          chan int
+	exitSyncChan      chan int
+
+	logf diskqueue.AppLogFunc
+}
+
+// New instantiates an instance of logQueue, rebuilding its index from the
+// filesystem and starting the read ahead goroutine
+func New(name string, dataPath string, maxBytesPerFile int64,
+	minMsgSize int32, maxMsgSize int32,
+	syncEvery int64, syncTimeout time.Duration,
+	keyFunc KeyFunc, logf diskqueue.AppLogFunc) Interface {
+	q := logQueue{
+		name:              name,
+		dataPath:          dataPath,
+		maxBytesPerFile:   maxBytesPerFile,
+		minMsgSize:        minMsgSize,
+		maxMsgSize:        maxMsgSize,
+		syncEvery:         syncEvery,
+		syncTimeout:       syncTimeout,
+		keyFunc:           keyFunc,
+		keys:              make(map[string]entry),
+		fileCounts:        make(map[int64]int),
+		files:             make(map[int64]*os.File),
+		readChan:          make(chan []byte),
+		depthChan:         make(chan int64),
+		getChan:           make(chan getRequest),
+		writeChan:         make(chan []byte),
+		writeResponseChan: make(chan error),
+		emptyChan:         make(chan int),
+		emptyResponseChan: make(chan error),
+		syncChan:          make(chan int),
+		syncResponseChan:  make(chan error),
+		exitChan:          make(chan int),
+		exitSyncChan:      make(chan int),
+		logf:              logf,
+	}
+
+	// no need to lock here, nothing else could possibly be touching this instance
+	err := q.recover()
+	if err != nil {
+		q.logf(diskqueue.ERROR, "LOGQUEUE(%s) failed to recover - %s", q.name, err)
+	}
+
+	go q.ioLoop()
+	return &q
+}
+
+// Depth returns the depth of the queue
+func (q *logQueue) Depth() int64 {
+	depth, ok := <-q.depthChan
+	if !ok {
+		// ioLoop exited
+		depth = int64(len(q.entries))
+	}
+	return depth
+}
+
+// DiskUsage returns the size of all of the queue's files
+func (q *logQueue) DiskUsage() int64 {
+	return filesSize(path.Join(q.dataPath, q.name+".logqueue.*"))
+}
+
+// ReadChan returns the receive-only []byte channel for reading data
+func (q *logQueue) ReadChan() <-chan []byte {
+	return q.readChan
+}
+
+// Put writes a []byte to the queue
+func (q *logQueue) Put(data []byte) error {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	q.writeChan <- data
+	return <-q.writeResponseChan
+}
+
+// Get returns the unread record indexed by key
+func (q *logQueue) Get(key []byte) ([]byte, error) {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return nil, errors.New("exiting")
+	}
+
+	req := getRequest{key: string(key), resp: make(chan getResponse, 1)}
+	q.getChan <- req
+	resp := <-req.resp
+	return resp.data, resp.err
+}
+
+// Close cleans up the queue and persists metadata
+func (q *logQueue) Close() error {
+	err := q.exit(false)
+	if err != nil {
+		return err
+	}
+	err = q.sync()
+	q.closeFiles()
+	return err
+}
+
+func (q *logQueue) Delete() error {
+	return q.exit(true)
+}
+
+func (q *logQueue) exit(deleted bool) error {
+	q.Lock()
+	defer q.Unlock()
+
+	q.exitFlag = 1
+
+	if deleted {
+		q.logf(diskqueue.INFO, "LOGQUEUE(%s): deleting", q.name)
+	} else {
+		q.logf(diskqueue.INFO, "LOGQUEUE(%s): closing", q.name)
+	}
+
+	close(q.exitChan)
+	// ensure that ioLoop has exited
+	<-q.exitSyncChan
+
+	close(q.depthChan)
+
+	if deleted {
+		q.closeFiles()
+	}
+
+	return nil
+}
+
+// Empty destructively clears out any pending data in the queue
+// by fast forwarding the read position and removing all segments
+func (q *logQueue) Empty() error {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	q.logf(diskqueue.INFO, "LOGQUEUE(%s): emptying", q.name)
+
+	q.emptyChan <- 1
+	return <-q.emptyResponseChan
+}
+
+// Sync fsyncs pending writes and persists metadata, once it returns the
+// queue's files can be copied consistently
+func (q *logQueue) Sync() error {
+	q.RLock()
+	defer q.RUnlock()
+
+	if q.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	q.syncChan <- 1
+	return <-q.syncResponseChan
+}
+
+func (q *logQueue) closeFiles() {
+	for fileNum, f := range q.files {
+		f.Close()
+		delete(q.files, fileNum)
+	}
+}
+
+func (q *logQueue) deleteAllFiles() error {
+	var err error
+
+	q.closeFiles()
+	fileNums, innerErr := q.segmentFileNums()
+	if innerErr != nil {
+		err = innerErr
+	}
+	for _, fileNum := range fileNums {
+		innerErr := os.Remove(q.fileName(fileNum))
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			q.logf(diskqueue.ERROR, "LOGQUEUE(%s) failed to remove data file - %s", q.name, innerErr)
+			err = innerErr
+		}
+	}
+
+	q.entries = nil
+	q.keys = make(map[string]entry)
+	q.fileCounts = make(map[int64]int)
+	q.readSeq = q.writeSeq
+	q.writeFileNum++
+	q.writePos = 0
+
+	innerErr = os.Remove(q.metaDataFileName())
+	if innerErr != nil && !os.IsNotExist(innerErr) {
+		q.logf(diskqueue.ERROR, "LOGQUEUE(%s) failed to remove metadata file - %s", q.name, innerErr)
+		err = innerErr
+	}
+
+	return err
+}
+
+func (q *logQueue) file(fileNum int64) (*os.File, error) {
+	f, ok := q.files[fileNum]
+	if ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(q.fileName(fileNum), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	q.files[fileNum] = f
+	return f, nil
+}
+
+// readEntry reads the data of a single record
+func (q *logQueue) readEntry(e entry) ([]byte, error) {
+	f, err := q.file(e.fileNum)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, e.size)
+	_, err = f.ReadAt(buf, e.pos)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(buf[8:], crcTable) != binary.BigEndian.Uint32(buf[4:8]) {
+		return nil, fmt.Errorf("checksum mismatch for record %d", e.seq)
+	}
+	return buf[headerSize+e.keyLen:], nil
+}
+
+// writeOne appends a single record, rolling segments if necessary
+func (q *logQueue) writeOne(data []byte) error {
+	var err error
+
+	dataLen := int32(len(data))
+	if dataLen < q.minMsgSize || dataLen > q.maxMsgSize {
+		return fmt.Errorf("invalid message write size (%d) minMsgSize=%d maxMsgSize=%d", dataLen, q.minMsgSize, q.maxMsgSize)
+	}
+
+	var key []byte
+	if q.keyFunc != nil {
+		key = q.keyFunc(data)
+	}
+	totalBytes := int64(headerSize + len(key) + len(data))
+
+	if q.writePos > 0 && q.writePos+totalBytes > q.maxBytesPerFile {
+		// sync every time we start writing to a new file
+		err = q.sync()
+		if err != nil {
+			q.logf(diskqueue.ERROR, "LOGQUEUE(%s) failed to sync - %s", q.name, err)
+		}
+		if q.fileCounts[q.writeFileNum] == 0 {
+			q.removeFile(q.writeFileNum)
+		}
+		q.writeFileNum++
+		q.writePos = 0
+	}
+
+	f, err := q.file(q.writeFileNum)
+	if err != nil {
+		return err
+	}
+
+	q.writeBuf.Reset()
+	var hdr [headerSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(totalBytes-4))
+	binary.BigEndian.PutUint64(hdr[8:16], q.writeSeq)
+	binary.BigEndian.PutUint16(hdr[16:18], uint16(len(key)))
+	q.writeBuf.Write(hdr[:])
+	q.writeBuf.Write(key)
+	q.writeBuf.Write(data)
+	buf := q.writeBuf.Bytes()
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[8:], crcTable))
+
+	// only write to the file once
+	_, err = f.WriteAt(buf, q.writePos)
+	if err != nil {
+		return err
+	}
+
+	q.addEntry(entry{
+		seq:     q.writeSeq,
+		fileNum: q.writeFileNum,
+		pos:     q.writePos,
+		size:    totalBytes,
+		keyLen:  int64(len(key)),
+	}, key)
+	q.writeSeq++
+	q.writePos += totalBytes
+
+	return nil
+}
+
+func (q *logQueue) addEntry(e entry, key []byte) {
+	q.entries = append(q.entries, e)
+	q.fileCounts[e.fileNum]++
+	if len(key) > 0 {
+		q.keys[string(key)] = e
+	}
+}
+
+func (q *logQueue) removeFile(fileNum int64) {
+	if f, ok := q.files[fileNum]; ok {
+		f.Close()
+		delete(q.files, fileNum)
+	}
+	delete(q.fileCounts, fileNum)
+	fn := q.fileName(fileNum)
+	err := os.Remove(fn)
+	if err != nil && !os.IsNotExist(err) {
+		q.logf(diskqueue.ERROR, "LOGQUEUE(%s) failed to Remove(%s) - %s", q.name, fn, err)
+	}
+}
+
+// moveForward consumes the head record
+func (q *logQueue) moveForward(key []byte) {
+	e := q.entries[0]
+	q.entries[0] = entry{}
+	q.entries = q.entries[1:]
+	if len(q.entries) == 0 {
+		q.entries = nil
+	}
+	if len(key) > 0 {
+		delete(q.keys, string(key))
+	}
+	q.readSeq = e.seq + 1
+
+	q.fileCounts[e.fileNum]--
+	if q.fileCounts[e.fileNum] == 0 && e.fileNum != q.writeFileNum {
+		// sync every time we finish reading a file
+		q.needSync = true
+		q.removeFile(e.fileNum)
+	}
+}
+
+// sync fsyncs the current write file and persists metadata
+func (q *logQueue) sync() error {
+	if f, ok := q.files[q.writeFileNum]; ok {
+		err := f.Sync()
+		if err != nil {
+			f.Close()
+			delete(q.files, q.writeFileNum)
+			return err
+		}
+	}
+
+	err := q.persistMetaData()
+	if err != nil {
+		return err
+	}
+
+	q.needSync = false
+	return nil
+}
+
+// segmentFileNums returns the numbers of all segment files, in order
+func (q *logQueue) segmentFileNums() ([]int64, error) {
+	prefix := path.Join(q.dataPath, q.name+".logqueue.")
+	matches, err := filepath.Glob(prefix + "*.dat")
+	if err != nil {
+		return nil, err
+	}
+	var fileNums []int64
+	for _, fn := range matches {
+		num, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(fn, prefix), ".dat"), 10, 64)
+		if err != nil {
+			// the metadata file
+			continue
+		}
+		fileNums = append(fileNums, num)
+	}
+	sort.Slice(fileNums, func(i, j int) bool { return fileNums[i] < fileNums[j] })
+	return fileNums, nil
+}
+
+// recover initializes state from the filesystem by scanning every segment
+func (q *logQueue) recover() error {
+	err := q.retrieveMetaData()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.writeSeq = q.readSeq
+
+	fileNums, err := q.segmentFileNums()
+	if err != nil {
+		return err
+	}
+	for i, fileNum := range fileNums {
+		last := i == len(fileNums)-1
+		err := q.scanFile(fileNum, last)
+		if err != nil {
+			return err
+		}
+		if q.fileCounts[fileNum] == 0 && !last {
+			q.removeFile(fileNum)
+		}
+	}
+	if len(fileNums) > 0 {
+		q.writeFileNum = fileNums[len(fileNums)-1]
+	}
+	return nil
+}
+
+// scanFile indexes every unread record in a segment, a torn or corrupt
+// record ends the scan and, in the last segment, is truncated so that
+// writes can resume after the last good record
+func (q *logQueue) scanFile(fileNum int64, last bool) error {
+	f, err := q.file(fileNum)
+	if err != nil {
+		return err
+	}
+
+	var pos int64
+	var hdr [headerSize]byte
+	for {
+		_, err = f.ReadAt(hdr[:], pos)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		size := int64(binary.BigEndian.Uint32(hdr[0:4])) + 4
+		keyLen := int64(binary.BigEndian.Uint16(hdr[16:18]))
+		if err == io.ErrUnexpectedEOF || size < headerSize+keyLen ||
+			size > headerSize+keyLen+int64(q.maxMsgSize) {
+			err = errors.New("invalid record header")
+		} else {
+			buf := make([]byte, size)
+			_, err = f.ReadAt(buf, pos)
+			if err == nil && crc32.Checksum(buf[8:], crcTable) != binary.BigEndian.Uint32(buf[4:8]) {
+				err = errors.New("checksum mismatch")
+			}
+			if err == nil {
+				seq := binary.BigEndian.Uint64(buf[8:16])
+				if seq >= q.writeSeq {
+					q.writeSeq = seq + 1
+				}
+				if seq >= q.readSeq {
+					key := buf[headerSize : headerSize+keyLen]
+					q.addEntry(entry{seq: seq, fileNum: fileNum, pos: pos, size: size, keyLen: keyLen}, key)
+				}
+				pos += size
+				continue
+			}
+		}
+
+		q.logf(diskqueue.WARN, "LOGQUEUE(%s) %s at %d of %s, discarding the rest of the file",
+			q.name, err, pos, q.fileName(fileNum))
+		if last {
+			err = f.Truncate(pos)
+			if err != nil {
+				return err
+			}
+		}
+		break
+	}
+
+	if last {
+		q.writePos = pos
+	}
+	return nil
+}
+
+// retrieveMetaData initializes the read position from the filesystem
+func (q *logQueue) retrieveMetaData() error {
+	f, err := os.OpenFile(q.metaDataFileName(), os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fscanf(f, "%d\n", &q.readSeq)
+	return err
+}
+
+// persistMetaData atomically writes the read position to the filesystem
+func (q *logQueue) persistMetaData() error {
+	var f *os.File
+	var err error
+
+	fileName := q.metaDataFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	// write to tmp file
+	f, err = os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%d\n", q.readSeq)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	// atomically rename
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (q *logQueue) metaDataFileName() string {
+	return fmt.Sprintf(path.Join(q.dataPath, "%s.logqueue.meta.dat"), q.name)
+}
+
+func (q *logQueue) fileName(fileNum int64) string {
+	return fmt.Sprintf(path.Join(q.dataPath, "%s.logqueue.%06d.dat"), q.name, fileNum)
+}
+
+// ioLoop owns all of the queue's state, it serves reads over readChan in
+// order as well as writes, random access lookups and syncs
+func (q *logQueue) ioLoop() {
+	var dataRead []byte
+	var keyRead []byte
+	var readSeq uint64
+	var haveRead bool
+	var err error
+	var count int64
+	var r chan []byte
+
+	syncTicker := time.NewTicker(q.syncTimeout)
+
+	for {
+		// dont sync all the time :)
+		if count == q.syncEvery {
+			q.needSync = true
+		}
+
+		if q.needSync {
+			err = q.sync()
+			if err != nil {
+				q.logf(diskqueue.ERROR, "LOGQUEUE(%s) failed to sync - %s", q.name, err)
+			}
+			count = 0
+		}
+
+		if len(q.entries) > 0 {
+			e := q.entries[0]
+			if !haveRead || readSeq != e.seq {
+				dataRead, err = q.readEntry(e)
+				if err != nil {
+					q.logf(diskqueue.ERROR, "LOGQUEUE(%s) reading record %d of %s - %s, skipping",
+						q.name, e.seq, q.fileName(e.fileNum), err)
+					q.moveForward(nil)
+					for k, ke := range q.keys {
+						if ke.seq == e.seq {
+							delete(q.keys, k)
+						}
+					}
+					haveRead = false
+					continue
+				}
+				keyRead = nil
+				if e.keyLen > 0 {
+					keyRead = q.keyFunc(dataRead)
+				}
+				readSeq = e.seq
+				haveRead = true
+			}
+			r = q.readChan
+		} else {
+			r = nil
+		}
+
+		select {
+		// the Go channel spec dictates that nil channel operations (read or write)
+		// in a select are skipped, we set r to q.readChan only when there is data to read
+		case r <- dataRead:
+			count++
+			q.moveForward(keyRead)
+			haveRead = false
+		case q.depthChan <- int64(len(q.entries)):
+		case req := <-q.getChan:
+			e, ok := q.keys[req.key]
+			if !ok {
+				req.resp <- getResponse{err: ErrNotFound}
+				continue
+			}
+			data, err := q.readEntry(e)
+			req.resp <- getResponse{data: data, err: err}
+		case <-q.emptyChan:
+			q.emptyResponseChan <- q.deleteAllFiles()
+			haveRead = false
+			count = 0
+		case <-q.syncChan:
+			q.syncResponseChan <- q.sync()
+			count = 0
+		case dataWrite := <-q.writeChan:
+			count++
+			q.writeResponseChan <- q.writeOne(dataWrite)
+		case <-syncTicker.C:
+			if count == 0 {
+				// avoid sync when there's no activity
+				continue
+			}
+			q.needSync = true
+		case <-q.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	q.logf(diskqueue.INFO, "LOGQUEUE(%s): closing ... ioLoop", q.name)
+	syncTicker.Stop()
+	q.exitSyncChan <- 1
+}
+
+// filesSize returns the total size of the files matching pattern
+func filesSize(pattern string) int64 {
+	matches, _ := filepath.Glob(pattern)
+	var size int64
+	for _, fn := range matches {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		size += fi.Size()
+	}
+	return size
+}
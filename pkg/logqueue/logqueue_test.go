@@ -0,0 +1,179 @@
+package logqueue
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+	"github.com/bhojpur/ems/pkg/diskqueue"
+)
+
+type tbLog interface {
+	Log(...interface{})
+}
+
+func newTestLogger(tbl tbLog) diskqueue.AppLogFunc {
+	return func(lvl diskqueue.LogLevel, f string, args ...interface{}) {
+		tbl.Log(fmt.Sprintf(lvl.String()+": "+f, args...))
+	}
+}
+
+// the first 4 bytes are the key
+func testKey(data []byte) []byte {
+	return data[:4]
+}
+
+func testMsg(i int) []byte {
+	b := make([]byte, 10)
+	binary.BigEndian.PutUint32(b, uint32(i))
+	copy(b[4:], "-value")
+	return b
+}
+
+func mustTempDir() string {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("ems-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	return tmpDir
+}
+
+func TestLogQueue(t *testing.T) {
+	l := newTestLogger(t)
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	name := "test_log_queue" + strconv.Itoa(int(time.Now().Unix()))
+	q := New(name, tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, testKey, l)
+	defer q.Close()
+	test.Equal(t, int64(0), q.Depth())
+
+	for i := 0; i < 3; i++ {
+		test.Nil(t, q.Put(testMsg(i)))
+	}
+	test.Equal(t, int64(3), q.Depth())
+
+	data, err := q.Get(testMsg(2)[:4])
+	test.Nil(t, err)
+	test.Equal(t, testMsg(2), data)
+
+	test.Equal(t, testMsg(0), <-q.ReadChan())
+	_, err = q.Get(testMsg(0)[:4])
+	test.Equal(t, ErrNotFound, err)
+	test.Equal(t, int64(2), q.Depth())
+
+	test.NotNil(t, q.Put([]byte("123")))
+}
+
+func TestLogQueueRoll(t *testing.T) {
+	l := newTestLogger(t)
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	name := "test_log_queue_roll" + strconv.Itoa(int(time.Now().Unix()))
+	q := New(name, tmpDir, 100, 4, 1<<10, 2500, 2*time.Second, testKey, l)
+	defer q.Close()
+
+	// 32 bytes per record, 3 per file
+	for i := 0; i < 10; i++ {
+		test.Nil(t, q.Put(testMsg(i)))
+	}
+	test.Equal(t, int64(10), q.Depth())
+	lq := q.(*logQueue)
+	files, _ := lq.segmentFileNums()
+	test.Equal(t, []int64{0, 1, 2, 3}, files)
+
+	for i := 0; i < 4; i++ {
+		test.Equal(t, testMsg(i), <-q.ReadChan())
+	}
+	// the ioLoop removes the file once the message is handed over
+	q.Depth()
+	files, _ = lq.segmentFileNums()
+	test.Equal(t, []int64{1, 2, 3}, files)
+}
+
+func TestLogQueueRecover(t *testing.T) {
+	l := newTestLogger(t)
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	name := "test_log_queue_recover" + strconv.Itoa(int(time.Now().Unix()))
+	q := New(name, tmpDir, 100, 4, 1<<10, 2500, 2*time.Second, testKey, l)
+	for i := 0; i < 8; i++ {
+		test.Nil(t, q.Put(testMsg(i)))
+	}
+	for i := 0; i < 2; i++ {
+		test.Equal(t, testMsg(i), <-q.ReadChan())
+	}
+	test.Nil(t, q.Close())
+
+	// tear the last record
+	fn := q.(*logQueue).fileName(2)
+	fi, err := os.Stat(fn)
+	test.Nil(t, err)
+	test.Nil(t, os.Truncate(fn, fi.Size()-3))
+
+	q = New(name, tmpDir, 100, 4, 1<<10, 2500, 2*time.Second, testKey, l)
+	defer q.Close()
+	test.Equal(t, int64(5), q.Depth())
+	data, err := q.Get(testMsg(6)[:4])
+	test.Nil(t, err)
+	test.Equal(t, testMsg(6), data)
+
+	// writes resume after the last good record
+	test.Nil(t, q.Put(testMsg(8)))
+	for _, i := range []int{2, 3, 4, 5, 6, 8} {
+		test.Equal(t, testMsg(i), <-q.ReadChan())
+	}
+	test.Equal(t, int64(0), q.Depth())
+}
+
+func TestLogQueueEmpty(t *testing.T) {
+	l := newTestLogger(t)
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	name := "test_log_queue_empty" + strconv.Itoa(int(time.Now().Unix()))
+	q := New(name, tmpDir, 100, 4, 1<<10, 2500, 2*time.Second, testKey, l)
+	for i := 0; i < 8; i++ {
+		test.Nil(t, q.Put(testMsg(i)))
+	}
+	test.Nil(t, q.Empty())
+	test.Equal(t, int64(0), q.Depth())
+	matches, _ := filepath.Glob(filepath.Join(tmpDir, name+".logqueue.*"))
+	test.Equal(t, 0, len(matches))
+
+	test.Nil(t, q.Put(testMsg(9)))
+	test.Equal(t, testMsg(9), <-q.ReadChan())
+	test.Nil(t, q.Close())
+
+	q = New(name, tmpDir, 100, 4, 1<<10, 2500, 2*time.Second, testKey, l)
+	defer q.Close()
+	test.Equal(t, int64(0), q.Depth())
+}
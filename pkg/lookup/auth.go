@@ -0,0 +1,146 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bhojpur/ems/pkg/core/http_api"
+	"github.com/julienschmidt/httprouter"
+)
+
+// buildTLSConfig returns the TLS config of the TCP listener, nil without a
+// certificate
+func buildTLSConfig(opts *Options) (*tls.Config, error) {
+	if opts.TLSCert == "" && opts.TLSKey == "" {
+		if opts.TLSClientAuthPolicy != "" {
+			return nil, errors.New("--tls-client-auth-policy requires --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var clientAuth tls.ClientAuthType
+	switch opts.TLSClientAuthPolicy {
+	case "":
+		clientAuth = tls.NoClientCert
+	case "require":
+		clientAuth = tls.RequireAnyClientCert
+	case "require-verify":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.New("--tls-client-auth-policy must be require or require-verify")
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if opts.TLSRootCAFile != "" {
+		tlsCertPool := x509.NewCertPool()
+		caCertFile, err := ioutil.ReadFile(opts.TLSRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
+			return nil, errors.New("failed to append certificate to pool")
+		}
+		tlsConfig.ClientCAs = tlsCertPool
+	}
+
+	return tlsConfig, nil
+}
+
+// nodeIdentities returns the identities a node is allowed with by
+// --allowed-node: the common name and subject alternative names of its client
+// certificate if it was verified against --tls-root-ca-file, else the IP
+// address it connected from. What it reports about itself in IDENTIFY (i.e.
+// its broadcast address) can't be trusted.
+func (l *EMSLookupd) nodeIdentities(conn net.Conn) []string {
+	if tlsConn, ok := conn.(*tls.Conn); ok && l.opts.TLSRootCAFile != "" {
+		state := tlsConn.ConnectionState()
+		if len(state.VerifiedChains) > 0 {
+			cert := state.PeerCertificates[0]
+			identities := []string{cert.Subject.CommonName}
+			identities = append(identities, cert.DNSNames...)
+			for _, ip := range cert.IPAddresses {
+				identities = append(identities, ip.String())
+			}
+			return identities
+		}
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return []string{host}
+}
+
+// authorizeNode checks the secret and identity of an emsd sending IDENTIFY
+func (l *EMSLookupd) authorizeNode(conn net.Conn, secret string) error {
+	if l.opts.RegistrationSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(l.opts.RegistrationSecret)) != 1 {
+		return errors.New("invalid secret")
+	}
+
+	if len(l.opts.AllowedNodes) == 0 {
+		return nil
+	}
+	identities := l.nodeIdentities(conn)
+	for _, allowed := range l.opts.AllowedNodes {
+		for _, identity := range identities {
+			if identity == allowed {
+				return nil
+			}
+		}
+	}
+	return errors.New("node not allowed")
+}
+
+// requireAdminToken rejects the requests without --http-admin-token as a bearer
+// token, if set
+func requireAdminToken(token string) http_api.Decorator {
+	return func(f http_api.APIHandler) http_api.APIHandler {
+		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+			if token != "" {
+				auth := req.Header.Get("Authorization")
+				if !strings.HasPrefix(auth, "Bearer ") ||
+					subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+					return nil, http_api.Err{401, "UNAUTHORIZED"}
+				}
+			}
+			return f(w, req, ps)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	emsctl "github.com/bhojpur/ems/pkg/client"
+	"github.com/bhojpur/ems/pkg/core/http_api"
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func identifyResponse(t *testing.T, conn net.Conn, secret string) []byte {
+	ci := make(map[string]interface{})
+	ci["tcp_port"] = TCPPort
+	ci["http_port"] = HTTPPort
+	ci["broadcast_address"] = HostAddr
+	ci["hostname"] = HostAddr
+	ci["version"] = EMSDVersion
+	if secret != "" {
+		ci["secret"] = secret
+	}
+	cmd, _ := emsctl.Identify(ci)
+	_, err := cmd.WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+	return resp
+}
+
+func isUnauthorized(resp []byte) bool {
+	return bytes.HasPrefix(resp, []byte("E_UNAUTHORIZED"))
+}
+
+func TestRegistrationSecret(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.RegistrationSecret = "s3cr3t"
+	tcpAddr, _, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	for secret, unauthorized := range map[string]bool{
+		"":       true,
+		"wrong":  true,
+		"s3cr3t": false,
+	} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		resp := identifyResponse(t, conn, secret)
+		test.Equal(t, unauthorized, isUnauthorized(resp))
+		conn.Close()
+	}
+
+	// REGISTER isn't possible without a successful IDENTIFY
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identifyResponse(t, conn, "wrong")
+	emsctl.Register("secret", "").WriteTo(conn)
+	emsctl.ReadResponse(conn)
+	test.Equal(t, 0, len(emslookupd.DB.FindRegistrations("topic", "secret", "")))
+}
+
+func TestAllowedNodes(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AllowedNodes = []string{fmt.Sprintf("%s:%d", HostAddr, TCPPort+1)}
+	tcpAddr, _, emslookupd := mustStartLookupd(opts)
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	test.Equal(t, true, isUnauthorized(identifyResponse(t, conn, "")))
+	conn.Close()
+	emslookupd.Exit()
+
+	// the broadcast address is only what the node claims
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AllowedNodes = []string{HostAddr}
+	tcpAddr, _, emslookupd = mustStartLookupd(opts)
+
+	conn = mustConnectLookupd(t, tcpAddr)
+	test.Equal(t, true, isUnauthorized(identifyResponse(t, conn, "")))
+	conn.Close()
+	emslookupd.Exit()
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AllowedNodes = []string{"other", "127.0.0.1"}
+	tcpAddr, _, emslookupd = mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	conn = mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	test.Equal(t, false, isUnauthorized(identifyResponse(t, conn, "")))
+}
+
+func TestTLSClientCert(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TLSCert = "../engine/test/certs/server.pem"
+	opts.TLSKey = "../engine/test/certs/server.key"
+	opts.TLSRootCAFile = "../engine/test/certs/ca.pem"
+	opts.TLSClientAuthPolicy = "require-verify"
+	opts.AllowedNodes = []string{"nsq.io"}
+	tcpAddr, _, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	// no client certificate
+	conn, err := tls.Dial("tcp", tcpAddr.String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Write(emsctl.MagicV1)
+		_, err = emsctl.ReadResponse(conn)
+		conn.Close()
+	}
+	test.NotNil(t, err)
+
+	cert, err := tls.LoadX509KeyPair("../engine/test/certs/client.pem", "../engine/test/certs/client.key")
+	test.Nil(t, err)
+	conn, err = tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", tcpAddr.String(),
+		&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+	test.Nil(t, err)
+	defer conn.Close()
+	conn.Write(emsctl.MagicV1)
+	test.Equal(t, false, isUnauthorized(identifyResponse(t, conn, "")))
+	emsctl.Register("tls", "").WriteTo(conn)
+	_, err = emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(emslookupd.DB.FindProducers("topic", "tls", "")))
+}
+
+func TestTLSClientCertUnverified(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TLSCert = "../engine/test/certs/server.pem"
+	opts.TLSKey = "../engine/test/certs/server.key"
+	opts.TLSRootCAFile = "../engine/test/certs/ca.pem"
+	opts.TLSClientAuthPolicy = "require"
+	opts.AllowedNodes = []string{"nsq.io"}
+	tcpAddr, _, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	// the names of a certificate which isn't verified aren't trusted
+	cert, err := tls.LoadX509KeyPair("../engine/test/certs/client.pem", "../engine/test/certs/client.key")
+	test.Nil(t, err)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", tcpAddr.String(),
+		&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+	test.Nil(t, err)
+	defer conn.Close()
+	conn.Write(emsctl.MagicV1)
+	test.Equal(t, true, isUnauthorized(identifyResponse(t, conn, "")))
+}
+
+func TestHTTPAdminToken(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPAdminToken = "t0ken"
+	_, httpAddr, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	endpoint := fmt.Sprintf("http://%s/topic/create?topic=admin", httpAddr)
+	err := client.POSTV1(endpoint)
+	test.NotNil(t, err)
+	err = client.WithAuthToken("wrong").POSTV1(endpoint)
+	test.NotNil(t, err)
+	test.Equal(t, 0, len(emslookupd.DB.FindRegistrations("topic", "admin", "")))
+
+	err = client.WithAuthToken("t0ken").POSTV1(endpoint)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(emslookupd.DB.FindRegistrations("topic", "admin", "")))
+
+	// reads don't need it
+	var topics TopicsDoc
+	err = client.GETV1(fmt.Sprintf("http://%s/topics", httpAddr), &topics)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(topics.Topics))
+}
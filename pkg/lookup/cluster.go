@@ -0,0 +1,656 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/http_api"
+)
+
+const (
+	// max size of a sync from another member
+	clusterReadMax = 64 * 1024 * 1024
+	// a member which didn't sync for that many intervals is dead, its
+	// producers are dropped
+	clusterMemberTimeoutIntervals = 5
+	// a dead member learned from another one is forgotten after that many
+	// intervals, members given with --cluster-peer are retried forever
+	clusterForgetIntervals = 100
+)
+
+// admin changes forwarded to the other members of the cluster
+const (
+	opCreateTopic   = "create_topic"
+	opDeleteTopic   = "delete_topic"
+	opCreateChannel = "create_channel"
+	opDeleteChannel = "delete_channel"
+	opTombstone     = "tombstone"
+	opSetPlacement  = "set_placement"
+	opDelPlacement  = "delete_placement"
+)
+
+// clusterOp is an admin change made via the HTTP API of any member
+type clusterOp struct {
+	Op      string `json:"op"`
+	Topic   string `json:"topic"`
+	Channel string `json:"channel,omitempty"`
+	Node    string `json:"node,omitempty"`
+
+	Rule *PlacementRule `json:"rule,omitempty"`
+}
+
+// isPlacementOp returns true for the ops changing placement rules rather than
+// a topic
+func (op *clusterOp) isPlacementOp() bool {
+	return op.Op == opSetPlacement || op.Op == opDelPlacement
+}
+
+// adminOp applies an admin change and forwards it to the other members
+func (l *EMSLookupd) adminOp(op *clusterOp) {
+	l.applyOp(op)
+	l.cluster.forward(op)
+}
+
+// applyOp applies an admin change, it returns false for an unknown op
+func (l *EMSLookupd) applyOp(op *clusterOp) bool {
+	switch op.Op {
+	case opCreateTopic:
+		l.logf(LOG_INFO, "DB: adding topic(%s)", op.Topic)
+		key := Registration{"topic", op.Topic, ""}
+		l.DB.AddRegistration(key)
+		l.setCreated(key, true)
+		l.cluster.setDeleted(key, false)
+	case opDeleteTopic:
+		registrations := l.DB.FindRegistrations("channel", op.Topic, "*")
+		for _, registration := range registrations {
+			l.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", registration.SubKey, op.Topic)
+			l.DB.RemoveRegistration(registration)
+			l.setCreated(registration, false)
+			l.cluster.setDeleted(registration, true)
+		}
+
+		registrations = l.DB.FindRegistrations("topic", op.Topic, "")
+		for _, registration := range registrations {
+			l.logf(LOG_INFO, "DB: removing topic(%s)", op.Topic)
+			l.DB.RemoveRegistration(registration)
+			l.setCreated(registration, false)
+			l.cluster.setDeleted(registration, true)
+		}
+	case opCreateChannel:
+		l.logf(LOG_INFO, "DB: adding channel(%s) in topic(%s)", op.Channel, op.Topic)
+		key := Registration{"channel", op.Topic, op.Channel}
+		l.DB.AddRegistration(key)
+		l.setCreated(key, true)
+		l.cluster.setDeleted(key, false)
+
+		l.logf(LOG_INFO, "DB: adding topic(%s)", op.Topic)
+		key = Registration{"topic", op.Topic, ""}
+		l.DB.AddRegistration(key)
+		l.setCreated(key, true)
+		l.cluster.setDeleted(key, false)
+	case opDeleteChannel:
+		l.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", op.Channel, op.Topic)
+		for _, registration := range l.DB.FindRegistrations("channel", op.Topic, op.Channel) {
+			l.DB.RemoveRegistration(registration)
+			l.setCreated(registration, false)
+			l.cluster.setDeleted(registration, true)
+		}
+	case opTombstone:
+		l.logf(LOG_INFO, "DB: setting tombstone for producer@%s of topic(%s)", op.Node, op.Topic)
+		producers := l.DB.FindProducers("topic", op.Topic, "")
+		// under the DB lock, the cluster snapshots tombstones concurrently
+		l.DB.Lock()
+		for _, p := range producers {
+			if producerNode(p.peerInfo) == op.Node {
+				p.Tombstone()
+			}
+		}
+		l.DB.Unlock()
+		l.DB.TopicChanged(op.Topic)
+	case opSetPlacement:
+		l.logf(LOG_INFO, "PLACEMENT: setting rule for pattern(%s) selector(%s) replicas(%d)",
+			op.Rule.Pattern, op.Rule.Selector, op.Rule.Replicas)
+		l.setPlacementRule(*op.Rule)
+		l.cluster.setDeleted(placementKey(op.Rule.Pattern), false)
+	case opDelPlacement:
+		l.logf(LOG_INFO, "PLACEMENT: removing rule for pattern(%s)", op.Rule.Pattern)
+		l.deletePlacementRule(op.Rule.Pattern)
+		l.cluster.setDeleted(placementKey(op.Rule.Pattern), true)
+	default:
+		return false
+	}
+
+	l.cluster.changed()
+	l.persistMetadata()
+	return true
+}
+
+// clusterSync is the state a member pushes to the others, its producers are
+// those connected to it
+type clusterSync struct {
+	From      string             `json:"from"`
+	Version   int64              `json:"version"`
+	Leaving   bool               `json:"leaving,omitempty"`
+	Members   []string           `json:"members"`
+	Producers []clusterProducer  `json:"producers"`
+	Created   []metaRegistration `json:"created"`
+	Placement []PlacementRule    `json:"placement,omitempty"`
+}
+
+type clusterProducer struct {
+	ID            string                `json:"id"`
+	PeerInfo      *PeerInfo             `json:"peer_info"`
+	Age           int64                 `json:"age"` // since its last update, in ns
+	Registrations []clusterRegistration `json:"registrations"`
+}
+
+type clusterRegistration struct {
+	Category     string `json:"category"`
+	Key          string `json:"key"`
+	SubKey       string `json:"subkey"`
+	TombstonedAt int64  `json:"tombstoned_at,omitempty"`
+}
+
+type clusterMember struct {
+	addr      string
+	seed      bool      // from --cluster-peer
+	added     time.Time // when it was learned
+	lastSeen  time.Time // last sync received from it
+	lastPush  time.Time // last sync successfully sent to it
+	version   int64     // of the last sync applied
+	producers map[string]*remoteProducer
+	created   map[Registration]bool // as of the last sync applied
+	placement map[string]PlacementRule
+}
+
+// remoteProducer is a producer connected to another member, its ID in the
+// RegistrationDB is prefixed with the member's address
+type remoteProducer struct {
+	peerInfo      *PeerInfo
+	registrations map[Registration]*Producer
+}
+
+type cluster struct {
+	sync.Mutex
+	l          *EMSLookupd
+	self       string
+	version    int64
+	members    map[string]*clusterMember
+	deleted    map[Registration]time.Time // recently deleted via the HTTP API, see placementKey
+	notifyChan chan struct{}
+	httpcli    *http_api.Client
+}
+
+func newCluster(l *EMSLookupd) *cluster {
+	port := l.RealHTTPAddr().Port
+	c := &cluster{
+		l:    l,
+		self: net.JoinHostPort(l.opts.BroadcastAddress, strconv.Itoa(port)),
+		// versions don't repeat across restarts
+		version:    time.Now().UnixNano(),
+		members:    make(map[string]*clusterMember),
+		deleted:    make(map[Registration]time.Time),
+		notifyChan: make(chan struct{}, 1),
+		httpcli: http_api.NewClient(nil, time.Second, 2*time.Second).
+			WithAuthToken(l.opts.HTTPAdminToken),
+	}
+	for _, addr := range l.opts.ClusterPeers {
+		if addr != c.self {
+			c.member(addr).seed = true
+		}
+	}
+	return c
+}
+
+// member returns the member at addr, adding it if needed, the caller must hold
+// c's lock
+func (c *cluster) member(addr string) *clusterMember {
+	m, ok := c.members[addr]
+	if !ok {
+		m = &clusterMember{
+			addr:      addr,
+			added:     time.Now(),
+			producers: make(map[string]*remoteProducer),
+			created:   make(map[Registration]bool),
+			placement: make(map[string]PlacementRule),
+		}
+		c.members[addr] = m
+		c.l.logf(LOG_INFO, "CLUSTER: added member %s", addr)
+	}
+	return m
+}
+
+// join adds a member, it's sent the state right away
+func (c *cluster) join(addr string) {
+	if addr == c.self {
+		return
+	}
+	c.Lock()
+	c.member(addr)
+	c.Unlock()
+	c.changed()
+}
+
+// leave forgets a member and drops its producers
+func (c *cluster) leave(addr string) bool {
+	c.Lock()
+	defer c.Unlock()
+	m, ok := c.members[addr]
+	if !ok {
+		return false
+	}
+	c.dropProducers(m)
+	delete(c.members, addr)
+	c.l.logf(LOG_INFO, "CLUSTER: removed member %s", addr)
+	return true
+}
+
+// placementKey is the key of a deleted placement rule in cluster.deleted
+func placementKey(pattern string) Registration {
+	return Registration{"placement", pattern, ""}
+}
+
+// setDeleted records a registration deleted via the HTTP API, syncs sent
+// before the deletion reached the other members don't create it again
+func (c *cluster) setDeleted(k Registration, deleted bool) {
+	c.Lock()
+	defer c.Unlock()
+	if deleted {
+		c.deleted[k] = time.Now()
+	} else {
+		delete(c.deleted, k)
+	}
+}
+
+// changed schedules a sync of the local state to the other members
+func (c *cluster) changed() {
+	select {
+	case c.notifyChan <- struct{}{}:
+	default:
+	}
+}
+
+func (c *cluster) alive(m *clusterMember, now time.Time) bool {
+	timeout := clusterMemberTimeoutIntervals * c.l.opts.ClusterSyncInterval
+	return now.Sub(m.lastSeen) < timeout || now.Sub(m.lastPush) < timeout
+}
+
+// loop pushes the local state to the other members on changes and every
+// --cluster-sync-interval
+func (c *cluster) loop() {
+	ticker := time.NewTicker(c.l.opts.ClusterSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.expire()
+		case <-c.notifyChan:
+		case <-c.l.exitChan:
+			c.push(c.snapshot(true))
+			return
+		}
+		c.push(c.snapshot(false))
+	}
+}
+
+// expire drops the producers of members which stopped syncing
+func (c *cluster) expire() {
+	now := time.Now()
+	interval := c.l.opts.ClusterSyncInterval
+	c.Lock()
+	defer c.Unlock()
+	for k, deletedAt := range c.deleted {
+		if now.Sub(deletedAt) >= clusterMemberTimeoutIntervals*interval {
+			delete(c.deleted, k)
+		}
+	}
+	for addr, m := range c.members {
+		if len(m.producers) > 0 && now.Sub(m.lastSeen) >= clusterMemberTimeoutIntervals*interval {
+			c.l.logf(LOG_WARN, "CLUSTER: member %s timed out, dropping its %d producers",
+				addr, len(m.producers))
+			c.dropProducers(m)
+		}
+		lastContact := m.added
+		if m.lastSeen.After(lastContact) {
+			lastContact = m.lastSeen
+		}
+		if m.lastPush.After(lastContact) {
+			lastContact = m.lastPush
+		}
+		if !m.seed && now.Sub(lastContact) >= clusterForgetIntervals*interval {
+			c.l.logf(LOG_INFO, "CLUSTER: forgetting member %s", addr)
+			delete(c.members, addr)
+		}
+	}
+}
+
+// snapshot returns the local state, i.e. the producers connected to this
+// member, the topics/channels created via its HTTP API and the placement rules
+func (c *cluster) snapshot(leaving bool) *clusterSync {
+	c.Lock()
+	c.version++
+	s := &clusterSync{
+		From:      c.self,
+		Version:   c.version,
+		Leaving:   leaving,
+		Members:   []string{c.self},
+		Producers: []clusterProducer{},
+		Created:   []metaRegistration{},
+	}
+	remote := make(map[string]bool)
+	for addr, m := range c.members {
+		s.Members = append(s.Members, addr)
+		for _, rp := range m.producers {
+			remote[rp.peerInfo.id] = true
+		}
+	}
+	noMembers := len(c.members) == 0
+	c.Unlock()
+	if leaving || noMembers {
+		return s
+	}
+
+	now := time.Now().UnixNano()
+	for _, p := range c.l.DB.FindProducers("client", "", "") {
+		if remote[p.peerInfo.id] {
+			continue
+		}
+		cp := clusterProducer{
+			ID:       p.peerInfo.id,
+			PeerInfo: p.peerInfo,
+			Age:      now - atomic.LoadInt64(&p.peerInfo.lastUpdate),
+		}
+		for _, k := range c.l.DB.LookupRegistrations(p.peerInfo.id) {
+			cr := clusterRegistration{Category: k.Category, Key: k.Key, SubKey: k.SubKey}
+			producers := c.l.DB.FindProducers(k.Category, k.Key, k.SubKey)
+			c.l.DB.RLock()
+			for _, rp := range producers {
+				if rp.peerInfo == p.peerInfo && rp.tombstoned {
+					cr.TombstonedAt = rp.tombstonedAt.UnixNano()
+				}
+			}
+			c.l.DB.RUnlock()
+			cp.Registrations = append(cp.Registrations, cr)
+		}
+		s.Producers = append(s.Producers, cp)
+	}
+
+	c.l.RLock()
+	for k := range c.l.created {
+		s.Created = append(s.Created, metaRegistration{
+			Category: k.Category,
+			Key:      k.Key,
+			SubKey:   k.SubKey,
+			Created:  true,
+		})
+	}
+	c.l.RUnlock()
+	s.Placement = c.l.placementRules()
+	return s
+}
+
+// push sends the local state to every member
+func (c *cluster) push(s *clusterSync) {
+	c.Lock()
+	addrs := make([]string, 0, len(c.members))
+	for addr := range c.members {
+		addrs = append(addrs, addr)
+	}
+	c.Unlock()
+	if len(addrs) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(s)
+	if err != nil {
+		c.l.logf(LOG_ERROR, "CLUSTER: failed to marshal sync - %s", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := c.httpcli.POSTV1Body("http://"+addr+"/cluster/sync", body)
+			if err != nil {
+				c.l.logf(LOG_DEBUG, "CLUSTER: failed to sync with %s - %s", addr, err)
+				return
+			}
+			c.Lock()
+			if m, ok := c.members[addr]; ok {
+				m.lastPush = time.Now()
+			}
+			c.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// apply replaces the producers of the member s is from
+func (c *cluster) apply(s *clusterSync) {
+	if s.From == "" || s.From == c.self {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if s.Leaving {
+		if m, ok := c.members[s.From]; ok {
+			c.l.logf(LOG_INFO, "CLUSTER: member %s is leaving", s.From)
+			c.dropProducers(m)
+			if !m.seed {
+				delete(c.members, s.From)
+			}
+		}
+		return
+	}
+
+	now := time.Now()
+	m := c.member(s.From)
+	m.lastSeen = now
+	for _, addr := range s.Members {
+		if addr != "" && addr != c.self {
+			c.member(addr)
+		}
+	}
+	if s.Version <= m.version {
+		return
+	}
+	m.version = s.Version
+
+	seen := make(map[string]bool)
+	for _, cp := range s.Producers {
+		if cp.PeerInfo == nil {
+			continue
+		}
+		seen[cp.ID] = true
+		rp, ok := m.producers[cp.ID]
+		if !ok {
+			peerInfo := *cp.PeerInfo
+			peerInfo.id = m.addr + "/" + cp.ID
+			rp = &remoteProducer{
+				peerInfo:      &peerInfo,
+				registrations: make(map[Registration]*Producer),
+			}
+			m.producers[cp.ID] = rp
+		}
+		atomic.StoreInt64(&rp.peerInfo.lastUpdate, now.UnixNano()-cp.Age)
+
+		keys := make(map[Registration]bool)
+		for _, cr := range cp.Registrations {
+			k := Registration{cr.Category, cr.Key, cr.SubKey}
+			keys[k] = true
+			p, ok := rp.registrations[k]
+			if !ok {
+				p = &Producer{peerInfo: rp.peerInfo}
+				rp.registrations[k] = p
+			}
+			tombstoned := cr.TombstonedAt != 0
+			c.l.DB.Lock()
+			changed := tombstoned != p.tombstoned
+			if changed {
+				p.tombstoned = tombstoned
+				p.tombstonedAt = time.Unix(0, cr.TombstonedAt)
+			}
+			c.l.DB.Unlock()
+			if changed {
+				c.l.DB.TopicChanged(k.Key)
+			}
+			if !ok {
+				c.l.DB.AddProducer(k, p)
+			}
+		}
+		for k := range rp.registrations {
+			if !keys[k] {
+				c.removeProducer(k, rp)
+			}
+		}
+	}
+	for id, rp := range m.producers {
+		if !seen[id] {
+			for k := range rp.registrations {
+				c.removeProducer(k, rp)
+			}
+			delete(m.producers, id)
+		}
+	}
+
+	// only what was created since the last sync, deletions are forwarded
+	// and a sync sent before one mustn't create again
+	created := make(map[Registration]bool)
+	for _, r := range s.Created {
+		k := Registration{r.Category, r.Key, r.SubKey}
+		created[k] = true
+		if _, ok := c.deleted[k]; !ok && !m.created[k] {
+			c.l.DB.AddRegistration(k)
+			c.l.setCreated(k, true)
+		}
+	}
+	m.created = created
+
+	// likewise for the placement rules
+	placement := make(map[string]PlacementRule)
+	changed := false
+	for _, r := range s.Placement {
+		if r.validate() != nil {
+			continue
+		}
+		placement[r.Pattern] = r
+		if _, ok := c.deleted[placementKey(r.Pattern)]; !ok && m.placement[r.Pattern] != r {
+			c.l.setPlacementRule(r)
+			changed = true
+		}
+	}
+	m.placement = placement
+	if changed {
+		c.l.persistMetadata()
+	}
+}
+
+// dropProducers removes the producers of a member, the caller must hold c's
+// lock
+func (c *cluster) dropProducers(m *clusterMember) {
+	for id, rp := range m.producers {
+		for k := range rp.registrations {
+			c.removeProducer(k, rp)
+		}
+		delete(m.producers, id)
+	}
+}
+
+func (c *cluster) removeProducer(k Registration, rp *remoteProducer) {
+	delete(rp.registrations, k)
+	_, left := c.l.DB.RemoveProducer(k, rp.peerInfo.id)
+	// as when an ephemeral channel is unregistered
+	if left == 0 && isEphemeral(k) {
+		c.l.DB.RemoveRegistration(k)
+	}
+}
+
+// forward sends an admin change to the other members
+func (c *cluster) forward(op *clusterOp) {
+	c.Lock()
+	addrs := make([]string, 0, len(c.members))
+	for addr, m := range c.members {
+		if c.alive(m, time.Now()) {
+			addrs = append(addrs, addr)
+		}
+	}
+	c.Unlock()
+	if len(addrs) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(op)
+	if err != nil {
+		c.l.logf(LOG_ERROR, "CLUSTER: failed to marshal %s - %s", op.Op, err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := c.httpcli.POSTV1Body("http://"+addr+"/cluster/apply", body)
+			if err != nil {
+				c.l.logf(LOG_ERROR, "CLUSTER: failed to forward %s of topic(%s) to %s - %s",
+					op.Op, op.Topic, addr, err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
+
+type clusterMemberInfo struct {
+	Address   string `json:"address"`
+	Alive     bool   `json:"alive"`
+	LastSeen  int64  `json:"last_seen"`
+	Producers int    `json:"producers"`
+}
+
+// membersInfo returns the other members of the cluster
+func (c *cluster) membersInfo() []clusterMemberInfo {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	members := make([]clusterMemberInfo, 0, len(c.members))
+	for addr, m := range c.members {
+		var lastSeen int64
+		if !m.lastSeen.IsZero() {
+			lastSeen = m.lastSeen.UnixNano()
+		}
+		members = append(members, clusterMemberInfo{
+			Address:   addr,
+			Alive:     c.alive(m, now),
+			LastSeen:  lastSeen,
+			Producers: len(m.producers),
+		})
+	}
+	return members
+}
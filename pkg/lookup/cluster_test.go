@@ -0,0 +1,249 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	emsctl "github.com/bhojpur/ems/pkg/client"
+	"github.com/bhojpur/ems/pkg/core/http_api"
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+const testClusterToken = "cluster-token"
+
+type testClusterMember struct {
+	tcpAddr  *net.TCPAddr
+	httpAddr *net.TCPAddr
+	l        *EMSLookupd
+}
+
+// mustStartCluster starts n lookupds, each one given only the previous one as
+// peer
+func mustStartCluster(t *testing.T, n int) []*testClusterMember {
+	var members []*testClusterMember
+	for i := 0; i < n; i++ {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		opts.BroadcastAddress = "127.0.0.1"
+		opts.ClusterSyncInterval = 50 * time.Millisecond
+		opts.HTTPAdminToken = testClusterToken
+		if i > 0 {
+			opts.ClusterPeers = []string{members[i-1].httpAddr.String()}
+		}
+		tcpAddr, httpAddr, l := mustStartLookupd(opts)
+		members = append(members, &testClusterMember{tcpAddr, httpAddr, l})
+	}
+	return members
+}
+
+func waitForCluster(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testLookup struct {
+	Channels  []string `json:"channels"`
+	Producers []struct {
+		BroadcastAddress string `json:"broadcast_address"`
+		HTTPPort         int    `json:"http_port"`
+	} `json:"producers"`
+}
+
+func lookupTopic(m *testClusterMember, topic string) (*testLookup, error) {
+	var lr testLookup
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", m.httpAddr, topic)
+	err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &lr)
+	return &lr, err
+}
+
+func TestClusterMembers(t *testing.T) {
+	members := mustStartCluster(t, 3)
+	for _, m := range members {
+		defer m.l.Exit()
+	}
+
+	// the first and last lookupd only learn about each other via the second
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	for _, m := range members {
+		m := m
+		waitForCluster(t, "members", func() bool {
+			var resp struct {
+				Self    string              `json:"self"`
+				Members []clusterMemberInfo `json:"members"`
+			}
+			err := client.GETV1(fmt.Sprintf("http://%s/cluster/members", m.httpAddr), &resp)
+			test.Nil(t, err)
+			test.Equal(t, m.httpAddr.String(), resp.Self)
+			alive := 0
+			for _, mi := range resp.Members {
+				if mi.Alive {
+					alive++
+				}
+			}
+			return alive == 2
+		})
+	}
+}
+
+func TestClusterRegister(t *testing.T) {
+	members := mustStartCluster(t, 3)
+	for _, m := range members {
+		defer m.l.Exit()
+	}
+
+	topicName := "cluster_register"
+	conn := mustConnectLookupd(t, members[2].tcpAddr)
+	identify(t, conn)
+	emsctl.Register(topicName, "ch").WriteTo(conn)
+	_, err := emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+
+	for _, m := range members {
+		m := m
+		waitForCluster(t, "registration", func() bool {
+			lr, err := lookupTopic(m, topicName)
+			return err == nil && len(lr.Producers) == 1 && len(lr.Channels) == 1
+		})
+		lr, _ := lookupTopic(m, topicName)
+		test.Equal(t, HostAddr, lr.Producers[0].BroadcastAddress)
+		test.Equal(t, HTTPPort, lr.Producers[0].HTTPPort)
+		test.Equal(t, "ch", lr.Channels[0])
+	}
+
+	// a tombstone via any member applies everywhere
+	endpoint := fmt.Sprintf("http://%s/topic/tombstone?topic=%s&node=%s:%d",
+		members[0].httpAddr, topicName, HostAddr, HTTPPort)
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).WithAuthToken(testClusterToken).POSTV1(endpoint)
+	test.Nil(t, err)
+	for _, m := range members {
+		m := m
+		waitForCluster(t, "tombstone", func() bool {
+			lr, err := lookupTopic(m, topicName)
+			return err == nil && len(lr.Producers) == 0
+		})
+	}
+
+	// the producer goes away everywhere when it disconnects
+	conn.Close()
+	for _, m := range members {
+		m := m
+		waitForCluster(t, "unregistration", func() bool {
+			return len(m.l.DB.FindProducers("topic", topicName, "")) == 0 &&
+				len(m.l.DB.FindProducers("client", "", "")) == 0
+		})
+	}
+}
+
+func TestClusterAdminOps(t *testing.T) {
+	members := mustStartCluster(t, 3)
+	for _, m := range members {
+		defer m.l.Exit()
+	}
+	for _, m := range members {
+		m := m
+		waitForCluster(t, "members", func() bool {
+			return len(m.l.cluster.membersInfo()) == 2
+		})
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).WithAuthToken(testClusterToken)
+	err := client.POSTV1(fmt.Sprintf("http://%s/channel/create?topic=created&channel=ch", members[1].httpAddr))
+	test.Nil(t, err)
+	for _, m := range members {
+		test.Equal(t, 1, len(m.l.DB.FindRegistrations("topic", "created", "")))
+		test.Equal(t, 1, len(m.l.DB.FindRegistrations("channel", "created", "ch")))
+	}
+
+	err = client.POSTV1(fmt.Sprintf("http://%s/topic/delete?topic=created", members[2].httpAddr))
+	test.Nil(t, err)
+	for _, m := range members {
+		test.Equal(t, 0, len(m.l.DB.FindRegistrations("topic", "created", "")))
+		test.Equal(t, 0, len(m.l.DB.FindRegistrations("channel", "created", "ch")))
+	}
+}
+
+func TestClusterLeave(t *testing.T) {
+	members := mustStartCluster(t, 2)
+	defer members[0].l.Exit()
+
+	topicName := "cluster_leave"
+	conn := mustConnectLookupd(t, members[1].tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+	emsctl.Register(topicName, "").WriteTo(conn)
+	_, err := emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+
+	waitForCluster(t, "registration", func() bool {
+		return len(members[0].l.DB.FindProducers("topic", topicName, "")) == 1
+	})
+
+	// an exiting member tells the others to drop its producers
+	members[1].l.Exit()
+	test.Equal(t, 0, len(members[0].l.DB.FindProducers("topic", topicName, "")))
+	test.Equal(t, 0, len(members[0].l.cluster.membersInfo()))
+}
+
+func TestClusterRegisterTwice(t *testing.T) {
+	members := mustStartCluster(t, 2)
+	for _, m := range members {
+		defer m.l.Exit()
+	}
+
+	// the same emsd registered with both members
+	topicName := "cluster_register_twice"
+	for _, m := range members {
+		conn := mustConnectLookupd(t, m.tcpAddr)
+		defer conn.Close()
+		identify(t, conn)
+		emsctl.Register(topicName, "").WriteTo(conn)
+		_, err := emsctl.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	for _, m := range members {
+		m := m
+		waitForCluster(t, "registration", func() bool {
+			return len(m.l.DB.FindProducers("topic", topicName, "")) == 2
+		})
+		lr, err := lookupTopic(m, topicName)
+		test.Nil(t, err)
+		test.Equal(t, 1, len(lr.Producers))
+
+		var nodes struct {
+			Producers []*node `json:"producers"`
+		}
+		err = client.GETV1(fmt.Sprintf("http://%s/nodes", m.httpAddr), &nodes)
+		test.Nil(t, err)
+		test.Equal(t, 1, len(nodes.Producers))
+		test.Equal(t, []string{topicName}, nodes.Producers[0].Topics)
+	}
+}
@@ -0,0 +1,352 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// max size of an answer over UDP, larger ones are truncated
+	dnsMaxUDPSize = 512
+	dnsTCPTimeout = 5 * time.Second
+)
+
+// dnsServer answers, under --dns-domain:
+//
+//   - SRV queries for _<topic>._tcp with the active producers of the topic
+//   - A/AAAA queries for nodes with every active node
+//   - A/AAAA queries for <address>.node, the targets of the SRV records of
+//     nodes broadcasting an IP address
+type dnsServer struct {
+	l           *EMSLookupd
+	domain      string // lower case, fully qualified
+	ttl         uint32
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	conns       sync.Map
+}
+
+func newDNSServer(l *EMSLookupd) (*dnsServer, error) {
+	udpConn, err := net.ListenPacket("udp", l.opts.DNSAddress)
+	if err != nil {
+		return nil, fmt.Errorf("listen (%s) failed - %s", l.opts.DNSAddress, err)
+	}
+	// TCP on the same port, the one picked for UDP with a 0 port
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("listen (%s) failed - %s", l.opts.DNSAddress, err)
+	}
+
+	ttl := l.opts.DNSTTL / time.Second
+	return &dnsServer{
+		l:           l,
+		domain:      strings.ToLower(strings.TrimSuffix(l.opts.DNSDomain, ".")) + ".",
+		ttl:         uint32(ttl),
+		udpConn:     udpConn,
+		tcpListener: tcpListener,
+	}, nil
+}
+
+func (d *dnsServer) serveUDP() {
+	d.l.logf(LOG_INFO, "DNS: listening on %s/udp", d.udpConn.LocalAddr())
+	buf := make([]byte, dnsMaxUDPSize)
+	for {
+		n, addr, err := d.udpConn.ReadFrom(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				d.l.logf(LOG_ERROR, "DNS: udp read failed - %s", err)
+			}
+			break
+		}
+		resp, err := d.answer(buf[:n], dnsMaxUDPSize)
+		if err != nil {
+			d.l.logf(LOG_DEBUG, "DNS: invalid query from %s - %s", addr, err)
+			continue
+		}
+		d.udpConn.WriteTo(resp, addr)
+	}
+	d.l.logf(LOG_INFO, "DNS: closing %s/udp", d.udpConn.LocalAddr())
+}
+
+func (d *dnsServer) serveTCP() {
+	d.l.logf(LOG_INFO, "DNS: listening on %s/tcp", d.tcpListener.Addr())
+	var wg sync.WaitGroup
+	for {
+		conn, err := d.tcpListener.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				d.l.logf(LOG_ERROR, "DNS: tcp accept failed - %s", err)
+			}
+			break
+		}
+		wg.Add(1)
+		go func() {
+			d.conns.Store(conn, true)
+			d.handleTCP(conn)
+			d.conns.Delete(conn)
+			wg.Done()
+		}()
+	}
+	d.conns.Range(func(k, v interface{}) bool {
+		k.(net.Conn).Close()
+		return true
+	})
+	wg.Wait()
+	d.l.logf(LOG_INFO, "DNS: closing %s/tcp", d.tcpListener.Addr())
+}
+
+// handleTCP answers the queries of a connection, each prefixed by its length
+func (d *dnsServer) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPTimeout))
+		var size uint16
+		err := binary.Read(conn, binary.BigEndian, &size)
+		if err != nil {
+			return
+		}
+		query := make([]byte, size)
+		_, err = io.ReadFull(conn, query)
+		if err != nil {
+			return
+		}
+		resp, err := d.answer(query, 65535)
+		if err != nil {
+			d.l.logf(LOG_DEBUG, "DNS: invalid query from %s - %s", conn.RemoteAddr(), err)
+			return
+		}
+		buf := make([]byte, 2, 2+len(resp))
+		binary.BigEndian.PutUint16(buf, uint16(len(resp)))
+		_, err = conn.Write(append(buf, resp...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (d *dnsServer) Close() {
+	d.udpConn.Close()
+	d.tcpListener.Close()
+}
+
+// dnsRecord is an answer, only one of srv and ip is set
+type dnsRecord struct {
+	name string
+	srv  *dnsmessage.SRVResource
+	ip   net.IP
+}
+
+// answer returns the response to a query, truncated to the question if larger
+// than maxSize
+func (d *dnsServer) answer(query []byte, maxSize int) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if h.Response {
+		return nil, fmt.Errorf("not a query")
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	rcode, answers, additionals := d.resolve(q)
+	resp, err := d.build(h.ID, q, rcode, answers, additionals, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) > maxSize {
+		return d.build(h.ID, q, rcode, nil, nil, true)
+	}
+	return resp, nil
+}
+
+func (d *dnsServer) build(id uint16, q dnsmessage.Question, rcode dnsmessage.RCode,
+	answers []dnsRecord, additionals []dnsRecord, truncated bool) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:            id,
+		Response:      true,
+		Authoritative: true,
+		Truncated:     truncated,
+		RCode:         rcode,
+	})
+	b.EnableCompression()
+	err := b.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+	err = b.Question(q)
+	if err != nil {
+		return nil, err
+	}
+	err = b.StartAnswers()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range answers {
+		err = d.addRecord(&b, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = b.StartAdditionals()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range additionals {
+		err = d.addRecord(&b, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func (d *dnsServer) addRecord(b *dnsmessage.Builder, r dnsRecord) error {
+	name, err := dnsmessage.NewName(r.name)
+	if err != nil {
+		return err
+	}
+	h := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: d.ttl}
+	switch {
+	case r.srv != nil:
+		return b.SRVResource(h, *r.srv)
+	case r.ip.To4() != nil:
+		var a dnsmessage.AResource
+		copy(a.A[:], r.ip.To4())
+		return b.AResource(h, a)
+	default:
+		var aaaa dnsmessage.AAAAResource
+		copy(aaaa.AAAA[:], r.ip.To16())
+		return b.AAAAResource(h, aaaa)
+	}
+}
+
+// resolve returns the answers to a question and the addresses of the SRV
+// targets
+func (d *dnsServer) resolve(q dnsmessage.Question) (dnsmessage.RCode, []dnsRecord, []dnsRecord) {
+	name := q.Name.String()
+	if q.Class != dnsmessage.ClassINET && q.Class != dnsmessage.ClassANY {
+		return dnsmessage.RCodeNotImplemented, nil, nil
+	}
+	if !strings.HasSuffix(strings.ToLower(name), "."+d.domain) {
+		return dnsmessage.RCodeRefused, nil, nil
+	}
+	// topic names are case sensitive
+	sub := name[:len(name)-len(d.domain)-1]
+
+	switch {
+	case strings.HasPrefix(sub, "_") && strings.HasSuffix(sub, "._tcp"):
+		topic := strings.TrimSuffix(strings.TrimPrefix(sub, "_"), "._tcp")
+		if len(d.l.DB.FindRegistrations("topic", topic, "")) == 0 {
+			return dnsmessage.RCodeNameError, nil, nil
+		}
+		if q.Type != dnsmessage.TypeSRV && q.Type != dnsmessage.TypeALL {
+			return dnsmessage.RCodeSuccess, nil, nil
+		}
+		producers := d.l.DB.FindProducers("topic", topic, "").FilterByActive(
+			d.l.opts.InactiveProducerTimeout, d.l.opts.TombstoneLifetime).Dedupe()
+		var answers, additionals []dnsRecord
+		for _, peerInfo := range producers.PeerInfo() {
+			target := d.target(peerInfo)
+			answers = append(answers, dnsRecord{
+				name: name,
+				srv: &dnsmessage.SRVResource{
+					Weight: 1,
+					Port:   uint16(peerInfo.TCPPort),
+					Target: dnsmessage.MustNewName(target),
+				},
+			})
+			if ip := net.ParseIP(peerInfo.BroadcastAddress); ip != nil && d.matchesIP(q.Type, ip, true) {
+				additionals = append(additionals, dnsRecord{name: target, ip: ip})
+			}
+		}
+		return dnsmessage.RCodeSuccess, answers, additionals
+	case strings.EqualFold(sub, "nodes"):
+		producers := d.l.DB.FindProducers("client", "", "").FilterByActive(
+			d.l.opts.InactiveProducerTimeout, 0)
+		var answers []dnsRecord
+		seen := make(map[string]bool)
+		for _, peerInfo := range producers.PeerInfo() {
+			ip := net.ParseIP(peerInfo.BroadcastAddress)
+			if ip == nil || seen[ip.String()] || !d.matchesIP(q.Type, ip, false) {
+				continue
+			}
+			seen[ip.String()] = true
+			answers = append(answers, dnsRecord{name: name, ip: ip})
+		}
+		return dnsmessage.RCodeSuccess, answers, nil
+	case strings.HasSuffix(strings.ToLower(sub), ".node"):
+		label := sub[:len(sub)-len(".node")]
+		ip := parseNodeLabel(label)
+		if ip == nil {
+			return dnsmessage.RCodeNameError, nil, nil
+		}
+		if !d.matchesIP(q.Type, ip, false) {
+			return dnsmessage.RCodeSuccess, nil, nil
+		}
+		return dnsmessage.RCodeSuccess, []dnsRecord{{name: name, ip: ip}}, nil
+	}
+	return dnsmessage.RCodeNameError, nil, nil
+}
+
+// target returns the SRV target of a node, its broadcast address if a host
+// name, else an <address>.node name
+func (d *dnsServer) target(peerInfo *PeerInfo) string {
+	ip := net.ParseIP(peerInfo.BroadcastAddress)
+	if ip == nil {
+		return strings.TrimSuffix(peerInfo.BroadcastAddress, ".") + "."
+	}
+	label := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	return label + ".node." + d.domain
+}
+
+// parseNodeLabel returns the IP address encoded in a .node label by target
+func parseNodeLabel(label string) net.IP {
+	if ip := net.ParseIP(strings.Replace(label, "-", ".", -1)); ip != nil {
+		return ip
+	}
+	return net.ParseIP(strings.Replace(label, "-", ":", -1))
+}
+
+// matchesIP returns true if an address answers a question of that type, for
+// additionals any address type matches an SRV question
+func (d *dnsServer) matchesIP(t dnsmessage.Type, ip net.IP, additional bool) bool {
+	if additional || t == dnsmessage.TypeALL {
+		return true
+	}
+	if ip.To4() != nil {
+		return t == dnsmessage.TypeA
+	}
+	return t == dnsmessage.TypeAAAA
+}
@@ -0,0 +1,149 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	emsctl "github.com/bhojpur/ems/pkg/client"
+	"github.com/bhojpur/ems/pkg/core/http_api"
+	"github.com/bhojpur/ems/pkg/core/test"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func identifyAddr(t *testing.T, conn net.Conn, broadcastAddress string, tcpPort int) {
+	ci := make(map[string]interface{})
+	ci["tcp_port"] = tcpPort
+	ci["http_port"] = HTTPPort
+	ci["broadcast_address"] = broadcastAddress
+	ci["hostname"] = HostAddr
+	ci["version"] = EMSDVersion
+	cmd, _ := emsctl.Identify(ci)
+	_, err := cmd.WriteTo(conn)
+	test.Nil(t, err)
+	_, err = emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+}
+
+func dnsResolver(network string, addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func TestDNS(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DNSAddress = "127.0.0.1:0"
+	opts.DNSDomain = "ems.test"
+	tcpAddr, httpAddr, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+	dnsAddr := emslookupd.dnsServer.udpConn.LocalAddr().String()
+
+	topicName := "dns_topic"
+	nodes := []struct {
+		addr string
+		port int
+	}{
+		{"10.0.0.1", 4150},
+		{"10.0.0.2", 4250},
+		{"emsd.example.com", 4350},
+	}
+	for _, n := range nodes {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		identifyAddr(t, conn, n.addr, n.port)
+		emsctl.Register(topicName, "").WriteTo(conn)
+		_, err := emsctl.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, network := range []string{"udp", "tcp"} {
+		r := dnsResolver(network, dnsAddr)
+
+		_, srvs, err := r.LookupSRV(ctx, topicName, "tcp", "ems.test.")
+		test.Nil(t, err)
+		var targets []string
+		for _, srv := range srvs {
+			targets = append(targets, fmt.Sprintf("%s:%d", srv.Target, srv.Port))
+		}
+		sort.Strings(targets)
+		test.Equal(t, []string{
+			"10-0-0-1.node.ems.test.:4150",
+			"10-0-0-2.node.ems.test.:4250",
+			"emsd.example.com.:4350",
+		}, targets)
+
+		addrs, err := r.LookupHost(ctx, "10-0-0-2.node.ems.test.")
+		test.Nil(t, err)
+		test.Equal(t, []string{"10.0.0.2"}, addrs)
+
+		addrs, err = r.LookupHost(ctx, "nodes.ems.test.")
+		test.Nil(t, err)
+		sort.Strings(addrs)
+		test.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addrs)
+
+		_, _, err = r.LookupSRV(ctx, "unknown", "tcp", "ems.test.")
+		test.NotNil(t, err)
+	}
+
+	// tombstoned producers aren't listed
+	endpoint := fmt.Sprintf("http://%s/topic/tombstone?topic=%s&node=10.0.0.1:%d",
+		httpAddr, topicName, HTTPPort)
+	err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).POSTV1(endpoint)
+	test.Nil(t, err)
+	_, srvs, err := dnsResolver("udp", dnsAddr).LookupSRV(ctx, topicName, "tcp", "ems.test.")
+	test.Nil(t, err)
+	test.Equal(t, 2, len(srvs))
+	for _, srv := range srvs {
+		test.NotEqual(t, "10-0-0-1.node.ems.test.", srv.Target)
+	}
+
+	// names outside the domain are refused
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("example.com."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	})
+	query, err := b.Finish()
+	test.Nil(t, err)
+
+	resp, err := emslookupd.dnsServer.answer(query, dnsMaxUDPSize)
+	test.Nil(t, err)
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	test.Nil(t, err)
+	test.Equal(t, uint16(1), h.ID)
+	test.Equal(t, dnsmessage.RCodeRefused, h.RCode)
+}
@@ -21,11 +21,13 @@ package lookup
 // THE SOFTWARE.
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/bhojpur/ems/pkg/core/http_api"
 	"github.com/bhojpur/ems/pkg/core/protocol"
@@ -39,8 +41,26 @@ type EMSLookupd struct {
 	tcpListener  net.Listener
 	httpListener net.Listener
 	tcpServer    *tcpServer
+	dnsServer    *dnsServer
 	waitGroup    util.WaitGroupWrapper
 	DB           *RegistrationDB
+	exitChan     chan int
+	exitOnce     sync.Once
+
+	// registrations created via the HTTP API, registrations restored from
+	// --data-path until an emsd registers them and restored tombstones until
+	// their producer registers
+	created    map[Registration]bool
+	restored   map[Registration]bool
+	tombstones map[tombstone]time.Time
+
+	// topic placement rules by pattern
+	placement map[string]PlacementRule
+
+	// held while checking the node ID of an identifying emsd until it's added
+	nodeIDLock sync.Mutex
+
+	cluster *cluster
 }
 
 func New(opts *Options) (*EMSLookupd, error) {
@@ -50,22 +70,54 @@ func New(opts *Options) (*EMSLookupd, error) {
 		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
 	}
 	l := &EMSLookupd{
-		opts: opts,
-		DB:   NewRegistrationDB(),
+		opts:       opts,
+		DB:         NewRegistrationDB(),
+		exitChan:   make(chan int),
+		created:    make(map[Registration]bool),
+		restored:   make(map[Registration]bool),
+		tombstones: make(map[tombstone]time.Time),
+		placement:  make(map[string]PlacementRule),
 	}
 
 	l.logf(LOG_INFO, version.String("emslookupd"))
 
+	err = validateNodeIDPolicy(opts.NodeIDPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := buildTLSConfig(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build TLS config - %s", err)
+	}
+
+	err = l.LoadMetadata()
+	if err != nil {
+		return nil, err
+	}
+
 	l.tcpServer = &tcpServer{emslookupd: l}
 	l.tcpListener, err = net.Listen("tcp", opts.TCPAddress)
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", opts.TCPAddress, err)
 	}
+	if tlsConfig != nil {
+		l.tcpListener = tls.NewListener(l.tcpListener, tlsConfig)
+	}
 	l.httpListener, err = net.Listen("tcp", opts.HTTPAddress)
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", opts.HTTPAddress, err)
 	}
 
+	if opts.DNSAddress != "" {
+		l.dnsServer, err = newDNSServer(l)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l.cluster = newCluster(l)
+
 	return l, nil
 }
 
@@ -90,11 +142,40 @@ func (l *EMSLookupd) Main() error {
 	l.waitGroup.Wrap(func() {
 		exitFunc(http_api.Serve(l.httpListener, httpServer, "HTTP", l.logf))
 	})
+	l.RLock()
+	restored := len(l.restored)
+	l.RUnlock()
+	if restored > 0 {
+		l.waitGroup.Wrap(l.reconcileLoop)
+	}
+	l.waitGroup.Wrap(l.cluster.loop)
+	l.waitGroup.Wrap(l.activityLoop)
+	if l.dnsServer != nil {
+		l.waitGroup.Wrap(l.dnsServer.serveUDP)
+		l.waitGroup.Wrap(l.dnsServer.serveTCP)
+	}
 
 	err := <-exitCh
 	return err
 }
 
+// activityInterval is how often producers timing out, or their tombstones
+// expiring, are noticed by /lookup/watch
+const activityInterval = time.Second
+
+func (l *EMSLookupd) activityLoop() {
+	ticker := time.NewTicker(activityInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.DB.UpdateActivity(l.opts.InactiveProducerTimeout, l.opts.TombstoneLifetime)
+		case <-l.exitChan:
+			return
+		}
+	}
+}
+
 func (l *EMSLookupd) RealTCPAddr() *net.TCPAddr {
 	return l.tcpListener.Addr().(*net.TCPAddr)
 }
@@ -115,5 +196,12 @@ func (l *EMSLookupd) Exit() {
 	if l.httpListener != nil {
 		l.httpListener.Close()
 	}
+
+	if l.dnsServer != nil {
+		l.dnsServer.Close()
+	}
+	l.exitOnce.Do(func() { close(l.exitChan) })
 	l.waitGroup.Wait()
+
+	l.persistMetadata()
 }
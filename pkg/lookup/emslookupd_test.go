@@ -215,6 +215,50 @@ func TestChannelUnregister(t *testing.T) {
 	test.Equal(t, 1, len(pr.Producers))
 }
 
+func TestReplicaRegister(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	topicName := "replica_register"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	emsctl.RegisterReplica(topicName).WriteTo(conn)
+	v, err := emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("OK"), v)
+
+	// a replica isn't a producer of the topic
+	topics := emslookupd.DB.FindRegistrations("topic", topicName, "")
+	test.Equal(t, 0, len(topics))
+
+	replicas := emslookupd.DB.FindProducers("replica", topicName, "")
+	test.Equal(t, 1, len(replicas))
+
+	nr := struct {
+		Producers []struct {
+			Replicas []string `json:"replicas"`
+		} `json:"producers"`
+	}{}
+	endpoint := fmt.Sprintf("http://%s/nodes", httpAddr)
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &nr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(nr.Producers))
+	test.Equal(t, []string{topicName}, nr.Producers[0].Replicas)
+
+	emsctl.UnRegisterReplica(topicName).WriteTo(conn)
+	v, err = emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("OK"), v)
+
+	test.Equal(t, 0, len(emslookupd.DB.FindRegistrations("replica", topicName, "")))
+}
+
 func TestTombstoneRecover(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -21,10 +21,17 @@ package lookup
 // THE SOFTWARE.
 
 import (
-	"fmt"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"path"
+	"sort"
+	"strconv"
 	"sync/atomic"
+	"time"
 
 	"github.com/bhojpur/ems/pkg/core/http_api"
 	"github.com/bhojpur/ems/pkg/core/protocol"
@@ -32,6 +39,12 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
+const (
+	// how long /lookup/watch waits for a change by default, and at most
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+)
+
 type httpServer struct {
 	emslookupd *EMSLookupd
 	router     http.Handler
@@ -39,6 +52,7 @@ type httpServer struct {
 
 func newHTTPServer(l *EMSLookupd) *httpServer {
 	log := http_api.Log(l.logf)
+	admin := requireAdminToken(l.opts.HTTPAdminToken)
 
 	router := httprouter.New()
 	router.HandleMethodNotAllowed = true
@@ -56,16 +70,31 @@ func newHTTPServer(l *EMSLookupd) *httpServer {
 	// v1 negotiate
 	router.Handle("GET", "/debug", http_api.Decorate(s.doDebug, log, http_api.V1))
 	router.Handle("GET", "/lookup", http_api.Decorate(s.doLookup, log, http_api.V1))
+	router.Handle("GET", "/lookup/watch", http_api.Decorate(s.doLookupWatch, log, http_api.V1))
 	router.Handle("GET", "/topics", http_api.Decorate(s.doTopics, log, http_api.V1))
 	router.Handle("GET", "/channels", http_api.Decorate(s.doChannels, log, http_api.V1))
 	router.Handle("GET", "/nodes", http_api.Decorate(s.doNodes, log, http_api.V1))
 
 	// only v1
-	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, log, http_api.V1))
-	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
-	router.Handle("POST", "/topic/tombstone", http_api.Decorate(s.doTombstoneTopicProducer, log, http_api.V1))
+	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, admin, log, http_api.V1))
+	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, admin, log, http_api.V1))
+	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, admin, log, http_api.V1))
+	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, admin, log, http_api.V1))
+	router.Handle("POST", "/topic/tombstone", http_api.Decorate(s.doTombstoneTopicProducer, admin, log, http_api.V1))
+
+	// cluster
+	router.Handle("GET", "/cluster/members", http_api.Decorate(s.doClusterMembers, log, http_api.V1))
+	router.Handle("POST", "/cluster/join", http_api.Decorate(s.doClusterJoin, admin, log, http_api.V1))
+	router.Handle("POST", "/cluster/leave", http_api.Decorate(s.doClusterLeave, admin, log, http_api.V1))
+	router.Handle("POST", "/cluster/sync", http_api.Decorate(s.doClusterSync, admin, log, http_api.V1))
+	router.Handle("POST", "/cluster/apply", http_api.Decorate(s.doClusterApply, admin, log, http_api.V1))
+
+	// placement
+	router.Handle("GET", "/placement", http_api.Decorate(s.doPlacement, log, http_api.V1))
+	router.Handle("GET", "/placement/rules", http_api.Decorate(s.doPlacementRules, log, http_api.V1))
+	router.Handle("GET", "/placement/violations", http_api.Decorate(s.doPlacementViolations, log, http_api.V1))
+	router.Handle("POST", "/placement/rule", http_api.Decorate(s.doSetPlacementRule, admin, log, http_api.V1))
+	router.Handle("POST", "/placement/rule/delete", http_api.Decorate(s.doDeletePlacementRule, admin, log, http_api.V1))
 
 	// debug
 	router.HandlerFunc("GET", "/debug/pprof", pprof.Index)
@@ -98,10 +127,18 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 }
 
 func (s *httpServer) doTopics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	topics := s.emslookupd.DB.FindRegistrations("topic", "*", "").Keys()
-	return map[string]interface{}{
-		"topics": topics,
-	}, nil
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	listParams, err := http_api.NewListParams(reqParams)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+
+	topics := listParams.Filter(s.emslookupd.DB.FindRegistrations("topic", "*", "").Keys())
+	return listResponse("topics", listParams, topics), nil
 }
 
 func (s *httpServer) doChannels(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -115,10 +152,26 @@ func (s *httpServer) doChannels(w http.ResponseWriter, req *http.Request, ps htt
 		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 
-	channels := s.emslookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
-	return map[string]interface{}{
-		"channels": channels,
-	}, nil
+	listParams, err := http_api.NewListParams(reqParams)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+
+	channels := listParams.Filter(s.emslookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys())
+	return listResponse("channels", listParams, channels), nil
+}
+
+// listResponse is the response of the name listings, the requested page of
+// names and the cursor of the next one
+func listResponse(key string, listParams *http_api.ListParams, names []string) map[string]interface{} {
+	names, next := listParams.PageStrings(names)
+	resp := map[string]interface{}{
+		key: names,
+	}
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+	return resp
 }
 
 func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -132,19 +185,114 @@ func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httpr
 		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 
+	prefs, err := getPreferences(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
 	registration := s.emslookupd.DB.FindRegistrations("topic", topicName, "")
 	if len(registration) == 0 {
 		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
 	}
 
+	return s.lookup(topicName, prefs), nil
+}
+
+// doLookupWatch is a long-polling /lookup, it returns once the registrations
+// of the topic differ from the version passed (right away without one) or
+// after the timeout. An unknown topic has no producers rather than a 404.
+func (s *httpServer) doLookupWatch(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	prefs, err := getPreferences(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	var version uint64
+	versionStr, err := reqParams.Get("version")
+	hasVersion := err == nil
+	if hasVersion {
+		version, err = strconv.ParseUint(versionStr, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_VERSION"}
+		}
+	}
+
+	timeout := defaultWatchTimeout
+	if timeoutStr, err := reqParams.Get("timeout"); err == nil {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil || timeout <= 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_TIMEOUT"}
+		}
+		if timeout > maxWatchTimeout {
+			timeout = maxWatchTimeout
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	current, changed, unwatch := s.emslookupd.DB.WatchTopic(topicName)
+	for hasVersion && current == version {
+		select {
+		case <-changed:
+			unwatch()
+			current, changed, unwatch = s.emslookupd.DB.WatchTopic(topicName)
+			continue
+		case <-timer.C:
+		case <-req.Context().Done():
+		case <-s.emslookupd.exitChan:
+		}
+		break
+	}
+	unwatch()
+
+	data := s.lookup(topicName, prefs)
+	data["version"] = current
+	return data, nil
+}
+
+// getPreferences returns the labels preferred by the client, from the "prefer"
+// parameter, if any
+func getPreferences(reqParams *http_api.ReqParams) ([]labelPreference, error) {
+	prefer, err := reqParams.Get("prefer")
+	if err != nil {
+		return nil, nil
+	}
+	prefs, err := parsePreferences(prefer)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_PREFER"}
+	}
+	return prefs, nil
+}
+
+// lookup returns the channels, producers and replicas of a topic, the
+// producers with the labels preferred first
+func (s *httpServer) lookup(topicName string, prefs []labelPreference) map[string]interface{} {
 	channels := s.emslookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
 	producers := s.emslookupd.DB.FindProducers("topic", topicName, "")
 	producers = producers.FilterByActive(s.emslookupd.opts.InactiveProducerTimeout,
-		s.emslookupd.opts.TombstoneLifetime)
+		s.emslookupd.opts.TombstoneLifetime).Dedupe()
+	replicas := s.emslookupd.DB.FindProducers("replica", topicName, "")
+	replicas = replicas.FilterByActive(s.emslookupd.opts.InactiveProducerTimeout, 0).Dedupe()
+	peers := producers.PeerInfo()
+	if len(prefs) > 0 {
+		preferLabels(peers, prefs)
+	}
 	return map[string]interface{}{
 		"channels":  channels,
-		"producers": producers.PeerInfo(),
-	}, nil
+		"producers": peers,
+		"replicas":  replicas.PeerInfo(),
+	}
 }
 
 func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -162,10 +310,7 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
 	}
 
-	s.emslookupd.logf(LOG_INFO, "DB: adding topic(%s)", topicName)
-	key := Registration{"topic", topicName, ""}
-	s.emslookupd.DB.AddRegistration(key)
-
+	s.emslookupd.adminOp(&clusterOp{Op: opCreateTopic, Topic: topicName})
 	return nil, nil
 }
 
@@ -180,18 +325,7 @@ func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 
-	registrations := s.emslookupd.DB.FindRegistrations("channel", topicName, "*")
-	for _, registration := range registrations {
-		s.emslookupd.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", registration.SubKey, topicName)
-		s.emslookupd.DB.RemoveRegistration(registration)
-	}
-
-	registrations = s.emslookupd.DB.FindRegistrations("topic", topicName, "")
-	for _, registration := range registrations {
-		s.emslookupd.logf(LOG_INFO, "DB: removing topic(%s)", topicName)
-		s.emslookupd.DB.RemoveRegistration(registration)
-	}
-
+	s.emslookupd.adminOp(&clusterOp{Op: opDeleteTopic, Topic: topicName})
 	return nil, nil
 }
 
@@ -211,15 +345,7 @@ func (s *httpServer) doTombstoneTopicProducer(w http.ResponseWriter, req *http.R
 		return nil, http_api.Err{400, "MISSING_ARG_NODE"}
 	}
 
-	s.emslookupd.logf(LOG_INFO, "DB: setting tombstone for producer@%s of topic(%s)", node, topicName)
-	producers := s.emslookupd.DB.FindProducers("topic", topicName, "")
-	for _, p := range producers {
-		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HTTPPort)
-		if thisNode == node {
-			p.Tombstone()
-		}
-	}
-
+	s.emslookupd.adminOp(&clusterOp{Op: opTombstone, Topic: topicName, Node: node})
 	return nil, nil
 }
 
@@ -234,14 +360,7 @@ func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, p
 		return nil, http_api.Err{400, err.Error()}
 	}
 
-	s.emslookupd.logf(LOG_INFO, "DB: adding channel(%s) in topic(%s)", channelName, topicName)
-	key := Registration{"channel", topicName, channelName}
-	s.emslookupd.DB.AddRegistration(key)
-
-	s.emslookupd.logf(LOG_INFO, "DB: adding topic(%s)", topicName)
-	key = Registration{"topic", topicName, ""}
-	s.emslookupd.DB.AddRegistration(key)
-
+	s.emslookupd.adminOp(&clusterOp{Op: opCreateChannel, Topic: topicName, Channel: channelName})
 	return nil, nil
 }
 
@@ -261,32 +380,61 @@ func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, p
 		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
 
-	s.emslookupd.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", channelName, topicName)
-	for _, registration := range registrations {
-		s.emslookupd.DB.RemoveRegistration(registration)
-	}
-
+	s.emslookupd.adminOp(&clusterOp{Op: opDeleteChannel, Topic: topicName, Channel: channelName})
 	return nil, nil
 }
 
 type node struct {
-	RemoteAddress    string   `json:"remote_address"`
-	Hostname         string   `json:"hostname"`
-	BroadcastAddress string   `json:"broadcast_address"`
-	TCPPort          int      `json:"tcp_port"`
-	HTTPPort         int      `json:"http_port"`
-	Version          string   `json:"version"`
-	Tombstones       []bool   `json:"tombstones"`
-	Topics           []string `json:"topics"`
+	RemoteAddress    string            `json:"remote_address"`
+	Hostname         string            `json:"hostname"`
+	BroadcastAddress string            `json:"broadcast_address"`
+	TCPPort          int               `json:"tcp_port"`
+	HTTPPort         int               `json:"http_port"`
+	Version          string            `json:"version"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	NodeID           *int64            `json:"node_id,omitempty"`
+	NodeIDConflict   bool              `json:"node_id_conflict,omitempty"` // another node uses its node ID
+	Tombstones       []bool            `json:"tombstones"`
+	Topics           []string          `json:"topics"`
+	Replicas         []string          `json:"replicas"`
 }
 
 func (s *httpServer) doNodes(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	var selector labelSelector
+	if selectorStr, err := reqParams.Get("selector"); err == nil {
+		selector, err = parseLabelSelector(selectorStr)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_SELECTOR"}
+		}
+	}
+
+	// nodes are named, filtered and sorted by their broadcast_address:http_port
+	listParams, err := http_api.NewListParams(reqParams, "topics")
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+
 	// dont filter out tombstoned nodes
 	producers := s.emslookupd.DB.FindProducers("client", "", "").FilterByActive(
-		s.emslookupd.opts.InactiveProducerTimeout, 0)
-	nodes := make([]*node, len(producers))
+		s.emslookupd.opts.InactiveProducerTimeout, 0).Dedupe()
+	nodes := make([]*node, 0, len(producers))
+	names := make(map[*node]string, len(producers))
 	topicProducersMap := make(map[string]Producers)
-	for i, p := range producers {
+	conflicts := s.emslookupd.nodeIDConflicts()
+	for _, p := range producers {
+		if !selector.Matches(p.peerInfo.Labels) {
+			continue
+		}
+		name := producerNode(p.peerInfo)
+		if !listParams.Match(name) {
+			continue
+		}
+
 		topics := s.emslookupd.DB.LookupRegistrations(p.peerInfo.id).Filter("topic", "*", "").Keys()
 
 		// for each topic find the producer that matches this peer
@@ -306,23 +454,221 @@ func (s *httpServer) doNodes(w http.ResponseWriter, req *http.Request, ps httpro
 			}
 		}
 
-		nodes[i] = &node{
+		n := &node{
 			RemoteAddress:    p.peerInfo.RemoteAddress,
 			Hostname:         p.peerInfo.Hostname,
 			BroadcastAddress: p.peerInfo.BroadcastAddress,
 			TCPPort:          p.peerInfo.TCPPort,
 			HTTPPort:         p.peerInfo.HTTPPort,
 			Version:          p.peerInfo.Version,
+			Labels:           p.peerInfo.Labels,
+			NodeID:           p.peerInfo.NodeID,
+			NodeIDConflict:   conflicts[name],
 			Tombstones:       tombstones,
 			Topics:           topics,
+			Replicas:         s.emslookupd.DB.LookupRegistrations(p.peerInfo.id).Filter("replica", "*", "").Keys(),
 		}
+		nodes = append(nodes, n)
+		names[n] = name
+	}
+
+	byName := func(i, j int) bool { return names[nodes[i]] < names[nodes[j]] }
+	sort.Slice(nodes, byName)
+	var key func(i int) interface{}
+	switch listParams.Sort {
+	case "name":
+		listParams.SortSlice(nodes, byName)
+	case "topics":
+		listParams.SortSlice(nodes, func(i, j int) bool { return len(nodes[i].Topics) < len(nodes[j].Topics) })
+		key = func(i int) interface{} { return len(nodes[i].Topics) }
 	}
+	start, end, next := listParams.Page(len(nodes), func(i int) string { return names[nodes[i]] }, key)
 
+	resp := map[string]interface{}{
+		"producers": nodes[start:end],
+	}
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+	return resp, nil
+}
+
+func (s *httpServer) doClusterMembers(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	return map[string]interface{}{
-		"producers": nodes,
+		"self":    s.emslookupd.cluster.self,
+		"members": s.emslookupd.cluster.membersInfo(),
 	}, nil
 }
 
+func (s *httpServer) getClusterAddress(req *http.Request) (string, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return "", http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	addr, err := reqParams.Get("address")
+	if err != nil {
+		return "", http_api.Err{400, "MISSING_ARG_ADDRESS"}
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", http_api.Err{400, "INVALID_ARG_ADDRESS"}
+	}
+	return addr, nil
+}
+
+func (s *httpServer) doClusterJoin(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	addr, err := s.getClusterAddress(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.emslookupd.cluster.join(addr)
+	return nil, nil
+}
+
+func (s *httpServer) doClusterLeave(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	addr, err := s.getClusterAddress(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.emslookupd.cluster.leave(addr) {
+		return nil, http_api.Err{404, "MEMBER_NOT_FOUND"}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doClusterSync(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, clusterReadMax))
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	var cs clusterSync
+	err = json.Unmarshal(body, &cs)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_BODY"}
+	}
+
+	s.emslookupd.cluster.apply(&cs)
+	return nil, nil
+}
+
+func (s *httpServer) doClusterApply(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, clusterReadMax))
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	var op clusterOp
+	err = json.Unmarshal(body, &op)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_BODY"}
+	}
+	if op.isPlacementOp() {
+		if op.Rule == nil || op.Rule.validate() != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_RULE"}
+		}
+	} else if !protocol.IsValidTopicName(op.Topic) {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
+	}
+
+	if !s.emslookupd.applyOp(&op) {
+		return nil, http_api.Err{400, "INVALID_ARG_OP"}
+	}
+	return nil, nil
+}
+
+// doPlacement returns the nodes a topic should be published to, best first
+func (s *httpServer) doPlacement(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
+	}
+
+	rule, peers := s.emslookupd.place(topicName)
+	return map[string]interface{}{
+		"rule":      rule,
+		"producers": peers,
+	}, nil
+}
+
+func (s *httpServer) doPlacementRules(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return map[string]interface{}{
+		"rules": s.emslookupd.placementRules(),
+	}, nil
+}
+
+func (s *httpServer) doPlacementViolations(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, _ := reqParams.Get("topic")
+	return map[string]interface{}{
+		"violations": s.emslookupd.placementViolations(topicName),
+	}, nil
+}
+
+func (s *httpServer) doSetPlacementRule(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	var rule PlacementRule
+	rule.Pattern, err = reqParams.Get("pattern")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_PATTERN"}
+	}
+	if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+		return nil, http_api.Err{400, "INVALID_ARG_PATTERN"}
+	}
+	rule.Selector, _ = reqParams.Get("selector")
+	if rule.Selector != "" {
+		if _, err := parseLabelSelector(rule.Selector); err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_SELECTOR"}
+		}
+	}
+	if replicasStr, err := reqParams.Get("replicas"); err == nil {
+		rule.Replicas, err = strconv.Atoi(replicasStr)
+		if err != nil || rule.Replicas < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_REPLICAS"}
+		}
+	}
+
+	s.emslookupd.adminOp(&clusterOp{Op: opSetPlacement, Rule: &rule})
+	return nil, nil
+}
+
+func (s *httpServer) doDeletePlacementRule(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	pattern, err := reqParams.Get("pattern")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_PATTERN"}
+	}
+
+	if _, ok := s.emslookupd.getPlacementRule(pattern); !ok {
+		return nil, http_api.Err{404, "RULE_NOT_FOUND"}
+	}
+
+	s.emslookupd.adminOp(&clusterOp{Op: opDelPlacement, Rule: &PlacementRule{Pattern: pattern}})
+	return nil, nil
+}
+
 func (s *httpServer) doDebug(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	s.emslookupd.DB.RLock()
 	defer s.emslookupd.DB.RUnlock()
@@ -27,9 +27,12 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	emsctl "github.com/bhojpur/ems/pkg/client"
+	"github.com/bhojpur/ems/pkg/core/http_api"
 	"github.com/bhojpur/ems/pkg/core/test"
 	"github.com/bhojpur/ems/pkg/core/version"
 	emssvr "github.com/bhojpur/ems/pkg/engine"
@@ -502,3 +505,176 @@ func TestDeleteChannel(t *testing.T) {
 	t.Logf("%s", body)
 	test.Equal(t, []byte(""), body)
 }
+
+type WatchDoc struct {
+	Producers []*PeerInfo `json:"producers"`
+	Version   uint64      `json:"version"`
+}
+
+func TestLookupWatch(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	topicName := "watched"
+
+	// without a version it returns right away, even for an unknown topic
+	var wd WatchDoc
+	endpoint := fmt.Sprintf("http://%s/lookup/watch?topic=%s", httpAddr, topicName)
+	err := client.GETV1(endpoint, &wd)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(wd.Producers))
+
+	// times out without changes
+	start := time.Now()
+	endpoint = fmt.Sprintf("http://%s/lookup/watch?topic=%s&version=%d&timeout=100ms",
+		httpAddr, topicName, wd.Version)
+	err = client.GETV1(endpoint, &wd)
+	test.Nil(t, err)
+	test.Equal(t, true, time.Since(start) >= 100*time.Millisecond)
+
+	// returns as soon as a producer registers
+	done := make(chan WatchDoc)
+	go func(version uint64) {
+		var wd WatchDoc
+		endpoint := fmt.Sprintf("http://%s/lookup/watch?topic=%s&version=%d&timeout=5s",
+			httpAddr, topicName, version)
+		client.GETV1(endpoint, &wd)
+		done <- wd
+	}(wd.Version)
+	time.Sleep(50 * time.Millisecond)
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+	start = time.Now()
+	emsctl.Register(topicName, "ch").WriteTo(conn)
+	_, err = emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+
+	changed := <-done
+	test.Equal(t, true, time.Since(start) < time.Second)
+	test.Equal(t, 1, len(changed.Producers))
+	test.NotEqual(t, wd.Version, changed.Version)
+
+	endpoint = fmt.Sprintf("http://%s/lookup/watch?topic=%s&version=x", httpAddr, topicName)
+	err = client.GETV1(endpoint, &wd)
+	test.NotNil(t, err)
+}
+
+func TestListParams(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+
+	for _, topicName := range []string{"orders.b", "orders.a", "orders.c", "users.a"} {
+		makeTopic(emslookupd, topicName)
+	}
+	for _, channelName := range []string{"ch3", "ch1", "ch2"} {
+		makeChannel(emslookupd, "users.a", channelName)
+	}
+
+	type listDoc struct {
+		Topics     []string `json:"topics"`
+		Channels   []string `json:"channels"`
+		NextCursor string   `json:"next_cursor"`
+	}
+	list := func(uri string) listDoc {
+		var doc listDoc
+		err := client.GETV1(fmt.Sprintf("http://%s%s", httpAddr, uri), &doc)
+		test.Nil(t, err)
+		return doc
+	}
+
+	// without parameters everything is listed in name order
+	doc := list("/topics")
+	test.Equal(t, []string{"orders.a", "orders.b", "orders.c", "users.a"}, doc.Topics)
+	test.Equal(t, "", doc.NextCursor)
+
+	doc = list("/topics?prefix=orders.&sort=-name")
+	test.Equal(t, []string{"orders.c", "orders.b", "orders.a"}, doc.Topics)
+
+	doc = list("/topics?regex=%5C.a%24")
+	test.Equal(t, []string{"orders.a", "users.a"}, doc.Topics)
+
+	// paging through with the cursors
+	var topics []string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		doc = list("/topics?limit=3&cursor=" + cursor)
+		topics = append(topics, doc.Topics...)
+		if doc.NextCursor == "" {
+			test.Equal(t, 2, pages)
+			break
+		}
+		cursor = doc.NextCursor
+	}
+	test.Equal(t, []string{"orders.a", "orders.b", "orders.c", "users.a"}, topics)
+
+	doc = list("/channels?topic=users.a&limit=2")
+	test.Equal(t, []string{"ch1", "ch2"}, doc.Channels)
+	doc = list("/channels?topic=users.a&limit=2&cursor=" + doc.NextCursor)
+	test.Equal(t, []string{"ch3"}, doc.Channels)
+	test.Equal(t, "", doc.NextCursor)
+
+	// the cursor resumes after the last item listed, whatever changed before it
+	doc = list("/channels?topic=users.a&limit=2")
+	test.Equal(t, []string{"ch1", "ch2"}, doc.Channels)
+	makeChannel(emslookupd, "users.a", "ch0")
+	emslookupd.DB.RemoveRegistration(Registration{"channel", "users.a", "ch1"})
+	doc = list("/channels?topic=users.a&limit=2&cursor=" + doc.NextCursor)
+	test.Equal(t, []string{"ch3"}, doc.Channels)
+
+	for uri, errMsg := range map[string]string{
+		"/topics?regex=%28":  "INVALID_ARG_REGEX",
+		"/topics?sort=depth": "INVALID_ARG_SORT",
+		"/topics?limit=-1":   "INVALID_ARG_LIMIT",
+		"/nodes?cursor=x":    "INVALID_ARG_CURSOR",
+	} {
+		err := client.GETV1(fmt.Sprintf("http://%s%s", httpAddr, uri), nil)
+		test.NotNil(t, err)
+		test.Equal(t, true, strings.Contains(err.Error(), errMsg))
+	}
+
+	// nodes are listed by broadcast_address:http_port, or by topic count
+	for i, addr := range []string{"10.0.0.2", "10.0.0.1", "10.0.0.3"} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		identifyAddr(t, conn, addr, TCPPort)
+		for j := 0; j <= i; j++ {
+			emsctl.Register(fmt.Sprintf("topic%d", j), "").WriteTo(conn)
+			_, err := emsctl.ReadResponse(conn)
+			test.Nil(t, err)
+		}
+	}
+
+	type nodesDoc struct {
+		Producers  []*node `json:"producers"`
+		NextCursor string  `json:"next_cursor"`
+	}
+	listNodes := func(query string) ([]string, string) {
+		var nodes nodesDoc
+		err := client.GETV1(fmt.Sprintf("http://%s/nodes?%s", httpAddr, query), &nodes)
+		test.Nil(t, err)
+		var addrs []string
+		for _, n := range nodes.Producers {
+			addrs = append(addrs, n.BroadcastAddress)
+		}
+		return addrs, nodes.NextCursor
+	}
+	addrs, cursor := listNodes("limit=2")
+	test.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addrs)
+	test.NotEqual(t, "", cursor)
+
+	addrs, cursor = listNodes("sort=-topics")
+	test.Equal(t, []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"}, addrs)
+	test.Equal(t, "", cursor)
+
+	addrs, _ = listNodes("prefix=10.0.0.3")
+	test.Equal(t, []string{"10.0.0.3"}, addrs)
+}
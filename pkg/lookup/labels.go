@@ -0,0 +1,121 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// labelPreference is a "<key>:<value>" passed to /lookup?prefer=
+type labelPreference struct {
+	key   string
+	value string
+}
+
+// parsePreferences parses a comma separated list of "<key>:<value>", earlier
+// ones weigh more
+func parsePreferences(s string) ([]labelPreference, error) {
+	var prefs []labelPreference
+	for _, term := range strings.Split(s, ",") {
+		idx := strings.IndexByte(term, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid preference %q, must be <key>:<value>", term)
+		}
+		prefs = append(prefs, labelPreference{term[:idx], term[idx+1:]})
+	}
+	return prefs, nil
+}
+
+// preferLabels orders the producers, those with the labels preferred first
+func preferLabels(peers []*PeerInfo, prefs []labelPreference) {
+	score := func(peerInfo *PeerInfo) int {
+		var n int
+		for _, pref := range prefs {
+			n <<= 1
+			if v, ok := peerInfo.Labels[pref.key]; ok && v == pref.value {
+				n |= 1
+			}
+		}
+		return n
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return score(peers[i]) > score(peers[j])
+	})
+}
+
+type labelRequirement struct {
+	key   string
+	value string
+	op    string // "=", "!=", "exists" or "!exists"
+}
+
+// labelSelector selects nodes by their labels, it's a comma separated list of
+// "<key>=<value>", "<key>!=<value>", "<key>" (has the label) or "!<key>" (has
+// not), all of them must match
+type labelSelector []labelRequirement
+
+func parseLabelSelector(s string) (labelSelector, error) {
+	var selector labelSelector
+	for _, term := range strings.Split(s, ",") {
+		var r labelRequirement
+		if idx := strings.Index(term, "!="); idx >= 0 {
+			r = labelRequirement{term[:idx], term[idx+2:], "!="}
+		} else if idx := strings.IndexByte(term, '='); idx >= 0 {
+			r = labelRequirement{term[:idx], term[idx+1:], "="}
+		} else if strings.HasPrefix(term, "!") {
+			r = labelRequirement{term[1:], "", "!exists"}
+		} else {
+			r = labelRequirement{term, "", "exists"}
+		}
+		if r.key == "" {
+			return nil, fmt.Errorf("invalid label selector %q", term)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+func (ls labelSelector) Matches(labels map[string]string) bool {
+	for _, r := range ls {
+		v, ok := labels[r.key]
+		switch r.op {
+		case "=":
+			if !ok || v != r.value {
+				return false
+			}
+		case "!=":
+			if ok && v == r.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
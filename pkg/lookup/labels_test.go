@@ -0,0 +1,119 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	emsctl "github.com/bhojpur/ems/pkg/client"
+	"github.com/bhojpur/ems/pkg/core/http_api"
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func identifyWithLabels(t *testing.T, conn net.Conn, httpPort int, labels map[string]string) {
+	ci := make(map[string]interface{})
+	ci["tcp_port"] = TCPPort
+	ci["http_port"] = httpPort
+	ci["broadcast_address"] = HostAddr
+	ci["hostname"] = HostAddr
+	ci["version"] = EMSDVersion
+	ci["labels"] = labels
+	cmd, _ := emsctl.Identify(ci)
+	_, err := cmd.WriteTo(conn)
+	test.Nil(t, err)
+	_, err = emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+}
+
+func TestLabels(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	topicName := "labels"
+	zones := []string{"a", "b", "c"}
+	for i, zone := range zones {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		identifyWithLabels(t, conn, HTTPPort+i, map[string]string{"zone": zone, "region": "eu"})
+		emsctl.Register(topicName, "").WriteTo(conn)
+		_, err := emsctl.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	var lr LookupDoc
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s&prefer=zone:b", httpAddr, topicName)
+	err := client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(lr.Producers))
+	test.Equal(t, "b", lr.Producers[0].Labels["zone"])
+	test.Equal(t, "eu", lr.Producers[0].Labels["region"])
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s&prefer=zone", httpAddr, topicName)
+	err = client.GETV1(endpoint, &lr)
+	test.NotNil(t, err)
+
+	var nodes struct {
+		Producers []*node `json:"producers"`
+	}
+	endpoint = fmt.Sprintf("http://%s/nodes?selector=region=eu,zone!=b", httpAddr)
+	err = client.GETV1(endpoint, &nodes)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(nodes.Producers))
+	for _, n := range nodes.Producers {
+		test.NotEqual(t, "b", n.Labels["zone"])
+	}
+
+	endpoint = fmt.Sprintf("http://%s/nodes?selector=!zone", httpAddr)
+	err = client.GETV1(endpoint, &nodes)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(nodes.Producers))
+}
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{"zone": "a", "rack": "r1"}
+	for s, matches := range map[string]bool{
+		"zone=a":           true,
+		"zone=b":           false,
+		"zone!=b":          true,
+		"zone=a,rack=r1":   true,
+		"zone=a,rack!=r1":  false,
+		"rack":             true,
+		"!rack":            false,
+		"!region,zone":     true,
+		"region!=eu":       true,
+		"region=":          false,
+		"zone=a,region=eu": false,
+	} {
+		selector, err := parseLabelSelector(s)
+		test.Nil(t, err)
+		test.Equal(t, matches, selector.Matches(labels))
+	}
+
+	_, err := parseLabelSelector("=a")
+	test.NotNil(t, err)
+	_, err = parseLabelSelector("zone=a,")
+	test.NotNil(t, err)
+}
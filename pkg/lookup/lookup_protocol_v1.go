@@ -95,12 +95,14 @@ func (p *LookupProtocolV1) IOLoop(c protocol.Client) error {
 
 	if client.peerInfo != nil {
 		registrations := p.emslookupd.DB.LookupRegistrations(client.peerInfo.id)
+		p.emslookupd.keepTombstones(registrations, client.peerInfo)
 		for _, r := range registrations {
 			if removed, _ := p.emslookupd.DB.RemoveProducer(r, client.peerInfo.id); removed {
 				p.emslookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
 					client, r.Category, r.Key, r.SubKey)
 			}
 		}
+		p.emslookupd.cluster.changed()
 	}
 
 	return err
@@ -116,6 +118,10 @@ func (p *LookupProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, params [
 		return p.REGISTER(client, reader, params[1:])
 	case "UNREGISTER":
 		return p.UNREGISTER(client, reader, params[1:])
+	case "REGISTER_REPLICA":
+		return p.REGISTER_REPLICA(client, reader, params[1:])
+	case "UNREGISTER_REPLICA":
+		return p.UNREGISTER_REPLICA(client, reader, params[1:])
 	}
 	return nil, protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
@@ -152,19 +158,28 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 		return nil, err
 	}
 
+	var persist bool
 	if channel != "" {
 		key := Registration{"channel", topic, channel}
-		if p.emslookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
+		producer, isNew := p.emslookupd.newProducer(key, client.peerInfo)
+		if p.emslookupd.DB.AddProducer(key, producer) {
 			p.emslookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
 				client, "channel", topic, channel)
 		}
+		persist = isNew
 	}
 	key := Registration{"topic", topic, ""}
-	if p.emslookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
+	producer, isNew := p.emslookupd.newProducer(key, client.peerInfo)
+	if p.emslookupd.DB.AddProducer(key, producer) {
 		p.emslookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
 			client, "topic", topic, "")
 	}
 
+	if persist || isNew {
+		p.emslookupd.persistMetadata()
+	}
+	p.emslookupd.cluster.changed()
+
 	return []byte("OK"), nil
 }
 
@@ -213,6 +228,53 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 			p.emslookupd.DB.RemoveRegistration(key)
 		}
 	}
+	p.emslookupd.cluster.changed()
+
+	return []byte("OK"), nil
+}
+
+// REGISTER_REPLICA records that the client holds a replica of a topic, replicas
+// aren't producers of the topic
+func (p *LookupProtocolV1) REGISTER_REPLICA(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	topic, _, err := getTopicChan("REGISTER_REPLICA", params)
+	if err != nil {
+		return nil, err
+	}
+
+	key := Registration{"replica", topic, ""}
+	if p.emslookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
+		p.emslookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
+			client, "replica", topic, "")
+	}
+	p.emslookupd.cluster.changed()
+
+	return []byte("OK"), nil
+}
+
+func (p *LookupProtocolV1) UNREGISTER_REPLICA(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	topic, _, err := getTopicChan("UNREGISTER_REPLICA", params)
+	if err != nil {
+		return nil, err
+	}
+
+	key := Registration{"replica", topic, ""}
+	removed, left := p.emslookupd.DB.RemoveProducer(key, client.peerInfo.id)
+	if removed {
+		p.emslookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
+			client, "replica", topic, "")
+	}
+	if left == 0 {
+		p.emslookupd.DB.RemoveRegistration(key)
+	}
+	p.emslookupd.cluster.changed()
 
 	return []byte("OK"), nil
 }
@@ -250,8 +312,24 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY", "IDENTIFY missing fields")
 	}
 
+	var auth struct {
+		Secret string `json:"secret"`
+	}
+	json.Unmarshal(body, &auth)
+	err = p.emslookupd.authorizeNode(client.Conn, auth.Secret)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_UNAUTHORIZED", "IDENTIFY unauthorized")
+	}
+
 	atomic.StoreInt64(&peerInfo.lastUpdate, time.Now().UnixNano())
 
+	p.emslookupd.nodeIDLock.Lock()
+	err = p.emslookupd.checkNodeID(&peerInfo)
+	if err != nil {
+		p.emslookupd.nodeIDLock.Unlock()
+		return nil, protocol.NewFatalClientErr(err, "E_NODE_ID_CONFLICT", err.Error())
+	}
+
 	p.emslookupd.logf(LOG_INFO, "CLIENT(%s): IDENTIFY Address:%s TCP:%d HTTP:%d Version:%s",
 		client, peerInfo.BroadcastAddress, peerInfo.TCPPort, peerInfo.HTTPPort, peerInfo.Version)
 
@@ -259,6 +337,8 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	if p.emslookupd.DB.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: client.peerInfo}) {
 		p.emslookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s", client, "client", "", "")
 	}
+	p.emslookupd.nodeIDLock.Unlock()
+	p.emslookupd.cluster.changed()
 
 	// build a response
 	data := make(map[string]interface{})
@@ -271,6 +351,10 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	}
 	data["broadcast_address"] = p.emslookupd.opts.BroadcastAddress
 	data["hostname"] = hostname
+	if peerInfo.NodeID != nil {
+		// possibly assigned
+		data["node_id"] = *peerInfo.NodeID
+	}
 
 	response, err := json.Marshal(data)
 	if err != nil {
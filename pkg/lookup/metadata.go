@@ -0,0 +1,310 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// meta is the registration state and the placement rules persisted in
+// --data-path across restarts
+type meta struct {
+	Registrations []metaRegistration `json:"registrations"`
+	Tombstones    []metaTombstone    `json:"tombstones"`
+	Placement     []PlacementRule    `json:"placement,omitempty"`
+}
+
+type metaRegistration struct {
+	Category string `json:"category"`
+	Key      string `json:"key"`
+	SubKey   string `json:"subkey"`
+	Created  bool   `json:"created,omitempty"` // via /topic/create or /channel/create
+}
+
+type metaTombstone struct {
+	Topic        string `json:"topic"`
+	Node         string `json:"node"`
+	TombstonedAt int64  `json:"tombstoned_at"`
+}
+
+// tombstone is a restored tombstone waiting for its producer to register
+type tombstone struct {
+	topic string
+	node  string
+}
+
+func newMetadataFile(opts *Options) string {
+	return path.Join(opts.DataPath, "emslookupd.dat")
+}
+
+func producerNode(peerInfo *PeerInfo) string {
+	return fmt.Sprintf("%s:%d", peerInfo.BroadcastAddress, peerInfo.HTTPPort)
+}
+
+func isEphemeral(k Registration) bool {
+	return strings.HasSuffix(k.Key, "#ephemeral") || strings.HasSuffix(k.SubKey, "#ephemeral")
+}
+
+// LoadMetadata restores the registrations, tombstones and placement rules
+// persisted in --data-path. Restored registrations have no producers, those
+// which weren't created via the HTTP API are dropped unless an emsd registers
+// them again within --inactive-producer-timeout.
+func (l *EMSLookupd) LoadMetadata() error {
+	if l.opts.DataPath == "" {
+		return nil
+	}
+
+	fn := newMetadataFile(l.opts)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // fresh start
+		}
+		return fmt.Errorf("failed to read metadata from %s - %s", fn, err)
+	}
+
+	var m meta
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return fmt.Errorf("failed to parse metadata in %s - %s", fn, err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for _, r := range m.Registrations {
+		k := Registration{r.Category, r.Key, r.SubKey}
+		l.DB.AddRegistration(k)
+		if r.Created {
+			l.created[k] = true
+		} else {
+			l.restored[k] = true
+		}
+	}
+	now := time.Now()
+	for _, t := range m.Tombstones {
+		tombstonedAt := time.Unix(0, t.TombstonedAt)
+		if now.Sub(tombstonedAt) >= l.opts.TombstoneLifetime {
+			continue
+		}
+		l.tombstones[tombstone{t.Topic, t.Node}] = tombstonedAt
+	}
+	for _, r := range m.Placement {
+		l.placement[r.Pattern] = r
+	}
+	l.logf(LOG_INFO, "DB: restored %d registrations, %d tombstones and %d placement rules from %s",
+		len(m.Registrations), len(l.tombstones), len(l.placement), fn)
+	return nil
+}
+
+// metadata returns the state to persist (pruning expired tombstones), the
+// caller must hold l's lock
+func (l *EMSLookupd) metadata() *meta {
+	m := &meta{
+		Registrations: []metaRegistration{},
+		Tombstones:    []metaTombstone{},
+	}
+
+	registrations := append(l.DB.FindRegistrations("topic", "*", ""),
+		l.DB.FindRegistrations("channel", "*", "*")...)
+	for _, k := range registrations {
+		if isEphemeral(k) {
+			continue
+		}
+		m.Registrations = append(m.Registrations, metaRegistration{
+			Category: k.Category,
+			Key:      k.Key,
+			SubKey:   k.SubKey,
+			Created:  l.created[k],
+		})
+		if k.Category != "topic" {
+			continue
+		}
+		for _, p := range l.DB.FindProducers("topic", k.Key, "") {
+			if p.IsTombstoned(l.opts.TombstoneLifetime) {
+				m.Tombstones = append(m.Tombstones, metaTombstone{
+					Topic:        k.Key,
+					Node:         producerNode(p.peerInfo),
+					TombstonedAt: p.tombstonedAt.UnixNano(),
+				})
+			}
+		}
+	}
+
+	now := time.Now()
+	for t, tombstonedAt := range l.tombstones {
+		if now.Sub(tombstonedAt) >= l.opts.TombstoneLifetime {
+			delete(l.tombstones, t)
+			continue
+		}
+		m.Tombstones = append(m.Tombstones, metaTombstone{
+			Topic:        t.topic,
+			Node:         t.node,
+			TombstonedAt: tombstonedAt.UnixNano(),
+		})
+	}
+
+	for _, r := range l.placement {
+		m.Placement = append(m.Placement, r)
+	}
+
+	sort.Slice(m.Registrations, func(i, j int) bool {
+		a, b := m.Registrations[i], m.Registrations[j]
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.SubKey < b.SubKey
+	})
+	sort.Slice(m.Tombstones, func(i, j int) bool {
+		a, b := m.Tombstones[i], m.Tombstones[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Node < b.Node
+	})
+	sort.Slice(m.Placement, func(i, j int) bool {
+		return m.Placement[i].Pattern < m.Placement[j].Pattern
+	})
+	return m
+}
+
+// PersistMetadata writes the registrations, tombstones and placement rules to
+// --data-path, it's a no-op without one
+func (l *EMSLookupd) PersistMetadata() error {
+	if l.opts.DataPath == "" {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	fileName := newMetadataFile(l.opts)
+	data, err := json.Marshal(l.metadata())
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err = writeSyncFile(tmpFileName, data)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (l *EMSLookupd) persistMetadata() {
+	err := l.PersistMetadata()
+	if err != nil {
+		l.logf(LOG_ERROR, "failed to persist metadata - %s", err)
+	}
+}
+
+func writeSyncFile(fn string, data []byte) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	return err
+}
+
+// newProducer returns the producer registering k, with its restored tombstone
+// if any. It returns true if k wasn't known (and needs persisting).
+func (l *EMSLookupd) newProducer(k Registration, peerInfo *PeerInfo) (*Producer, bool) {
+	p := &Producer{peerInfo: peerInfo}
+	isNew := len(l.DB.FindRegistrations(k.Category, k.Key, k.SubKey)) == 0
+
+	l.Lock()
+	defer l.Unlock()
+	delete(l.restored, k)
+	if k.Category == "topic" {
+		t := tombstone{k.Key, producerNode(peerInfo)}
+		if tombstonedAt, ok := l.tombstones[t]; ok {
+			p.tombstoned = true
+			p.tombstonedAt = tombstonedAt
+			delete(l.tombstones, t)
+		}
+	}
+	return p, isNew && !isEphemeral(k)
+}
+
+// keepTombstones holds on to the tombstones of a disconnecting producer, they
+// apply again if it registers before they expire
+func (l *EMSLookupd) keepTombstones(registrations Registrations, peerInfo *PeerInfo) {
+	l.Lock()
+	defer l.Unlock()
+	for _, k := range registrations.Filter("topic", "*", "") {
+		for _, p := range l.DB.FindProducers("topic", k.Key, "") {
+			if p.peerInfo == peerInfo && p.IsTombstoned(l.opts.TombstoneLifetime) {
+				l.tombstones[tombstone{k.Key, producerNode(peerInfo)}] = p.tombstonedAt
+			}
+		}
+	}
+}
+
+// setCreated records whether k was created via the HTTP API
+func (l *EMSLookupd) setCreated(k Registration, created bool) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.restored, k)
+	if created {
+		l.created[k] = true
+	} else {
+		delete(l.created, k)
+	}
+}
+
+// reconcileLoop drops the restored registrations no emsd registered again
+func (l *EMSLookupd) reconcileLoop() {
+	select {
+	case <-time.After(l.opts.InactiveProducerTimeout):
+	case <-l.exitChan:
+		return
+	}
+
+	l.Lock()
+	for k := range l.restored {
+		if len(l.DB.FindProducers(k.Category, k.Key, k.SubKey)) == 0 {
+			l.logf(LOG_INFO, "DB: removing restored registration category:%s key:%s subkey:%s",
+				k.Category, k.Key, k.SubKey)
+			l.DB.RemoveRegistration(k)
+		}
+		delete(l.restored, k)
+	}
+	l.Unlock()
+
+	l.persistMetadata()
+}
@@ -0,0 +1,130 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	emsctl "github.com/bhojpur/ems/pkg/client"
+	"github.com/bhojpur/ems/pkg/core/http_api"
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func TestPersistMetadata(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "emslookupd-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	tcpAddr, httpAddr, emslookupd := mustStartLookupd(opts)
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err = client.POSTV1(fmt.Sprintf("http://%s/channel/create?topic=created&channel=ch", httpAddr))
+	test.Nil(t, err)
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	identify(t, conn)
+	emsctl.Register("registered", "ch").WriteTo(conn)
+	_, err = emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+	emsctl.Register("tombstoned", "").WriteTo(conn)
+	_, err = emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+	emsctl.Register("ephemeral#ephemeral", "").WriteTo(conn)
+	_, err = emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+
+	err = client.POSTV1(fmt.Sprintf("http://%s/topic/tombstone?topic=tombstoned&node=%s:%d",
+		httpAddr, HostAddr, HTTPPort))
+	test.Nil(t, err)
+
+	conn.Close()
+	emslookupd.Exit()
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	opts.InactiveProducerTimeout = 200 * time.Millisecond
+	tcpAddr, _, emslookupd = mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	test.Equal(t, 3, len(emslookupd.DB.FindRegistrations("topic", "*", "")))
+	test.Equal(t, 0, len(emslookupd.DB.FindRegistrations("topic", "ephemeral#ephemeral", "")))
+	test.Equal(t, 1, len(emslookupd.DB.FindRegistrations("channel", "created", "ch")))
+	test.Equal(t, 1, len(emslookupd.DB.FindRegistrations("channel", "registered", "ch")))
+
+	// the tombstone is restored when the producer registers again
+	conn = mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+	emsctl.Register("tombstoned", "").WriteTo(conn)
+	_, err = emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+	producers := emslookupd.DB.FindProducers("topic", "tombstoned", "")
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, true, producers[0].IsTombstoned(opts.TombstoneLifetime))
+
+	// registrations no emsd reports are dropped, created ones are kept
+	time.Sleep(400 * time.Millisecond)
+	test.Equal(t, 1, len(emslookupd.DB.FindRegistrations("topic", "created", "")))
+	test.Equal(t, 1, len(emslookupd.DB.FindRegistrations("channel", "created", "ch")))
+	test.Equal(t, 1, len(emslookupd.DB.FindRegistrations("topic", "tombstoned", "")))
+	test.Equal(t, 0, len(emslookupd.DB.FindRegistrations("topic", "registered", "")))
+	test.Equal(t, 0, len(emslookupd.DB.FindRegistrations("channel", "registered", "ch")))
+
+	emslookupd.Lock()
+	m := emslookupd.metadata()
+	emslookupd.Unlock()
+	test.Equal(t, 3, len(m.Registrations))
+	test.Equal(t, true, m.Registrations[0].Created)
+	test.Equal(t, 1, len(m.Tombstones))
+}
+
+func TestPersistMetadataDeleteTopic(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "emslookupd-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	_, httpAddr, emslookupd := mustStartLookupd(opts)
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err = client.POSTV1(fmt.Sprintf("http://%s/topic/create?topic=deleted", httpAddr))
+	test.Nil(t, err)
+	err = client.POSTV1(fmt.Sprintf("http://%s/topic/delete?topic=deleted", httpAddr))
+	test.Nil(t, err)
+	emslookupd.Exit()
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	_, _, emslookupd = mustStartLookupd(opts)
+	defer emslookupd.Exit()
+	test.Equal(t, 0, len(emslookupd.DB.FindRegistrations("topic", "*", "")))
+}
@@ -0,0 +1,127 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// --node-id-policy, what to do when an emsd identifies with the node ID of
+// another live node
+const (
+	nodeIDPolicyWarn   = "warn"   // log it, /nodes reports the conflict
+	nodeIDPolicyReject = "reject" // refuse the IDENTIFY
+	nodeIDPolicyAssign = "assign" // answer with a free node ID the emsd switches to
+)
+
+// maxNodeIDs is the number of node IDs, emsd embeds them in 10 bits of its
+// message IDs
+const maxNodeIDs = 1024
+
+func validateNodeIDPolicy(policy string) error {
+	switch policy {
+	case nodeIDPolicyWarn, nodeIDPolicyReject, nodeIDPolicyAssign:
+		return nil
+	}
+	return fmt.Errorf("invalid --node-id-policy %q, must be one of %s, %s or %s",
+		policy, nodeIDPolicyWarn, nodeIDPolicyReject, nodeIDPolicyAssign)
+}
+
+// nodeIDOwners returns the nodes (as producerNode) using each node ID among
+// the active peers, local and from the other cluster members
+func (l *EMSLookupd) nodeIDOwners() map[int64][]string {
+	owners := make(map[int64][]string)
+	seen := make(map[string]bool)
+	peers := l.DB.FindProducers("client", "", "").
+		FilterByActive(l.opts.InactiveProducerTimeout, 0).PeerInfo()
+	for _, peerInfo := range peers {
+		node := producerNode(peerInfo)
+		if peerInfo.NodeID == nil || seen[node] {
+			continue
+		}
+		seen[node] = true
+		owners[*peerInfo.NodeID] = append(owners[*peerInfo.NodeID], node)
+	}
+	for _, nodes := range owners {
+		sort.Strings(nodes)
+	}
+	return owners
+}
+
+// checkNodeID applies --node-id-policy to an identifying peer, it returns an
+// error if it must be rejected. The caller must hold l.nodeIDLock until the
+// peer is added.
+func (l *EMSLookupd) checkNodeID(peerInfo *PeerInfo) error {
+	if peerInfo.NodeID == nil {
+		// emsd too old to report it
+		return nil
+	}
+
+	node := producerNode(peerInfo)
+	owners := l.nodeIDOwners()
+	var other string
+	for _, n := range owners[*peerInfo.NodeID] {
+		// the same node, connected to another member or reconnecting
+		if n != node {
+			other = n
+			break
+		}
+	}
+	if other == "" {
+		return nil
+	}
+
+	switch l.opts.NodeIDPolicy {
+	case nodeIDPolicyReject:
+		return fmt.Errorf("node ID %d of %s already used by %s", *peerInfo.NodeID, node, other)
+	case nodeIDPolicyAssign:
+		for id := int64(0); id < maxNodeIDs; id++ {
+			if len(owners[id]) == 0 {
+				l.logf(LOG_WARN, "node ID %d of %s already used by %s, assigning %d",
+					*peerInfo.NodeID, node, other, id)
+				peerInfo.NodeID = &id
+				return nil
+			}
+		}
+		return fmt.Errorf("node ID %d of %s already used by %s, no free node ID",
+			*peerInfo.NodeID, node, other)
+	default:
+		l.logf(LOG_WARN, "node ID %d of %s already used by %s, their message IDs may collide",
+			*peerInfo.NodeID, node, other)
+		return nil
+	}
+}
+
+// nodeIDConflicts returns the nodes (as producerNode) sharing their node ID
+// with another active node
+func (l *EMSLookupd) nodeIDConflicts() map[string]bool {
+	conflicts := make(map[string]bool)
+	for _, nodes := range l.nodeIDOwners() {
+		if len(nodes) < 2 {
+			continue
+		}
+		for _, node := range nodes {
+			conflicts[node] = true
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,135 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	emsctl "github.com/bhojpur/ems/pkg/client"
+	"github.com/bhojpur/ems/pkg/core/http_api"
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+func identifyNodeID(t *testing.T, conn net.Conn, httpPort int, nodeID int64) []byte {
+	ci := make(map[string]interface{})
+	ci["tcp_port"] = TCPPort
+	ci["http_port"] = httpPort
+	ci["broadcast_address"] = HostAddr
+	ci["hostname"] = HostAddr
+	ci["version"] = EMSDVersion
+	ci["node_id"] = nodeID
+	cmd, _ := emsctl.Identify(ci)
+	_, err := cmd.WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := emsctl.ReadResponse(conn)
+	test.Nil(t, err)
+	return resp
+}
+
+func responseNodeID(t *testing.T, resp []byte) int64 {
+	var r struct {
+		NodeID *int64 `json:"node_id"`
+	}
+	err := json.Unmarshal(resp, &r)
+	test.Nil(t, err)
+	test.NotNil(t, r.NodeID)
+	return *r.NodeID
+}
+
+func TestNodeIDWarn(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	for i, nodeID := range []int64{7, 7, 8} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		resp := identifyNodeID(t, conn, HTTPPort+i, nodeID)
+		test.Equal(t, nodeID, responseNodeID(t, resp))
+	}
+
+	var nodes struct {
+		Producers []*node `json:"producers"`
+	}
+	endpoint := fmt.Sprintf("http://%s/nodes", httpAddr)
+	err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &nodes)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(nodes.Producers))
+	conflicts := make(map[int]bool)
+	for _, n := range nodes.Producers {
+		conflicts[n.HTTPPort] = n.NodeIDConflict
+	}
+	test.Equal(t, map[int]bool{HTTPPort: true, HTTPPort + 1: true, HTTPPort + 2: false}, conflicts)
+}
+
+func TestNodeIDReject(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NodeIDPolicy = "reject"
+	tcpAddr, _, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	resp := identifyNodeID(t, conn, HTTPPort, 7)
+	test.Equal(t, int64(7), responseNodeID(t, resp))
+
+	conn = mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	resp = identifyNodeID(t, conn, HTTPPort+1, 7)
+	test.Equal(t, true, bytes.HasPrefix(resp, []byte("E_NODE_ID_CONFLICT")))
+
+	// the same node registering again isn't a conflict
+	conn = mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	resp = identifyNodeID(t, conn, HTTPPort, 7)
+	test.Equal(t, int64(7), responseNodeID(t, resp))
+}
+
+func TestNodeIDAssign(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NodeIDPolicy = "assign"
+	tcpAddr, _, emslookupd := mustStartLookupd(opts)
+	defer emslookupd.Exit()
+
+	for i, ids := range [][2]int64{{0, 0}, {7, 7}, {7, 1}, {1, 2}} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		resp := identifyNodeID(t, conn, HTTPPort+i, ids[0])
+		test.Equal(t, ids[1], responseNodeID(t, resp))
+	}
+
+	test.Equal(t, 0, len(emslookupd.nodeIDConflicts()))
+}
+
+func TestNodeIDPolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NodeIDPolicy = "ignore"
+	_, err := New(opts)
+	test.NotNil(t, err)
+}
@@ -36,9 +36,32 @@ type Options struct {
 	TCPAddress       string `flag:"tcp-address"`
 	HTTPAddress      string `flag:"http-address"`
 	BroadcastAddress string `flag:"broadcast-address"`
+	DataPath         string `flag:"data-path"`
 
 	InactiveProducerTimeout time.Duration `flag:"inactive-producer-timeout"`
 	TombstoneLifetime       time.Duration `flag:"tombstone-lifetime"`
+
+	// TLS for the TCP listener
+	TLSCert             string `flag:"tls-cert"`
+	TLSKey              string `flag:"tls-key"`
+	TLSClientAuthPolicy string `flag:"tls-client-auth-policy"`
+	TLSRootCAFile       string `flag:"tls-root-ca-file"`
+
+	// emsd registration and HTTP admin authentication
+	RegistrationSecret string   `flag:"registration-secret"`
+	AllowedNodes       []string `flag:"allowed-node" cfg:"allowed_nodes"`
+	HTTPAdminToken     string   `flag:"http-admin-token"`
+
+	// what to do when emsd identifies with the node ID of another node
+	NodeIDPolicy string `flag:"node-id-policy"`
+
+	// embedded DNS server, disabled without an address
+	DNSAddress string        `flag:"dns-address"`
+	DNSDomain  string        `flag:"dns-domain"`
+	DNSTTL     time.Duration `flag:"dns-ttl"`
+
+	ClusterPeers        []string      `flag:"cluster-peer" cfg:"cluster_peers"`
+	ClusterSyncInterval time.Duration `flag:"cluster-sync-interval"`
 }
 
 func NewOptions() *Options {
@@ -56,5 +79,12 @@ func NewOptions() *Options {
 
 		InactiveProducerTimeout: 300 * time.Second,
 		TombstoneLifetime:       45 * time.Second,
+
+		NodeIDPolicy: nodeIDPolicyWarn,
+
+		DNSDomain: "ems.local",
+		DNSTTL:    5 * time.Second,
+
+		ClusterSyncInterval: 2 * time.Second,
 	}
 }
@@ -0,0 +1,278 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// PlacementRule says which nodes should host the topics matching Pattern
+type PlacementRule struct {
+	Pattern  string `json:"pattern"`            // glob on the topic name, as path.Match
+	Selector string `json:"selector,omitempty"` // label selector of the nodes, all nodes if empty
+	Replicas int    `json:"replicas,omitempty"` // number of nodes, all those selected if 0
+}
+
+func (r PlacementRule) validate() error {
+	if r.Pattern == "" {
+		return fmt.Errorf("missing pattern")
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q - %s", r.Pattern, err)
+	}
+	if r.Selector != "" {
+		if _, err := parseLabelSelector(r.Selector); err != nil {
+			return err
+		}
+	}
+	if r.Replicas < 0 {
+		return fmt.Errorf("invalid replicas %d", r.Replicas)
+	}
+	return nil
+}
+
+func (r PlacementRule) selector() labelSelector {
+	if r.Selector == "" {
+		return nil
+	}
+	// validated when set
+	selector, _ := parseLabelSelector(r.Selector)
+	return selector
+}
+
+// placement violations
+const (
+	placementUnselectedNode  = "unselected_node"  // hosted on a node the selector doesn't match
+	placementUnderReplicated = "under_replicated" // hosted on fewer selected nodes than wanted
+	placementOverReplicated  = "over_replicated"  // hosted on more selected nodes than wanted
+)
+
+type placementViolation struct {
+	Topic   string `json:"topic"`
+	Pattern string `json:"pattern"`
+	Reason  string `json:"reason"`
+	Node    string `json:"node,omitempty"` // for unselected_node
+	Hosts   int    `json:"hosts"`          // selected nodes hosting the topic
+	Wanted  int    `json:"wanted"`
+}
+
+// setPlacementRule adds or replaces the rule for its pattern
+func (l *EMSLookupd) setPlacementRule(r PlacementRule) {
+	l.Lock()
+	defer l.Unlock()
+	l.placement[r.Pattern] = r
+}
+
+// deletePlacementRule removes the rule for pattern, it returns false if there
+// was none
+func (l *EMSLookupd) deletePlacementRule(pattern string) bool {
+	l.Lock()
+	defer l.Unlock()
+	_, ok := l.placement[pattern]
+	delete(l.placement, pattern)
+	return ok
+}
+
+// getPlacementRule returns the rule for pattern
+func (l *EMSLookupd) getPlacementRule(pattern string) (PlacementRule, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	r, ok := l.placement[pattern]
+	return r, ok
+}
+
+// placementRules returns the rules ordered by pattern
+func (l *EMSLookupd) placementRules() []PlacementRule {
+	l.RLock()
+	rules := make([]PlacementRule, 0, len(l.placement))
+	for _, r := range l.placement {
+		rules = append(rules, r)
+	}
+	l.RUnlock()
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Pattern < rules[j].Pattern
+	})
+	return rules
+}
+
+// placementRule returns the rule for a topic, the one with the longest
+// pattern if several match
+func (l *EMSLookupd) placementRule(topic string) *PlacementRule {
+	var rule *PlacementRule
+	for _, r := range l.placementRules() {
+		if ok, _ := path.Match(r.Pattern, topic); !ok {
+			continue
+		}
+		if rule == nil || len(r.Pattern) > len(rule.Pattern) {
+			r := r
+			rule = &r
+		}
+	}
+	return rule
+}
+
+// topicHosts returns the active, not tombstoned, producers of a topic keyed by
+// node (see producerNode) and the nodes where it's tombstoned
+func (l *EMSLookupd) topicHosts(topic string) (map[string]*PeerInfo, map[string]bool) {
+	hosts := make(map[string]*PeerInfo)
+	tombstoned := make(map[string]bool)
+	producers := l.DB.FindProducers("topic", topic, "").
+		FilterByActive(l.opts.InactiveProducerTimeout, 0)
+	for _, p := range producers {
+		node := producerNode(p.peerInfo)
+		if p.IsTombstoned(l.opts.TombstoneLifetime) {
+			tombstoned[node] = true
+			continue
+		}
+		hosts[node] = p.peerInfo
+	}
+	for node := range tombstoned {
+		delete(hosts, node)
+	}
+	return hosts, tombstoned
+}
+
+// place returns the nodes a topic should be published to, best first. Those
+// already hosting it come first, then the ones hosting the fewest topics. It's
+// all the nodes selected by the topic's rule (or all the nodes without one),
+// up to its replicas.
+func (l *EMSLookupd) place(topic string) (*PlacementRule, []*PeerInfo) {
+	rule := l.placementRule(topic)
+	var selector labelSelector
+	if rule != nil {
+		selector = rule.selector()
+	}
+
+	hosts, tombstoned := l.topicHosts(topic)
+	type candidate struct {
+		peerInfo *PeerInfo
+		hosting  bool
+		topics   int
+	}
+	var candidates []candidate
+	nodes := l.DB.FindProducers("client", "", "").
+		FilterByActive(l.opts.InactiveProducerTimeout, 0).Dedupe()
+	for _, p := range nodes {
+		node := producerNode(p.peerInfo)
+		if tombstoned[node] || !selector.Matches(p.peerInfo.Labels) {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			peerInfo: p.peerInfo,
+			hosting:  hosts[node] != nil,
+			topics:   len(l.DB.LookupRegistrations(p.peerInfo.id).Filter("topic", "*", "")),
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.hosting != b.hosting {
+			return a.hosting
+		}
+		if a.topics != b.topics {
+			return a.topics < b.topics
+		}
+		return producerNode(a.peerInfo) < producerNode(b.peerInfo)
+	})
+	if rule != nil && rule.Replicas > 0 && len(candidates) > rule.Replicas {
+		candidates = candidates[:rule.Replicas]
+	}
+
+	peers := make([]*PeerInfo, 0, len(candidates))
+	for _, c := range candidates {
+		peers = append(peers, c.peerInfo)
+	}
+	return rule, peers
+}
+
+// placementViolations checks the registered topics (or only topic if not
+// empty) against the placement rules
+func (l *EMSLookupd) placementViolations(topic string) []placementViolation {
+	violations := []placementViolation{}
+	if len(l.placementRules()) == 0 {
+		return violations
+	}
+
+	topics := l.DB.FindRegistrations("topic", "*", "").Keys()
+	if topic != "" {
+		topics = l.DB.FindRegistrations("topic", topic, "").Keys()
+	}
+	sort.Strings(topics)
+
+	nodes := l.DB.FindProducers("client", "", "").
+		FilterByActive(l.opts.InactiveProducerTimeout, 0).Dedupe()
+	for _, t := range topics {
+		rule := l.placementRule(t)
+		if rule == nil {
+			continue
+		}
+		selector := rule.selector()
+
+		hosts, _ := l.topicHosts(t)
+		var selected int
+		var unselected []string
+		for _, peerInfo := range hosts {
+			if selector.Matches(peerInfo.Labels) {
+				selected++
+			} else {
+				unselected = append(unselected, producerNode(peerInfo))
+			}
+		}
+		sort.Strings(unselected)
+
+		wanted := rule.Replicas
+		if wanted == 0 {
+			for _, p := range nodes {
+				if selector.Matches(p.peerInfo.Labels) {
+					wanted++
+				}
+			}
+		}
+
+		for _, node := range unselected {
+			violations = append(violations, placementViolation{
+				Topic:   t,
+				Pattern: rule.Pattern,
+				Reason:  placementUnselectedNode,
+				Node:    node,
+				Hosts:   selected,
+				Wanted:  wanted,
+			})
+		}
+		reason := ""
+		if selected < wanted {
+			reason = placementUnderReplicated
+		} else if selected > wanted {
+			reason = placementOverReplicated
+		}
+		if reason != "" {
+			violations = append(violations, placementViolation{
+				Topic:   t,
+				Pattern: rule.Pattern,
+				Reason:  reason,
+				Hosts:   selected,
+				Wanted:  wanted,
+			})
+		}
+	}
+	return violations
+}
@@ -0,0 +1,211 @@
+package lookup
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	emsctl "github.com/bhojpur/ems/pkg/client"
+	"github.com/bhojpur/ems/pkg/core/http_api"
+	"github.com/bhojpur/ems/pkg/core/test"
+)
+
+type testPlacement struct {
+	Rule      *PlacementRule `json:"rule"`
+	Producers []*PeerInfo    `json:"producers"`
+}
+
+func TestPlacement(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "emslookupd-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	tcpAddr, httpAddr, emslookupd := mustStartLookupd(opts)
+
+	// zone a hosts orders.eu, zone b hosts other and zone c nothing
+	zones := []string{"a", "b", "c"}
+	topics := []string{"orders.eu", "other", ""}
+	for i, zone := range zones {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		identifyWithLabels(t, conn, HTTPPort+i, map[string]string{"zone": zone})
+		if topics[i] == "" {
+			continue
+		}
+		emsctl.Register(topics[i], "").WriteTo(conn)
+		_, err := emsctl.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	var pr testPlacement
+
+	// without rules any node, the least loaded first
+	err = client.GETV1(fmt.Sprintf("http://%s/placement?topic=new", httpAddr), &pr)
+	test.Nil(t, err)
+	test.Nil(t, pr.Rule)
+	test.Equal(t, 3, len(pr.Producers))
+	test.Equal(t, "c", pr.Producers[0].Labels["zone"])
+	test.Equal(t, "a", pr.Producers[1].Labels["zone"])
+	test.Equal(t, "b", pr.Producers[2].Labels["zone"])
+
+	// those already hosting the topic first
+	err = client.GETV1(fmt.Sprintf("http://%s/placement?topic=other", httpAddr), &pr)
+	test.Nil(t, err)
+	test.Equal(t, "b", pr.Producers[0].Labels["zone"])
+
+	var violations struct {
+		Violations []placementViolation `json:"violations"`
+	}
+	err = client.GETV1(fmt.Sprintf("http://%s/placement/violations", httpAddr), &violations)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(violations.Violations))
+
+	for _, qs := range []string{
+		"pattern=orders.*&selector=zone!=a&replicas=2",
+		"pattern=orders.us&selector=zone=a",
+	} {
+		err = client.POSTV1(fmt.Sprintf("http://%s/placement/rule?%s", httpAddr, qs))
+		test.Nil(t, err)
+	}
+	for _, qs := range []string{
+		"selector=zone=a",
+		"pattern=[",
+		"pattern=orders.*&selector==a",
+		"pattern=orders.*&replicas=-1",
+	} {
+		err = client.POSTV1(fmt.Sprintf("http://%s/placement/rule?%s", httpAddr, qs))
+		test.NotNil(t, err)
+	}
+
+	var rules struct {
+		Rules []PlacementRule `json:"rules"`
+	}
+	err = client.GETV1(fmt.Sprintf("http://%s/placement/rules", httpAddr), &rules)
+	test.Nil(t, err)
+	test.Equal(t, []PlacementRule{
+		{Pattern: "orders.*", Selector: "zone!=a", Replicas: 2},
+		{Pattern: "orders.us", Selector: "zone=a"},
+	}, rules.Rules)
+
+	err = client.GETV1(fmt.Sprintf("http://%s/placement?topic=orders.new", httpAddr), &pr)
+	test.Nil(t, err)
+	test.Equal(t, "orders.*", pr.Rule.Pattern)
+	test.Equal(t, 2, len(pr.Producers))
+	test.Equal(t, "c", pr.Producers[0].Labels["zone"])
+	test.Equal(t, "b", pr.Producers[1].Labels["zone"])
+
+	// the longest matching pattern applies
+	err = client.GETV1(fmt.Sprintf("http://%s/placement?topic=orders.us", httpAddr), &pr)
+	test.Nil(t, err)
+	test.Equal(t, "orders.us", pr.Rule.Pattern)
+	test.Equal(t, 1, len(pr.Producers))
+	test.Equal(t, "a", pr.Producers[0].Labels["zone"])
+
+	err = client.GETV1(fmt.Sprintf("http://%s/placement/violations?topic=orders.eu", httpAddr), &violations)
+	test.Nil(t, err)
+	test.Equal(t, []placementViolation{
+		{
+			Topic:   "orders.eu",
+			Pattern: "orders.*",
+			Reason:  placementUnselectedNode,
+			Node:    fmt.Sprintf("%s:%d", HostAddr, HTTPPort),
+			Wanted:  2,
+		},
+		{
+			Topic:   "orders.eu",
+			Pattern: "orders.*",
+			Reason:  placementUnderReplicated,
+			Wanted:  2,
+		},
+	}, violations.Violations)
+
+	// tombstoned producers don't host the topic anymore
+	err = client.POSTV1(fmt.Sprintf("http://%s/topic/tombstone?topic=orders.eu&node=%s:%d",
+		httpAddr, HostAddr, HTTPPort))
+	test.Nil(t, err)
+	err = client.GETV1(fmt.Sprintf("http://%s/placement/violations", httpAddr), &violations)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(violations.Violations))
+	test.Equal(t, placementUnderReplicated, violations.Violations[0].Reason)
+
+	err = client.POSTV1(fmt.Sprintf("http://%s/placement/rule/delete?pattern=orders.us", httpAddr))
+	test.Nil(t, err)
+	err = client.POSTV1(fmt.Sprintf("http://%s/placement/rule/delete?pattern=orders.us", httpAddr))
+	test.NotNil(t, err)
+
+	// the rules are persisted
+	emslookupd.Exit()
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	_, _, emslookupd = mustStartLookupd(opts)
+	defer emslookupd.Exit()
+	test.Equal(t, []PlacementRule{
+		{Pattern: "orders.*", Selector: "zone!=a", Replicas: 2},
+	}, emslookupd.placementRules())
+}
+
+func TestClusterPlacement(t *testing.T) {
+	members := mustStartCluster(t, 2)
+	for _, m := range members {
+		defer m.l.Exit()
+	}
+	waitForCluster(t, "members", func() bool {
+		return len(members[0].l.cluster.membersInfo()) == 1
+	})
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).WithAuthToken(testClusterToken)
+	err := client.POSTV1(fmt.Sprintf("http://%s/placement/rule?pattern=a*&replicas=1", members[0].httpAddr))
+	test.Nil(t, err)
+	err = client.POSTV1(fmt.Sprintf("http://%s/placement/rule?pattern=b*&replicas=2", members[0].httpAddr))
+	test.Nil(t, err)
+	test.Equal(t, 2, len(members[1].l.placementRules()))
+
+	err = client.POSTV1(fmt.Sprintf("http://%s/placement/rule/delete?pattern=a*", members[1].httpAddr))
+	test.Nil(t, err)
+	test.Equal(t, 1, len(members[0].l.placementRules()))
+
+	// a member joining later gets the rules with the syncs, the deleted
+	// one isn't set again
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.BroadcastAddress = "127.0.0.1"
+	opts.ClusterSyncInterval = 50 * time.Millisecond
+	opts.HTTPAdminToken = testClusterToken
+	opts.ClusterPeers = []string{members[1].httpAddr.String()}
+	_, _, l := mustStartLookupd(opts)
+	defer l.Exit()
+	waitForCluster(t, "placement rules", func() bool {
+		return len(l.placementRules()) == 1
+	})
+	time.Sleep(200 * time.Millisecond)
+	for _, l := range []*EMSLookupd{members[0].l, members[1].l, l} {
+		test.Equal(t, []PlacementRule{{Pattern: "b*", Replicas: 2}}, l.placementRules())
+	}
+}
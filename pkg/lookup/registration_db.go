@@ -30,6 +30,16 @@ import (
 type RegistrationDB struct {
 	sync.RWMutex
 	registrationMap map[Registration]ProducerMap
+
+	version  uint64                 // bumped on every change
+	versions map[string]uint64      // per topic, version of its last change
+	watchers map[string]*topicWatch // per topic, while it's watched
+}
+
+// topicWatch is closed on the next change of a topic
+type topicWatch struct {
+	changed  chan struct{}
+	watchers int
 }
 
 type Registration struct {
@@ -48,12 +58,16 @@ type PeerInfo struct {
 	TCPPort          int    `json:"tcp_port"`
 	HTTPPort         int    `json:"http_port"`
 	Version          string `json:"version"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+	NodeID *int64            `json:"node_id,omitempty"` // the ID in its message IDs
 }
 
 type Producer struct {
 	peerInfo     *PeerInfo
 	tombstoned   bool
 	tombstonedAt time.Time
+	inactive     bool // as of the last UpdateActivity
 }
 
 type Producers []*Producer
@@ -72,9 +86,110 @@ func (p *Producer) IsTombstoned(lifetime time.Duration) bool {
 	return p.tombstoned && time.Now().Sub(p.tombstonedAt) < lifetime
 }
 
+func (p *Producer) isActive(now time.Time, inactivityTimeout time.Duration, tombstoneLifetime time.Duration) bool {
+	cur := time.Unix(0, atomic.LoadInt64(&p.peerInfo.lastUpdate))
+	tombstoned := p.tombstoned && now.Sub(p.tombstonedAt) < tombstoneLifetime
+	return now.Sub(cur) <= inactivityTimeout && !tombstoned
+}
+
 func NewRegistrationDB() *RegistrationDB {
 	return &RegistrationDB{
 		registrationMap: make(map[Registration]ProducerMap),
+		// versions don't repeat across restarts
+		version:  uint64(time.Now().UnixNano()),
+		versions: make(map[string]uint64),
+		watchers: make(map[string]*topicWatch),
+	}
+}
+
+// WatchTopic returns the version of a topic's registrations (0 if they never
+// changed), a channel closed when they next change and a function to call
+// once done waiting on it
+func (r *RegistrationDB) WatchTopic(topic string) (uint64, <-chan struct{}, func()) {
+	r.Lock()
+	defer r.Unlock()
+	w, ok := r.watchers[topic]
+	if !ok {
+		w = &topicWatch{changed: make(chan struct{})}
+		r.watchers[topic] = w
+	}
+	w.watchers++
+	return r.versions[topic], w.changed, func() { r.unwatchTopic(topic, w) }
+}
+
+func (r *RegistrationDB) unwatchTopic(topic string, w *topicWatch) {
+	r.Lock()
+	defer r.Unlock()
+	w.watchers--
+	if w.watchers == 0 && r.watchers[topic] == w {
+		delete(r.watchers, topic)
+		r.forgetTopic(topic)
+	}
+}
+
+// forgetTopic drops the version of a topic which is neither registered nor
+// watched anymore
+func (r *RegistrationDB) forgetTopic(topic string) {
+	if _, ok := r.watchers[topic]; ok {
+		return
+	}
+	for k := range r.registrationMap {
+		if k.Key == topic {
+			return
+		}
+	}
+	delete(r.versions, topic)
+}
+
+// TopicChanged wakes up the watchers of a topic, i.e. after one of its
+// producers is tombstoned
+func (r *RegistrationDB) TopicChanged(topic string) {
+	r.Lock()
+	defer r.Unlock()
+	r.topicChanged(topic)
+}
+
+func (r *RegistrationDB) topicChanged(topic string) {
+	if topic == "" {
+		// client registrations
+		return
+	}
+	r.version++
+	r.versions[topic] = r.version
+	if w, ok := r.watchers[topic]; ok {
+		close(w.changed)
+		delete(r.watchers, topic)
+	}
+}
+
+// UpdateActivity wakes up the watchers of the topics whose producers became
+// inactive, or active again, since it was last called, i.e. when they time
+// out or their tombstone expires
+func (r *RegistrationDB) UpdateActivity(inactivityTimeout time.Duration, tombstoneLifetime time.Duration) {
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	for k, producers := range r.registrationMap {
+		lifetime := tombstoneLifetime
+		switch k.Category {
+		case "topic":
+		case "replica":
+			// replicas aren't tombstoned
+			lifetime = 0
+		default:
+			continue
+		}
+		changed := false
+		for _, p := range producers {
+			inactive := !p.isActive(now, inactivityTimeout, lifetime)
+			if inactive != p.inactive {
+				p.inactive = inactive
+				changed = true
+			}
+		}
+		if changed {
+			r.topicChanged(k.Key)
+		}
 	}
 }
 
@@ -85,6 +200,7 @@ func (r *RegistrationDB) AddRegistration(k Registration) {
 	_, ok := r.registrationMap[k]
 	if !ok {
 		r.registrationMap[k] = make(map[string]*Producer)
+		r.topicChanged(k.Key)
 	}
 }
 
@@ -100,6 +216,7 @@ func (r *RegistrationDB) AddProducer(k Registration, p *Producer) bool {
 	_, found := producers[p.peerInfo.id]
 	if found == false {
 		producers[p.peerInfo.id] = p
+		r.topicChanged(k.Key)
 	}
 	return !found
 }
@@ -115,6 +232,7 @@ func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 	removed := false
 	if _, exists := producers[id]; exists {
 		removed = true
+		r.topicChanged(k.Key)
 	}
 
 	// Note: this leaves keys in the DB even if they have empty lists
@@ -126,7 +244,11 @@ func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 func (r *RegistrationDB) RemoveRegistration(k Registration) {
 	r.Lock()
 	defer r.Unlock()
-	delete(r.registrationMap, k)
+	if _, ok := r.registrationMap[k]; ok {
+		delete(r.registrationMap, k)
+		r.topicChanged(k.Key)
+		r.forgetTopic(k.Key)
+	}
 }
 
 func (r *RegistrationDB) needFilter(key string, subkey string) bool {
@@ -233,8 +355,7 @@ func (pp Producers) FilterByActive(inactivityTimeout time.Duration, tombstoneLif
 	now := time.Now()
 	results := Producers{}
 	for _, p := range pp {
-		cur := time.Unix(0, atomic.LoadInt64(&p.peerInfo.lastUpdate))
-		if now.Sub(cur) > inactivityTimeout || p.IsTombstoned(tombstoneLifetime) {
+		if !p.isActive(now, inactivityTimeout, tombstoneLifetime) {
 			continue
 		}
 		results = append(results, p)
@@ -242,6 +363,27 @@ func (pp Producers) FilterByActive(inactivityTimeout time.Duration, tombstoneLif
 	return results
 }
 
+// Dedupe keeps one producer per node (see producerNode), the most recently
+// updated, as an emsd registered with several cluster members is known
+// through each of them
+func (pp Producers) Dedupe() Producers {
+	results := Producers{}
+	index := make(map[string]int)
+	for _, p := range pp {
+		node := producerNode(p.peerInfo)
+		i, ok := index[node]
+		if !ok {
+			index[node] = len(results)
+			results = append(results, p)
+			continue
+		}
+		if atomic.LoadInt64(&p.peerInfo.lastUpdate) > atomic.LoadInt64(&results[i].peerInfo.lastUpdate) {
+			results[i] = p
+		}
+	}
+	return results
+}
+
 func (pp Producers) PeerInfo() []*PeerInfo {
 	results := []*PeerInfo{}
 	for _, p := range pp {
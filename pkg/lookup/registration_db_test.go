@@ -32,13 +32,13 @@ import (
 func TestRegistrationDB(t *testing.T) {
 	sec30 := 30 * time.Second
 	beginningOfTime := time.Unix(1348797047, 0)
-	pi1 := &PeerInfo{beginningOfTime.UnixNano(), "1", "remote_addr:1", "host", "b_addr", 1, 2, "v1"}
-	pi2 := &PeerInfo{beginningOfTime.UnixNano(), "2", "remote_addr:2", "host", "b_addr", 2, 3, "v1"}
-	pi3 := &PeerInfo{beginningOfTime.UnixNano(), "3", "remote_addr:3", "host", "b_addr", 3, 4, "v1"}
-	p1 := &Producer{pi1, false, beginningOfTime}
-	p2 := &Producer{pi2, false, beginningOfTime}
-	p3 := &Producer{pi3, false, beginningOfTime}
-	p4 := &Producer{pi1, false, beginningOfTime}
+	pi1 := &PeerInfo{beginningOfTime.UnixNano(), "1", "remote_addr:1", "host", "b_addr", 1, 2, "v1", nil, nil}
+	pi2 := &PeerInfo{beginningOfTime.UnixNano(), "2", "remote_addr:2", "host", "b_addr", 2, 3, "v1", nil, nil}
+	pi3 := &PeerInfo{beginningOfTime.UnixNano(), "3", "remote_addr:3", "host", "b_addr", 3, 4, "v1", nil, nil}
+	p1 := &Producer{pi1, false, beginningOfTime, false}
+	p2 := &Producer{pi2, false, beginningOfTime, false}
+	p3 := &Producer{pi3, false, beginningOfTime, false}
+	p4 := &Producer{pi1, false, beginningOfTime, false}
 
 	db := NewRegistrationDB()
 
@@ -119,6 +119,70 @@ func TestRegistrationDB(t *testing.T) {
 	test.Equal(t, 0, len(k))
 }
 
+func TestRegistrationDBWatch(t *testing.T) {
+	db := NewRegistrationDB()
+	topic := Registration{"topic", "watched", ""}
+	p := &Producer{peerInfo: &PeerInfo{id: "1", lastUpdate: time.Now().UnixNano()}}
+
+	version, changed, unwatch := db.WatchTopic("watched")
+	test.Equal(t, uint64(0), version)
+	db.AddProducer(topic, p)
+	<-changed
+	unwatch()
+	test.Equal(t, 0, len(db.watchers))
+
+	// a producer timing out or coming back changes the version
+	version, changed, unwatch = db.WatchTopic("watched")
+	db.UpdateActivity(time.Minute, time.Minute)
+	select {
+	case <-changed:
+		t.Fatal("changed without activity changes")
+	default:
+	}
+	p.peerInfo.lastUpdate = time.Now().Add(-2 * time.Minute).UnixNano()
+	db.UpdateActivity(time.Minute, time.Minute)
+	<-changed
+	unwatch()
+	next, changed, unwatch := db.WatchTopic("watched")
+	test.NotEqual(t, version, next)
+	p.peerInfo.lastUpdate = time.Now().UnixNano()
+	db.UpdateActivity(time.Minute, time.Minute)
+	<-changed
+	unwatch()
+
+	// so does its tombstone expiring
+	p.Tombstone()
+	p.tombstonedAt = time.Now().Add(-2 * time.Minute)
+	version, changed, unwatch = db.WatchTopic("watched")
+	db.UpdateActivity(time.Minute, time.Minute)
+	select {
+	case <-changed:
+		t.Fatal("changed without activity changes")
+	default:
+	}
+	db.UpdateActivity(time.Minute, 5*time.Minute)
+	<-changed
+	unwatch()
+	db.UpdateActivity(time.Minute, time.Minute)
+	next, _, unwatch = db.WatchTopic("watched")
+	unwatch()
+	test.NotEqual(t, version, next)
+
+	// nothing is left once the topic is gone and no longer watched
+	_, changed, unwatch = db.WatchTopic("watched")
+	db.RemoveRegistration(topic)
+	<-changed
+	unwatch()
+	test.Equal(t, 0, len(db.versions))
+	test.Equal(t, 0, len(db.watchers))
+
+	// nor for topics which are watched without ever being registered
+	_, _, unwatch = db.WatchTopic("unknown")
+	test.Equal(t, 1, len(db.watchers))
+	unwatch()
+	test.Equal(t, 0, len(db.watchers))
+}
+
 func fillRegDB(registrations int, producers int) *RegistrationDB {
 	regDB := NewRegistrationDB()
 	for i := 0; i < registrations; i++ {
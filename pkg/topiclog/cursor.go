@@ -0,0 +1,243 @@
+package topiclog
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/bhojpur/ems/pkg/diskqueue"
+)
+
+// Cursor reads a Log on behalf of a single reader (a channel), records are
+// delivered in order over ReadChan and the cursor only moves past a record
+// once it has been received
+type Cursor struct {
+	log       *Log
+	name      string
+	ephemeral bool
+	open      bool
+	pos       position // the next record to deliver, guarded by the log
+
+	// only touched by readLoop
+	file    *os.File
+	fileNum int64
+
+	readChan     chan []byte
+	emptyChan    chan chan error
+	exitChan     chan int
+	exitSyncChan chan int
+}
+
+// ReadChan returns the receive-only []byte channel for reading data
+func (c *Cursor) ReadChan() <-chan []byte {
+	return c.readChan
+}
+
+// Depth returns the number of records written which the cursor has not
+// delivered yet
+func (c *Cursor) Depth() int64 {
+	c.log.Lock()
+	defer c.log.Unlock()
+	depth := c.log.write.Seq - c.pos.Seq
+	if depth < 0 {
+		depth = 0
+	}
+	return depth
+}
+
+// Empty skips every record which has not been delivered yet
+func (c *Cursor) Empty() error {
+	resp := make(chan error, 1)
+	select {
+	case c.emptyChan <- resp:
+		return <-resp
+	case <-c.exitChan:
+		return errors.New("exiting")
+	}
+}
+
+// Close stops reading, the position is kept (and persisted) unless the cursor
+// is ephemeral
+func (c *Cursor) Close() error {
+	if !c.stop() {
+		return errors.New("exiting")
+	}
+
+	l := c.log
+	l.Lock()
+	defer l.Unlock()
+	if c.ephemeral {
+		l.removeCursor(c)
+	}
+	return nil
+}
+
+// Delete stops reading and removes the cursor, which allows the segments it
+// had yet to read to be removed
+func (c *Cursor) Delete() error {
+	if !c.stop() {
+		return errors.New("exiting")
+	}
+
+	l := c.log
+	l.Lock()
+	defer l.Unlock()
+	l.removeCursor(c)
+	return nil
+}
+
+// stop ends readLoop, it returns false if the cursor was already stopped
+func (c *Cursor) stop() bool {
+	c.log.Lock()
+	if !c.open {
+		c.log.Unlock()
+		return false
+	}
+	c.open = false
+	c.log.Unlock()
+
+	close(c.exitChan)
+	<-c.exitSyncChan
+	return true
+}
+
+// removeCursor forgets a (stopped) cursor, if it was the last one whatever
+// it had not read is retained for the next cursor
+//
+// this expects the caller to hold the log's lock
+func (l *Log) removeCursor(c *Cursor) {
+	delete(l.cursors, c.name)
+	if len(l.cursors) == 0 {
+		l.start = c.pos
+	}
+	l.gc()
+	l.dirty = true
+}
+
+// moveTo sets the position of the next record to deliver
+//
+// this expects the caller to hold the log's lock
+func (c *Cursor) moveTo(pos position) {
+	fileChanged := pos.FileNum != c.pos.FileNum
+	c.pos = pos
+	c.log.dirty = true
+	if fileChanged {
+		c.log.gc()
+	}
+}
+
+// readNext reads the next record to deliver along with the position after
+// it, if there is nothing to deliver it instead returns a channel which is
+// closed once there might be
+func (c *Cursor) readNext() ([]byte, position, <-chan struct{}) {
+	l := c.log
+	for {
+		l.Lock()
+		pos := c.pos
+		if l.paused || !pos.before(l.write) {
+			wait := l.appended
+			l.Unlock()
+			return nil, pos, wait
+		}
+		l.Unlock()
+
+		// records before the write position are complete, so this doesn't
+		// need the lock
+		buf, size, err := c.read(pos)
+		if err == nil {
+			seq := int64(binary.BigEndian.Uint64(buf[8:16]))
+			return buf[headerSize:], position{FileNum: pos.FileNum, Pos: pos.Pos + size, Seq: seq + 1}, nil
+		}
+
+		if err != io.EOF {
+			l.logf(diskqueue.ERROR, "TOPICLOG(%s) cursor %s reading at %d of %s - %s, skipping to the next file",
+				l.name, c.name, pos.Pos, l.fileName(pos.FileNum), err)
+		}
+		l.Lock()
+		c.moveTo(position{FileNum: pos.FileNum + 1, Seq: pos.Seq})
+		l.Unlock()
+	}
+}
+
+func (c *Cursor) read(pos position) ([]byte, int64, error) {
+	if c.file != nil && c.fileNum != pos.FileNum {
+		c.file.Close()
+		c.file = nil
+	}
+	if c.file == nil {
+		f, err := os.Open(c.log.fileName(pos.FileNum))
+		if err != nil {
+			return nil, 0, err
+		}
+		c.file = f
+		c.fileNum = pos.FileNum
+	}
+	return readRecord(c.file, pos.Pos, c.log.maxMsgSize)
+}
+
+// readLoop reads ahead one record at a time and delivers it over readChan
+func (c *Cursor) readLoop() {
+	var dataRead []byte
+	var next position
+	var wait <-chan struct{}
+	var r chan []byte
+
+	for {
+		if dataRead == nil {
+			dataRead, next, wait = c.readNext()
+		}
+		if dataRead != nil {
+			r = c.readChan
+			wait = nil
+		} else {
+			r = nil
+		}
+
+		select {
+		// the Go channel spec dictates that nil channel operations (read or write)
+		// in a select are skipped, we set r to c.readChan only when there is data to read
+		case r <- dataRead:
+			c.log.Lock()
+			c.moveTo(next)
+			c.log.Unlock()
+			dataRead = nil
+		case <-wait:
+		case resp := <-c.emptyChan:
+			c.log.Lock()
+			c.moveTo(c.log.write)
+			c.log.Unlock()
+			dataRead = nil
+			resp <- nil
+		case <-c.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	c.exitSyncChan <- 1
+}
@@ -0,0 +1,708 @@
+package topiclog
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/diskqueue"
+)
+
+// record header: size (of everything after it), crc32c, sequence
+const headerSize = 4 + 4 + 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// position locates a record in the log, Seq is the sequence number of the
+// record at FileNum/Pos (which may not have been written yet)
+type position struct {
+	FileNum int64 `json:"file_num"`
+	Pos     int64 `json:"pos"`
+	Seq     int64 `json:"seq"`
+}
+
+func (p position) before(o position) bool {
+	return p.FileNum < o.FileNum || (p.FileNum == o.FileNum && p.Pos < o.Pos)
+}
+
+type metaData struct {
+	OldestFileNum int64               `json:"oldest_file_num"`
+	Start         position            `json:"start"`
+	Write         position            `json:"write"`
+	Cursors       map[string]position `json:"cursors"`
+}
+
+// Log is an append-only log of a topic's messages which is shared by all of
+// its channels
+//
+// rather than every message being copied to each channel, each channel reads
+// the log through its own Cursor so that fanning out to another channel
+// only costs a position. Segments are removed once every cursor has read
+// past them, while there are no cursors at all everything written since the
+// last cursor went away is retained for the next one.
+type Log struct {
+	sync.Mutex
+
+	// instantiation time metadata
+	name            string
+	dataPath        string
+	maxBytesPerFile int64
+	minMsgSize      int32
+	maxMsgSize      int32
+	syncEvery       int64         // number of writes per fsync
+	syncTimeout     time.Duration // duration of time per fsync
+	exitFlag        int32
+	paused          bool
+	dirty           bool
+
+	// run-time state (also persisted to disk)
+	oldestFileNum int64
+	start         position // where the first cursor starts reading
+	write         position // where the next record is written
+	cursors       map[string]*Cursor
+
+	writeFile  *os.File
+	writeBuf   bytes.Buffer
+	writeCount int64
+
+	// closed (and replaced) every time there is something new for cursors
+	appended chan struct{}
+
+	exitChan     chan int
+	exitSyncChan chan int
+
+	logf diskqueue.AppLogFunc
+}
+
+// New opens (or creates) the log for a topic, recovering every record which
+// made it to disk and starting the sync goroutine
+func New(name string, dataPath string, maxBytesPerFile int64,
+	minMsgSize int32, maxMsgSize int32,
+	syncEvery int64, syncTimeout time.Duration,
+	logf diskqueue.AppLogFunc) *Log {
+	l := &Log{
+		name:            name,
+		dataPath:        dataPath,
+		maxBytesPerFile: maxBytesPerFile,
+		minMsgSize:      minMsgSize,
+		maxMsgSize:      maxMsgSize,
+		syncEvery:       syncEvery,
+		syncTimeout:     syncTimeout,
+		cursors:         make(map[string]*Cursor),
+		appended:        make(chan struct{}),
+		exitChan:        make(chan int),
+		exitSyncChan:    make(chan int),
+		logf:            logf,
+	}
+
+	// no need to lock here, nothing else could possibly be touching this instance
+	err := l.recover()
+	if err != nil {
+		l.logf(diskqueue.ERROR, "TOPICLOG(%s) failed to recover - %s", l.name, err)
+	}
+
+	go l.syncLoop()
+	return l
+}
+
+// Put appends a single record
+func (l *Log) Put(data []byte) error {
+	_, err := l.PutBatch([][]byte{data})
+	return err
+}
+
+// PutBatch appends records in order, they become visible to cursors together.
+// It returns how many records were written, when an I/O error is returned
+// the records before the last file roll may have been.
+func (l *Log) PutBatch(batch [][]byte) (int, error) {
+	for _, data := range batch {
+		dataLen := int32(len(data))
+		if dataLen < l.minMsgSize || dataLen > l.maxMsgSize {
+			return 0, fmt.Errorf("invalid message write size (%d) minMsgSize=%d maxMsgSize=%d", dataLen, l.minMsgSize, l.maxMsgSize)
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.exitFlag == 1 {
+		return 0, errors.New("exiting")
+	}
+
+	n, err := l.writeRecords(batch)
+	if n == 0 {
+		return 0, err
+	}
+
+	l.writeCount += int64(n)
+	if l.writeCount >= l.syncEvery {
+		syncErr := l.sync()
+		if syncErr != nil {
+			l.logf(diskqueue.ERROR, "TOPICLOG(%s) failed to sync - %s", l.name, syncErr)
+		}
+	}
+	l.dirty = true
+	l.signal()
+	return n, err
+}
+
+// Depth returns the number of records retained for the next cursor, once
+// there are cursors each one has its own depth
+func (l *Log) Depth() int64 {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.cursors) > 0 {
+		return 0
+	}
+	return l.write.Seq - l.start.Seq
+}
+
+// DiskUsage returns the size of all of the log's files
+func (l *Log) DiskUsage() int64 {
+	matches, _ := filepath.Glob(path.Join(l.dataPath, l.name+".topiclog.*"))
+	var size int64
+	for _, fn := range matches {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		size += fi.Size()
+	}
+	return size
+}
+
+// Empty discards the records retained for the next cursor, it has no effect
+// on existing cursors
+func (l *Log) Empty() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+	if len(l.cursors) > 0 {
+		return nil
+	}
+
+	l.logf(diskqueue.INFO, "TOPICLOG(%s): emptying", l.name)
+	l.start = l.write
+	l.gc()
+	return l.persistMetaData()
+}
+
+// Sync fsyncs pending writes and persists metadata (including every
+// cursor's position), once it returns the log's files can be copied
+// consistently
+func (l *Log) Sync() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+	return l.sync()
+}
+
+// SetPaused stops (or resumes) delivery to every cursor
+func (l *Log) SetPaused(paused bool) {
+	l.Lock()
+	l.paused = paused
+	l.signal()
+	l.Unlock()
+}
+
+// Close closes every cursor, persists metadata and closes the log
+func (l *Log) Close() error {
+	err := l.exit()
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	err = l.sync()
+	if l.writeFile != nil {
+		l.writeFile.Close()
+		l.writeFile = nil
+	}
+	return err
+}
+
+// Delete closes the log and removes all of its files
+func (l *Log) Delete() error {
+	err := l.exit()
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.writeFile != nil {
+		l.writeFile.Close()
+		l.writeFile = nil
+	}
+	return l.deleteAllFiles()
+}
+
+func (l *Log) exit() error {
+	l.Lock()
+	if l.exitFlag == 1 {
+		l.Unlock()
+		return errors.New("exiting")
+	}
+	l.exitFlag = 1
+	l.logf(diskqueue.INFO, "TOPICLOG(%s): closing", l.name)
+	var open []*Cursor
+	for _, c := range l.cursors {
+		if c.open {
+			open = append(open, c)
+		}
+	}
+	l.Unlock()
+
+	// cursors need the lock to make progress so they are stopped without it
+	for _, c := range open {
+		c.stop()
+	}
+
+	close(l.exitChan)
+	<-l.exitSyncChan
+	return nil
+}
+
+// OpenCursor starts reading the log for name, an existing cursor resumes
+// where it was closed. A new cursor starts with whatever is retained if it is
+// the only one, otherwise (or if it's ephemeral) it starts with the next record
+// written. Ephemeral cursors are not persisted and are removed on Close.
+func (l *Log) OpenCursor(name string, ephemeral bool) (*Cursor, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.exitFlag == 1 {
+		return nil, errors.New("exiting")
+	}
+
+	c, ok := l.cursors[name]
+	if ok && c.open {
+		return nil, fmt.Errorf("cursor %s is already open", name)
+	}
+	if !ok {
+		c = &Cursor{log: l, name: name, pos: l.write}
+		if len(l.cursors) == 0 && !ephemeral {
+			c.pos = l.start
+		}
+		l.cursors[name] = c
+		l.dirty = true
+	}
+	c.ephemeral = ephemeral
+	c.open = true
+	c.readChan = make(chan []byte)
+	c.emptyChan = make(chan chan error)
+	c.exitChan = make(chan int)
+	c.exitSyncChan = make(chan int)
+	go c.readLoop()
+	return c, nil
+}
+
+// signal wakes up every cursor waiting for new records
+func (l *Log) signal() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// writeRecords appends records to the current segment, rolling segments if
+// necessary, with a single write per segment, and returns how many were written
+func (l *Log) writeRecords(batch [][]byte) (int, error) {
+	l.writeBuf.Reset()
+	pos := l.write
+	written := 0
+	for i, data := range batch {
+		totalBytes := int64(headerSize + len(data))
+		if pos.Pos > 0 && pos.Pos+totalBytes > l.maxBytesPerFile {
+			err := l.flush(pos)
+			if err != nil {
+				return written, err
+			}
+			written = i
+			err = l.roll()
+			if err != nil {
+				return written, err
+			}
+			pos = l.write
+		}
+
+		var hdr [headerSize]byte
+		binary.BigEndian.PutUint32(hdr[0:4], uint32(totalBytes-4))
+		binary.BigEndian.PutUint64(hdr[8:16], uint64(pos.Seq))
+		start := l.writeBuf.Len()
+		l.writeBuf.Write(hdr[:])
+		l.writeBuf.Write(data)
+		buf := l.writeBuf.Bytes()[start:]
+		binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[8:], crcTable))
+
+		pos.Pos += totalBytes
+		pos.Seq++
+	}
+	err := l.flush(pos)
+	if err != nil {
+		return written, err
+	}
+	return len(batch), nil
+}
+
+// flush writes the buffered records and moves the write position to pos
+func (l *Log) flush(pos position) error {
+	if l.writeBuf.Len() == 0 {
+		return nil
+	}
+	if l.writeFile == nil {
+		f, err := os.OpenFile(l.fileName(l.write.FileNum), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		l.writeFile = f
+	}
+	_, err := l.writeFile.WriteAt(l.writeBuf.Bytes(), l.write.Pos)
+	l.writeBuf.Reset()
+	if err != nil {
+		return err
+	}
+	l.write = pos
+	return nil
+}
+
+// roll starts a new segment, syncing the one that was just completed
+func (l *Log) roll() error {
+	err := l.sync()
+	if err != nil {
+		l.logf(diskqueue.ERROR, "TOPICLOG(%s) failed to sync - %s", l.name, err)
+	}
+	if l.writeFile != nil {
+		l.writeFile.Close()
+		l.writeFile = nil
+	}
+	l.write.FileNum++
+	l.write.Pos = 0
+	return nil
+}
+
+// gc removes the segments which no cursor (or, without cursors, the start
+// position) still needs
+func (l *Log) gc() {
+	min := l.start.FileNum
+	if len(l.cursors) > 0 {
+		min = l.write.FileNum
+		for _, c := range l.cursors {
+			if c.pos.FileNum < min {
+				min = c.pos.FileNum
+			}
+		}
+	}
+	if min > l.write.FileNum {
+		min = l.write.FileNum
+	}
+	for ; l.oldestFileNum < min; l.oldestFileNum++ {
+		fn := l.fileName(l.oldestFileNum)
+		err := os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			l.logf(diskqueue.ERROR, "TOPICLOG(%s) failed to Remove(%s) - %s", l.name, fn, err)
+		}
+		l.dirty = true
+	}
+}
+
+// sync fsyncs the current segment and persists metadata
+func (l *Log) sync() error {
+	if l.writeFile != nil {
+		err := l.writeFile.Sync()
+		if err != nil {
+			l.writeFile.Close()
+			l.writeFile = nil
+			return err
+		}
+	}
+
+	err := l.persistMetaData()
+	if err != nil {
+		return err
+	}
+
+	l.writeCount = 0
+	l.dirty = false
+	return nil
+}
+
+// syncLoop persists cursor positions and unsynced writes every syncTimeout
+func (l *Log) syncLoop() {
+	syncTicker := time.NewTicker(l.syncTimeout)
+	for {
+		select {
+		case <-syncTicker.C:
+			l.Lock()
+			if l.dirty {
+				err := l.sync()
+				if err != nil {
+					l.logf(diskqueue.ERROR, "TOPICLOG(%s) failed to sync - %s", l.name, err)
+				}
+			}
+			l.Unlock()
+		case <-l.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	syncTicker.Stop()
+	l.exitSyncChan <- 1
+}
+
+func (l *Log) deleteAllFiles() error {
+	var err error
+
+	fileNums, innerErr := l.segmentFileNums()
+	if innerErr != nil {
+		err = innerErr
+	}
+	for _, fileNum := range fileNums {
+		innerErr := os.Remove(l.fileName(fileNum))
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			l.logf(diskqueue.ERROR, "TOPICLOG(%s) failed to remove data file - %s", l.name, innerErr)
+			err = innerErr
+		}
+	}
+
+	innerErr = os.Remove(l.metaDataFileName())
+	if innerErr != nil && !os.IsNotExist(innerErr) {
+		l.logf(diskqueue.ERROR, "TOPICLOG(%s) failed to remove metadata file - %s", l.name, innerErr)
+		err = innerErr
+	}
+
+	return err
+}
+
+// segmentFileNums returns the numbers of all segment files, in order
+func (l *Log) segmentFileNums() ([]int64, error) {
+	prefix := path.Join(l.dataPath, l.name+".topiclog.")
+	matches, err := filepath.Glob(prefix + "*.dat")
+	if err != nil {
+		return nil, err
+	}
+	var fileNums []int64
+	for _, fn := range matches {
+		num, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(fn, prefix), ".dat"), 10, 64)
+		if err != nil {
+			// the metadata file
+			continue
+		}
+		fileNums = append(fileNums, num)
+	}
+	sort.Slice(fileNums, func(i, j int) bool { return fileNums[i] < fileNums[j] })
+	return fileNums, nil
+}
+
+// recover initializes state from the metadata file and then scans whatever
+// was written after the persisted write position, so that records which
+// made it to disk before a crash are not lost
+func (l *Log) recover() error {
+	err := l.retrieveMetaData()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fileNums, err := l.segmentFileNums()
+	if err != nil {
+		return err
+	}
+	lastFileNum := l.write.FileNum
+	if len(fileNums) > 0 && fileNums[len(fileNums)-1] > lastFileNum {
+		lastFileNum = fileNums[len(fileNums)-1]
+	}
+	for fileNum := l.write.FileNum; fileNum <= lastFileNum; fileNum++ {
+		if fileNum > l.write.FileNum {
+			l.write.FileNum = fileNum
+			l.write.Pos = 0
+		}
+		err := l.scanFile(fileNum == lastFileNum)
+		if err != nil {
+			return err
+		}
+	}
+
+	// records which cursors had read might not have made it to disk
+	for name, c := range l.cursors {
+		if l.write.before(c.pos) {
+			l.logf(diskqueue.WARN, "TOPICLOG(%s) cursor %s is past the end of the log, resetting it", l.name, name)
+			c.pos = l.write
+		}
+	}
+	if l.write.before(l.start) {
+		l.start = l.write
+	}
+	return nil
+}
+
+// scanFile moves the write position past every valid record after it in the
+// current write segment, the rest of the last segment is truncated
+func (l *Log) scanFile(last bool) error {
+	f, err := os.OpenFile(l.fileName(l.write.FileNum), os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		data, size, err := readRecord(f, l.write.Pos, l.maxMsgSize)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil && int64(binary.BigEndian.Uint64(data[8:16])) != l.write.Seq {
+			err = errors.New("unexpected sequence number")
+		}
+		if err != nil {
+			l.logf(diskqueue.WARN, "TOPICLOG(%s) %s at %d of %s, discarding the rest of the file",
+				l.name, err, l.write.Pos, l.fileName(l.write.FileNum))
+			if last {
+				return f.Truncate(l.write.Pos)
+			}
+			return nil
+		}
+		l.write.Pos += size
+		l.write.Seq++
+	}
+}
+
+// readRecord reads and verifies the record at pos, returning it (including
+// its header) and its size, io.EOF means there is no record at pos
+func readRecord(f *os.File, pos int64, maxMsgSize int32) ([]byte, int64, error) {
+	var hdr [headerSize]byte
+	_, err := f.ReadAt(hdr[:], pos)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, 0, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(hdr[0:4])) + 4
+	if err == io.ErrUnexpectedEOF || size < headerSize || size > headerSize+int64(maxMsgSize) {
+		return nil, 0, errors.New("invalid record header")
+	}
+	buf := make([]byte, size)
+	_, err = f.ReadAt(buf, pos)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(buf[8:], crcTable) != binary.BigEndian.Uint32(buf[4:8]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	return buf, size, nil
+}
+
+// retrieveMetaData initializes state from the filesystem
+func (l *Log) retrieveMetaData() error {
+	data, err := ioutil.ReadFile(l.metaDataFileName())
+	if err != nil {
+		return err
+	}
+
+	var m metaData
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return fmt.Errorf("failed to parse metadata - %s", err)
+	}
+	l.oldestFileNum = m.OldestFileNum
+	l.start = m.Start
+	l.write = m.Write
+	for name, pos := range m.Cursors {
+		l.cursors[name] = &Cursor{log: l, name: name, pos: pos}
+	}
+	return nil
+}
+
+// persistMetaData atomically writes state to the filesystem
+func (l *Log) persistMetaData() error {
+	m := metaData{
+		OldestFileNum: l.oldestFileNum,
+		Start:         l.start,
+		Write:         l.write,
+		Cursors:       make(map[string]position, len(l.cursors)),
+	}
+	for name, c := range l.cursors {
+		if c.ephemeral {
+			continue
+		}
+		m.Cursors[name] = c.pos
+	}
+	data, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+
+	fileName := l.metaDataFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	// write to tmp file
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	// atomically rename
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (l *Log) metaDataFileName() string {
+	return fmt.Sprintf(path.Join(l.dataPath, "%s.topiclog.meta.dat"), l.name)
+}
+
+func (l *Log) fileName(fileNum int64) string {
+	return fmt.Sprintf(path.Join(l.dataPath, "%s.topiclog.%06d.dat"), l.name, fileNum)
+}
@@ -0,0 +1,277 @@
+package topiclog
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bhojpur/ems/pkg/core/test"
+	"github.com/bhojpur/ems/pkg/diskqueue"
+)
+
+type tbLog interface {
+	Log(...interface{})
+}
+
+func newTestLogger(tbl tbLog) diskqueue.AppLogFunc {
+	return func(lvl diskqueue.LogLevel, f string, args ...interface{}) {
+		tbl.Log(fmt.Sprintf(lvl.String()+": "+f, args...))
+	}
+}
+
+func testMsg(i int) []byte {
+	return []byte(fmt.Sprintf("msg-%06d", i))
+}
+
+func mustTempDir() string {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("ems-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	return tmpDir
+}
+
+func readCursor(t *testing.T, c *Cursor) []byte {
+	select {
+	case b := <-c.ReadChan():
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout reading from cursor")
+	}
+	return nil
+}
+
+func assertCursorEmpty(t *testing.T, c *Cursor) {
+	select {
+	case b := <-c.ReadChan():
+		t.Fatalf("unexpected read %s", b)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func segmentCount(t *testing.T, dir string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, "test.topiclog.0*.dat"))
+	test.Nil(t, err)
+	return len(matches)
+}
+
+func TestTopicLogFanout(t *testing.T) {
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	l := New("test", tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, newTestLogger(t))
+	defer l.Close()
+
+	// retained until the first cursor
+	for i := 0; i < 5; i++ {
+		test.Nil(t, l.Put(testMsg(i)))
+	}
+	test.Equal(t, int64(5), l.Depth())
+
+	a, err := l.OpenCursor("a", false)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), l.Depth())
+	test.Equal(t, int64(5), a.Depth())
+
+	// later cursors only see new records
+	b, err := l.OpenCursor("b", false)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), b.Depth())
+	_, err = l.OpenCursor("b", false)
+	test.NotNil(t, err)
+
+	n, err := l.PutBatch([][]byte{testMsg(5), testMsg(6)})
+	test.Nil(t, err)
+	test.Equal(t, 2, n)
+	for i := 0; i < 7; i++ {
+		test.Equal(t, testMsg(i), readCursor(t, a))
+	}
+	for i := 5; i < 7; i++ {
+		test.Equal(t, testMsg(i), readCursor(t, b))
+	}
+	assertCursorEmpty(t, a)
+	assertCursorEmpty(t, b)
+	test.Equal(t, int64(0), a.Depth())
+	test.Equal(t, int64(0), b.Depth())
+
+	test.NotNil(t, l.Put([]byte("abc")))
+}
+
+func TestTopicLogRollAndGC(t *testing.T) {
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	// 26 byte records, 3 per segment
+	l := New("test", tmpDir, 80, 4, 1<<10, 2500, 2*time.Second, newTestLogger(t))
+	defer l.Close()
+
+	a, err := l.OpenCursor("a", false)
+	test.Nil(t, err)
+	b, err := l.OpenCursor("b", false)
+	test.Nil(t, err)
+
+	for i := 0; i < 30; i++ {
+		test.Nil(t, l.Put(testMsg(i)))
+	}
+	test.Equal(t, 10, segmentCount(t, tmpDir))
+
+	for i := 0; i < 30; i++ {
+		test.Equal(t, testMsg(i), readCursor(t, a))
+	}
+	// b still needs every segment
+	test.Equal(t, 10, segmentCount(t, tmpDir))
+
+	// b moved on to the 6th segment before delivering its first record
+	for i := 0; i < 16; i++ {
+		test.Equal(t, testMsg(i), readCursor(t, b))
+	}
+	test.Equal(t, 5, segmentCount(t, tmpDir))
+
+	// deleting the slowest cursor releases what it had left
+	test.Nil(t, b.Delete())
+	test.Equal(t, 1, segmentCount(t, tmpDir))
+}
+
+func TestTopicLogEmpty(t *testing.T) {
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	l := New("test", tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, newTestLogger(t))
+	defer l.Close()
+
+	for i := 0; i < 5; i++ {
+		test.Nil(t, l.Put(testMsg(i)))
+	}
+	test.Nil(t, l.Empty())
+	test.Equal(t, int64(0), l.Depth())
+
+	a, err := l.OpenCursor("a", false)
+	test.Nil(t, err)
+	b, err := l.OpenCursor("b", false)
+	test.Nil(t, err)
+	assertCursorEmpty(t, a)
+
+	for i := 5; i < 10; i++ {
+		test.Nil(t, l.Put(testMsg(i)))
+	}
+	test.Nil(t, a.Empty())
+	test.Equal(t, int64(0), a.Depth())
+	test.Equal(t, int64(5), b.Depth())
+	assertCursorEmpty(t, a)
+	test.Equal(t, testMsg(5), readCursor(t, b))
+
+	test.Nil(t, l.Put(testMsg(10)))
+	test.Equal(t, testMsg(10), readCursor(t, a))
+}
+
+func TestTopicLogPause(t *testing.T) {
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	l := New("test", tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, newTestLogger(t))
+	defer l.Close()
+
+	l.SetPaused(true)
+	a, err := l.OpenCursor("a", false)
+	test.Nil(t, err)
+	test.Nil(t, l.Put(testMsg(0)))
+	assertCursorEmpty(t, a)
+	test.Equal(t, int64(1), a.Depth())
+
+	l.SetPaused(false)
+	test.Equal(t, testMsg(0), readCursor(t, a))
+}
+
+func TestTopicLogReopen(t *testing.T) {
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	l := New("test", tmpDir, 80, 4, 1<<10, 2500, 2*time.Second, newTestLogger(t))
+	a, err := l.OpenCursor("a", false)
+	test.Nil(t, err)
+	e, err := l.OpenCursor("e", true)
+	test.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		test.Nil(t, l.Put(testMsg(i)))
+	}
+	for i := 0; i < 4; i++ {
+		test.Equal(t, testMsg(i), readCursor(t, a))
+	}
+	test.Nil(t, e.Close())
+	test.Nil(t, a.Close())
+	test.Nil(t, l.Close())
+
+	l = New("test", tmpDir, 80, 4, 1<<10, 2500, 2*time.Second, newTestLogger(t))
+	defer l.Close()
+	a, err = l.OpenCursor("a", false)
+	test.Nil(t, err)
+	test.Equal(t, int64(6), a.Depth())
+	for i := 4; i < 10; i++ {
+		test.Equal(t, testMsg(i), readCursor(t, a))
+	}
+
+	// the ephemeral cursor was forgotten
+	e, err = l.OpenCursor("e", true)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), e.Depth())
+}
+
+func TestTopicLogRecover(t *testing.T) {
+	tmpDir := mustTempDir()
+	defer os.RemoveAll(tmpDir)
+
+	l := New("test", tmpDir, 80, 4, 1<<10, 1, 2*time.Second, newTestLogger(t))
+	for i := 0; i < 5; i++ {
+		test.Nil(t, l.Put(testMsg(i)))
+	}
+	metaFile := l.metaDataFileName()
+	meta, err := ioutil.ReadFile(metaFile)
+	test.Nil(t, err)
+	for i := 5; i < 10; i++ {
+		test.Nil(t, l.Put(testMsg(i)))
+	}
+	test.Nil(t, l.Close())
+
+	// metadata which lags behind the segments, as if emsd crashed after
+	// writing, and a torn record at the end
+	test.Nil(t, ioutil.WriteFile(metaFile, meta, 0600))
+	f, err := os.OpenFile(l.fileName(3), os.O_WRONLY|os.O_APPEND, 0600)
+	test.Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 30, 1, 2})
+	test.Nil(t, err)
+	f.Close()
+
+	l = New("test", tmpDir, 80, 4, 1<<10, 1, 2*time.Second, newTestLogger(t))
+	defer l.Close()
+	test.Equal(t, int64(10), l.Depth())
+	test.Nil(t, l.Put(testMsg(10)))
+
+	a, err := l.OpenCursor("a", false)
+	test.Nil(t, err)
+	for i := 0; i < 11; i++ {
+		test.Equal(t, testMsg(i), readCursor(t, a))
+	}
+}